@@ -0,0 +1,178 @@
+// Command sprpc-capture decodes and replays captures made with
+// rpc.NewCaptureConn.
+//
+//	sprpc-capture decode [-names protocols.json] capture
+//	sprpc-capture replay -uri sprpc://host:port [-requests sent|received]
+//	    [-keep-timing] [-timeout 10s] [-ca ca.pem] [-names protocols.json] capture
+//
+// The names file is the JSON encoding of the []ProtocolV2Description returned
+// by the reflection protocol, and is used to resolve V2 methods.
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/foks-proj/go-snowpack-rpc/rpc"
+)
+
+func usage() {
+	fmt.Fprintf(os.Stderr, "usage: %s decode|replay [flags] capture\n", os.Args[0])
+	os.Exit(2)
+}
+
+func main() {
+	if len(os.Args) < 2 {
+		usage()
+	}
+	var err error
+	switch os.Args[1] {
+	case "decode":
+		err = decode(os.Args[2:])
+	case "replay":
+		err = replay(os.Args[2:])
+	default:
+		usage()
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s: %v\n", os.Args[0], err)
+		os.Exit(1)
+	}
+}
+
+func loadNames(file string) (rpc.CaptureNames, error) {
+	if file == "" {
+		return nil, nil
+	}
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return rpc.LoadCaptureNames(f)
+}
+
+func readCapture(fs *flag.FlagSet) ([]rpc.CaptureRecord, error) {
+	if fs.NArg() != 1 {
+		fs.Usage()
+		os.Exit(2)
+	}
+	f, err := os.Open(fs.Arg(0))
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	r, err := rpc.NewCaptureReader(f)
+	if err != nil {
+		return nil, err
+	}
+	return r.ReadAll()
+}
+
+func decode(args []string) error {
+	fs := flag.NewFlagSet("decode", flag.ExitOnError)
+	namesFile := fs.String("names", "", "JSON file of V2 protocol descriptions")
+	_ = fs.Parse(args)
+
+	names, err := loadNames(*namesFile)
+	if err != nil {
+		return err
+	}
+	recs, err := readCapture(fs)
+	if err != nil {
+		return err
+	}
+	dec := rpc.NewCaptureDecoder(names)
+	for _, rec := range recs {
+		ts := rec.Time.Format(time.RFC3339Nano)
+		desc, err := dec.Decode(rec)
+		if err != nil {
+			fmt.Printf("%s %c error: %v\n", ts, rec.Direction, err)
+			continue
+		}
+		b, err := json.Marshal(desc)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("%s %c %s\n", ts, rec.Direction, b)
+	}
+	return nil
+}
+
+func replay(args []string) error {
+	fs := flag.NewFlagSet("replay", flag.ExitOnError)
+	uri := fs.String("uri", "", "server to replay against, e.g. sprpc://localhost:4000")
+	requests := fs.String("requests", "sent", "direction of the frames to replay: sent or received")
+	keepTiming := fs.Bool("keep-timing", false, "wait between frames as long as in the capture")
+	timeout := fs.Duration("timeout", 10*time.Second, "how long to wait for replies")
+	caFile := fs.String("ca", "", "PEM file of CAs to trust, for sprpc+tls")
+	namesFile := fs.String("names", "", "JSON file of V2 protocol descriptions")
+	_ = fs.Parse(args)
+
+	if *uri == "" {
+		return errors.New("-uri is required")
+	}
+	u, err := rpc.ParseSPURI(*uri)
+	if err != nil {
+		return err
+	}
+	opts := rpc.ReplayOpts{KeepTiming: *keepTiming, Timeout: *timeout, Codec: u.Codec}
+	switch *requests {
+	case "sent":
+		opts.Requests = rpc.CaptureSent
+	case "received":
+		opts.Requests = rpc.CaptureReceived
+	default:
+		return fmt.Errorf("bad -requests: %q", *requests)
+	}
+	if opts.Names, err = loadNames(*namesFile); err != nil {
+		return err
+	}
+	recs, err := readCapture(fs)
+	if err != nil {
+		return err
+	}
+
+	var config *tls.Config
+	if *caFile != "" {
+		pem, err := os.ReadFile(*caFile)
+		if err != nil {
+			return err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return fmt.Errorf("no certificates in %s", *caFile)
+		}
+		config = &tls.Config{RootCAs: pool, ServerName: u.Host}
+	}
+	conn, err := u.DialWithConfig(config)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	report, err := rpc.ReplayCapture(context.Background(), conn, recs, opts)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("sent %d frames, got %d replies\n", report.Sent, report.Replies)
+	for _, m := range report.Mismatches {
+		exp, _ := json.Marshal(m.Expected)
+		act := []byte("(no reply)")
+		if m.Actual != nil {
+			act, _ = json.Marshal(m.Actual)
+		}
+		fmt.Printf("mismatch seqno=%d method=%s\n  expected: %s\n  actual:   %s\n", m.SeqNo, m.Method, exp, act)
+	}
+	if !report.OK() {
+		return fmt.Errorf("%d mismatched replies", len(report.Mismatches))
+	}
+	return nil
+}
@@ -0,0 +1,269 @@
+// Command sprpc makes ad-hoc calls and notifies to a framed msgpack RPC
+// server.
+//
+//	sprpc -uri sprpc://host:port [flags] method [arg]
+//
+// The method is either a V1 "protocol.method", or a V2 "puid/position", with
+// the ProtocolUniqueID in decimal or 0x-prefixed hex. The argument is JSON,
+// and defaults to {}. The result, or the error, is printed as JSON.
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"math"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/foks-proj/go-ctxlog"
+	"github.com/foks-proj/go-snowpack-rpc/rpc"
+)
+
+// tagFlags collects repeated -tag key=value flags.
+type tagFlags ctxlog.CtxLogTags
+
+func (t tagFlags) String() string {
+	return fmt.Sprint(map[string]interface{}(t))
+}
+
+func (t tagFlags) Set(s string) error {
+	k, v, ok := strings.Cut(s, "=")
+	if !ok || k == "" {
+		return fmt.Errorf("expected key=value, got %q", s)
+	}
+	t[k] = v
+	return nil
+}
+
+// remoteError is an error returned by the server, kept as a generic value so
+// that it can be printed as JSON.
+type remoteError struct {
+	v interface{}
+}
+
+func (e remoteError) Error() string {
+	return fmt.Sprint(e.v)
+}
+
+// errorUnwrapper decodes errors of any type.
+type errorUnwrapper struct{}
+
+func (errorUnwrapper) MakeArg() interface{} {
+	return new(interface{})
+}
+
+func (errorUnwrapper) UnwrapError(arg interface{}) (error, error) {
+	v := *arg.(*interface{})
+	if v == nil || v == "" {
+		return nil, nil
+	}
+	return remoteError{v: v}, nil
+}
+
+func main() {
+	uri := flag.String("uri", "", "server to connect to, e.g. sprpc://localhost:4000, sprpc+tls://host:4001, sprpc+json://localhost:4000 or wss://host/rpc")
+	caFile := flag.String("ca", "", "PEM file of root CAs to trust, for sprpc+tls and wss")
+	timeout := flag.Duration("timeout", 30*time.Second, "timeout for the call")
+	compression := flag.String("compression", "none", "compression of V1 calls: none, gzip or msgpackzip")
+	notify := flag.Bool("notify", false, "send a notify instead of a call")
+	maxFrame := flag.Int("max-frame", 16*1024*1024, "maximum length of a reply frame")
+	tags := make(tagFlags)
+	flag.Var(tags, "tag", "ctxlog tag to send, as key=value; can be repeated")
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "usage: %s -uri URI [flags] method [arg]\n", os.Args[0])
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	if *uri == "" || flag.NArg() < 1 || flag.NArg() > 2 {
+		flag.Usage()
+		os.Exit(2)
+	}
+	argJSON := "{}"
+	if flag.NArg() == 2 {
+		argJSON = flag.Arg(1)
+	}
+	ctype, err := rpc.ParseCompressionType(*compression)
+	if err != nil {
+		fail(err)
+	}
+
+	res, err := run(*uri, *caFile, flag.Arg(0), argJSON, ctype, *notify, *timeout, int32(*maxFrame),
+		ctxlog.CtxLogTags(tags))
+	if err != nil {
+		var rerr remoteError
+		if errors.As(err, &rerr) {
+			printJSON(map[string]interface{}{"error": toJSON(rerr.v)})
+			os.Exit(1)
+		}
+		fail(err)
+	}
+	if !*notify {
+		printJSON(map[string]interface{}{"result": toJSON(res)})
+	}
+}
+
+func fail(err error) {
+	fmt.Fprintf(os.Stderr, "%s: %v\n", os.Args[0], err)
+	os.Exit(1)
+}
+
+func printJSON(v interface{}) {
+	b, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		fail(err)
+	}
+	fmt.Println(string(b))
+}
+
+// parseMethod parses "protocol.method" or "puid/position".
+func parseMethod(s string) (rpc.Methoder, error) {
+	if p, pos, ok := strings.Cut(s, "/"); ok {
+		puid, err := strconv.ParseUint(p, 0, 64)
+		if err != nil {
+			return nil, fmt.Errorf("bad protocol ID %q: %v", p, err)
+		}
+		position, err := strconv.ParseUint(pos, 0, 64)
+		if err != nil {
+			return nil, fmt.Errorf("bad position %q: %v", pos, err)
+		}
+		return rpc.NewMethodV2(rpc.ProtocolUniqueID(puid), rpc.Position(position), s), nil
+	}
+	if !strings.Contains(s, ".") {
+		return nil, fmt.Errorf("expected protocol.method or puid/position, got %q", s)
+	}
+	return rpc.NewMethodV1(s), nil
+}
+
+// parseArg decodes a JSON argument, keeping integers as integers so that
+// they're encoded as such in msgpack.
+func parseArg(s string) (interface{}, error) {
+	dec := json.NewDecoder(strings.NewReader(s))
+	dec.UseNumber()
+	var v interface{}
+	if err := dec.Decode(&v); err != nil {
+		return nil, fmt.Errorf("bad JSON argument: %v", err)
+	}
+	if dec.More() {
+		return nil, errors.New("bad JSON argument: trailing data")
+	}
+	return fromJSON(v), nil
+}
+
+func fromJSON(v interface{}) interface{} {
+	switch t := v.(type) {
+	case json.Number:
+		if i, err := t.Int64(); err == nil {
+			return i
+		}
+		if u, err := strconv.ParseUint(string(t), 10, 64); err == nil {
+			return u
+		}
+		f, _ := t.Float64()
+		return f
+	case map[string]interface{}:
+		for k, e := range t {
+			t[k] = fromJSON(e)
+		}
+		return t
+	case []interface{}:
+		for i, e := range t {
+			t[i] = fromJSON(e)
+		}
+		return t
+	default:
+		return v
+	}
+}
+
+// toJSON converts generic msgpack values into ones that can be encoded to
+// JSON.
+func toJSON(v interface{}) interface{} {
+	switch t := v.(type) {
+	case map[interface{}]interface{}:
+		ret := make(map[string]interface{}, len(t))
+		for k, e := range t {
+			ret[fmt.Sprint(k)] = toJSON(e)
+		}
+		return ret
+	case []interface{}:
+		ret := make([]interface{}, len(t))
+		for i, e := range t {
+			ret[i] = toJSON(e)
+		}
+		return ret
+	case float64:
+		if math.IsInf(t, 0) || math.IsNaN(t) {
+			return fmt.Sprint(t)
+		}
+		return t
+	default:
+		return v
+	}
+}
+
+func tlsConfig(caFile string, host string) (*tls.Config, error) {
+	if caFile == "" {
+		return nil, nil
+	}
+	pem, err := os.ReadFile(caFile)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("no certificates in %s", caFile)
+	}
+	return &tls.Config{RootCAs: pool, ServerName: host}, nil
+}
+
+func run(uri, caFile, methodName, argJSON string, ctype rpc.CompressionType, notify bool,
+	timeout time.Duration, maxFrame int32, tags ctxlog.CtxLogTags) (interface{}, error) {
+	method, err := parseMethod(methodName)
+	if err != nil {
+		return nil, err
+	}
+	if _, ok := method.(*rpc.MethodV2); ok && ctype != rpc.CompressionNone {
+		return nil, errors.New("compression is only supported for V1 calls")
+	}
+	arg, err := parseArg(argJSON)
+	if err != nil {
+		return nil, err
+	}
+	u, err := rpc.ParseSPURI(uri)
+	if err != nil {
+		return nil, err
+	}
+	config, err := tlsConfig(caFile, u.Host)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := u.DialWithConfig(config)
+	if err != nil {
+		return nil, err
+	}
+
+	ctx := context.Background()
+	if len(tags) > 0 {
+		ctx = ctxlog.AddTagsToContext(ctx, tags)
+	}
+	xp := rpc.NewTransportWithOpts(ctx, conn, nil, nil, nil, maxFrame, rpc.TransportOpts{Codec: u.Codec})
+	defer xp.Close()
+	cli := rpc.NewClient(xp, errorUnwrapper{}, nil)
+
+	if notify {
+		return nil, cli.Notify(ctx, method, arg, timeout)
+	}
+	var res interface{}
+	if err := cli.CallCompressed(ctx, method, arg, &res, ctype, timeout); err != nil {
+		return nil, err
+	}
+	return res, nil
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/foks-proj/go-snowpack-rpc/rpc"
+	"github.com/stretchr/testify/require"
+)
+
+type addArg struct {
+	A int `codec:"a"`
+	B int `codec:"b"`
+}
+
+const testProtocolID = rpc.ProtocolUniqueID(0x2a)
+
+func testAdd(_ context.Context, i interface{}) (interface{}, error) {
+	arg := i.(*addArg)
+	if arg.A < 0 || arg.B < 0 {
+		return nil, errors.New("negative")
+	}
+	return arg.A + arg.B, nil
+}
+
+func testAddDescription() rpc.ServeHandlerDescription {
+	return rpc.ServeHandlerDescription{
+		MakeArg: func() interface{} { return new(addArg) },
+		Handler: testAdd,
+	}
+}
+
+// runTestServer serves a V1 and a V2 protocol on a loopback TCP port, and
+// returns its URI. Notifies are sent to notifyCh.
+func runTestServer(t *testing.T, notifyCh chan<- addArg) string {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() { listener.Close() })
+
+	wrapError := func(err error) interface{} {
+		if err == nil {
+			return nil
+		}
+		return err.Error()
+	}
+	go func() {
+		for {
+			c, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			xp := rpc.NewTransport(context.Background(), c, nil, nil, wrapError, 1024*1024)
+			srv := rpc.NewServer(xp, wrapError)
+			require.NoError(t, srv.Register(rpc.Protocol{
+				Name: "test",
+				Methods: map[string]rpc.ServeHandlerDescription{
+					"add": testAddDescription(),
+					"notify": {
+						MakeArg: func() interface{} { return new(addArg) },
+						Handler: func(_ context.Context, i interface{}) (interface{}, error) {
+							notifyCh <- *i.(*addArg)
+							return nil, nil
+						},
+					},
+				},
+				WrapError: wrapError,
+			}))
+			require.NoError(t, srv.RegisterV2(rpc.ProtocolV2{
+				Name: "testV2",
+				ID:   testProtocolID,
+				Methods: map[rpc.Position]rpc.ServeHandlerDescriptionV2{
+					1: {ServeHandlerDescription: testAddDescription(), Name: "add"},
+				},
+				WrapError: wrapError,
+			}))
+			srv.Run()
+		}
+	}()
+	return "sprpc://" + listener.Addr().String()
+}
+
+func TestRun(t *testing.T) {
+	notifyCh := make(chan addArg, 1)
+	uri := runTestServer(t, notifyCh)
+	timeout := 5 * time.Second
+
+	res, err := run(uri, "", "test.add", `{"a":1,"b":2}`, rpc.CompressionNone, false, timeout, 1024*1024, nil)
+	require.NoError(t, err)
+	require.EqualValues(t, 3, res)
+
+	// V1 calls can be compressed.
+	ctype, err := rpc.ParseCompressionType("gzip")
+	require.NoError(t, err)
+	res, err = run(uri, "", "test.add", `{"a":4,"b":5}`, ctype, false, timeout, 1024*1024, nil)
+	require.NoError(t, err)
+	require.EqualValues(t, 9, res)
+
+	// V2 methods, with the protocol ID in hex or decimal.
+	res, err = run(uri, "", "0x2a/1", `{"a":2,"b":3}`, rpc.CompressionNone, false, timeout, 1024*1024, nil)
+	require.NoError(t, err)
+	require.EqualValues(t, 5, res)
+	res, err = run(uri, "", "42/1", `{"a":3,"b":3}`, rpc.CompressionNone, false, timeout, 1024*1024, nil)
+	require.NoError(t, err)
+	require.EqualValues(t, 6, res)
+
+	res, err = run(uri, "", "test.notify", `{"a":7,"b":8}`, rpc.CompressionNone, true, timeout, 1024*1024, nil)
+	require.NoError(t, err)
+	require.Nil(t, res)
+	select {
+	case arg := <-notifyCh:
+		require.Equal(t, addArg{A: 7, B: 8}, arg)
+	case <-time.After(timeout):
+		require.FailNow(t, "notify not received")
+	}
+
+	// Errors of the server come back as remoteErrors.
+	_, err = run(uri, "", "test.add", `{"a":-1,"b":2}`, rpc.CompressionNone, false, timeout, 1024*1024, nil)
+	var rerr remoteError
+	require.ErrorAs(t, err, &rerr)
+	require.Equal(t, "negative", rerr.v)
+
+	_, err = run(uri, "", "0x2a/1", `{}`, ctype, false, timeout, 1024*1024, nil)
+	require.EqualError(t, err, "compression is only supported for V1 calls")
+	_, err = run(uri, "", "test.add", `{"a":`, rpc.CompressionNone, false, timeout, 1024*1024, nil)
+	require.ErrorContains(t, err, "bad JSON argument")
+}
+
+func TestParseMethod(t *testing.T) {
+	m, err := parseMethod("test.add")
+	require.NoError(t, err)
+	require.Equal(t, rpc.NewMethodV1("test.add"), m)
+
+	m, err = parseMethod("0x2a/3")
+	require.NoError(t, err)
+	require.Equal(t, rpc.NewMethodV2(testProtocolID, 3, "0x2a/3"), m)
+
+	m, err = parseMethod("42/0x3")
+	require.NoError(t, err)
+	require.Equal(t, rpc.NewMethodV2(testProtocolID, 3, "42/0x3"), m)
+
+	for _, s := range []string{"add", "x/1", "1/x", "-1/1"} {
+		_, err = parseMethod(s)
+		require.Error(t, err, s)
+	}
+}
+
+func TestParseArg(t *testing.T) {
+	v, err := parseArg(`{"i":-3,"u":18446744073709551615,"f":1.5,"l":[1,"x",null],"b":true}`)
+	require.NoError(t, err)
+	require.Equal(t, map[string]interface{}{
+		"i": int64(-3),
+		"u": uint64(18446744073709551615),
+		"f": 1.5,
+		"l": []interface{}{int64(1), "x", nil},
+		"b": true,
+	}, v)
+
+	_, err = parseArg(`{"a":1`)
+	require.ErrorContains(t, err, "bad JSON argument")
+	_, err = parseArg(`{} {}`)
+	require.EqualError(t, err, "bad JSON argument: trailing data")
+}
@@ -0,0 +1,151 @@
+package rpc
+
+import (
+	"net"
+	"time"
+)
+
+// WriteBatchOpts configure the batching of outgoing frames. When frames are
+// batched, the writer takes every frame that's waiting to be written, up to
+// the limits, and writes them all at once: with a single writev on TCP and
+// Unix sockets, or a single Write on other connections. This trades a little
+// latency for far fewer syscalls when many small calls or notifies are sent
+// concurrently.
+//
+// Each frame still gets its own write error, and SendNotifiers are still
+// called in order, right before the write that includes their frame.
+type WriteBatchOpts struct {
+	// MaxFrames bounds the number of frames in a batch. It defaults to
+	// 64.
+	MaxFrames int
+	// MaxBytes bounds the size of a batch. A frame that's bigger than
+	// MaxBytes is written on its own. It defaults to 64KiB.
+	MaxBytes int64
+	// MaxDelay is how long the writer waits for more frames before
+	// writing a batch that isn't full. Zero means that only the frames
+	// that are already waiting are batched, so nothing is delayed.
+	MaxDelay time.Duration
+}
+
+const (
+	defaultWriteBatchMaxFrames = 64
+	defaultWriteBatchMaxBytes  = 64 * 1024
+)
+
+func (o *WriteBatchOpts) withDefaults() *WriteBatchOpts {
+	ret := *o
+	if ret.MaxFrames <= 0 {
+		ret.MaxFrames = defaultWriteBatchMaxFrames
+	}
+	if ret.MaxBytes <= 0 {
+		ret.MaxBytes = defaultWriteBatchMaxBytes
+	}
+	return &ret
+}
+
+func (e *framedMsgpackEncoder) batchWriterLoop() {
+	batch := make([]writeBundle, 0, e.batch.MaxFrames)
+	for {
+		select {
+		case <-e.doneCh:
+			close(e.closedCh)
+			return
+		case write := <-e.writeCh:
+			batch = e.fillBatch(append(batch[:0], write))
+			e.writeBatch(batch)
+			// Don't keep the written frames alive until the next batch.
+			for i := range batch {
+				batch[i] = writeBundle{}
+			}
+		}
+	}
+}
+
+// fillBatch adds the frames that are waiting to batch, which holds one
+// frame, and waits up to MaxDelay for more until the batch is full.
+func (e *framedMsgpackEncoder) fillBatch(batch []writeBundle) []writeBundle {
+	size := batch[0].frame.size()
+	full := func() bool {
+		return len(batch) >= e.batch.MaxFrames || size >= e.batch.MaxBytes
+	}
+	var timeout <-chan time.Time
+	for !full() {
+		select {
+		case write := <-e.writeCh:
+			batch = append(batch, write)
+			size += write.frame.size()
+			continue
+		default:
+		}
+		if e.batch.MaxDelay <= 0 {
+			break
+		}
+		if timeout == nil {
+			timer := time.NewTimer(e.batch.MaxDelay)
+			defer timer.Stop()
+			timeout = timer.C
+		}
+		select {
+		case write := <-e.writeCh:
+			batch = append(batch, write)
+			size += write.frame.size()
+		case <-timeout:
+			return batch
+		case <-e.doneCh:
+			return batch
+		}
+	}
+	return batch
+}
+
+// writeBatch writes the frames of batch, and reports the outcome to each of
+// them. If the write fails part way, the frames that were written in full
+// succeed, and the others get the error.
+func (e *framedMsgpackEncoder) writeBatch(batch []writeBundle) {
+	var total int64
+	for _, write := range batch {
+		if write.sn != nil {
+			write.sn()
+		}
+		total += write.frame.size()
+	}
+
+	var n int64
+	var err error
+	switch {
+	case len(batch) == 1:
+		if err = e.writeFrame(batch[0].frame); err == nil {
+			n = total
+		}
+	case !e.writev && total <= e.batch.MaxBytes:
+		e.scratch = e.scratch[:0]
+		for _, write := range batch {
+			e.scratch = append(append(e.scratch, write.frame.header[:write.frame.hlen]...), write.frame.body...)
+		}
+		var written int
+		written, err = e.writer.Write(e.scratch)
+		n = int64(written)
+	default:
+		e.vecs = e.vecs[:0]
+		for _, write := range batch {
+			e.vecs = append(e.vecs, write.frame.header[:write.frame.hlen], write.frame.body)
+		}
+		bufs := net.Buffers(e.vecs)
+		n, err = bufs.WriteTo(e.writer)
+		for i := range e.vecs {
+			e.vecs[i] = nil
+		}
+	}
+
+	var end int64
+	for _, write := range batch {
+		end += write.frame.size()
+		e.putFrameBuffer(write.frame)
+		e.queued.Add(-1)
+		if err != nil && end > n {
+			write.ch <- err
+		} else {
+			write.ch <- nil
+		}
+	}
+}
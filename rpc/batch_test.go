@@ -0,0 +1,146 @@
+package rpc
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/keybase/go-codec/codec"
+	"github.com/stretchr/testify/require"
+)
+
+// recordingWriter keeps each write separately, and fails once limit bytes
+// have been written, if limit is positive.
+type recordingWriter struct {
+	sync.Mutex
+	writes [][]byte
+	events []string
+	limit  int
+	total  int
+}
+
+func (w *recordingWriter) event(s string) {
+	w.Lock()
+	defer w.Unlock()
+	w.events = append(w.events, s)
+}
+
+func (w *recordingWriter) Write(b []byte) (int, error) {
+	w.Lock()
+	defer w.Unlock()
+	w.events = append(w.events, "write")
+	if w.limit > 0 && w.total+len(b) > w.limit {
+		n := w.limit - w.total
+		w.writes = append(w.writes, append([]byte(nil), b[:n]...))
+		w.total = w.limit
+		return n, errors.New("writer is full")
+	}
+	w.writes = append(w.writes, append([]byte(nil), b...))
+	w.total += len(b)
+	return len(b), nil
+}
+
+func encodeTestFrame(t *testing.T, frame []interface{}) []byte {
+	var body []byte
+	require.NoError(t, codec.NewEncoderBytes(&body, newCodecMsgpackHandle()).Encode(frame))
+	var header [frameHeaderSize]byte
+	return append(header[:putFrameLength(header[:], len(body))], body...)
+}
+
+func TestWriteBatching(t *testing.T) {
+	w := &recordingWriter{}
+	enc := newFramedEncoder(testMaxFrameLength, w, CodecMsgpack, &WriteBatchOpts{MaxFrames: 3, MaxDelay: time.Minute})
+	defer enc.Close()
+
+	frames := [][]interface{}{{MethodNotify, "a", 1}, {MethodNotify, "b", 2}, {MethodNotify, "c", 3}}
+	var errChs []<-chan error
+	var expected []byte
+	for i, frame := range frames {
+		name := frame[1].(string)
+		_, errCh := enc.EncodeAndWrite(context.Background(), frame, func() { w.event("sent " + name) })
+		errChs = append(errChs, errCh)
+		expected = append(expected, encodeTestFrame(t, frames[i])...)
+	}
+	for _, errCh := range errChs {
+		require.NoError(t, <-errCh)
+	}
+
+	// The batch is written at once, after every SendNotifier was called,
+	// in order.
+	require.Equal(t, [][]byte{expected}, w.writes)
+	require.Equal(t, []string{"sent a", "sent b", "sent c", "write"}, w.events)
+	require.Zero(t, enc.queueDepth())
+}
+
+func TestWriteBatchingPartialFailure(t *testing.T) {
+	frames := [][]interface{}{{MethodNotify, "a", 1}, {MethodNotify, "b", 2}, {MethodNotify, "c", 3}}
+	first := encodeTestFrame(t, frames[0])
+	// The write fails part way through the second frame.
+	w := &recordingWriter{limit: len(first) + 2}
+	enc := newFramedEncoder(testMaxFrameLength, w, CodecMsgpack, &WriteBatchOpts{MaxFrames: 3, MaxDelay: time.Minute})
+	defer enc.Close()
+
+	var errChs []<-chan error
+	for _, frame := range frames {
+		_, errCh := enc.EncodeAndWrite(context.Background(), frame, nil)
+		errChs = append(errChs, errCh)
+	}
+	require.NoError(t, <-errChs[0])
+	require.EqualError(t, <-errChs[1], "writer is full")
+	require.EqualError(t, <-errChs[2], "writer is full")
+}
+
+func TestWriteBatchingLimits(t *testing.T) {
+	w := &recordingWriter{}
+	enc := newFramedEncoder(testMaxFrameLength, w, CodecMsgpack, &WriteBatchOpts{MaxBytes: 10, MaxDelay: time.Minute})
+	defer enc.Close()
+
+	// A frame bigger than MaxBytes is written on its own, without
+	// waiting for more.
+	big := []interface{}{MethodNotify, "big", bytes.Repeat([]byte{'x'}, 20)}
+	_, errCh := enc.EncodeAndWrite(context.Background(), big, nil)
+	require.NoError(t, <-errCh)
+	require.Equal(t, [][]byte{encodeTestFrame(t, big)}, w.writes)
+
+	// Without MaxDelay, a lone frame isn't held back.
+	w2 := &recordingWriter{}
+	enc2 := newFramedEncoder(testMaxFrameLength, w2, CodecMsgpack, &WriteBatchOpts{})
+	defer enc2.Close()
+	_, errCh = enc2.EncodeAndWrite(context.Background(), []interface{}{MethodNotify, "a", 1}, nil)
+	require.NoError(t, <-errCh)
+	require.Len(t, w2.writes, 1)
+}
+
+func TestTransportWriteBatching(t *testing.T) {
+	opts := TransportOpts{WriteBatching: &WriteBatchOpts{MaxDelay: time.Millisecond}}
+	clientConn, serverConn := net.Pipe()
+	sxp := NewTransportWithOpts(context.Background(), serverConn, nil, nil, nil, testMaxFrameLength, opts)
+	srv := NewServer(sxp, nil)
+	require.NoError(t, srv.Register(drainTestProtocol(nil, nil)))
+	srv.Run()
+	cxp := NewTransportWithOpts(context.Background(), clientConn, nil, nil, nil, testMaxFrameLength, opts)
+	defer cxp.Close()
+	defer sxp.Close()
+	cli := NewClient(cxp, nil, nil)
+
+	var wg sync.WaitGroup
+	errs := make([]error, 50)
+	for i := range errs {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			var res int
+			if errs[i] = cli.Call(context.Background(), newMethodV1("drain.echo"), i, &res, 0); errs[i] == nil && res != i {
+				errs[i] = errors.New("wrong result")
+			}
+		}(i)
+	}
+	wg.Wait()
+	for _, err := range errs {
+		require.NoError(t, err)
+	}
+}
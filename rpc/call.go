@@ -2,7 +2,9 @@ package rpc
 
 import (
 	"context"
+	"sort"
 	"sync"
+	"time"
 )
 
 type call struct {
@@ -17,13 +19,16 @@ type call struct {
 	ctype          CompressionType
 	errorUnwrapper ErrorUnwrapper
 	instrumenter   *NetworkInstrumenter
+	start          time.Time
 }
 
 type callContainer struct {
 	callsMtx sync.RWMutex
 	calls    map[SeqNumber]*call
-	seqMtx   sync.Mutex
-	seqid    SeqNumber
+	// Closed the next time calls becomes empty. Protected by callsMtx.
+	emptyWaiters []chan struct{}
+	seqMtx       sync.Mutex
+	seqid        SeqNumber
 }
 
 func newCallContainer() *callContainer {
@@ -49,6 +54,7 @@ func (cc *callContainer) NewCall(ctx context.Context, m Methoder, arg interface{
 		errorUnwrapper: u,
 		seqid:          cc.nextSeqid(),
 		instrumenter:   instrumenter,
+		start:          time.Now(),
 	}
 }
 
@@ -80,4 +86,53 @@ func (cc *callContainer) RemoveCall(seqid SeqNumber) {
 	defer cc.callsMtx.Unlock()
 
 	delete(cc.calls, seqid)
+	if len(cc.calls) == 0 {
+		for _, ch := range cc.emptyWaiters {
+			close(ch)
+		}
+		cc.emptyWaiters = nil
+	}
+}
+
+// WaitEmpty blocks until there are no outstanding calls, or until ctx is
+// done.
+func (cc *callContainer) WaitEmpty(ctx context.Context) error {
+	ch := func() chan struct{} {
+		cc.callsMtx.Lock()
+		defer cc.callsMtx.Unlock()
+		if len(cc.calls) == 0 {
+			return nil
+		}
+		ch := make(chan struct{})
+		cc.emptyWaiters = append(cc.emptyWaiters, ch)
+		return ch
+	}()
+	if ch == nil {
+		return nil
+	}
+	select {
+	case <-ch:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// describe lists the outstanding calls, by seqno.
+func (cc *callContainer) describe(now time.Time) []OutstandingCallInfo {
+	cc.callsMtx.RLock()
+	defer cc.callsMtx.RUnlock()
+
+	ret := make([]OutstandingCallInfo, 0, len(cc.calls))
+	for _, c := range cc.calls {
+		ret = append(ret, OutstandingCallInfo{
+			SeqNo:       c.seqid,
+			Method:      c.method.String(),
+			Compression: c.ctype,
+			Started:     c.start,
+			Age:         now.Sub(c.start),
+		})
+	}
+	sort.Slice(ret, func(i, j int) bool { return ret[i].SeqNo < ret[j].SeqNo })
+	return ret
 }
@@ -0,0 +1,314 @@
+package rpc
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+// Captures record the frames that go through a connection, for debugging
+// and replay. A capture file is:
+//
+//	magic   [8]byte  "SPRPCAP\x01"
+//	records ...
+//
+// and each record is:
+//
+//	direction  byte      '>' for frames sent, '<' for frames received
+//	time       int64     big-endian, in nanoseconds since the Unix epoch
+//	length     uint32    big-endian, the length of the frame
+//	frame      [length]byte
+//
+// Frames are stored without their length prefix, so each one is a single
+// msgpack array, as described in protocol.go. Transports with other codecs
+// can't be captured.
+const captureMagic = "SPRPCAP\x01"
+
+// maxCaptureFrameLength bounds the frames that are captured, and read back.
+const maxCaptureFrameLength = 1 << 30
+
+// CaptureDirection tells whether a captured frame was sent or received by
+// the side that captured it.
+type CaptureDirection byte
+
+const (
+	CaptureSent     CaptureDirection = '>'
+	CaptureReceived CaptureDirection = '<'
+)
+
+func (d CaptureDirection) String() string {
+	switch d {
+	case CaptureSent:
+		return "sent"
+	case CaptureReceived:
+		return "received"
+	default:
+		return fmt.Sprintf("CaptureDirection(%d)", byte(d))
+	}
+}
+
+// Opposite returns the direction of the replies to frames going in d.
+func (d CaptureDirection) Opposite() CaptureDirection {
+	if d == CaptureSent {
+		return CaptureReceived
+	}
+	return CaptureSent
+}
+
+// CaptureRecord is a single captured frame.
+type CaptureRecord struct {
+	Time      time.Time
+	Direction CaptureDirection
+	Frame     []byte
+}
+
+// CaptureWriter writes captured frames to a file. It is safe for concurrent
+// use.
+type CaptureWriter struct {
+	sync.Mutex
+	w   io.Writer
+	err error
+}
+
+// NewCaptureWriter writes the file header to w, and returns a CaptureWriter
+// for the records.
+func NewCaptureWriter(w io.Writer) (*CaptureWriter, error) {
+	if _, err := io.WriteString(w, captureMagic); err != nil {
+		return nil, err
+	}
+	return &CaptureWriter{w: w}, nil
+}
+
+// Write writes a record. After the first error, all writes fail.
+func (c *CaptureWriter) Write(rec CaptureRecord) error {
+	c.Lock()
+	defer c.Unlock()
+	if c.err != nil {
+		return c.err
+	}
+	var hdr [13]byte
+	hdr[0] = byte(rec.Direction)
+	binary.BigEndian.PutUint64(hdr[1:9], uint64(rec.Time.UnixNano()))
+	binary.BigEndian.PutUint32(hdr[9:13], uint32(len(rec.Frame)))
+	if _, c.err = c.w.Write(hdr[:]); c.err != nil {
+		return c.err
+	}
+	_, c.err = c.w.Write(rec.Frame)
+	return c.err
+}
+
+// CaptureReader reads the records of a capture file.
+type CaptureReader struct {
+	r *bufio.Reader
+}
+
+// NewCaptureReader checks the file header, and returns a CaptureReader for
+// the records.
+func NewCaptureReader(r io.Reader) (*CaptureReader, error) {
+	br := bufio.NewReader(r)
+	var magic [len(captureMagic)]byte
+	if _, err := io.ReadFull(br, magic[:]); err != nil {
+		return nil, err
+	}
+	if string(magic[:]) != captureMagic {
+		return nil, errors.New("not a capture file")
+	}
+	return &CaptureReader{r: br}, nil
+}
+
+// Next returns the next record, or io.EOF at the end of the file.
+func (c *CaptureReader) Next() (CaptureRecord, error) {
+	var hdr [13]byte
+	if _, err := io.ReadFull(c.r, hdr[:]); err != nil {
+		if err == io.ErrUnexpectedEOF {
+			return CaptureRecord{}, errors.New("truncated capture record")
+		}
+		return CaptureRecord{}, err
+	}
+	dir := CaptureDirection(hdr[0])
+	if dir != CaptureSent && dir != CaptureReceived {
+		return CaptureRecord{}, fmt.Errorf("bad capture direction: %#x", hdr[0])
+	}
+	l := binary.BigEndian.Uint32(hdr[9:13])
+	if l > maxCaptureFrameLength {
+		return CaptureRecord{}, fmt.Errorf("capture frame too big: %d", l)
+	}
+	frame := make([]byte, l)
+	if _, err := io.ReadFull(c.r, frame); err != nil {
+		return CaptureRecord{}, errors.New("truncated capture record")
+	}
+	return CaptureRecord{
+		Time:      time.Unix(0, int64(binary.BigEndian.Uint64(hdr[1:9]))),
+		Direction: dir,
+		Frame:     frame,
+	}, nil
+}
+
+// ReadAll returns all of the remaining records.
+func (c *CaptureReader) ReadAll() ([]CaptureRecord, error) {
+	var ret []CaptureRecord
+	for {
+		rec, err := c.Next()
+		if err == io.EOF {
+			return ret, nil
+		}
+		if err != nil {
+			return ret, err
+		}
+		ret = append(ret, rec)
+	}
+}
+
+// frameLengthSizes are the sizes of the msgpack integers that can prefix a
+// frame, other than positive fixints, by type byte.
+var frameLengthSizes = map[byte]int{
+	0xcc: 1, 0xcd: 2, 0xce: 4, 0xcf: 8,
+	0xd0: 1, 0xd1: 2, 0xd2: 4, 0xd3: 8,
+}
+
+// parseFrameLength parses the msgpack integer that prefixes a frame. It
+// returns the length and the size of the prefix, or a zero size if b is too
+// short.
+func parseFrameLength(b []byte) (length int64, n int, err error) {
+	if len(b) == 0 {
+		return 0, 0, nil
+	}
+	size := frameLengthSizes
+	switch c := b[0]; {
+	case c <= 0x7f:
+		return int64(c), 1, nil
+	case size[c] > 0:
+		if len(b) < 1+size[c] {
+			return 0, 0, nil
+		}
+		var v uint64
+		for _, x := range b[1 : 1+size[c]] {
+			v = v<<8 | uint64(x)
+		}
+		if c >= 0xd0 {
+			// Sign-extend.
+			shift := 64 - 8*size[c]
+			length = int64(v<<shift) >> shift
+		} else {
+			length = int64(v)
+		}
+		if length < 0 || length > maxCaptureFrameLength {
+			return 0, 0, fmt.Errorf("bad frame length: %d", length)
+		}
+		return length, 1 + size[c], nil
+	default:
+		return 0, 0, fmt.Errorf("bad frame length prefix: %#x", c)
+	}
+}
+
+// isMsgpackArray is true if b starts a msgpack array: a fixarray, an array
+// 16 or an array 32.
+func isMsgpackArray(b byte) bool {
+	return (b >= 0x90 && b <= 0x9f) || b == 0xdc || b == 0xdd
+}
+
+// frameSplitter reassembles the frames of one direction of a stream.
+type frameSplitter struct {
+	buf []byte
+	err error
+}
+
+// feed adds bytes from the stream, and returns the frames that they
+// complete. Once the stream is found to be malformed, or not to be framed
+// msgpack, it returns nothing.
+func (s *frameSplitter) feed(p []byte) (frames [][]byte) {
+	if s.err != nil {
+		return nil
+	}
+	s.buf = append(s.buf, p...)
+	for {
+		l, n, err := parseFrameLength(s.buf)
+		if err != nil {
+			s.err = err
+			s.buf = nil
+			return frames
+		}
+		if n == 0 || int64(len(s.buf)-n) < l {
+			return frames
+		}
+		// Frames are msgpack arrays. Anything else means that the
+		// stream uses another codec.
+		if l == 0 || !isMsgpackArray(s.buf[n]) {
+			s.err = fmt.Errorf("not a msgpack frame")
+			s.buf = nil
+			return frames
+		}
+		frame := make([]byte, l)
+		copy(frame, s.buf[n:n+int(l)])
+		frames = append(frames, frame)
+		s.buf = s.buf[n+int(l):]
+	}
+}
+
+// captureConn is a net.Conn that captures the frames that go through it.
+type captureConn struct {
+	net.Conn
+	w *CaptureWriter
+
+	readMtx  sync.Mutex
+	read     frameSplitter
+	writeMtx sync.Mutex
+	written  frameSplitter
+}
+
+// NewCaptureConn wraps c so that the frames read from it and written to it
+// are captured to w. c must carry a transport with the msgpack codec.
+// Capturing is best-effort: errors writing the capture are ignored, and if
+// the stream doesn't look like framed msgpack, capturing stops for that
+// direction.
+func NewCaptureConn(c net.Conn, w *CaptureWriter) net.Conn {
+	return &captureConn{Conn: c, w: w}
+}
+
+// NewCaptureConnWithCodec is like NewCaptureConn, for a transport with the
+// codec ct. It returns a CaptureCodecError unless ct is CodecMsgpack.
+func NewCaptureConnWithCodec(c net.Conn, w *CaptureWriter, ct CodecType) (net.Conn, error) {
+	if ct != CodecMsgpack {
+		return nil, CaptureCodecError{Codec: ct}
+	}
+	return NewCaptureConn(c, w), nil
+}
+
+func (c *captureConn) capture(dir CaptureDirection, frames [][]byte) {
+	now := time.Now()
+	for _, f := range frames {
+		_ = c.w.Write(CaptureRecord{Time: now, Direction: dir, Frame: f})
+	}
+}
+
+func (c *captureConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	if n > 0 {
+		c.readMtx.Lock()
+		c.capture(CaptureReceived, c.read.feed(b[:n]))
+		c.readMtx.Unlock()
+	}
+	return n, err
+}
+
+// Write captures the frames before writing them, so that they come before
+// their replies in the capture.
+func (c *captureConn) Write(b []byte) (int, error) {
+	c.writeMtx.Lock()
+	c.capture(CaptureSent, c.written.feed(b))
+	c.writeMtx.Unlock()
+	return c.Conn.Write(b)
+}
+
+// writeRawFrame writes a frame with its length prefix.
+func writeRawFrame(w io.Writer, frame []byte) error {
+	buf := make([]byte, frameHeaderSize, frameHeaderSize+len(frame))
+	buf = append(buf[:putFrameLength(buf, len(frame))], frame...)
+	_, err := w.Write(buf)
+	return err
+}
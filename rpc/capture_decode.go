@@ -0,0 +1,573 @@
+package rpc
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"reflect"
+	"sort"
+	"time"
+
+	"github.com/keybase/go-codec/codec"
+)
+
+// CaptureNames resolves the ProtocolUniqueIDs and Positions of V2 methods to
+// names, for decoding captures. It's usually built from the output of
+// ReflectionClient.ListProtocolsV2.
+type CaptureNames map[ProtocolUniqueID]ProtocolV2Description
+
+// NewCaptureNames returns the names of the given protocols, along with those
+// of the built-in ones.
+func NewCaptureNames(protocols []ProtocolV2Description) CaptureNames {
+	ret := make(CaptureNames, len(protocols)+1)
+	reflection := reflectionProtocol(nil, ReflectionOpts{})
+	builtin := ProtocolV2Description{ID: reflection.ID, Name: reflection.Name, Methods: make(map[Position]string)}
+	for pos, m := range reflection.Methods {
+		builtin.Methods[pos] = m.Name
+	}
+	ret[builtin.ID] = builtin
+	for _, p := range protocols {
+		ret[p.ID] = p
+	}
+	return ret
+}
+
+// LoadCaptureNames reads the JSON encoding of a []ProtocolV2Description.
+func LoadCaptureNames(r io.Reader) (CaptureNames, error) {
+	var protocols []ProtocolV2Description
+	if err := json.NewDecoder(r).Decode(&protocols); err != nil {
+		return nil, err
+	}
+	return NewCaptureNames(protocols), nil
+}
+
+// name returns "protocol.method", or the IDs in hex and decimal if they're
+// unknown.
+func (n CaptureNames) name(p ProtocolUniqueID, pos Position) string {
+	if d, ok := n[p]; ok {
+		if m, ok := d.Methods[pos]; ok {
+			return d.Name + "." + m
+		}
+		return fmt.Sprintf("%s.#%d", d.Name, pos)
+	}
+	return fmt.Sprintf("%#x.#%d", uint64(p), pos)
+}
+
+// FrameDescription is a decoded frame. Arguments, results and errors are
+// generic msgpack values, with maps keyed by strings so that they can be
+// encoded to JSON.
+type FrameDescription struct {
+	Type MethodType
+	// SeqNo is -1 for frames without one.
+	SeqNo       SeqNumber
+	Method      string
+	Compression CompressionType
+	Arg         interface{}
+	Error       interface{}
+	Result      interface{}
+	Tags        interface{}
+	Headers     map[string]string
+}
+
+// MarshalJSON encodes f with readable names, leaving out the fields that
+// don't apply.
+func (f FrameDescription) MarshalJSON() ([]byte, error) {
+	type frame struct {
+		Type        string            `json:"type"`
+		SeqNo       *SeqNumber        `json:"seqno,omitempty"`
+		Method      string            `json:"method,omitempty"`
+		Compression string            `json:"compression,omitempty"`
+		Arg         interface{}       `json:"arg,omitempty"`
+		Error       interface{}       `json:"error,omitempty"`
+		Result      interface{}       `json:"result,omitempty"`
+		Tags        interface{}       `json:"tags,omitempty"`
+		Headers     map[string]string `json:"headers,omitempty"`
+	}
+	ret := frame{
+		Type:    f.Type.String(),
+		Method:  f.Method,
+		Arg:     f.Arg,
+		Error:   f.Error,
+		Result:  f.Result,
+		Tags:    f.Tags,
+		Headers: f.Headers,
+	}
+	if f.SeqNo >= 0 {
+		seqno := f.SeqNo
+		ret.SeqNo = &seqno
+	}
+	if f.Compression != CompressionNone {
+		ret.Compression = f.Compression.String()
+	}
+	return json.Marshal(ret)
+}
+
+type captureCallKey struct {
+	dir   CaptureDirection
+	seqno SeqNumber
+}
+
+type captureCall struct {
+	method string
+	ctype  CompressionType
+}
+
+// CaptureDecoder decodes captured frames. It keeps track of calls, so that
+// responses can be matched to their method, and so it must see the frames in
+// order. It is not safe for concurrent use.
+type CaptureDecoder struct {
+	names CaptureNames
+	calls map[captureCallKey]captureCall
+}
+
+// NewCaptureDecoder makes a CaptureDecoder that resolves V2 methods with
+// names, which can be nil.
+func NewCaptureDecoder(names CaptureNames) *CaptureDecoder {
+	if names == nil {
+		names = NewCaptureNames(nil)
+	}
+	return &CaptureDecoder{names: names, calls: make(map[captureCallKey]captureCall)}
+}
+
+// captureFields pops the fields of a frame, in order.
+type captureFields []interface{}
+
+func (f *captureFields) next() (interface{}, error) {
+	if len(*f) == 0 {
+		return nil, fmt.Errorf("frame is too short")
+	}
+	ret := (*f)[0]
+	*f = (*f)[1:]
+	return ret, nil
+}
+
+func (f *captureFields) nextUint() (uint64, error) {
+	v, err := f.next()
+	if err != nil {
+		return 0, err
+	}
+	switch i := v.(type) {
+	case uint64:
+		return i, nil
+	case int64:
+		if i >= 0 {
+			return uint64(i), nil
+		}
+	}
+	return 0, fmt.Errorf("expected an unsigned integer, got %v", v)
+}
+
+func (f *captureFields) nextString() (string, error) {
+	v, err := f.next()
+	if err != nil {
+		return "", err
+	}
+	s, ok := v.(string)
+	if !ok {
+		return "", fmt.Errorf("expected a string, got %v", v)
+	}
+	return s, nil
+}
+
+// Decode decodes a captured frame.
+func (c *CaptureDecoder) Decode(rec CaptureRecord) (*FrameDescription, error) {
+	var raw []interface{}
+	if err := codec.NewDecoderBytes(rec.Frame, newCodecMsgpackHandle()).Decode(&raw); err != nil {
+		return nil, err
+	}
+	fields := captureFields(raw)
+	typ, err := fields.nextUint()
+	if err != nil {
+		return nil, err
+	}
+	ret := &FrameDescription{Type: MethodType(typ), SeqNo: -1}
+	switch ret.Type {
+	case MethodCall, MethodCallCompressed, MethodCallV2:
+		err = c.decodeCall(rec.Direction, ret, &fields)
+	case MethodNotify, MethodNotifyV2:
+		err = c.decodeNotify(ret, &fields)
+	case MethodResponse:
+		err = c.decodeResponse(rec.Direction, ret, &fields)
+	case MethodCancel, MethodCancelV2:
+		err = c.decodeCancel(ret, &fields)
+	case MethodGoAway:
+		// Any fields are reserved for future use.
+	case MethodHandshake:
+		ret.Arg, err = fields.next()
+		ret.Arg = captureJSONValue(ret.Arg)
+	default:
+		err = fmt.Errorf("unknown frame type: %d", typ)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return ret, nil
+}
+
+func (c *CaptureDecoder) decodeSeqNo(ret *FrameDescription, fields *captureFields) error {
+	v, err := fields.next()
+	if err != nil {
+		return err
+	}
+	switch i := v.(type) {
+	case int64:
+		ret.SeqNo = SeqNumber(i)
+	case uint64:
+		ret.SeqNo = SeqNumber(i)
+	default:
+		return fmt.Errorf("bad seqno: %v", v)
+	}
+	return nil
+}
+
+func (c *CaptureDecoder) decodeMethod(ret *FrameDescription, fields *captureFields) (err error) {
+	switch ret.Type {
+	case MethodCallV2, MethodNotifyV2, MethodCancelV2:
+		p, err := fields.nextUint()
+		if err != nil {
+			return err
+		}
+		pos, err := fields.nextUint()
+		if err != nil {
+			return err
+		}
+		ret.Method = c.names.name(ProtocolUniqueID(p), Position(pos))
+	default:
+		ret.Method, err = fields.nextString()
+	}
+	return err
+}
+
+// decodePayload decodes an argument or result, decompressing it first if
+// need be.
+func decodePayload(v interface{}, ctype CompressionType) (interface{}, error) {
+	compressor := ctype.NewCompressor()
+	if compressor == nil || v == nil {
+		return captureJSONValue(v), nil
+	}
+	compressed, ok := v.([]byte)
+	if !ok {
+		return nil, fmt.Errorf("expected compressed bytes, got %v", v)
+	}
+	if len(compressed) == 0 {
+		return nil, nil
+	}
+	uncompressed, err := compressor.Decompress(compressed)
+	if err != nil {
+		return nil, err
+	}
+	var ret interface{}
+	if err := codec.NewDecoderBytes(uncompressed, newCodecMsgpackHandle()).Decode(&ret); err != nil {
+		return nil, err
+	}
+	return captureJSONValue(ret), nil
+}
+
+// decodeTrailer decodes the optional ctxlog tags and headers.
+func (c *CaptureDecoder) decodeTrailer(ret *FrameDescription, fields *captureFields) {
+	if tags, err := fields.next(); err == nil {
+		ret.Tags = captureJSONValue(tags)
+	}
+	if headers, err := fields.next(); err == nil {
+		ret.Headers = toHeaders(headers)
+	}
+}
+
+func (c *CaptureDecoder) decodeCall(dir CaptureDirection, ret *FrameDescription, fields *captureFields) error {
+	if err := c.decodeSeqNo(ret, fields); err != nil {
+		return err
+	}
+	if ret.Type == MethodCallCompressed {
+		ctype, err := fields.nextUint()
+		if err != nil {
+			return err
+		}
+		ret.Compression = CompressionType(ctype)
+	}
+	if err := c.decodeMethod(ret, fields); err != nil {
+		return err
+	}
+	arg, err := fields.next()
+	if err != nil {
+		return err
+	}
+	if ret.Arg, err = decodePayload(arg, ret.Compression); err != nil {
+		return err
+	}
+	c.decodeTrailer(ret, fields)
+	c.calls[captureCallKey{dir, ret.SeqNo}] = captureCall{method: ret.Method, ctype: ret.Compression}
+	return nil
+}
+
+func (c *CaptureDecoder) decodeNotify(ret *FrameDescription, fields *captureFields) error {
+	if err := c.decodeMethod(ret, fields); err != nil {
+		return err
+	}
+	arg, err := fields.next()
+	if err != nil {
+		return err
+	}
+	ret.Arg = captureJSONValue(arg)
+	c.decodeTrailer(ret, fields)
+	return nil
+}
+
+func (c *CaptureDecoder) decodeCancel(ret *FrameDescription, fields *captureFields) error {
+	if err := c.decodeSeqNo(ret, fields); err != nil {
+		return err
+	}
+	return c.decodeMethod(ret, fields)
+}
+
+func (c *CaptureDecoder) decodeResponse(dir CaptureDirection, ret *FrameDescription, fields *captureFields) error {
+	if err := c.decodeSeqNo(ret, fields); err != nil {
+		return err
+	}
+	key := captureCallKey{dir.Opposite(), ret.SeqNo}
+	call, found := c.calls[key]
+	if found {
+		delete(c.calls, key)
+		ret.Method = call.method
+		ret.Compression = call.ctype
+	}
+	respErr, err := fields.next()
+	if err != nil {
+		return err
+	}
+	if s, ok := respErr.(string); !ok || s != "" {
+		ret.Error = captureJSONValue(respErr)
+	}
+	res, err := fields.next()
+	if err != nil {
+		return err
+	}
+	ret.Result, err = decodePayload(res, ret.Compression)
+	return err
+}
+
+// captureJSONValue converts generic msgpack values into ones that can be
+// encoded to JSON.
+func captureJSONValue(v interface{}) interface{} {
+	switch t := v.(type) {
+	case map[interface{}]interface{}:
+		ret := make(map[string]interface{}, len(t))
+		for k, e := range t {
+			ret[fmt.Sprint(k)] = captureJSONValue(e)
+		}
+		return ret
+	case []interface{}:
+		ret := make([]interface{}, len(t))
+		for i, e := range t {
+			ret[i] = captureJSONValue(e)
+		}
+		return ret
+	default:
+		return v
+	}
+}
+
+// ReplayOpts are the options of ReplayCapture.
+type ReplayOpts struct {
+	// Requests is the direction of the frames to replay. Frames in the
+	// opposite direction are the expected replies. It defaults to
+	// CaptureSent, for captures made on the client side.
+	Requests CaptureDirection
+	// KeepTiming waits between frames as long as in the capture.
+	KeepTiming bool
+	// Timeout bounds the wait for the replies, after the last frame is
+	// sent. It defaults to 10 seconds.
+	Timeout time.Duration
+	// Names resolves V2 methods in the report.
+	Names CaptureNames
+	// Codec is that of the server. Only CodecMsgpack, the default, is
+	// supported.
+	Codec CodecType
+}
+
+// ReplayMismatch is a reply that differs from the captured one. Actual is
+// nil if no reply came back.
+type ReplayMismatch struct {
+	SeqNo    SeqNumber
+	Method   string
+	Expected *FrameDescription
+	Actual   *FrameDescription
+}
+
+// ReplayReport is the outcome of ReplayCapture.
+type ReplayReport struct {
+	// Sent is the number of frames sent.
+	Sent int
+	// Replies is the number of replies received.
+	Replies int
+	// Mismatches are sorted by SeqNo.
+	Mismatches []ReplayMismatch
+}
+
+// OK is true if all the replies matched the capture.
+func (r *ReplayReport) OK() bool {
+	return len(r.Mismatches) == 0
+}
+
+// replayReader reads the frames sent back during a replay, until conn fails
+// or done is closed.
+func replayReader(conn net.Conn, ch chan<- []byte, errCh chan<- error, done <-chan struct{}) {
+	br := bufio.NewReader(conn)
+	dec := codec.NewDecoder(br, newCodecMsgpackHandle())
+	for {
+		var l int
+		if err := dec.Decode(&l); err != nil {
+			errCh <- err
+			return
+		}
+		if l < 0 || l > maxCaptureFrameLength {
+			errCh <- fmt.Errorf("bad frame length: %d", l)
+			return
+		}
+		frame := make([]byte, l)
+		if _, err := io.ReadFull(br, frame); err != nil {
+			errCh <- err
+			return
+		}
+		select {
+		case ch <- frame:
+		case <-done:
+			return
+		}
+	}
+}
+
+// ReplayCapture sends the requests of a capture over conn, such as a
+// connection to a server on a LoopbackListener, and compares the responses
+// to those in the capture. Responses are matched by sequence number, and
+// compared on their decoded errors and results. Frames other than responses
+// that come back are ignored.
+//
+// ReplayCapture doesn't close conn, which the caller must do once it
+// returns, to stop the goroutine that reads the replies from it.
+func ReplayCapture(ctx context.Context, conn net.Conn, records []CaptureRecord, opts ReplayOpts) (*ReplayReport, error) {
+	if opts.Codec != CodecMsgpack {
+		return nil, CaptureCodecError{Codec: opts.Codec}
+	}
+	if opts.Requests == 0 {
+		opts.Requests = CaptureSent
+	}
+	if opts.Timeout == 0 {
+		opts.Timeout = 10 * time.Second
+	}
+
+	// Decode the capture to find the expected responses.
+	dec := NewCaptureDecoder(opts.Names)
+	expected := make(map[SeqNumber]*FrameDescription)
+	var requests []CaptureRecord
+	for _, rec := range records {
+		desc, err := dec.Decode(rec)
+		if err != nil {
+			return nil, err
+		}
+		switch {
+		case rec.Direction == opts.Requests && desc.Type != MethodResponse:
+			requests = append(requests, rec)
+		case rec.Direction != opts.Requests && desc.Type == MethodResponse:
+			expected[desc.SeqNo] = desc
+		}
+	}
+
+	frames := make(chan []byte, 16)
+	readErr := make(chan error, 1)
+	done := make(chan struct{})
+	defer close(done)
+	go replayReader(conn, frames, readErr, done)
+
+	report := &ReplayReport{}
+	actual := make(map[SeqNumber]*FrameDescription)
+	// The replayed requests are decoded with their replies, since that's
+	// the direction the replies are matched in.
+	replayDec := NewCaptureDecoder(opts.Names)
+	var readErrSeen error
+	receive := func(frame []byte) error {
+		desc, err := replayDec.Decode(CaptureRecord{Direction: opts.Requests.Opposite(), Frame: frame})
+		if err != nil {
+			return err
+		}
+		if desc.Type == MethodResponse {
+			report.Replies++
+			actual[desc.SeqNo] = desc
+		}
+		return nil
+	}
+	// drain handles the replies that already arrived.
+	drain := func() error {
+		for {
+			select {
+			case frame := <-frames:
+				if err := receive(frame); err != nil {
+					return err
+				}
+			default:
+				return nil
+			}
+		}
+	}
+
+	var last time.Time
+	for _, rec := range requests {
+		if opts.KeepTiming && !last.IsZero() {
+			select {
+			case <-time.After(rec.Time.Sub(last)):
+			case <-ctx.Done():
+				return report, ctx.Err()
+			}
+		}
+		last = rec.Time
+		if _, err := replayDec.Decode(rec); err != nil {
+			return report, err
+		}
+		if err := writeRawFrame(conn, rec.Frame); err != nil {
+			return report, err
+		}
+		report.Sent++
+		if err := drain(); err != nil {
+			return report, err
+		}
+	}
+
+	timer := time.NewTimer(opts.Timeout)
+	defer timer.Stop()
+	for len(actual) < len(expected) && readErrSeen == nil {
+		select {
+		case frame := <-frames:
+			if err := receive(frame); err != nil {
+				return report, err
+			}
+		case readErrSeen = <-readErr:
+		case <-timer.C:
+			readErrSeen = io.EOF
+		case <-ctx.Done():
+			return report, ctx.Err()
+		}
+	}
+	if err := drain(); err != nil {
+		return report, err
+	}
+
+	for seqno, exp := range expected {
+		act := actual[seqno]
+		if act != nil && reflect.DeepEqual(exp.Error, act.Error) &&
+			reflect.DeepEqual(exp.Result, act.Result) {
+			continue
+		}
+		report.Mismatches = append(report.Mismatches, ReplayMismatch{
+			SeqNo:    seqno,
+			Method:   exp.Method,
+			Expected: exp,
+			Actual:   act,
+		})
+	}
+	sort.Slice(report.Mismatches, func(i, j int) bool {
+		return report.Mismatches[i].SeqNo < report.Mismatches[j].SeqNo
+	})
+	return report, nil
+}
@@ -0,0 +1,306 @@
+package rpc
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/foks-proj/go-ctxlog"
+	"github.com/stretchr/testify/require"
+)
+
+type captureTestArg struct {
+	A int
+	B string
+}
+
+const captureTestProtocolID ProtocolUniqueID = 0xca57
+
+func captureTestServer(t *testing.T, conn net.Conn, suffix string) Transporter {
+	xp := NewTransport(context.Background(), conn, nil, nil, nil, testMaxFrameLength)
+	srv := NewServer(xp, nil)
+	require.NoError(t, srv.Register(Protocol{
+		Name: "capture",
+		Methods: map[string]ServeHandlerDescription{
+			"echo": {
+				MakeArg: func() interface{} { return new(captureTestArg) },
+				Handler: func(_ context.Context, arg interface{}) (interface{}, error) {
+					a := *arg.(*captureTestArg)
+					a.B += suffix
+					return a, nil
+				},
+			},
+			"fail": {
+				MakeArg: func() interface{} { return new(captureTestArg) },
+				Handler: func(_ context.Context, arg interface{}) (interface{}, error) {
+					return nil, errors.New("failed on purpose")
+				},
+			},
+		},
+	}))
+	require.NoError(t, srv.RegisterV2(ProtocolV2{
+		Name: "capture2",
+		ID:   captureTestProtocolID,
+		Methods: map[Position]ServeHandlerDescriptionV2{
+			0: {
+				ServeHandlerDescription: ServeHandlerDescription{
+					MakeArg: func() interface{} { return new(int) },
+					Handler: func(_ context.Context, arg interface{}) (interface{}, error) {
+						return *arg.(*int) * 2, nil
+					},
+				},
+				Name: "double",
+			},
+		},
+	}))
+	srv.Run()
+	return xp
+}
+
+func TestCaptureFile(t *testing.T) {
+	var buf bytes.Buffer
+	w, err := NewCaptureWriter(&buf)
+	require.NoError(t, err)
+	now := time.Unix(0, time.Now().UnixNano())
+	require.NoError(t, w.Write(CaptureRecord{Time: now, Direction: CaptureSent, Frame: []byte{0x90}}))
+	require.NoError(t, w.Write(CaptureRecord{Time: now, Direction: CaptureReceived, Frame: []byte{0x91, 0x01}}))
+
+	r, err := NewCaptureReader(bytes.NewReader(buf.Bytes()))
+	require.NoError(t, err)
+	recs, err := r.ReadAll()
+	require.NoError(t, err)
+	require.Equal(t, []CaptureRecord{
+		{Time: now, Direction: CaptureSent, Frame: []byte{0x90}},
+		{Time: now, Direction: CaptureReceived, Frame: []byte{0x91, 0x01}},
+	}, recs)
+	_, err = r.Next()
+	require.Equal(t, io.EOF, err)
+
+	_, err = NewCaptureReader(bytes.NewReader([]byte("not a capture")))
+	require.Error(t, err)
+	r, err = NewCaptureReader(bytes.NewReader(buf.Bytes()[:buf.Len()-1]))
+	require.NoError(t, err)
+	_, err = r.ReadAll()
+	require.Error(t, err)
+}
+
+func TestFrameSplitter(t *testing.T) {
+	var stream bytes.Buffer
+	small := []byte{0x91, 0x01}
+	big := append([]byte{0xdc, 0x00, 0xc8}, bytes.Repeat([]byte{0x01}, 200)...)
+	require.NoError(t, writeRawFrame(&stream, small))
+	require.NoError(t, writeRawFrame(&stream, big))
+	require.NoError(t, writeRawFrame(&stream, small))
+
+	// Feed the stream a byte at a time, to split prefixes and frames.
+	var s frameSplitter
+	var frames [][]byte
+	for _, b := range stream.Bytes() {
+		frames = append(frames, s.feed([]byte{b})...)
+	}
+	require.Equal(t, [][]byte{small, big, small}, frames)
+
+	require.Empty(t, s.feed([]byte{0xc0}))
+	require.Error(t, s.err)
+	require.Empty(t, s.feed([]byte{0x01, 0x90}))
+}
+
+// captureTestTraffic runs some calls over a captured connection, and
+// returns the capture.
+func captureTestTraffic(t *testing.T) []CaptureRecord {
+	var buf bytes.Buffer
+	w, err := NewCaptureWriter(&buf)
+	require.NoError(t, err)
+
+	clientConn, serverConn := net.Pipe()
+	sxp := captureTestServer(t, serverConn, "!")
+	defer sxp.Close()
+	cxp := NewTransport(context.Background(), NewCaptureConn(clientConn, w), nil, nil, nil, testMaxFrameLength)
+	defer cxp.Close()
+	cli := NewClient(cxp, nil, nil)
+
+	ctx := ctxlog.AddTagsToContext(context.Background(), ctxlog.CtxLogTags{"req": "r1"})
+	var res captureTestArg
+	require.NoError(t, cli.Call(ctx, newMethodV1("capture.echo"), captureTestArg{1, "a"}, &res, 0))
+	require.Equal(t, "a!", res.B)
+	require.NoError(t, cli.CallCompressed(ctx, newMethodV1("capture.echo"), captureTestArg{2, "b"}, &res,
+		CompressionGzip, 0))
+	require.Error(t, cli.Call(ctx, newMethodV1("capture.fail"), captureTestArg{}, &res, 0))
+	var doubled int
+	require.NoError(t, cli.Call(ctx, NewMethodV2(captureTestProtocolID, 0, "capture2.double"), 21, &doubled, 0))
+	require.Equal(t, 42, doubled)
+	require.NoError(t, cli.Notify(ctx, newMethodV1("capture.echo"), captureTestArg{3, "c"}, 0))
+
+	r, err := NewCaptureReader(bytes.NewReader(buf.Bytes()))
+	require.NoError(t, err)
+	recs, err := r.ReadAll()
+	require.NoError(t, err)
+	return recs
+}
+
+func TestCaptureDecode(t *testing.T) {
+	recs := captureTestTraffic(t)
+	require.Len(t, recs, 9)
+
+	// Without names, V2 methods show their IDs.
+	desc, err := NewCaptureDecoder(nil).Decode(recs[6])
+	require.NoError(t, err)
+	require.Equal(t, "0xca57.#0", desc.Method)
+
+	dec := NewCaptureDecoder(NewCaptureNames([]ProtocolV2Description{
+		{ID: captureTestProtocolID, Name: "capture2", Methods: map[Position]string{0: "double"}},
+	}))
+	var descs []*FrameDescription
+	for _, rec := range recs {
+		desc, err := dec.Decode(rec)
+		require.NoError(t, err)
+		descs = append(descs, desc)
+	}
+
+	require.Equal(t, CaptureSent, recs[0].Direction)
+	require.Equal(t, MethodCall, descs[0].Type)
+	require.Equal(t, SeqNumber(0), descs[0].SeqNo)
+	require.Equal(t, "capture.echo", descs[0].Method)
+	require.Equal(t, map[string]interface{}{"A": int64(1), "B": "a"}, descs[0].Arg)
+	require.Equal(t, map[string]interface{}{"req": "r1"}, descs[0].Tags)
+
+	require.Equal(t, CaptureReceived, recs[1].Direction)
+	require.Equal(t, MethodResponse, descs[1].Type)
+	require.Equal(t, "capture.echo", descs[1].Method)
+	require.Nil(t, descs[1].Error)
+	require.Equal(t, map[string]interface{}{"A": int64(1), "B": "a!"}, descs[1].Result)
+
+	require.Equal(t, MethodCallCompressed, descs[2].Type)
+	require.Equal(t, CompressionGzip, descs[2].Compression)
+	require.Equal(t, map[string]interface{}{"A": int64(2), "B": "b"}, descs[2].Arg)
+	require.Equal(t, CompressionGzip, descs[3].Compression)
+	require.Equal(t, map[string]interface{}{"A": int64(2), "B": "b!"}, descs[3].Result)
+
+	require.Equal(t, "capture.fail", descs[5].Method)
+	require.Contains(t, descs[5].Error, "failed on purpose")
+
+	require.Equal(t, MethodCallV2, descs[6].Type)
+	require.Equal(t, "capture2.double", descs[6].Method)
+	require.Equal(t, int64(21), descs[6].Arg)
+	require.Equal(t, "capture2.double", descs[7].Method)
+	require.Equal(t, int64(42), descs[7].Result)
+
+	require.Equal(t, MethodNotify, descs[8].Type)
+	require.Equal(t, SeqNumber(-1), descs[8].SeqNo)
+
+	b, err := json.Marshal(descs[7])
+	require.NoError(t, err)
+	require.JSONEq(t, `{"type":"Response","seqno":3,"method":"capture2.double","result":42}`, string(b))
+}
+
+func TestReplayCapture(t *testing.T) {
+	recs := captureTestTraffic(t)
+
+	replay := func(suffix string) *ReplayReport {
+		ll := NewLoopbackListener(nil)
+		defer ll.Close()
+		go func() {
+			conn, err := ll.Accept()
+			if err != nil {
+				return
+			}
+			captureTestServer(t, conn, suffix)
+		}()
+		conn, err := ll.Dial(context.Background())
+		require.NoError(t, err)
+		defer conn.Close()
+		report, err := ReplayCapture(context.Background(), conn, recs, ReplayOpts{Timeout: 5 * time.Second})
+		require.NoError(t, err)
+		return report
+	}
+
+	report := replay("!")
+	require.True(t, report.OK(), "%+v", report.Mismatches)
+	require.Equal(t, 5, report.Sent)
+	require.Equal(t, 4, report.Replies)
+
+	// A server that behaves differently is caught.
+	report = replay("?")
+	require.False(t, report.OK())
+	require.Len(t, report.Mismatches, 2)
+	require.Equal(t, SeqNumber(0), report.Mismatches[0].SeqNo)
+	require.Equal(t, "capture.echo", report.Mismatches[0].Method)
+	require.Equal(t, map[string]interface{}{"A": int64(1), "B": "a?"}, report.Mismatches[0].Actual.Result)
+	require.Equal(t, SeqNumber(1), report.Mismatches[1].SeqNo)
+}
+
+func TestReplayReaderStops(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+
+	// Nobody receives the frames, as after ReplayCapture returned.
+	frames := make(chan []byte)
+	done := make(chan struct{})
+	exited := make(chan struct{})
+	go func() {
+		replayReader(client, frames, make(chan error, 1), done)
+		close(exited)
+	}()
+	require.NoError(t, writeRawFrame(server, []byte{0xc0}))
+	close(done)
+	select {
+	case <-exited:
+	case <-time.After(5 * time.Second):
+		t.Fatal("replay reader is stuck")
+	}
+}
+
+func TestCaptureOtherCodecs(t *testing.T) {
+	for _, ct := range []CodecType{CodecJSON, CodecCBOR} {
+		t.Run(ct.String(), func(t *testing.T) {
+			var buf bytes.Buffer
+			w, err := NewCaptureWriter(&buf)
+			require.NoError(t, err)
+			clientConn, serverConn := net.Pipe()
+			_, err = NewCaptureConnWithCodec(clientConn, w, ct)
+			require.Equal(t, CaptureCodecError{Codec: ct}, err)
+
+			// The stream isn't mistaken for msgpack, even if the
+			// codec isn't given.
+			opts := TransportOpts{Codec: ct}
+			sxp := NewTransportWithOpts(context.Background(), serverConn, nil, nil, nil, testMaxFrameLength, opts)
+			defer sxp.Close()
+			srv := NewServer(sxp, nil)
+			require.NoError(t, srv.Register(Protocol{
+				Name: "capture",
+				Methods: map[string]ServeHandlerDescription{
+					"echo": {
+						MakeArg: func() interface{} { return new(captureTestArg) },
+						Handler: func(_ context.Context, arg interface{}) (interface{}, error) {
+							return *arg.(*captureTestArg), nil
+						},
+					},
+				},
+			}))
+			srv.Run()
+			cxp := NewTransportWithOpts(context.Background(), NewCaptureConn(clientConn, w), nil, nil, nil,
+				testMaxFrameLength, opts)
+			defer cxp.Close()
+			var res captureTestArg
+			for i := 0; i < 3; i++ {
+				require.NoError(t, NewClient(cxp, nil, nil).Call(context.Background(), newMethodV1("capture.echo"),
+					captureTestArg{A: 1, B: strings.Repeat("a", 100*i)}, &res, 0))
+			}
+			r, err := NewCaptureReader(bytes.NewReader(buf.Bytes()))
+			require.NoError(t, err)
+			recs, err := r.ReadAll()
+			require.NoError(t, err)
+			require.Empty(t, recs)
+
+			_, err = ReplayCapture(context.Background(), clientConn, nil, ReplayOpts{Codec: ct})
+			require.Equal(t, CaptureCodecError{Codec: ct}, err)
+		})
+	}
+}
@@ -16,20 +16,39 @@ type Client struct {
 	errorUnwrapper ErrorUnwrapper
 	tagsFunc       LogTagsFromContext
 	sendNotifier   SendNotifier
+	rateLimits     *MethodRateLimits
+	rateLimiter    RateLimiter
 }
 
 // NewClient constructs a new client from the given RPC Transporter and the
 // ErrorUnwrapper.
 func NewClient(xp Transporter, u ErrorUnwrapper,
 	tagsFunc LogTagsFromContext) *Client {
-	return &Client{xp, u, tagsFunc, nil}
+	return &Client{xp: xp, errorUnwrapper: u, tagsFunc: tagsFunc}
 }
 
 // NewClientWithSendNotifier constructs a new client from the given RPC Transporter, the
 // ErrorUnwrapper, and the SendNotifier
 func NewClientWithSendNotifier(xp Transporter, u ErrorUnwrapper,
 	tagsFunc LogTagsFromContext, sendNotifier SendNotifier) *Client {
-	return &Client{xp, u, tagsFunc, sendNotifier}
+	return &Client{xp: xp, errorUnwrapper: u, tagsFunc: tagsFunc, sendNotifier: sendNotifier}
+}
+
+// NewClientWithRateLimits constructs a new client that waits, before each
+// call, until the call fits in the given per-method rate limits.
+func NewClientWithRateLimits(xp Transporter, u ErrorUnwrapper,
+	tagsFunc LogTagsFromContext, rateLimits MethodRateLimits) *Client {
+	rateLimiter := rateLimits.Limiter
+	if rateLimiter == nil {
+		rateLimiter = NewMemoryRateLimiter()
+	}
+	return &Client{
+		xp:             xp,
+		errorUnwrapper: u,
+		tagsFunc:       tagsFunc,
+		rateLimits:     &rateLimits,
+		rateLimiter:    rateLimiter,
+	}
 }
 
 // SendNotifier notifies the Caller when an RPC is released into the stream of
@@ -88,6 +107,14 @@ func (c *Client) call(ctx context.Context, method Methoder,
 		}
 	}
 
+	if c.rateLimits != nil {
+		name := method.String()
+		limit := c.rateLimits.limitFor(name)
+		if err := c.rateLimiter.Wait(ctx, name, limit, 1); err != nil {
+			return err
+		}
+	}
+
 	c.xp.receiveFrames()
 	d, err := c.xp.getDispatcher()
 	if err != nil {
@@ -2,8 +2,13 @@ package rpc
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+	"syscall"
 
 	"github.com/keybase/go-codec/codec"
 )
@@ -15,93 +20,237 @@ func newCodecMsgpackHandle() codec.Handle {
 	}
 }
 
+// frameHeaderSize is the size of the longest length prefix, of any codec: a
+// JSON one, with ten digits and a newline.
+const frameHeaderSize = 11
+
+// maxPooledFrameSize bounds the buffers that go back to the pool, so that an
+// occasional big frame doesn't stay pinned in memory.
+const maxPooledFrameSize = 64 * 1024
+
+// maxCoalescedFrameSize bounds the frames that are copied into a single
+// buffer, for writers that can't take the header and body in one writev.
+const maxCoalescedFrameSize = 16 * 1024
+
+// frameBuffer is an encoded frame, with the encoder that encoded it. The
+// length prefix goes in header, so that body never has to be copied to
+// prepend it. frameBuffers are pooled by their framedMsgpackEncoder.
+type frameBuffer struct {
+	enc    *codec.Encoder
+	header [frameHeaderSize]byte
+	hlen   int
+	body   []byte
+	// vec backs bufs, so that writing doesn't allocate.
+	vec  [2][]byte
+	bufs net.Buffers
+}
+
+func (f *frameBuffer) size() int64 {
+	return int64(f.hlen + len(f.body))
+}
+
+// putFrameLength writes n to dst as a msgpack uint, as the codec would, and
+// returns the number of bytes written. dst must be frameHeaderSize long.
+func putFrameLength(dst []byte, n int) int {
+	switch {
+	case n <= 0x7f:
+		dst[0] = byte(n)
+		return 1
+	case n <= 0xff:
+		dst[0], dst[1] = 0xcc, byte(n)
+		return 2
+	case n <= 0xffff:
+		dst[0], dst[1], dst[2] = 0xcd, byte(n>>8), byte(n)
+		return 3
+	default:
+		dst[0], dst[1], dst[2], dst[3], dst[4] = 0xce, byte(n>>24), byte(n>>16), byte(n>>8), byte(n)
+		return 5
+	}
+}
+
 type writeBundle struct {
-	bytes []byte
+	frame *frameBuffer
 	ch    chan error
 	sn    func()
 }
 
+// framedMsgpackEncoder encodes and writes frames. Despite its name, it
+// encodes them with any codec, msgpack being the default.
 type framedMsgpackEncoder struct {
 	maxFrameLength   int32
+	ct               CodecType
+	codec            wireCodec
 	handle           codec.Handle
 	writer           io.Writer
 	writeCh          chan writeBundle
 	doneCh           chan struct{}
 	closedCh         chan struct{}
 	compressorCacher *compressorCacher
+	// queued counts the frames waiting to be written, or being written.
+	queued atomic.Int64
+	pool   sync.Pool
+	// writev is set if the writer does vectored writes of net.Buffers.
+	writev bool
+	// scratch is used by the writer loop to coalesce small frames.
+	scratch []byte
+	// batch is set if frames are written in batches. See WriteBatchOpts.
+	batch *WriteBatchOpts
+	// vecs backs the net.Buffers of a batch.
+	vecs [][]byte
+}
+
+// newRawEncodingHandle returns a handle of wc that encodes codec.Raw values
+// as they are, which replies cached by an IdempotencyCache are.
+func newRawEncodingHandle(wc wireCodec) codec.Handle {
+	h := wc.newHandle()
+	switch h := h.(type) {
+	case *codec.MsgpackHandle:
+		h.Raw = true
+	case *codec.CborHandle:
+		h.Raw = true
+	case *codec.JsonHandle:
+		h.Raw = true
+	}
+	return h
 }
 
 func newFramedMsgpackEncoder(maxFrameLength int32, writer io.Writer) *framedMsgpackEncoder {
+	return newFramedEncoder(maxFrameLength, writer, CodecMsgpack, nil)
+}
+
+// newFramedEncoder is like newFramedMsgpackEncoder, but encodes frames with
+// ct, and writes them in batches if batch is set.
+func newFramedEncoder(maxFrameLength int32, writer io.Writer, ct CodecType, batch *WriteBatchOpts) *framedMsgpackEncoder {
+	wc := ct.wireCodec()
 	e := &framedMsgpackEncoder{
 		maxFrameLength:   maxFrameLength,
-		handle:           newCodecMsgpackHandle(),
+		ct:               ct,
+		codec:            wc,
+		handle:           newRawEncodingHandle(wc),
 		writer:           writer,
 		writeCh:          make(chan writeBundle),
 		doneCh:           make(chan struct{}),
 		closedCh:         make(chan struct{}),
 		compressorCacher: newCompressorCacher(),
 	}
-	go e.writerLoop()
+	e.pool.New = func() interface{} {
+		f := &frameBuffer{body: make([]byte, 0, 512)}
+		f.enc = codec.NewEncoderBytes(&f.body, e.handle)
+		return f
+	}
+	// Only connections backed by a file descriptor, such as TCP and Unix
+	// sockets, turn net.Buffers into a writev.
+	_, e.writev = writer.(syscall.Conn)
+	if batch != nil {
+		e.batch = batch.withDefaults()
+		go e.batchWriterLoop()
+	} else {
+		go e.writerLoop()
+	}
 	return e
 }
 
-func encodeToBytes(enc *codec.Encoder, i interface{}) (v []byte, err error) {
-	enc.ResetBytes(&v)
-	err = enc.Encode(i)
-	return v, err
+// getFrameBuffer returns an empty frameBuffer, ready to encode into.
+func (e *framedMsgpackEncoder) getFrameBuffer() *frameBuffer {
+	f := e.pool.Get().(*frameBuffer)
+	f.enc.ResetBytes(&f.body)
+	return f
+}
+
+// putFrameBuffer returns f to the pool. f must not be used afterwards.
+func (e *framedMsgpackEncoder) putFrameBuffer(f *frameBuffer) {
+	if cap(f.body) > maxPooledFrameSize {
+		return
+	}
+	f.body = f.body[:0]
+	f.hlen = 0
+	f.vec = [2][]byte{}
+	f.bufs = nil
+	e.pool.Put(f)
 }
 
-func (e *framedMsgpackEncoder) compressData(ctype CompressionType, i interface{}) (interface{}, error) {
+// compressData encodes and compresses i, and records the sizes in record.
+func (e *framedMsgpackEncoder) compressData(ctype CompressionType, i interface{}, record *NetworkInstrumenter) (interface{}, error) {
 	c := e.compressorCacher.getCompressor(ctype)
 	if c == nil {
 		return i, nil
 	}
-	enc := codec.NewEncoderBytes(nil, e.handle)
-	content, err := encodeToBytes(enc, i)
-	if err != nil {
+	if ctype == CompressionMsgpackzip {
+		if _, ok := e.codec.(msgpackWireCodec); !ok {
+			return nil, errors.New("msgpackzip compression needs the msgpack codec")
+		}
+	}
+	f := e.getFrameBuffer()
+	defer e.putFrameBuffer(f)
+	if err := f.enc.Encode(i); err != nil {
 		return nil, err
 	}
-	compressedContent, err := c.Compress(content)
+	// Compressors return a new slice, so the buffer can be reused.
+	compressedContent, err := c.Compress(f.body)
 	if err != nil {
 		return nil, err
 	}
+	record.addCompression(len(compressedContent), len(f.body))
 	compressedI := interface{}(compressedContent)
 	return compressedI, nil
 }
 
-func (e *framedMsgpackEncoder) encodeFrame(i interface{}) ([]byte, error) {
-	enc := codec.NewEncoderBytes(nil, e.handle)
-	content, err := encodeToBytes(enc, i)
-	if err != nil {
+// encodeFrame encodes i into a pooled frameBuffer, which the caller must
+// return with putFrameBuffer.
+func (e *framedMsgpackEncoder) encodeFrame(i interface{}) (*frameBuffer, error) {
+	f := e.getFrameBuffer()
+	if err := f.enc.Encode(i); err != nil {
+		e.putFrameBuffer(f)
 		return nil, err
 	}
-	if len(content) > int(e.maxFrameLength) {
-		return nil, fmt.Errorf("frame length too big: %d > %d", len(content), e.maxFrameLength)
+	if len(f.body) > int(e.maxFrameLength) {
+		l := len(f.body)
+		e.putFrameBuffer(f)
+		return nil, fmt.Errorf("frame length too big: %d > %d", l, e.maxFrameLength)
 	}
-	length, err := encodeToBytes(enc, len(content))
-	if err != nil {
-		return nil, err
+	f.hlen = e.codec.putFrameLength(f.header[:], len(f.body))
+	return f, nil
+}
+
+// writeFrame writes f to the writer. Writers that do vectored writes get
+// the header and body in a single writev. Others, such as TLS connections,
+// would turn each slice into its own write, so small frames are coalesced
+// first.
+func (e *framedMsgpackEncoder) writeFrame(f *frameBuffer) error {
+	if !e.writev && len(f.body) <= maxCoalescedFrameSize {
+		e.scratch = append(append(e.scratch[:0], f.header[:f.hlen]...), f.body...)
+		_, err := e.writer.Write(e.scratch)
+		return err
 	}
-	return append(length, content...), nil
+	f.vec = [2][]byte{f.header[:f.hlen], f.body}
+	f.bufs = f.vec[:]
+	_, err := f.bufs.WriteTo(e.writer)
+	return err
 }
 
 // encodeAndWriteInternal is called directly by tests that need to
 // write invalid frames.
 func (e *framedMsgpackEncoder) encodeAndWriteInternal(ctx context.Context, frame interface{}, sendNotifier func()) (int64, <-chan error) {
-	bytes, err := e.encodeFrame(frame)
+	f, err := e.encodeFrame(frame)
 	ch := make(chan error, 1)
 	if err != nil {
 		ch <- err
 		return 0, ch
 	}
+	size := f.size()
+	e.queued.Add(1)
 	select {
 	case <-e.doneCh:
+		e.queued.Add(-1)
+		e.putFrameBuffer(f)
 		ch <- io.EOF
 	case <-ctx.Done():
+		e.queued.Add(-1)
+		e.putFrameBuffer(f)
 		ch <- ctx.Err()
-	case e.writeCh <- writeBundle{bytes, ch, sendNotifier}:
+	case e.writeCh <- writeBundle{f, ch, sendNotifier}:
 	}
-	return int64(len(bytes)), ch
+	return size, ch
 }
 
 func (e *framedMsgpackEncoder) EncodeAndWrite(ctx context.Context, frame []interface{}, sendNotifier func()) (int64, <-chan error) {
@@ -109,26 +258,32 @@ func (e *framedMsgpackEncoder) EncodeAndWrite(ctx context.Context, frame []inter
 }
 
 func (e *framedMsgpackEncoder) EncodeAndWriteAsync(frame []interface{}) (int64, <-chan error) {
-	bytes, err := e.encodeFrame(frame)
+	f, err := e.encodeFrame(frame)
 	ch := make(chan error, 1)
 	if err != nil {
 		ch <- err
 		return 0, ch
 	}
+	size := f.size()
+	e.queued.Add(1)
 	select {
 	case <-e.doneCh:
+		e.queued.Add(-1)
+		e.putFrameBuffer(f)
 		ch <- io.EOF
-	case e.writeCh <- writeBundle{bytes, ch, nil}:
+	case e.writeCh <- writeBundle{f, ch, nil}:
 	default:
 		go func() {
 			select {
 			case <-e.doneCh:
+				e.queued.Add(-1)
+				e.putFrameBuffer(f)
 				ch <- io.EOF
-			case e.writeCh <- writeBundle{bytes, ch, nil}:
+			case e.writeCh <- writeBundle{f, ch, nil}:
 			}
 		}()
 	}
-	return int64(len(bytes)), ch
+	return size, ch
 }
 
 func (e *framedMsgpackEncoder) writerLoop() {
@@ -141,12 +296,20 @@ func (e *framedMsgpackEncoder) writerLoop() {
 			if write.sn != nil {
 				write.sn()
 			}
-			_, err := e.writer.Write(write.bytes)
+			err := e.writeFrame(write.frame)
+			e.putFrameBuffer(write.frame)
+			e.queued.Add(-1)
 			write.ch <- err
 		}
 	}
 }
 
+// queueDepth returns the number of frames waiting to be written, or being
+// written.
+func (e *framedMsgpackEncoder) queueDepth() int {
+	return int(e.queued.Load())
+}
+
 func (e *framedMsgpackEncoder) Close() <-chan struct{} {
 	close(e.doneCh)
 	return e.closedCh
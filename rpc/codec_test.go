@@ -2,6 +2,8 @@ package rpc
 
 import (
 	"bytes"
+	"context"
+	"io"
 	"testing"
 
 	"github.com/keybase/go-codec/codec"
@@ -48,3 +50,90 @@ func TestMap(t *testing.T) {
 	require.Equal(t, "world", b)
 	require.Equal(t, m, c)
 }
+
+func TestPutFrameLength(t *testing.T) {
+	mh := newCodecMsgpackHandle()
+	for _, n := range []int{0, 1, 0x7f, 0x80, 0xff, 0x100, 0xffff, 0x10000, 1 << 30} {
+		var expected []byte
+		require.NoError(t, codec.NewEncoderBytes(&expected, mh).Encode(n))
+		var header [frameHeaderSize]byte
+		l := putFrameLength(header[:], n)
+		require.Equal(t, expected, header[:l], "n=%d", n)
+	}
+}
+
+func TestFramedMsgpackEncoderReusesBuffers(t *testing.T) {
+	var buf bytes.Buffer
+	enc := newFramedMsgpackEncoder(testMaxFrameLength, &buf)
+	defer enc.Close()
+	ctx := context.Background()
+
+	big := bytes.Repeat([]byte{'x'}, 300)
+	for _, frame := range [][]interface{}{{1, "short"}, {2, big}, {3, "short again"}} {
+		size, errCh := enc.EncodeAndWrite(ctx, frame, nil)
+		require.NoError(t, <-errCh)
+		var expected []byte
+		require.NoError(t, codec.NewEncoderBytes(&expected, enc.handle).Encode(frame))
+		var header [frameHeaderSize]byte
+		expected = append(header[:putFrameLength(header[:], len(expected))], expected...)
+		require.Equal(t, int64(len(expected)), size)
+		require.Equal(t, expected, buf.Next(len(expected)))
+	}
+	require.Zero(t, buf.Len())
+	require.Zero(t, enc.queueDepth())
+
+	_, errCh := enc.EncodeAndWrite(ctx, []interface{}{bytes.Repeat([]byte{'x'}, testMaxFrameLength)}, nil)
+	require.Error(t, <-errCh)
+}
+
+type benchmarkArg struct {
+	Name  string
+	Count int
+	Tags  []string
+}
+
+func benchmarkEncoder(b *testing.B, frame func(seqno int) []interface{}) {
+	enc := newFramedMsgpackEncoder(DefaultMaxFrameLength, io.Discard)
+	defer enc.Close()
+	ctx := context.Background()
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		_, errCh := enc.EncodeAndWrite(ctx, frame(i), nil)
+		if err := <-errCh; err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+var benchArg = benchmarkArg{Name: "benchmark", Count: 42, Tags: []string{"a", "b", "c"}}
+
+func BenchmarkEncodeCall(b *testing.B) {
+	benchmarkEncoder(b, func(seqno int) []interface{} {
+		return []interface{}{MethodCall, seqno, "bench.call", benchArg}
+	})
+}
+
+func BenchmarkEncodeCallCompressed(b *testing.B) {
+	enc := newFramedMsgpackEncoder(DefaultMaxFrameLength, io.Discard)
+	defer enc.Close()
+	benchmarkEncoder(b, func(seqno int) []interface{} {
+		arg, err := enc.compressData(CompressionGzip, benchArg, nil)
+		if err != nil {
+			b.Fatal(err)
+		}
+		return []interface{}{MethodCallCompressed, seqno, CompressionGzip, "bench.call", arg}
+	})
+}
+
+func BenchmarkEncodeNotify(b *testing.B) {
+	benchmarkEncoder(b, func(_ int) []interface{} {
+		return []interface{}{MethodNotify, "bench.notify", benchArg}
+	})
+}
+
+func BenchmarkEncodeResponse(b *testing.B) {
+	benchmarkEncoder(b, func(seqno int) []interface{} {
+		return []interface{}{MethodResponse, seqno, nil, benchArg}
+	})
+}
@@ -61,6 +61,50 @@ type ConnectionTransport interface {
 	Close()
 }
 
+// goAwayObserver can be implemented by a ConnectionTransport that wants to
+// know when the server on the other end of its finalized transport has
+// announced that it's going away.
+type goAwayObserver interface {
+	onGoAway(xp Transporter)
+}
+
+// retiredTransportDrainTimeout bounds how long a transport whose server
+// announced it's going away is kept around for its outstanding calls once
+// it's been replaced.
+const retiredTransportDrainTimeout = time.Minute
+
+// drainingRemoteMarkDuration is how long an address whose server announced
+// it's going away is skipped by a DrainingRemote.
+const drainingRemoteMarkDuration = time.Minute
+
+func isGoingAway(xp Transporter) bool {
+	if xp == nil {
+		return false
+	}
+	select {
+	case <-xp.goingAway():
+		return true
+	default:
+		return false
+	}
+}
+
+// retireTransport gets rid of a transport that's been replaced by a new one.
+// If the server announced it's going away, the calls still outstanding on
+// it are given a chance to finish in the background. Otherwise it's closed
+// right away.
+func retireTransport(xp Transporter) {
+	if !isGoingAway(xp) {
+		xp.Close()
+		return
+	}
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), retiredTransportDrainTimeout)
+		defer cancel()
+		_ = xp.Drain(ctx)
+	}()
+}
+
 type connTransport struct {
 	uri                 *SPURI
 	instrumenterStorage NetworkInstrumenterStorage
@@ -68,6 +112,8 @@ type connTransport struct {
 	wef                 WrapErrorFunc
 	maxFrameLength      int32
 	dialable            Dialable
+	tlsConfig           *tls.Config
+	opts                TransportOpts
 	conn                net.Conn
 	transport           Transporter
 	stagedTransport     Transporter
@@ -87,6 +133,20 @@ func NewConnectionTransport(uri *SPURI, l LogFactory, instrumenterStorage Networ
 	}
 }
 
+// NewConnectionTransportWithOpts is like NewConnectionTransport, but the
+// transports it makes are created with the given options.
+func NewConnectionTransportWithOpts(uri *SPURI, l LogFactory, instrumenterStorage NetworkInstrumenterStorage,
+	wef WrapErrorFunc, maxFrameLength int32, opts TransportOpts) ConnectionTransport {
+	return &connTransport{
+		uri:                 uri,
+		l:                   l,
+		instrumenterStorage: instrumenterStorage,
+		wef:                 wef,
+		maxFrameLength:      maxFrameLength,
+		opts:                opts,
+	}
+}
+
 // NewConnectionTransportWithDialable creates a ConnectionTransport for a given SPURI via the given Dialable
 func NewConnectionTransportWithDialable(uri *SPURI, l LogFactory, instrumenterStorage NetworkInstrumenterStorage,
 	wef WrapErrorFunc, maxFrameLength int32, dialable Dialable) ConnectionTransport {
@@ -100,15 +160,36 @@ func NewConnectionTransportWithDialable(uri *SPURI, l LogFactory, instrumenterSt
 	}
 }
 
+// NewWebSocketConnectionTransport creates a ConnectionTransport for a
+// "ws://" or "wss://" SPURI. config is used for "wss://", and can be nil to
+// use the system's roots.
+func NewWebSocketConnectionTransport(uri *SPURI, config *tls.Config, l LogFactory,
+	instrumenterStorage NetworkInstrumenterStorage, wef WrapErrorFunc, maxFrameLength int32,
+	opts TransportOpts) ConnectionTransport {
+	return &connTransport{
+		uri:                 uri,
+		l:                   l,
+		instrumenterStorage: instrumenterStorage,
+		wef:                 wef,
+		maxFrameLength:      maxFrameLength,
+		tlsConfig:           config,
+		opts:                opts,
+	}
+}
+
 func (t *connTransport) Dial(ctx context.Context) (Transporter, error) {
 	var err error
-	if t.conn != nil {
+	// The conn of a transport that's going away is left to retireTransport.
+	if t.conn != nil && !isGoingAway(t.transport) {
 		t.conn.Close()
 	}
-	if t.dialable != nil {
+	switch {
+	case t.uri.UseWebSocket():
+		t.conn, err = t.uri.dialWebSocket(ctx, t.dialable, t.tlsConfig)
+	case t.dialable != nil:
 		t.conn, err = t.dialable.Dial(ctx, "tcp", t.uri.HostPort)
-	} else {
-		t.conn, err = t.uri.Dial()
+	default:
+		t.conn, err = t.uri.DialWithConfig(t.tlsConfig)
 	}
 	if err != nil {
 		// If we get a DNS error, it could be because glibc has cached an old
@@ -123,15 +204,22 @@ func (t *connTransport) Dial(ctx context.Context) (Transporter, error) {
 		return nil, err
 	}
 
-	// Disable SIGPIPE on platforms that require it (Darwin). See sigpipe_bsd.go.
-	if err = DisableSigPipe(t.conn); err != nil {
-		return nil, err
+	// Disable SIGPIPE on platforms that require it (Darwin). See
+	// sigpipe_bsd.go. dialWebSocket does it for the underlying connection.
+	if !t.uri.UseWebSocket() {
+		if err = DisableSigPipe(t.conn); err != nil {
+			return nil, err
+		}
 	}
 
 	if t.stagedTransport != nil {
 		t.stagedTransport.Close()
 	}
-	t.stagedTransport = NewTransport(ctx, t.conn, t.l, t.instrumenterStorage, t.wef, t.maxFrameLength)
+	opts := t.opts
+	if opts.Codec == CodecMsgpack {
+		opts.Codec = t.uri.Codec
+	}
+	t.stagedTransport = NewTransportWithOpts(ctx, t.conn, t.l, t.instrumenterStorage, t.wef, t.maxFrameLength, opts)
 	return t.stagedTransport, nil
 }
 
@@ -141,7 +229,7 @@ func (t *connTransport) IsConnected() bool {
 
 func (t *connTransport) Finalize() {
 	if t.transport != nil {
-		t.transport.Close()
+		retireTransport(t.transport)
 	}
 	t.transport = t.stagedTransport
 	t.stagedTransport = nil
@@ -200,12 +288,15 @@ type ConnectionTransportTLS struct {
 	tlsConfig      *tls.Config
 	maxFrameLength int32
 	dialable       Dialable
+	rpcHandshake   *HandshakeConfig
 
 	// Protects everything below.
 	mutex               sync.Mutex
 	transport           Transporter
 	stagedTransport     Transporter
 	conn                net.Conn
+	addr                string
+	stagedAddr          string
 	dialerTimeout       time.Duration
 	handshakeTimeout    time.Duration
 	instrumenterStorage NetworkInstrumenterStorage
@@ -309,15 +400,18 @@ func (ct *ConnectionTransportTLS) Dial(ctx context.Context) (
 
 	ct.mutex.Lock()
 	defer ct.mutex.Unlock()
-	if ct.conn != nil {
+	// The conn of a transport that's going away is left to retireTransport.
+	if ct.conn != nil && !isGoingAway(ct.transport) {
 		ct.conn.Close()
 	}
-	transport := NewTransport(ctx, conn, ct.logFactory, ct.instrumenterStorage, ct.wef, ct.maxFrameLength)
+	transport := NewTransportWithOpts(ctx, conn, ct.logFactory, ct.instrumenterStorage, ct.wef, ct.maxFrameLength,
+		TransportOpts{Handshake: ct.rpcHandshake})
 	ct.conn = conn
 	if ct.stagedTransport != nil {
 		ct.stagedTransport.Close()
 	}
 	ct.stagedTransport = transport
+	ct.stagedAddr = addr
 	return transport, nil
 }
 
@@ -333,13 +427,29 @@ func (ct *ConnectionTransportTLS) Finalize() {
 	ct.mutex.Lock()
 	defer ct.mutex.Unlock()
 	if ct.transport != nil {
-		ct.transport.Close()
+		retireTransport(ct.transport)
 	}
 	ct.transport = ct.stagedTransport
+	ct.addr = ct.stagedAddr
 	ct.stagedTransport = nil
+	ct.stagedAddr = ""
 	ct.srvRemote.Reset()
 }
 
+// onGoAway implements the goAwayObserver interface. It steers the next
+// Dial away from the address of the server that's going away, if the Remote
+// supports that.
+func (ct *ConnectionTransportTLS) onGoAway(xp Transporter) {
+	ct.mutex.Lock()
+	defer ct.mutex.Unlock()
+	if xp != ct.transport {
+		return
+	}
+	if r, ok := ct.srvRemote.(DrainingRemote); ok {
+		r.MarkDraining(ct.addr, drainingRemoteMarkDuration)
+	}
+}
+
 // Close is an implementation of the ConnectionTransport interface.
 func (ct *ConnectionTransportTLS) Close() {
 	ct.mutex.Lock()
@@ -368,6 +478,8 @@ type Connection struct {
 	tagsFunc         LogTagsFromContext
 	log              ConnectionLog
 	protocols        []Protocol
+	pubSub           *PubSubClient
+	orderedNotifier  *OrderedNotifier
 
 	// protects everything below.
 	mutex             sync.Mutex
@@ -377,6 +489,12 @@ type Connection struct {
 	reconnectErrPtr   *error             // Filled in with fatal reconnect err (if any) before reconnectChan is closed
 	cancelFunc        context.CancelFunc // used to cancel the reconnect loop
 	reconnectedBefore bool
+	// xp is the transport that client and server use.
+	xp Transporter
+	// goingAway is set once the server on the other end of xp has
+	// announced that it's going away, so that new commands wait for the
+	// next connection.
+	goingAway bool
 
 	firstConnectDelayDuration     time.Duration
 	initialReconnectBackoffWindow func() time.Duration
@@ -422,6 +540,18 @@ type ConnectionOpts struct {
 	// HandshakeTimeout is a timeout on how long we wait for TLS handshake to
 	// complete. If no value specified, we default to time.Minute.
 	HandshakeTimeout time.Duration
+	// Handshake, if set, enables the RPC handshake (not to be confused
+	// with the TLS one) on the transports of TLS connections. The
+	// result is available to OnConnect via HandshakeResultFromContext.
+	// See HandshakeConfig about peers that predate the handshake.
+	Handshake *HandshakeConfig
+	// PubSub, if set, is registered on each new transport, and
+	// subscribes again to its topics once OnConnect succeeds, so that
+	// its subscriptions survive reconnects.
+	PubSub *PubSubClient
+	// OrderedNotifier, if set, is attached to each new transport after
+	// OnConnect, so that it sends its notifies again after reconnects.
+	OrderedNotifier *OrderedNotifier
 }
 
 // NewTLSConnectionWithConnectionLogFactory is like NewTLSConnection,
@@ -446,6 +576,7 @@ func NewTLSConnectionWithConnectionLogFactory(
 		wef:                 opts.WrapErrorFunc,
 		dialerTimeout:       opts.DialerTimeout,
 		handshakeTimeout:    opts.HandshakeTimeout,
+		rpcHandshake:        opts.Handshake,
 		log:                 connectionLogFactory.Make("conn_tspt"),
 	}
 	connLog := connectionLogFactory.Make("conn")
@@ -475,6 +606,7 @@ func NewTLSConnection(
 		wef:                 opts.WrapErrorFunc,
 		dialerTimeout:       opts.DialerTimeout,
 		handshakeTimeout:    opts.HandshakeTimeout,
+		rpcHandshake:        opts.Handshake,
 		log:                 newConnectionLogUnstructured(logOutput, "CONNTSPT"),
 	}
 	return newConnectionWithTransportAndProtocols(handler, transport, errorUnwrapper, logOutput, opts)
@@ -502,6 +634,7 @@ func NewTLSConnectionWithTLSConfig(
 		wef:                 opts.WrapErrorFunc,
 		dialerTimeout:       opts.DialerTimeout,
 		handshakeTimeout:    opts.HandshakeTimeout,
+		rpcHandshake:        opts.Handshake,
 		log:                 newConnectionLogUnstructured(logOutput, "CONNTSPT"),
 	}
 	return newConnectionWithTransportAndProtocols(handler, transport, errorUnwrapper, logOutput, opts)
@@ -530,6 +663,7 @@ func NewTLSConnectionWithDialable(
 		wef:                 opts.WrapErrorFunc,
 		dialerTimeout:       opts.DialerTimeout,
 		handshakeTimeout:    opts.HandshakeTimeout,
+		rpcHandshake:        opts.Handshake,
 		log:                 newConnectionLogUnstructured(logOutput, "CONNTSPT"),
 		dialable:            dialable,
 	}
@@ -578,6 +712,8 @@ func newConnectionWithTransportAndProtocolsWithLog(handler ConnectionHandler,
 		tagsFunc:                      opts.TagsFunc,
 		log:                           log,
 		protocols:                     opts.Protocols,
+		pubSub:                        opts.PubSub,
+		orderedNotifier:               opts.OrderedNotifier,
 		reconnectedBefore:             opts.ForceInitialBackoff,
 	}
 	if !opts.DontConnectNow {
@@ -624,6 +760,28 @@ func (c *Connection) connect(ctx context.Context) error {
 		}
 	}
 
+	if transport != nil {
+		res, err := transport.Handshake(ctx)
+		if err != nil {
+			c.log.Warnw("connect error",
+				LogField{Key: ConnectionLogMsgKey, Value: "handshake"},
+				LogField{Key: "error", Value: err})
+			return err
+		}
+		if res != nil {
+			ctx = withHandshakeResult(ctx, res)
+		}
+	}
+
+	if c.pubSub != nil {
+		if err := c.pubSub.registerHandler(server); err != nil {
+			c.log.Warnw("connect error",
+				LogField{Key: ConnectionLogMsgKey, Value: "pubsub"},
+				LogField{Key: "error", Value: err})
+			return err
+		}
+	}
+
 	// call the connect handler
 	c.log.Debugw("connect", LogField{Key: ConnectionLogMsgKey, Value: "calling OnConnect"})
 	err = c.handler.OnConnect(ctx, c, client, server)
@@ -634,6 +792,17 @@ func (c *Connection) connect(ctx context.Context) error {
 		return err
 	}
 
+	// Subscribe again only once the handler has done its setup, which
+	// the broker might need to let us subscribe.
+	if c.pubSub != nil {
+		if err := c.pubSub.resubscribe(ctx, client); err != nil {
+			c.log.Warnw("connect error",
+				LogField{Key: ConnectionLogMsgKey, Value: "pubsub"},
+				LogField{Key: "error", Value: err})
+			return err
+		}
+	}
+
 	// set the client for other callers.
 	// we wait to do this so the handler has time to do
 	// any setup required, e.g. authenticate.
@@ -641,12 +810,45 @@ func (c *Connection) connect(ctx context.Context) error {
 	defer c.mutex.Unlock()
 	c.client = client
 	c.server = server
+	c.xp = transport
+	c.goingAway = false
 	c.transport.Finalize()
+	if transport != nil {
+		go c.watchGoAway(transport)
+		if c.orderedNotifier != nil {
+			c.orderedNotifier.Attach(transport)
+		}
+	}
 
 	c.log.Debugw("connect", LogField{Key: ConnectionLogMsgKey, Value: "connected"})
 	return nil
 }
 
+// watchGoAway waits for the server on the other end of xp to announce that
+// it's going away, and if xp is still the current transport, starts
+// reconnecting right away. Commands already running on xp are left to
+// finish there, while new ones wait for the new connection.
+func (c *Connection) watchGoAway(xp Transporter) {
+	select {
+	case <-xp.goingAway():
+	case <-xp.done():
+		return
+	}
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if c.xp != xp {
+		return
+	}
+	c.log.Infow("goaway",
+		LogField{Key: ConnectionLogMsgKey, Value: "server is going away, reconnecting"})
+	c.goingAway = true
+	if o, ok := c.transport.(goAwayObserver); ok {
+		o.onGoAway(xp)
+	}
+	c.getReconnectChanLocked()
+}
+
 // DoCommand executes the specific rpc command wrapped in rpcFunc.
 func (c *Connection) DoCommand(ctx context.Context, name Methoder, timeout time.Duration,
 	rpcFunc func(GenericClient) error) error {
@@ -744,7 +946,7 @@ func (c *Connection) checkForRetry(err error) bool {
 }
 
 func (c *Connection) isConnectedLocked() bool {
-	return c.transport.IsConnected() && c.client != nil
+	return c.transport.IsConnected() && c.client != nil && !c.goingAway
 }
 
 // IsConnected returns true if the connection is connected.  The mutex
@@ -777,7 +979,7 @@ func (c *Connection) getReconnectChanLocked() (
 			disconnectStatus = StartingFirstConnection
 			c.reconnectedBefore = true
 		}
-		go c.doReconnect(ctx, disconnectStatus, c.reconnectChan, c.reconnectErrPtr)
+		go c.doReconnect(ctx, disconnectStatus, c.goingAway, c.reconnectChan, c.reconnectErrPtr)
 	} else {
 		disconnectStatus = UsingExistingConnection
 	}
@@ -794,9 +996,12 @@ func (c *Connection) getReconnectChan() (
 
 // doReconnect attempts a reconnection.  It assumes that reconnectChan
 // and reconnectErrPtr are the same ones in c, but are passed in to
-// avoid having to take the mutex at the beginning of the method.
+// avoid having to take the mutex at the beginning of the method. A
+// reconnection because the server is going away starts right away,
+// without the initial reconnect backoff, since nothing failed, and new
+// commands would otherwise wait it out while the server drains.
 func (c *Connection) doReconnect(ctx context.Context, disconnectStatus DisconnectStatus,
-	reconnectChan chan struct{}, reconnectErrPtr *error) {
+	goingAway bool, reconnectChan chan struct{}, reconnectErrPtr *error) {
 	// inform the handler of our disconnected state
 	c.handler.OnDisconnected(ctx, disconnectStatus)
 	if c.firstConnectDelayDuration != 0 &&
@@ -810,7 +1015,7 @@ func (c *Connection) doReconnect(ctx context.Context, disconnectStatus Disconnec
 		c.log.Debugw("doReconnect waited", LogField{
 			Key: ConnectionLogMsgKey, Value: "initial connect backoff done"})
 	} else if c.initialReconnectBackoffWindow != nil &&
-		disconnectStatus == StartingNonFirstConnection {
+		disconnectStatus == StartingNonFirstConnection && !goingAway {
 		waitDur := c.connectDelayTimer.StartRandom(c.initialReconnectBackoffWindow())
 		c.log.Debugw("starting random",
 			LogField{
@@ -896,6 +1101,30 @@ func (c *Connection) Shutdown() {
 	}
 }
 
+// Drain gracefully shuts down the connection. It cancels any reconnect loop
+// in progress, and then drains the current transport, letting outstanding
+// calls in both directions finish (see Transporter.Drain). Like Shutdown,
+// calling this invalidates the connection object.
+func (c *Connection) Drain(ctx context.Context) error {
+	client := func() GenericClient {
+		c.mutex.Lock()
+		defer c.mutex.Unlock()
+		if c.cancelFunc != nil {
+			c.cancelFunc()
+		}
+		return c.client
+	}()
+	var err error
+	if client != nil {
+		var xp Transporter
+		if xp, err = client.Transport(ctx); err == nil {
+			err = xp.Drain(ctx)
+		}
+	}
+	c.Shutdown()
+	return err
+}
+
 // FastForwardConnectDelayTimer causes any pending reconnect to happen
 // immediately.
 func (c *Connection) FastForwardConnectDelayTimer() {
@@ -910,6 +1139,8 @@ var _ GenericClient = connectionClient{}
 
 func (c connectionClient) Call(ctx context.Context, s Methoder, args interface{},
 	res interface{}, timeout time.Duration) error {
+	// Retries must carry the same idempotency key.
+	ctx = withNewIdempotencyKey(ctx)
 	return c.conn.DoCommand(ctx, s, timeout, func(rawClient GenericClient) error {
 		return rawClient.Call(ctx, s, args, res, timeout)
 	})
@@ -917,6 +1148,8 @@ func (c connectionClient) Call(ctx context.Context, s Methoder, args interface{}
 
 func (c connectionClient) Call2(ctx context.Context, s Methoder, args interface{},
 	res interface{}, timeout time.Duration, ew ErrorUnwrapper) error {
+	// Retries must carry the same idempotency key.
+	ctx = withNewIdempotencyKey(ctx)
 	return c.conn.DoCommand(ctx, s, timeout, func(rawClient GenericClient) error {
 		return rawClient.Call2(ctx, s, args, res, timeout, ew)
 	})
@@ -924,6 +1157,8 @@ func (c connectionClient) Call2(ctx context.Context, s Methoder, args interface{
 
 func (c connectionClient) CallCompressed(ctx context.Context, s Methoder,
 	args interface{}, res interface{}, ctype CompressionType, timeout time.Duration) error {
+	// Retries must carry the same idempotency key.
+	ctx = withNewIdempotencyKey(ctx)
 	return c.conn.DoCommand(ctx, s, timeout, func(rawClient GenericClient) error {
 		return rawClient.CallCompressed(ctx, s, args, res, ctype, timeout)
 	})
@@ -0,0 +1,130 @@
+package rpc
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func makeGoAwayTestCert(t *testing.T, hosts ...string) ([]byte, tls.Certificate) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: hosts[0]},
+		DNSNames:              hosts,
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	require.NoError(t, err)
+	cert := tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), cert
+}
+
+type goAwayTestServer struct {
+	addr string
+	xp   Transporter
+}
+
+// goAwayTestDialable serves the given protocol over TLS on the other end of
+// every connection it dials.
+type goAwayTestDialable struct {
+	t       *testing.T
+	cert    tls.Certificate
+	p       Protocol
+	servers chan goAwayTestServer
+}
+
+func (d *goAwayTestDialable) SetOpts(time.Duration, time.Duration) {}
+
+func (d *goAwayTestDialable) Dial(_ context.Context, _ string, addr string) (net.Conn, error) {
+	clientConn, serverConn := net.Pipe()
+	tlsConn := tls.Server(serverConn, &tls.Config{Certificates: []tls.Certificate{d.cert}})
+	lf := NewSimpleLogFactory(&testLogOutput{t: d.t}, nil)
+	sxp := NewTransportWithOpts(context.Background(), tlsConn, lf, nil, nil, testMaxFrameLength,
+		TransportOpts{Handshake: &HandshakeConfig{}})
+	srv := NewServer(sxp, nil)
+	require.NoError(d.t, srv.Register(d.p))
+	srv.Run()
+	d.t.Cleanup(sxp.Close)
+	d.servers <- goAwayTestServer{addr: addr, xp: sxp}
+	return clientConn, nil
+}
+
+func TestConnectionGoAway(t *testing.T) {
+	started := make(chan struct{})
+	release := make(chan struct{})
+	rootCerts, cert := makeGoAwayTestCert(t, "a", "b")
+	d := &goAwayTestDialable{
+		t:       t,
+		cert:    cert,
+		p:       drainTestProtocol(started, release),
+		servers: make(chan goAwayTestServer, 2),
+	}
+	remote, err := NewPrioritizedRoundRobinRemote([][]string{{"a:1", "b:1"}})
+	require.NoError(t, err)
+	output := testLogOutput{t: t}
+	conn := NewTLSConnectionWithDialable(remote, rootCerts, testErrorUnwrapper{},
+		testConnectionHandler{}, nil, nil, &output, testMaxFrameLength,
+		ConnectionOpts{
+			DontConnectNow: true,
+			Handshake:      &HandshakeConfig{},
+			// Which a goaway doesn't wait out.
+			InitialReconnectBackoffWindow: func() time.Duration { return time.Hour },
+		}, d)
+	defer conn.Shutdown()
+	cli := conn.GetClient()
+	ctx := context.Background()
+
+	callErrCh := make(chan error, 1)
+	var res int
+	go func() {
+		callErrCh <- cli.Call(ctx, newMethodV1("drain.block"), 7, &res, 0)
+	}()
+	first := <-d.servers
+	<-started
+
+	drainErrCh := make(chan error, 1)
+	go func() {
+		drainErrCh <- first.xp.Drain(ctx)
+	}()
+
+	// The client reconnects right away, and avoids the draining server.
+	var second goAwayTestServer
+	select {
+	case second = <-d.servers:
+	case <-time.After(5 * time.Second):
+		require.Fail(t, "no reconnect after goaway")
+	}
+	require.NotEqual(t, first.addr, second.addr)
+
+	// New calls go to the new server.
+	var res2 int
+	require.NoError(t, cli.Call(ctx, newMethodV1("drain.echo"), 3, &res2, 0))
+	require.Equal(t, 3, res2)
+	require.True(t, conn.IsConnected())
+
+	// While the outstanding one finishes on the old one.
+	close(release)
+	require.NoError(t, <-callErrCh)
+	require.Equal(t, 7, res)
+	require.NoError(t, <-drainErrCh)
+	require.False(t, first.xp.IsConnected())
+	require.True(t, second.xp.IsConnected())
+}
@@ -3,8 +3,6 @@ package rpc
 import (
 	"context"
 	"io"
-
-	"github.com/foks-proj/go-ctxlog"
 )
 
 type dispatcher interface {
@@ -25,6 +23,8 @@ type dispatch struct {
 
 	instrumenterStorage NetworkInstrumenterStorage
 	log                 LogInterface
+	tracer              *rpcTracer
+	slow                *slowCallWatcher
 }
 
 func newDispatch(enc *framedMsgpackEncoder, calls *callContainer,
@@ -51,7 +51,7 @@ func currySendNotifier(sendNotifier SendNotifier, seqid SeqNumber) func() {
 }
 
 func (d *dispatch) Call(ctx context.Context, name Methoder, arg interface{}, res interface{},
-	ctype CompressionType, u ErrorUnwrapper, sendNotifier SendNotifier) error {
+	ctype CompressionType, u ErrorUnwrapper, sendNotifier SendNotifier) (err error) {
 	profiler := d.log.StartProfiler("call %s", name.String())
 	defer profiler.Stop()
 
@@ -63,12 +63,24 @@ func (d *dispatch) Call(ctx context.Context, name Methoder, arg interface{}, res
 		methodType = MethodCallCompressed
 	}
 
+	var size, resSize int64
+	ctx, span, headers := d.tracer.startClient(ctx, SpanKindClient, methodType, name, ctype)
+	headers = addOrderedNotifyHeader(ctx, headers)
+	headers = addIdempotencyHeader(ctx, headers)
+	defer func() {
+		span.SetSentSize(size)
+		span.SetReceivedSize(resSize)
+		span.End(err)
+	}()
+
 	record := NewNetworkInstrumenter(d.instrumenterStorage, InstrumentTag(methodType, name.String()))
 	c := d.calls.NewCall(ctx, name, arg, res, ctype, u, record)
+	span.SetSeqNo(c.seqid)
 
 	// Have to add call before encoding otherwise we'll race the response
 	d.calls.AddCall(c)
 	defer d.calls.RemoveCall(c.seqid)
+	defer d.slow.watch(ctx, false, c.seqid, c.method.String(), c.arg, nil)()
 
 	var v []interface{}
 	var logCall func()
@@ -77,24 +89,26 @@ func (d *dispatch) Call(ctx context.Context, name Methoder, arg interface{}, res
 		v = []interface{}{methodType, c.seqid}
 		v = c.method.appendForEncoding(v)
 		v = append(v, c.arg)
-		logCall = func() { d.log.ClientCall(c.seqid, c.method.String(), c.arg) }
+		logCall = func() { d.log.ClientCall(c.seqid, c.method.String(), redactLater(nil, c.arg)) }
 	default:
-		arg, err := d.writer.compressData(c.ctype, c.arg)
+		arg, err := d.writer.compressData(c.ctype, c.arg, record)
 		if err != nil {
 			return err
 		}
 		v = []interface{}{methodType, c.seqid, c.ctype}
 		v = c.method.appendForEncoding(v)
 		v = append(v, arg)
-		logCall = func() { d.log.ClientCallCompressed(c.seqid, c.method.String(), c.arg, c.ctype) }
+		logCall = func() {
+			d.log.ClientCallCompressed(c.seqid, c.method.String(), redactLater(nil, c.arg), c.ctype)
+		}
 	}
 
-	rpcTags, _ := ctxlog.TagsFromContext(ctx)
-	if len(rpcTags) > 0 {
-		v = append(v, rpcTags)
-	}
+	v = appendTrailer(ctx, v, headers)
 	size, errCh := d.writer.EncodeAndWrite(ctx, v, currySendNotifier(sendNotifier, c.seqid))
-	defer func() { _ = record.RecordAndFinish(ctx, size) }()
+	defer func() {
+		record.setFailed(err)
+		_ = record.RecordAndFinish(ctx, size)
+	}()
 
 	// Wait for result from encode
 	select {
@@ -113,7 +127,9 @@ func (d *dispatch) Call(ctx context.Context, name Methoder, arg interface{}, res
 	// Wait for result from call
 	select {
 	case res := <-c.resultCh:
-		d.log.ClientReply(c.seqid, c.method.String(), res.ResponseErr(), res.Res())
+		// Only the reply has been recorded so far.
+		resSize = record.received()
+		d.log.ClientReply(c.seqid, c.method.String(), res.ResponseErr(), redactLater(nil, res.Res()))
 		return res.ResponseErr()
 	case <-c.ctx.Done():
 		return d.handleCancel(ctx, c)
@@ -122,23 +138,31 @@ func (d *dispatch) Call(ctx context.Context, name Methoder, arg interface{}, res
 	}
 }
 
-func (d *dispatch) Notify(ctx context.Context, name Methoder, arg interface{}, sendNotifier SendNotifier) error {
-	rpcTags, _ := ctxlog.TagsFromContext(ctx)
+func (d *dispatch) Notify(ctx context.Context, name Methoder, arg interface{}, sendNotifier SendNotifier) (err error) {
+	var size int64
+	ctx, span, headers := d.tracer.startClient(ctx, SpanKindProducer, name.NotifyMethodType(), name, CompressionNone)
+	defer func() {
+		span.SetSentSize(size)
+		span.End(err)
+	}()
+
 	v := []interface{}{name.NotifyMethodType()}
 	v = name.appendForEncoding(v)
 	v = append(v, arg)
-	if len(rpcTags) > 0 {
-		v = append(v, rpcTags)
-	}
+	v = appendTrailer(ctx, v, headers)
 
 	size, errCh := d.writer.EncodeAndWrite(ctx, v, currySendNotifier(sendNotifier, SeqNumber(-1)))
-	record := NewNetworkInstrumenter(d.instrumenterStorage, InstrumentTag(MethodNotify, name.String()))
-	defer func() { _ = record.RecordAndFinish(ctx, size) }()
+	record := newNetworkInstrumenter(d.instrumenterStorage, InstrumentTag(MethodNotify, name.String()),
+		InstrumentTag(name.NotifyMethodType(), name.String()))
+	defer func() {
+		record.setFailed(err)
+		_ = record.RecordAndFinish(ctx, size)
+	}()
 
 	select {
 	case err := <-errCh:
 		if err == nil {
-			d.log.ClientNotify(name.String(), arg)
+			d.log.ClientNotify(name.String(), redactLater(nil, arg))
 		}
 		return err
 	case <-d.stopCh:
@@ -158,7 +182,8 @@ func (d *dispatch) handleCancel(ctx context.Context, c *call) error {
 	v := []interface{}{c.method.CancelMethodType(), c.seqid}
 	v = c.method.appendForEncoding(v)
 	size, errCh := d.writer.EncodeAndWriteAsync(v)
-	record := NewNetworkInstrumenter(d.instrumenterStorage, InstrumentTag(MethodCancel, c.method.String()))
+	record := newNetworkInstrumenter(d.instrumenterStorage, InstrumentTag(MethodCancel, c.method.String()),
+		InstrumentTag(c.method.CancelMethodType(), c.method.String()))
 	defer func() { _ = record.RecordAndFinish(ctx, size) }()
 	select {
 	case err := <-errCh:
@@ -0,0 +1,164 @@
+package rpc
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func drainTestProtocol(started chan<- struct{}, release <-chan struct{}) Protocol {
+	return Protocol{
+		Name: "drain",
+		Methods: map[string]ServeHandlerDescription{
+			"block": {
+				MakeArg: func() interface{} { return new(int) },
+				Handler: func(ctx context.Context, arg interface{}) (interface{}, error) {
+					started <- struct{}{}
+					select {
+					case <-release:
+					case <-ctx.Done():
+						return nil, ctx.Err()
+					}
+					return *arg.(*int), nil
+				},
+			},
+			"echo": {
+				MakeArg: func() interface{} { return new(int) },
+				Handler: func(_ context.Context, arg interface{}) (interface{}, error) {
+					return *arg.(*int), nil
+				},
+			},
+		},
+	}
+}
+
+func prepDrainTest(t *testing.T, p Protocol, opts TransportOpts) (Transporter, Transporter) {
+	clientConn, serverConn := net.Pipe()
+	lf := NewSimpleLogFactory(&testLogOutput{t: t}, nil)
+	sxp := NewTransportWithOpts(context.Background(), serverConn, lf, nil, nil, testMaxFrameLength, opts)
+	srv := NewServer(sxp, nil)
+	require.NoError(t, srv.Register(p))
+	srv.Run()
+	cxp := NewTransportWithOpts(context.Background(), clientConn, lf, nil, nil, testMaxFrameLength, opts)
+	t.Cleanup(func() {
+		cxp.Close()
+		sxp.Close()
+	})
+	return cxp, sxp
+}
+
+func TestDrainServer(t *testing.T) {
+	started := make(chan struct{})
+	release := make(chan struct{})
+	cxp, sxp := prepDrainTest(t, drainTestProtocol(started, release),
+		TransportOpts{Handshake: &HandshakeConfig{}})
+	cli := NewClient(cxp, nil, nil)
+	ctx := context.Background()
+
+	callErrCh := make(chan error, 1)
+	var res int
+	go func() {
+		callErrCh <- cli.Call(ctx, newMethodV1("drain.block"), 7, &res, 0)
+	}()
+	<-started
+
+	drainErrCh := make(chan error, 1)
+	go func() {
+		drainErrCh <- sxp.Drain(ctx)
+	}()
+
+	select {
+	case <-cxp.goingAway():
+	case <-time.After(5 * time.Second):
+		require.Fail(t, "no goaway received")
+	}
+
+	// New calls are refused while draining.
+	var res2 int
+	err := cli.Call(ctx, newMethodV1("drain.echo"), 1, &res2, 0)
+	require.EqualError(t, err, DrainingError{}.Error())
+
+	// But the outstanding one can finish.
+	select {
+	case err := <-drainErrCh:
+		require.Fail(t, "drain finished early", "err: %v", err)
+	default:
+	}
+	close(release)
+	require.NoError(t, <-callErrCh)
+	require.Equal(t, 7, res)
+	require.NoError(t, <-drainErrCh)
+	require.False(t, sxp.IsConnected())
+}
+
+func TestDrainWithoutHandshake(t *testing.T) {
+	started := make(chan struct{})
+	release := make(chan struct{})
+	cxp, sxp := prepDrainTest(t, drainTestProtocol(started, release), TransportOpts{})
+	cli := NewClient(cxp, nil, nil)
+	ctx := context.Background()
+
+	callErrCh := make(chan error, 1)
+	var res int
+	go func() {
+		callErrCh <- cli.Call(ctx, newMethodV1("drain.block"), 7, &res, 0)
+	}()
+	<-started
+	drainErrCh := make(chan error, 1)
+	go func() {
+		drainErrCh <- sxp.Drain(ctx)
+	}()
+
+	// The peer might predate goaways, so it just gets its new calls
+	// refused.
+	require.Eventually(t, func() bool {
+		var res2 int
+		err := cli.Call(ctx, newMethodV1("drain.echo"), 1, &res2, 0)
+		return errors.Is(err, DrainingError{})
+	}, 5*time.Second, time.Millisecond)
+	select {
+	case <-cxp.goingAway():
+		require.Fail(t, "goaway sent to a peer that didn't advertise it")
+	default:
+	}
+	close(release)
+	require.NoError(t, <-callErrCh)
+	require.NoError(t, <-drainErrCh)
+}
+
+func TestDrainWaitsForOutgoingCalls(t *testing.T) {
+	started := make(chan struct{})
+	release := make(chan struct{})
+	cxp, _ := prepDrainTest(t, drainTestProtocol(started, release), TransportOpts{})
+	cli := NewClient(cxp, nil, nil)
+
+	callErrCh := make(chan error, 1)
+	var res int
+	go func() {
+		callErrCh <- cli.Call(context.Background(), newMethodV1("drain.block"), 3, &res, 0)
+	}()
+	<-started
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	err := cxp.Drain(ctx)
+	require.Equal(t, context.DeadlineExceeded, err)
+	require.False(t, cxp.IsConnected())
+
+	_, err = cxp.getDispatcher()
+	require.Error(t, err)
+	close(release)
+	require.Error(t, <-callErrCh)
+}
+
+func TestDrainRefusesOutgoingCalls(t *testing.T) {
+	cxp, _ := prepDrainTest(t, drainTestProtocol(nil, nil), TransportOpts{})
+	tr := cxp.(*transport)
+	tr.draining.Store(true)
+	_, err := cxp.getDispatcher()
+	require.Equal(t, DrainingError{}, err)
+}
@@ -1,6 +1,7 @@
 package rpc
 
 import (
+	"errors"
 	"fmt"
 )
 
@@ -158,6 +159,186 @@ func (c NilResultError) Error() string {
 	return fmt.Sprintf("Nil result supplied for sequence number %d", c.seqno)
 }
 
+// ResourceExhaustedError is returned for an incoming call that was rejected
+// because the peer went over one of the configured rate limits, or too many
+// requests were waiting for its SerialKey. The client gets it back typed,
+// whatever the WrapErrorFunc of the protocol.
+type ResourceExhaustedError struct {
+	Resource string
+	Method   string
+}
+
+func newResourceExhaustedError(resource string, method string) ResourceExhaustedError {
+	return ResourceExhaustedError{
+		Resource: resource,
+		Method:   method,
+	}
+}
+
+func (r ResourceExhaustedError) Error() string {
+	return fmt.Sprintf("resource exhausted: too many %s (method %s)", r.Resource, r.Method)
+}
+
+// replyStatusCode tells the errors that the library itself replies with
+// apart, so that the client can return them typed.
+type replyStatusCode int
+
+const (
+	replyStatusResourceExhausted replyStatusCode = 1
+	replyStatusDraining          replyStatusCode = 2
+	replyStatusProtocolNotFound  replyStatusCode = 3
+	replyStatusMethodNotFound    replyStatusCode = 4
+	replyStatusOrderedNotifyGap  replyStatusCode = 5
+)
+
+// replyStatus is an optional field of a response, after the result, which
+// peers that don't know of it ignore. It's sent along with the error wrapped
+// by the protocol's WrapErrorFunc, and takes precedence over it.
+type replyStatus struct {
+	Code     replyStatusCode `codec:"code"`
+	Resource string          `codec:"resource,omitempty"`
+	// Protocol is the name of the V2 protocol of a method that wasn't
+	// found.
+	Protocol string `codec:"protocol,omitempty"`
+}
+
+// newReplyStatus returns the status of err, or nil if it has none.
+func newReplyStatus(err error) *replyStatus {
+	var re ResourceExhaustedError
+	var me MethodV2NotFoundError
+	switch {
+	case errors.As(err, &re):
+		return &replyStatus{Code: replyStatusResourceExhausted, Resource: re.Resource}
+	case errors.As(err, new(DrainingError)):
+		return &replyStatus{Code: replyStatusDraining}
+	case errors.As(err, new(ProtocolNotFoundError)), errors.As(err, new(ProtocolV2NotFoundError)):
+		return &replyStatus{Code: replyStatusProtocolNotFound}
+	case errors.As(err, &me):
+		return &replyStatus{Code: replyStatusMethodNotFound, Protocol: me.ProtName}
+	case errors.As(err, new(MethodNotFoundError)):
+		return &replyStatus{Code: replyStatusMethodNotFound}
+	case errors.As(err, new(orderedNotifyGapError)):
+		return &replyStatus{Code: replyStatusOrderedNotifyGap}
+	default:
+		return nil
+	}
+}
+
+// err returns the error of a response with status s, to the given method.
+func (s replyStatus) err(method Methoder) error {
+	m2, isV2 := method.(*MethodV2)
+	p, m := splitMethodName(method.String())
+	switch {
+	case s.Code == replyStatusResourceExhausted:
+		return newResourceExhaustedError(s.Resource, method.String())
+	case s.Code == replyStatusDraining:
+		return DrainingError{}
+	case s.Code == replyStatusProtocolNotFound && isV2:
+		return NewProtocolV2NotFoundError(m2.puid)
+	case s.Code == replyStatusProtocolNotFound:
+		return newProtocolNotFoundError(p)
+	case s.Code == replyStatusMethodNotFound && isV2:
+		return NewMethodV2NotFoundError(m2.puid, m2.method, s.Protocol)
+	case s.Code == replyStatusMethodNotFound:
+		return newMethodNotFoundError(p, m)
+	case s.Code == replyStatusOrderedNotifyGap:
+		return orderedNotifyGapError{}
+	default:
+		return nil
+	}
+}
+
+// isRefusal tells whether err is one that the library replies with to a
+// request that it didn't serve, e.g. because the transport is draining, so
+// that the request can be sent again, or elsewhere.
+func isRefusal(err error) bool {
+	return newReplyStatus(err) != nil
+}
+
+// DrainingError is returned for calls made on, or received by, a transport
+// that is draining. The client of a refused call gets it back typed,
+// whatever the WrapErrorFunc of the protocol.
+type DrainingError struct{}
+
+func (DrainingError) Error() string {
+	return "transport is draining"
+}
+
+// orderedNotifyGapError is returned for an ordered notify that comes after
+// one of its session that was refused, so that it's sent again after it.
+type orderedNotifyGapError struct{}
+
+func (orderedNotifyGapError) Error() string {
+	return "ordered notify sent after one that was refused"
+}
+
+// HandshakeError is returned when the peer's handshake couldn't be received.
+type HandshakeError struct {
+	msg string
+}
+
+func (h HandshakeError) Error() string {
+	return "handshake error: " + h.msg
+}
+
+// PeerNotFoundError is returned when no peer is registered under an ID in a
+// PeerRegistry.
+type PeerNotFoundError struct {
+	ID PeerID
+}
+
+func (p PeerNotFoundError) Error() string {
+	return fmt.Sprintf("peer %q not found", p.ID)
+}
+
+// BroadcastError is returned when a notify to several peers fails for some of
+// them. The others got it.
+type BroadcastError struct {
+	// Errors are the errors, by peer.
+	Errors map[PeerID]error
+	// Peers is how many peers the notify was sent to.
+	Peers int
+}
+
+func (b BroadcastError) Error() string {
+	return fmt.Sprintf("notify failed for %d of %d peers", len(b.Errors), b.Peers)
+}
+
+// CaptureCodecError is returned when capturing or replaying the frames of a
+// transport whose codec isn't msgpack, which is the only one captures
+// support.
+type CaptureCodecError struct {
+	Codec CodecType
+}
+
+func (c CaptureCodecError) Error() string {
+	return fmt.Sprintf("captures only support the msgpack codec, not %s", c.Codec)
+}
+
+// MuxError is returned when the peer of a Mux breaks the mux protocol. It
+// closes the Mux.
+type MuxError struct {
+	msg string
+}
+
+func (m MuxError) Error() string {
+	return "mux error: " + m.msg
+}
+
+func newMuxError(d string, a ...interface{}) MuxError {
+	return MuxError{msg: fmt.Sprintf(d, a...)}
+}
+
+// MuxChannelLimitError is returned by Mux.Open when MuxOpts.MaxChannels
+// channels are open already.
+type MuxChannelLimitError struct {
+	Max int
+}
+
+func (e MuxChannelLimitError) Error() string {
+	return fmt.Sprintf("too many mux channels: %d open", e.Max)
+}
+
 type DecodeError struct {
 	err   error
 	typ   MethodType
@@ -1,22 +1,66 @@
 package rpc
 
 import (
+	"context"
 	"crypto/tls"
 	"fmt"
 	"net"
 	"net/url"
+	"strings"
 )
 
 const (
 	spSchemeStandard = "sprpc"
 	spSchemeTLS      = "sprpc+tls"
+	wsScheme         = "ws"
+	wssScheme        = "wss"
 )
 
-// SPURI represents a URI with an FMP scheme.
+// SPURI represents a URI with an FMP scheme. The scheme can name a codec
+// other than msgpack, after the TLS part if any, e.g. "sprpc+json" or
+// "sprpc+tls+cbor". The "ws" and "wss" schemes carry the frames over
+// WebSocket, to the URI's path; they can name a codec too, e.g. "wss+json".
 type SPURI struct {
 	Scheme   string
 	HostPort string
 	Host     string
+	Codec    CodecType
+	// Path is the path of a WebSocket URI.
+	Path string
+}
+
+// spScheme is a parsed SPURI scheme.
+type spScheme struct {
+	tls       bool
+	webSocket bool
+	codec     CodecType
+}
+
+// parseSPScheme splits a scheme into its base, TLS and codec parts.
+func parseSPScheme(scheme string) (ret spScheme, ok bool) {
+	base, rest, _ := strings.Cut(scheme, "+")
+	switch base {
+	case spSchemeStandard:
+		if rest == "tls" || strings.HasPrefix(rest, "tls+") {
+			ret.tls = true
+			rest = strings.TrimPrefix(strings.TrimPrefix(rest, "tls"), "+")
+		}
+	case wsScheme:
+		ret.webSocket = true
+	case wssScheme:
+		ret.webSocket, ret.tls = true, true
+	default:
+		return ret, false
+	}
+	if rest == "" {
+		return ret, true
+	}
+	ct, err := ParseCodecType(rest)
+	if err != nil {
+		return ret, false
+	}
+	ret.codec = ct
+	return ret, true
 }
 
 // ParseSPURI parses an FMPURI.
@@ -28,11 +72,22 @@ func ParseSPURI(s string) (*SPURI, error) {
 
 	f := &SPURI{Scheme: uri.Scheme, HostPort: uri.Host}
 
-	switch f.Scheme {
-	case spSchemeStandard, spSchemeTLS:
-	default:
+	scheme, ok := parseSPScheme(f.Scheme)
+	if !ok {
 		return nil, fmt.Errorf("invalid framed msgpack rpc scheme %s", uri.Scheme)
 	}
+	f.Codec = scheme.codec
+	if scheme.webSocket {
+		f.Path = uri.EscapedPath()
+		// Like HTTP, WebSocket has default ports.
+		if uri.Port() == "" && uri.Hostname() != "" {
+			port := "80"
+			if scheme.tls {
+				port = "443"
+			}
+			f.HostPort = net.JoinHostPort(uri.Hostname(), port)
+		}
+	}
 
 	host, _, err := net.SplitHostPort(f.HostPort)
 	if err != nil {
@@ -47,14 +102,24 @@ func ParseSPURI(s string) (*SPURI, error) {
 }
 
 func (f *SPURI) UseTLS() bool {
-	return f.Scheme == spSchemeTLS
+	scheme, _ := parseSPScheme(f.Scheme)
+	return scheme.tls
+}
+
+// UseWebSocket returns whether the frames go over WebSocket.
+func (f *SPURI) UseWebSocket() bool {
+	scheme, _ := parseSPScheme(f.Scheme)
+	return scheme.webSocket
 }
 
 func (f *SPURI) String() string {
-	return fmt.Sprintf("%s://%s", f.Scheme, f.HostPort)
+	return fmt.Sprintf("%s://%s%s", f.Scheme, f.HostPort, f.Path)
 }
 
 func (f *SPURI) DialWithConfig(config *tls.Config) (net.Conn, error) {
+	if f.UseWebSocket() {
+		return f.dialWebSocket(context.Background(), nil, config)
+	}
 	network, addr := "tcp", f.HostPort
 	if f.UseTLS() {
 		return tls.Dial(network, addr, config)
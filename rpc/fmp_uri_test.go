@@ -23,6 +23,16 @@ var spURITests = []spURITest{
 	{in: "sprpc://gregor.api.keybase.io", err: addrErr.Error()},
 	{in: "sprpc+tls://gregor.api.keybase.io", err: addrErr.Error()},
 	{in: "sprpc+tls://:443", err: "missing host in address :443"},
+	{in: "sprpc+json://localhost:80", out: &SPURI{Scheme: "sprpc+json", HostPort: "localhost:80", Host: "localhost", Codec: CodecJSON}},
+	{in: "sprpc+tls+cbor://localhost:443", out: &SPURI{Scheme: "sprpc+tls+cbor", HostPort: "localhost:443", Host: "localhost", Codec: CodecCBOR}, tls: true},
+	{in: "sprpc+tls+msgpack://localhost:443", out: &SPURI{Scheme: "sprpc+tls+msgpack", HostPort: "localhost:443", Host: "localhost"}, tls: true},
+	{in: "sprpc+xml://localhost:80", err: "invalid framed msgpack rpc scheme sprpc+xml"},
+	{in: "sprpc+json+tls://localhost:80", err: "invalid framed msgpack rpc scheme sprpc+json+tls"},
+	{in: "sprpcx://localhost:80", err: "invalid framed msgpack rpc scheme sprpcx"},
+	{in: "ws://localhost:8080/rpc", out: &SPURI{Scheme: "ws", HostPort: "localhost:8080", Host: "localhost", Path: "/rpc"}},
+	{in: "wss://localhost/rpc", out: &SPURI{Scheme: "wss", HostPort: "localhost:443", Host: "localhost", Path: "/rpc"}, tls: true},
+	{in: "ws+cbor://localhost", out: &SPURI{Scheme: "ws+cbor", HostPort: "localhost:80", Host: "localhost", Codec: CodecCBOR}},
+	{in: "ws+tls://localhost", err: "invalid framed msgpack rpc scheme ws+tls"},
 }
 
 func TestParseSPURI(t *testing.T) {
@@ -49,6 +59,12 @@ func TestParseSPURI(t *testing.T) {
 		if u.HostPort != test.out.HostPort {
 			t.Errorf("Parse(%q) host: %q, expected %q", test.in, u.Host, test.out.Host)
 		}
+		if u.Path != test.out.Path {
+			t.Errorf("Parse(%q) path: %q, expected %q", test.in, u.Path, test.out.Path)
+		}
+		if u.Codec != test.out.Codec {
+			t.Errorf("Parse(%q) codec: %v, expected %v", test.in, u.Codec, test.out.Codec)
+		}
 		if u.UseTLS() != test.tls {
 			t.Errorf("Parse(%q) use tls: %v, expected %v", test.in, u.UseTLS(), test.tls)
 		}
@@ -0,0 +1,234 @@
+package rpc
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"time"
+)
+
+// LibraryVersion is the version of this library, as advertised in
+// handshakes.
+const LibraryVersion = "1"
+
+// Features is a set of optional capabilities that a peer advertises in its
+// handshake.
+type Features uint64
+
+const (
+	// FeatureMethodV2 means the peer understands MethodCallV2,
+	// MethodNotifyV2 and MethodCancelV2.
+	FeatureMethodV2 Features = 1 << iota
+	// FeatureCompressedCalls means the peer understands
+	// MethodCallCompressed.
+	FeatureCompressedCalls
+	// FeatureGoAway means the peer understands MethodGoAway.
+	FeatureGoAway
+)
+
+// LocalFeatures are the features supported by this version of the library.
+const LocalFeatures = FeatureMethodV2 | FeatureCompressedCalls | FeatureGoAway
+
+// Has returns true if all of the features in o are in f.
+func (f Features) Has(o Features) bool {
+	return f&o == o
+}
+
+// DefaultHandshakeTimeout is used when HandshakeConfig.Timeout is zero.
+const DefaultHandshakeTimeout = 30 * time.Second
+
+// HandshakeConfig enables the handshake on a transport. The handshake is
+// sent as the very first frame. Peers that haven't enabled it answer with a
+// default handshake of their own, and peers that don't answer in time are
+// assumed to have none of the optional features (see
+// HandshakeResult.PeerMissing). Peers running versions of this library that
+// predate the handshake treat it as a protocol error and drop the
+// connection, though, so it should only be enabled once all peers have been
+// upgraded.
+type HandshakeConfig struct {
+	// Compressions are the compression types that we accept. Defaults
+	// to all of the ones that this library supports.
+	Compressions []CompressionType
+	// Metadata is application-specific, and is passed to the peer as-is.
+	Metadata map[string]string
+	// Timeout bounds how long Transporter.Handshake waits for the peer's
+	// handshake. Defaults to DefaultHandshakeTimeout.
+	Timeout time.Duration
+}
+
+// HandshakeInfo is what a peer advertises about itself in its handshake.
+type HandshakeInfo struct {
+	Version        string            `codec:"v"`
+	Features       Features          `codec:"f"`
+	Compressions   []CompressionType `codec:"c"`
+	MaxFrameLength int32             `codec:"l"`
+	Metadata       map[string]string `codec:"m"`
+}
+
+// HandshakeResult is the outcome of a handshake: what both sides
+// advertised, and what they have in common.
+type HandshakeResult struct {
+	Local HandshakeInfo
+	Peer  HandshakeInfo
+	// Features are the features supported by both sides.
+	Features Features
+	// Compressions are the compression types supported by both sides.
+	Compressions []CompressionType
+	// MaxFrameLength is the smaller of the two max frame lengths.
+	MaxFrameLength int32
+	// PeerMissing is set if the peer's handshake didn't arrive in time,
+	// in which case Peer is empty, and nothing optional is supported.
+	PeerMissing bool
+}
+
+// SupportsCompression returns true if both sides support ctype.
+func (r HandshakeResult) SupportsCompression(ctype CompressionType) bool {
+	if ctype == CompressionNone {
+		return true
+	}
+	for _, c := range r.Compressions {
+		if c == ctype {
+			return true
+		}
+	}
+	return false
+}
+
+func newHandshakeResult(local, peer HandshakeInfo) HandshakeResult {
+	ret := HandshakeResult{
+		Local:          local,
+		Peer:           peer,
+		Features:       local.Features & peer.Features,
+		MaxFrameLength: local.MaxFrameLength,
+	}
+	if peer.MaxFrameLength > 0 && peer.MaxFrameLength < ret.MaxFrameLength {
+		ret.MaxFrameLength = peer.MaxFrameLength
+	}
+	for _, c := range local.Compressions {
+		for _, pc := range peer.Compressions {
+			if c == pc {
+				ret.Compressions = append(ret.Compressions, c)
+				break
+			}
+		}
+	}
+	return ret
+}
+
+// handshaker keeps the state of the handshake of one transport.
+type handshaker struct {
+	local   HandshakeInfo
+	timeout time.Duration
+	peerCh  fireOnce
+
+	mutex  sync.Mutex
+	result *HandshakeResult
+}
+
+func newHandshaker(config *HandshakeConfig, maxFrameLength int32) *handshaker {
+	local := HandshakeInfo{
+		Version:        LibraryVersion,
+		Features:       LocalFeatures,
+		Compressions:   append([]CompressionType(nil), config.Compressions...),
+		MaxFrameLength: maxFrameLength,
+		Metadata:       config.Metadata,
+	}
+	if config.Compressions == nil {
+		local.Compressions = []CompressionType{CompressionGzip, CompressionMsgpackzip}
+	}
+	sort.Slice(local.Compressions, func(i, j int) bool {
+		return local.Compressions[i] < local.Compressions[j]
+	})
+	timeout := config.Timeout
+	if timeout == 0 {
+		timeout = DefaultHandshakeTimeout
+	}
+	return &handshaker{
+		local:   local,
+		timeout: timeout,
+		peerCh:  newFireOnce(),
+	}
+}
+
+func (h *handshaker) frame() []interface{} {
+	return []interface{}{MethodHandshake, h.local}
+}
+
+// receive records the peer's handshake. Only the first one counts.
+func (h *handshaker) receive(peer HandshakeInfo) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	if h.result != nil {
+		return
+	}
+	res := newHandshakeResult(h.local, peer)
+	h.result = &res
+	h.peerCh.fire()
+}
+
+// receiveMissing records that the peer's handshake is missing, unless it
+// arrived in the meantime, and returns the result.
+func (h *handshaker) receiveMissing() *HandshakeResult {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	if h.result == nil {
+		res := newHandshakeResult(h.local, HandshakeInfo{})
+		res.PeerMissing = true
+		h.result = &res
+		h.peerCh.fire()
+	}
+	return h.result
+}
+
+func (h *handshaker) getResult() *HandshakeResult {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	return h.result
+}
+
+// wait waits for the peer's handshake, for at most the configured timeout.
+func (h *handshaker) wait(ctx context.Context, done <-chan struct{}) (*HandshakeResult, error) {
+	timer := time.NewTimer(h.timeout)
+	defer timer.Stop()
+	select {
+	case <-h.peerCh.ch:
+		return h.getResult(), nil
+	case <-done:
+		// The handshake might have been the last thing received.
+		if res := h.getResult(); res != nil {
+			return res, nil
+		}
+		return nil, HandshakeError{msg: "transport closed before the handshake"}
+	case <-timer.C:
+		// The peer doesn't do handshakes, or not fast enough, so
+		// carry on without its features. A handshake that arrives
+		// later is ignored.
+		return h.receiveMissing(), nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// peerHas returns true if the peer advertised f in its handshake. Without
+// one, we can't tell, and older peers might not support it.
+func (h *handshaker) peerHas(f Features) bool {
+	if h == nil {
+		return false
+	}
+	res := h.getResult()
+	return res != nil && res.Peer.Features.Has(f)
+}
+
+type handshakeResultKey struct{}
+
+func withHandshakeResult(ctx context.Context, res *HandshakeResult) context.Context {
+	return context.WithValue(ctx, handshakeResultKey{}, res)
+}
+
+// HandshakeResultFromContext returns the result of the handshake of the
+// connection being set up, as passed to ConnectionHandler.OnConnect when the
+// handshake is enabled via ConnectionOpts.Handshake.
+func HandshakeResultFromContext(ctx context.Context) (*HandshakeResult, bool) {
+	res, ok := ctx.Value(handshakeResultKey{}).(*HandshakeResult)
+	return res, ok
+}
@@ -0,0 +1,169 @@
+package rpc
+
+import (
+	"context"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func makeHandshakeTestTransports(t *testing.T, copts, sopts TransportOpts, smax int32) (Transporter, Transporter) {
+	clientConn, serverConn := net.Pipe()
+	lf := NewSimpleLogFactory(&testLogOutput{t: t}, nil)
+	cxp := NewTransportWithOpts(context.Background(), clientConn, lf, nil, nil, testMaxFrameLength, copts)
+	sxp := NewTransportWithOpts(context.Background(), serverConn, lf, nil, nil, smax, sopts)
+	t.Cleanup(func() {
+		cxp.Close()
+		sxp.Close()
+	})
+	return cxp, sxp
+}
+
+func TestHandshake(t *testing.T) {
+	copts := TransportOpts{Handshake: &HandshakeConfig{
+		Compressions: []CompressionType{CompressionMsgpackzip},
+		Metadata:     map[string]string{"app": "client"},
+	}}
+	sopts := TransportOpts{Handshake: &HandshakeConfig{}}
+	cxp, sxp := makeHandshakeTestTransports(t, copts, sopts, testMaxFrameLength/2)
+	ctx := context.Background()
+
+	cres, err := cxp.Handshake(ctx)
+	require.NoError(t, err)
+	sres, err := sxp.Handshake(ctx)
+	require.NoError(t, err)
+
+	require.Equal(t, LibraryVersion, cres.Peer.Version)
+	require.Equal(t, LocalFeatures, cres.Features)
+	require.True(t, cres.Features.Has(FeatureGoAway))
+	require.Equal(t, []CompressionType{CompressionMsgpackzip}, cres.Compressions)
+	require.Equal(t, cres.Compressions, sres.Compressions)
+	require.True(t, sres.SupportsCompression(CompressionMsgpackzip))
+	require.False(t, sres.SupportsCompression(CompressionGzip))
+	require.True(t, sres.SupportsCompression(CompressionNone))
+	require.Equal(t, int32(testMaxFrameLength/2), cres.MaxFrameLength)
+	require.Equal(t, int32(testMaxFrameLength/2), sres.MaxFrameLength)
+	require.Equal(t, map[string]string{"app": "client"}, sres.Peer.Metadata)
+	require.Equal(t, cres.Local, sres.Peer)
+
+	// RPCs work as usual afterwards.
+	srv := NewServer(sxp, nil)
+	require.NoError(t, srv.Register(rateLimitTestProtocol(nil, nil)))
+	srv.Run()
+	var res int
+	require.NoError(t, NewClient(cxp, nil, nil).Call(ctx, newMethodV1("limited.ping"), 4, &res, 0))
+	require.Equal(t, 4, res)
+}
+
+func TestHandshakeDisabled(t *testing.T) {
+	cxp, _ := makeHandshakeTestTransports(t, TransportOpts{}, TransportOpts{}, testMaxFrameLength)
+	res, err := cxp.Handshake(context.Background())
+	require.NoError(t, err)
+	require.Nil(t, res)
+}
+
+func TestHandshakeTimeout(t *testing.T) {
+	clientConn, serverConn := net.Pipe()
+	defer serverConn.Close()
+	go func() {
+		_, _ = io.Copy(io.Discard, serverConn)
+	}()
+	lf := NewSimpleLogFactory(&testLogOutput{t: t}, nil)
+	cxp := NewTransportWithOpts(context.Background(), clientConn, lf, nil, nil, testMaxFrameLength,
+		TransportOpts{Handshake: &HandshakeConfig{Timeout: 10 * time.Millisecond}})
+	defer cxp.Close()
+
+	// A peer that doesn't answer is taken to have none of the optional
+	// features.
+	res, err := cxp.Handshake(context.Background())
+	require.NoError(t, err)
+	require.True(t, res.PeerMissing)
+	require.Zero(t, res.Features)
+	require.False(t, res.SupportsCompression(CompressionGzip))
+	require.False(t, cxp.(*transport).handshake.peerHas(FeatureGoAway))
+}
+
+func TestHandshakeClosed(t *testing.T) {
+	cxp, sxp := makeHandshakeTestTransports(t, TransportOpts{Handshake: &HandshakeConfig{}},
+		TransportOpts{}, testMaxFrameLength)
+	sxp.Close()
+	_, err := cxp.Handshake(context.Background())
+	require.IsType(t, HandshakeError{}, err)
+}
+
+func TestHandshakeOnlyOneSide(t *testing.T) {
+	// The peer hasn't enabled the handshake, but answers ours with its
+	// defaults.
+	copts := TransportOpts{Handshake: &HandshakeConfig{Timeout: 5 * time.Second}}
+	cxp, sxp := makeHandshakeTestTransports(t, copts,
+		TransportOpts{}, testMaxFrameLength)
+	sxp.receiveFrames()
+	res, err := cxp.Handshake(context.Background())
+	require.NoError(t, err)
+	require.False(t, res.PeerMissing)
+	require.Equal(t, LibraryVersion, res.Peer.Version)
+	require.Equal(t, LocalFeatures, res.Features)
+	res, err = sxp.Handshake(context.Background())
+	require.NoError(t, err)
+	require.Nil(t, res)
+
+	// RPCs work as usual afterwards.
+	srv := NewServer(sxp, nil)
+	require.NoError(t, srv.Register(rateLimitTestProtocol(nil, nil)))
+	srv.Run()
+	var n int
+	require.NoError(t, NewClient(cxp, nil, nil).Call(context.Background(), newMethodV1("limited.ping"), 4, &n, 0))
+	require.Equal(t, 4, n)
+}
+
+func TestHandshakePeerHas(t *testing.T) {
+	var h *handshaker
+	require.False(t, h.peerHas(FeatureGoAway))
+	h = newHandshaker(&HandshakeConfig{}, testMaxFrameLength)
+	require.False(t, h.peerHas(FeatureGoAway))
+	h.receive(HandshakeInfo{Features: FeatureMethodV2})
+	require.False(t, h.peerHas(FeatureGoAway))
+	require.True(t, h.peerHas(FeatureMethodV2))
+}
+
+type handshakeTestHandler struct {
+	testConnectionHandler
+	resCh chan *HandshakeResult
+}
+
+func (h handshakeTestHandler) OnConnect(ctx context.Context, _ *Connection, _ GenericClient, _ *Server) error {
+	res, _ := HandshakeResultFromContext(ctx)
+	h.resCh <- res
+	return nil
+}
+
+func TestHandshakeOnConnect(t *testing.T) {
+	sopts := TransportOpts{Handshake: &HandshakeConfig{Metadata: map[string]string{"app": "server"}}}
+	cxp, _ := makeHandshakeTestTransports(t, TransportOpts{Handshake: &HandshakeConfig{}}, sopts, testMaxFrameLength)
+	h := handshakeTestHandler{resCh: make(chan *HandshakeResult, 1)}
+	output := testLogOutput{t: t}
+	conn := NewConnectionWithTransport(h, singleTransport{cxp}, nil, &output, ConnectionOpts{})
+	defer conn.Shutdown()
+
+	res := <-h.resCh
+	require.NotNil(t, res)
+	require.Equal(t, "server", res.Peer.Metadata["app"])
+}
+
+func TestHandshakeOnConnectOnlyOneSide(t *testing.T) {
+	cxp, sxp := makeHandshakeTestTransports(t, TransportOpts{Handshake: &HandshakeConfig{}},
+		TransportOpts{}, testMaxFrameLength)
+	sxp.receiveFrames()
+	h := handshakeTestHandler{resCh: make(chan *HandshakeResult, 1)}
+	output := testLogOutput{t: t}
+	conn := NewConnectionWithTransport(h, singleTransport{cxp}, nil, &output, ConnectionOpts{})
+	defer conn.Shutdown()
+
+	res := <-h.resCh
+	require.NotNil(t, res)
+	require.False(t, res.PeerMissing)
+	require.Equal(t, LocalFeatures, res.Features)
+}
@@ -0,0 +1,372 @@
+package rpc
+
+import (
+	"container/list"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/keybase/go-codec/codec"
+)
+
+// Calls can carry an idempotency key, in their headers, so that a server
+// with an IdempotencyCache serves each key only once, and replays the reply
+// to the calls that come with it again, e.g. when Connection.DoCommand
+// retries a call after the connection dropped, not knowing whether it went
+// through. The calls made through a Connection's client get a new key each,
+// unless their context already has one; see WithIdempotencyKey.
+
+// idempotencyHeader is the header with the idempotency key of a call.
+const idempotencyHeader = "snowpack-idempotency"
+
+const (
+	defaultIdempotencyTTL        = 10 * time.Minute
+	defaultIdempotencyMaxEntries = 10000
+)
+
+type idempotencyKeyKey struct{}
+
+// WithIdempotencyKey makes the calls made with ctx carry key, as their
+// idempotency key. Keys need only be unique per peer.
+func WithIdempotencyKey(ctx context.Context, key string) context.Context {
+	return context.WithValue(ctx, idempotencyKeyKey{}, key)
+}
+
+// IdempotencyKeyFromContext returns the idempotency key of ctx, if any.
+func IdempotencyKeyFromContext(ctx context.Context) (string, bool) {
+	key, ok := ctx.Value(idempotencyKeyKey{}).(string)
+	return key, ok && key != ""
+}
+
+// withNewIdempotencyKey gives ctx a random idempotency key, unless it has
+// one already.
+func withNewIdempotencyKey(ctx context.Context) context.Context {
+	if _, ok := IdempotencyKeyFromContext(ctx); ok {
+		return ctx
+	}
+	var key [16]byte
+	_, _ = rand.Read(key[:])
+	return WithIdempotencyKey(ctx, hex.EncodeToString(key[:]))
+}
+
+// addIdempotencyHeader adds the idempotency key of ctx, if any, to headers.
+func addIdempotencyHeader(ctx context.Context, headers map[string]string) map[string]string {
+	key, ok := IdempotencyKeyFromContext(ctx)
+	if !ok {
+		return headers
+	}
+	if headers == nil {
+		headers = make(map[string]string)
+	}
+	headers[idempotencyHeader] = key
+	return headers
+}
+
+// IdempotencyKey identifies a call in an IdempotencyStore.
+type IdempotencyKey struct {
+	// Peer identifies the peer that made the call. See
+	// IdempotencyCacheOpts.PeerIdentity.
+	Peer string
+	Key  string
+}
+
+// IdempotentReply is the reply to a call, as cached in an IdempotencyStore.
+type IdempotentReply struct {
+	// Codec is that of the transport that the call came in on, which
+	// encoded Err and Res.
+	Codec CodecType
+	Err   []byte
+	Res   []byte
+}
+
+// IdempotencyStore stores the replies of an IdempotencyCache. It must be
+// safe for concurrent use.
+type IdempotencyStore interface {
+	// Get returns the reply stored for key, if any, and if it hasn't
+	// expired.
+	Get(ctx context.Context, key IdempotencyKey) (IdempotentReply, bool, error)
+	// Put stores the reply to key, for at least ttl.
+	Put(ctx context.Context, key IdempotencyKey, reply IdempotentReply, ttl time.Duration) error
+}
+
+// MemoryIdempotencyStore is an IdempotencyStore in memory, which holds up to
+// a maximum number of replies, and drops the least recently used ones to
+// make room.
+type MemoryIdempotencyStore struct {
+	maxEntries int
+
+	sync.Mutex
+	entries map[IdempotencyKey]*list.Element
+	lru     *list.List
+}
+
+var _ IdempotencyStore = (*MemoryIdempotencyStore)(nil)
+
+type memoryIdempotencyEntry struct {
+	key     IdempotencyKey
+	reply   IdempotentReply
+	expires time.Time
+}
+
+// NewMemoryIdempotencyStore makes a MemoryIdempotencyStore that holds up to
+// maxEntries replies, or 10000 if it's not positive.
+func NewMemoryIdempotencyStore(maxEntries int) *MemoryIdempotencyStore {
+	if maxEntries <= 0 {
+		maxEntries = defaultIdempotencyMaxEntries
+	}
+	return &MemoryIdempotencyStore{
+		maxEntries: maxEntries,
+		entries:    make(map[IdempotencyKey]*list.Element),
+		lru:        list.New(),
+	}
+}
+
+func (s *MemoryIdempotencyStore) Get(_ context.Context, key IdempotencyKey) (IdempotentReply, bool, error) {
+	s.Lock()
+	defer s.Unlock()
+	elem, ok := s.entries[key]
+	if !ok {
+		return IdempotentReply{}, false, nil
+	}
+	entry := elem.Value.(*memoryIdempotencyEntry)
+	if time.Now().After(entry.expires) {
+		s.lru.Remove(elem)
+		delete(s.entries, key)
+		return IdempotentReply{}, false, nil
+	}
+	s.lru.MoveToFront(elem)
+	return entry.reply, true, nil
+}
+
+func (s *MemoryIdempotencyStore) Put(_ context.Context, key IdempotencyKey, reply IdempotentReply, ttl time.Duration) error {
+	s.Lock()
+	defer s.Unlock()
+	entry := &memoryIdempotencyEntry{key: key, reply: reply, expires: time.Now().Add(ttl)}
+	if elem, ok := s.entries[key]; ok {
+		elem.Value = entry
+		s.lru.MoveToFront(elem)
+		return nil
+	}
+	s.entries[key] = s.lru.PushFront(entry)
+	for s.lru.Len() > s.maxEntries {
+		elem := s.lru.Back()
+		s.lru.Remove(elem)
+		delete(s.entries, elem.Value.(*memoryIdempotencyEntry).key)
+	}
+	return nil
+}
+
+// Len returns how many replies are stored, including expired ones that
+// weren't dropped yet.
+func (s *MemoryIdempotencyStore) Len() int {
+	s.Lock()
+	defer s.Unlock()
+	return s.lru.Len()
+}
+
+// IdempotencyCacheOpts are the options of an IdempotencyCache.
+type IdempotencyCacheOpts struct {
+	// Store stores the replies. It defaults to a MemoryIdempotencyStore
+	// with the default size.
+	Store IdempotencyStore
+	// TTL is how long replies are kept. It defaults to 10 minutes.
+	TTL time.Duration
+	// PeerIdentity, if set, returns the identity of the peer that made
+	// a call, from the context of the call, which is derived from that
+	// of the transport. It defaults to the host of the peer's address,
+	// which doesn't tell apart the peers behind the same address, and
+	// changes when a peer's does.
+	PeerIdentity func(ctx context.Context) string
+}
+
+// IdempotencyCache serves the calls with an idempotency key only once per
+// key and peer, and replays the reply to the calls that come with the same
+// key again, on the transports that it's given to (see
+// TransportOpts.Idempotency). Retries can come in on a new transport, so a
+// server should use one cache for all of its transports. Replies to calls
+// that were canceled aren't cached. It is safe for concurrent use.
+type IdempotencyCache struct {
+	opts IdempotencyCacheOpts
+
+	sync.Mutex
+	// inflight has the keys of the calls being served, so that retries
+	// wait for them.
+	inflight map[IdempotencyKey]chan struct{}
+}
+
+// NewIdempotencyCache makes an IdempotencyCache with an in-memory store.
+func NewIdempotencyCache() *IdempotencyCache {
+	return NewIdempotencyCacheWithOpts(IdempotencyCacheOpts{})
+}
+
+// NewIdempotencyCacheWithOpts is like NewIdempotencyCache, but takes
+// additional optional parameters.
+func NewIdempotencyCacheWithOpts(opts IdempotencyCacheOpts) *IdempotencyCache {
+	if opts.Store == nil {
+		opts.Store = NewMemoryIdempotencyStore(0)
+	}
+	if opts.TTL <= 0 {
+		opts.TTL = defaultIdempotencyTTL
+	}
+	return &IdempotencyCache{
+		opts:     opts,
+		inflight: make(map[IdempotencyKey]chan struct{}),
+	}
+}
+
+// peerHost returns the host of addr, which is the default peer identity.
+func peerHost(addr net.Addr) string {
+	if addr == nil {
+		return ""
+	}
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return addr.String()
+	}
+	return host
+}
+
+// begin waits for any call being served with key to finish, and marks key as
+// being served. It returns the function to call once the call is served.
+func (c *IdempotencyCache) begin(ctx context.Context, key IdempotencyKey) (func(), error) {
+	c.Lock()
+	defer c.Unlock()
+	for {
+		ch, ok := c.inflight[key]
+		if !ok {
+			break
+		}
+		c.Unlock()
+		select {
+		case <-ch:
+		case <-ctx.Done():
+			c.Lock()
+			return nil, ctx.Err()
+		}
+		c.Lock()
+	}
+	ch := make(chan struct{})
+	c.inflight[key] = ch
+	return func() {
+		c.Lock()
+		defer c.Unlock()
+		delete(c.inflight, key)
+		close(ch)
+	}, nil
+}
+
+// idempotencyKey returns the idempotency key of req, if it's a call that has
+// one, and the replies are cached.
+func (r *receiveHandler) idempotencyKey(req request) (IdempotencyKey, bool) {
+	if r.idempotency == nil {
+		return IdempotencyKey{}, false
+	}
+	var headers map[string]string
+	switch req := req.(type) {
+	case *callRequest:
+		headers = req.headers
+	case *callCompressedRequest:
+		headers = req.headers
+	default:
+		return IdempotencyKey{}, false
+	}
+	key, ok := headers[idempotencyHeader]
+	if !ok || key == "" {
+		return IdempotencyKey{}, false
+	}
+	ret := IdempotencyKey{Peer: r.peer, Key: key}
+	if f := r.idempotency.opts.PeerIdentity; f != nil {
+		ret.Peer = f(req.serveContext())
+	}
+	return ret, true
+}
+
+// serveIdempotent serves req, whose idempotency key is key, or replays the
+// cached reply to it.
+func (r *receiveHandler) serveIdempotent(req request, key IdempotencyKey, serveHandler *ServeHandlerDescription,
+	wrapErrorFunc WrapErrorFunc) {
+	c := r.idempotency
+	ctx := req.serveContext()
+	end, err := c.begin(ctx, key)
+	if err != nil {
+		req.LogInvocation(err)
+		req.setFailed(err)
+		_ = req.Reply(r.writer, nil, wrapError(wrapErrorFunc, err))
+		return
+	}
+	defer end()
+
+	reply, found, err := c.opts.Store.Get(ctx, key)
+	if err != nil {
+		r.log.Warnw("idempotency store error", LogField{"seqno", req.SeqNo()}, LogField{"err", err})
+	}
+	if found {
+		errArg, res, err := r.decodeIdempotentReply(reply)
+		if err == nil {
+			r.log.Infow("replaying cached reply", LogField{"seqno", req.SeqNo()}, LogField{"method", req.Name().String()})
+			if err := req.Reply(r.writer, res, errArg); err != nil {
+				r.log.Infow("unable to reply", LogField{"err", err})
+			}
+			return
+		}
+		r.log.Warnw("bad cached reply", LogField{"seqno", req.SeqNo()}, LogField{"err", err})
+	}
+
+	var res interface{}
+	var handlerErr error
+	h := *serveHandler
+	h.Handler = func(ctx context.Context, arg interface{}) (interface{}, error) {
+		res, handlerErr = serveHandler.Handler(ctx, arg)
+		return res, handlerErr
+	}
+	req.Serve(r.writer, &h, wrapErrorFunc)
+	// A call that gave up because it was canceled might not have been
+	// done, so its retry has to be served, and so does that of one that
+	// was refused, e.g. by a draining server that the handler called. One
+	// that completed is cached even if its transport is gone by now, which
+	// is when it's retried.
+	if errors.Is(handlerErr, context.Canceled) || errors.Is(handlerErr, context.DeadlineExceeded) ||
+		isRefusal(handlerErr) {
+		return
+	}
+	reply = IdempotentReply{Codec: r.writer.ct}
+	if reply.Err, err = encodeToBytes(r.writer.handle, wrapError(wrapErrorFunc, handlerErr)); err == nil {
+		reply.Res, err = encodeToBytes(r.writer.handle, res)
+	}
+	if err == nil {
+		err = c.opts.Store.Put(context.WithoutCancel(ctx), key, reply, c.opts.TTL)
+	}
+	if err != nil {
+		r.log.Warnw("unable to cache reply", LogField{"seqno", req.SeqNo()}, LogField{"err", err})
+	}
+}
+
+// decodeIdempotentReply returns the error and result of reply, ready to be
+// encoded again. If reply was encoded with the codec of this transport, they
+// are written as they are.
+func (r *receiveHandler) decodeIdempotentReply(reply IdempotentReply) (errArg, res interface{}, err error) {
+	if reply.Codec == r.writer.ct {
+		return codec.Raw(reply.Err), codec.Raw(reply.Res), nil
+	}
+	if !reply.Codec.valid() {
+		return nil, nil, NewTypeError(CodecMsgpack, reply.Codec)
+	}
+	h := reply.Codec.wireCodec().newHandle()
+	if err := codec.NewDecoderBytes(reply.Err, h).Decode(&errArg); err != nil {
+		return nil, nil, err
+	}
+	if err := codec.NewDecoderBytes(reply.Res, h).Decode(&res); err != nil {
+		return nil, nil, err
+	}
+	return errArg, res, nil
+}
+
+func encodeToBytes(h codec.Handle, v interface{}) ([]byte, error) {
+	var ret []byte
+	err := codec.NewEncoderBytes(&ret, h).Encode(v)
+	return ret, err
+}
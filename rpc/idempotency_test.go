@@ -0,0 +1,323 @@
+package rpc
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+var shout = newMethodV1("idem.shout")
+
+type idempotencyTestServer struct {
+	sync.Mutex
+	calls int
+}
+
+func (s *idempotencyTestServer) handle(_ context.Context, arg interface{}) (interface{}, error) {
+	s.Lock()
+	defer s.Unlock()
+	s.calls++
+	if *arg.(*string) == "fail" {
+		return nil, errors.New("failed")
+	}
+	return *arg.(*string) + "!", nil
+}
+
+func (s *idempotencyTestServer) numCalls() int {
+	s.Lock()
+	defer s.Unlock()
+	return s.calls
+}
+
+func (s *idempotencyTestServer) serve(t *testing.T, conn net.Conn, c *IdempotencyCache, ct CodecType) Transporter {
+	sxp := NewTransportWithOpts(context.Background(), conn, nil, nil, nil, testMaxFrameLength, TransportOpts{
+		Codec:       ct,
+		Idempotency: c,
+	})
+	srv := NewServer(sxp, nil)
+	require.NoError(t, srv.Register(Protocol{
+		Name: "idem",
+		Methods: map[string]ServeHandlerDescription{
+			"shout": {
+				MakeArg: func() interface{} { return new(string) },
+				Handler: s.handle,
+			},
+		},
+	}))
+	srv.Run()
+	return sxp
+}
+
+// dial makes a new transport to a server that uses c.
+func (s *idempotencyTestServer) dial(t *testing.T, c *IdempotencyCache, ct CodecType) GenericClient {
+	clientConn, serverConn := net.Pipe()
+	sxp := s.serve(t, serverConn, c, ct)
+	t.Cleanup(sxp.Close)
+	xp := NewTransportWithOpts(context.Background(), clientConn, nil, nil, nil, testMaxFrameLength, TransportOpts{Codec: ct})
+	t.Cleanup(xp.Close)
+	return NewClient(xp, nil, nil)
+}
+
+func TestIdempotencyReplay(t *testing.T) {
+	doWithAllCodecs(t, func(t *testing.T, ct CodecType) {
+		s := &idempotencyTestServer{}
+		c := NewIdempotencyCache()
+		ctx := WithIdempotencyKey(context.Background(), "k1")
+
+		// The retry of a call comes in on a new transport, and gets the
+		// reply of the first one.
+		var res string
+		require.NoError(t, s.dial(t, c, ct).Call(ctx, shout, "hi", &res, 0))
+		require.Equal(t, "hi!", res)
+		res = ""
+		require.NoError(t, s.dial(t, c, ct).Call(ctx, shout, "hi", &res, 0))
+		require.Equal(t, "hi!", res)
+		require.Equal(t, 1, s.numCalls())
+
+		// Errors are replayed too.
+		ctx = WithIdempotencyKey(context.Background(), "k2")
+		cli := s.dial(t, c, ct)
+		require.EqualError(t, cli.Call(ctx, shout, "fail", &res, 0), "failed")
+		require.EqualError(t, cli.Call(ctx, shout, "fail", &res, 0), "failed")
+		require.Equal(t, 2, s.numCalls())
+
+		// Calls without a key, or with another, are served.
+		require.NoError(t, cli.Call(context.Background(), shout, "hi", &res, 0))
+		require.NoError(t, cli.Call(WithIdempotencyKey(context.Background(), "k3"), shout, "hi", &res, 0))
+		require.Equal(t, 4, s.numCalls())
+	})
+}
+
+func TestIdempotencyReplayOtherCodec(t *testing.T) {
+	s := &idempotencyTestServer{}
+	c := NewIdempotencyCache()
+	ctx := WithIdempotencyKey(context.Background(), "k")
+
+	var res string
+	require.NoError(t, s.dial(t, c, CodecMsgpack).Call(ctx, shout, "hi", &res, 0))
+	res = ""
+	require.NoError(t, s.dial(t, c, CodecJSON).Call(ctx, shout, "hi", &res, 0))
+	require.Equal(t, "hi!", res)
+	require.Equal(t, 1, s.numCalls())
+}
+
+func TestIdempotencyReplayAfterDrop(t *testing.T) {
+	s := &idempotencyTestServer{}
+	entered := make(chan struct{})
+	clientConn, serverConn := net.Pipe()
+	c := NewIdempotencyCache()
+	// The handler applies the call, but the connection drops before it
+	// replies.
+	sxp := NewTransportWithOpts(context.Background(), serverConn, nil, nil, nil, testMaxFrameLength, TransportOpts{
+		Idempotency: c,
+	})
+	defer sxp.Close()
+	srv := NewServer(sxp, nil)
+	require.NoError(t, srv.Register(Protocol{
+		Name: "idem",
+		Methods: map[string]ServeHandlerDescription{
+			"shout": {
+				MakeArg: func() interface{} { return new(string) },
+				Handler: func(ctx context.Context, arg interface{}) (interface{}, error) {
+					res, err := s.handle(ctx, arg)
+					close(entered)
+					<-ctx.Done()
+					return res, err
+				},
+			},
+		},
+	}))
+	srv.Run()
+	xp := NewTransport(context.Background(), clientConn, nil, nil, nil, testMaxFrameLength)
+	defer xp.Close()
+
+	ctx := WithIdempotencyKey(context.Background(), "k")
+	errCh := make(chan error, 1)
+	go func() {
+		var res string
+		errCh <- NewClient(xp, nil, nil).Call(ctx, shout, "hi", &res, 0)
+	}()
+	<-entered
+	xp.Close()
+	require.Error(t, <-errCh)
+
+	// The retry gets the reply that was never sent.
+	var res string
+	require.NoError(t, s.dial(t, c, CodecMsgpack).Call(ctx, shout, "hi", &res, 0))
+	require.Equal(t, "hi!", res)
+	require.Equal(t, 1, s.numCalls())
+}
+
+func TestIdempotencyPeerIdentity(t *testing.T) {
+	s := &idempotencyTestServer{}
+	var peer string
+	c := NewIdempotencyCacheWithOpts(IdempotencyCacheOpts{
+		PeerIdentity: func(context.Context) string { return peer },
+	})
+	ctx := WithIdempotencyKey(context.Background(), "k")
+
+	var res string
+	peer = "alice"
+	require.NoError(t, s.dial(t, c, CodecMsgpack).Call(ctx, shout, "hi", &res, 0))
+	peer = "bob"
+	require.NoError(t, s.dial(t, c, CodecMsgpack).Call(ctx, shout, "hi", &res, 0))
+	require.Equal(t, 2, s.numCalls())
+}
+
+func TestIdempotencyConnectionKeys(t *testing.T) {
+	s := &idempotencyTestServer{}
+	store := NewMemoryIdempotencyStore(0)
+	c := NewIdempotencyCacheWithOpts(IdempotencyCacheOpts{Store: store})
+	ct := &pipeConnectionTransport{serve: func(conn net.Conn) Transporter {
+		return s.serve(t, conn, c, CodecMsgpack)
+	}}
+	conn := NewConnectionWithTransport(testConnectionHandler{}, ct, nil, &testLogOutput{t: t}, ConnectionOpts{})
+	defer conn.Shutdown()
+
+	// Each call of the client gets a key of its own.
+	cli := conn.GetClient()
+	var res string
+	require.NoError(t, cli.Call(context.Background(), shout, "a", &res, 0))
+	require.NoError(t, cli.Call(context.Background(), shout, "a", &res, 0))
+	require.Equal(t, 2, s.numCalls())
+	// The reply is cached right after it's sent.
+	require.Eventually(t, func() bool { return store.Len() == 2 }, 5*time.Second, time.Millisecond)
+
+	// Unless the caller gives one.
+	ctx := WithIdempotencyKey(context.Background(), "mine")
+	require.NoError(t, cli.Call(ctx, shout, "b", &res, 0))
+	require.NoError(t, cli.Call(ctx, shout, "b", &res, 0))
+	require.Equal(t, 3, s.numCalls())
+	_, found, err := store.Get(context.Background(), IdempotencyKey{Peer: "pipe", Key: "mine"})
+	require.NoError(t, err)
+	require.True(t, found)
+	require.Equal(t, 3, store.Len())
+}
+
+func TestMemoryIdempotencyStore(t *testing.T) {
+	ctx := context.Background()
+	s := NewMemoryIdempotencyStore(2)
+	key := func(k string) IdempotencyKey { return IdempotencyKey{Peer: "p", Key: k} }
+	reply := IdempotentReply{Res: []byte{1}}
+
+	require.NoError(t, s.Put(ctx, key("a"), reply, time.Hour))
+	require.NoError(t, s.Put(ctx, key("b"), reply, time.Hour))
+	_, found, err := s.Get(ctx, key("a"))
+	require.NoError(t, err)
+	require.True(t, found)
+
+	// The least recently used reply is dropped to make room.
+	require.NoError(t, s.Put(ctx, key("c"), reply, time.Hour))
+	require.Equal(t, 2, s.Len())
+	_, found, _ = s.Get(ctx, key("b"))
+	require.False(t, found)
+	got, found, _ := s.Get(ctx, key("a"))
+	require.True(t, found)
+	require.Equal(t, reply, got)
+
+	// Expired replies are gone.
+	require.NoError(t, s.Put(ctx, key("d"), reply, time.Millisecond))
+	time.Sleep(5 * time.Millisecond)
+	_, found, _ = s.Get(ctx, key("d"))
+	require.False(t, found)
+	require.Equal(t, 1, s.Len())
+}
+
+func TestIdempotencyDrain(t *testing.T) {
+	s := &idempotencyTestServer{}
+	store := NewMemoryIdempotencyStore(0)
+	held := make(chan struct{})
+	release := make(chan struct{})
+	clientConn, serverConn := net.Pipe()
+	sxp := NewTransportWithOpts(context.Background(), serverConn, nil, nil, nil, testMaxFrameLength, TransportOpts{
+		Idempotency: NewIdempotencyCacheWithOpts(IdempotencyCacheOpts{Store: store}),
+		Handshake:   &HandshakeConfig{},
+	})
+	defer sxp.Close()
+	srv := NewServer(sxp, nil)
+	require.NoError(t, srv.Register(Protocol{
+		Name: "idem",
+		Methods: map[string]ServeHandlerDescription{
+			"shout": {
+				MakeArg: func() interface{} { return new(string) },
+				Handler: s.handle,
+			},
+			"hold": {
+				MakeArg: func() interface{} { return new(string) },
+				Handler: func(context.Context, interface{}) (interface{}, error) {
+					close(held)
+					<-release
+					return nil, nil
+				},
+			},
+		},
+	}))
+	srv.Run()
+	xp := NewTransportWithOpts(context.Background(), clientConn, nil, nil, nil, testMaxFrameLength, TransportOpts{
+		Handshake: &HandshakeConfig{},
+	})
+	defer xp.Close()
+	cli := NewClient(xp, nil, nil)
+
+	// A held call keeps the server draining, and refusing calls.
+	holdErrCh := make(chan error, 1)
+	go func() {
+		holdErrCh <- cli.Call(context.Background(), newMethodV1("idem.hold"), "", nil, 0)
+	}()
+	<-held
+	drainErrCh := make(chan error, 1)
+	go func() { drainErrCh <- sxp.Drain(context.Background()) }()
+	<-xp.goingAway()
+	ctx := WithIdempotencyKey(context.Background(), "k")
+	var res string
+	require.Equal(t, DrainingError{}, cli.Call(ctx, shout, "hi", &res, 0))
+	close(release)
+	require.NoError(t, <-holdErrCh)
+	require.NoError(t, <-drainErrCh)
+
+	// The retry, on a server that shares the store, is served rather than
+	// refused again.
+	c := NewIdempotencyCacheWithOpts(IdempotencyCacheOpts{Store: store})
+	require.NoError(t, s.dial(t, c, CodecMsgpack).Call(ctx, shout, "hi", &res, 0))
+	require.Equal(t, "hi!", res)
+	require.Equal(t, 1, s.numCalls())
+
+	// Nor are the refusals of the servers that a handler calls cached.
+	var refused bool
+	h := &idempotencyTestServer{}
+	c = NewIdempotencyCache()
+	clientConn, serverConn = net.Pipe()
+	sxp2 := NewTransportWithOpts(context.Background(), serverConn, nil, nil, nil, testMaxFrameLength, TransportOpts{
+		Idempotency: c,
+	})
+	defer sxp2.Close()
+	srv = NewServer(sxp2, nil)
+	require.NoError(t, srv.Register(Protocol{
+		Name: "idem",
+		Methods: map[string]ServeHandlerDescription{
+			"shout": {
+				MakeArg: func() interface{} { return new(string) },
+				Handler: func(ctx context.Context, arg interface{}) (interface{}, error) {
+					if !refused {
+						refused = true
+						return nil, newResourceExhaustedError("calls", "backend.shout")
+					}
+					return h.handle(ctx, arg)
+				},
+			},
+		},
+	}))
+	srv.Run()
+	xp2 := NewTransport(context.Background(), clientConn, nil, nil, nil, testMaxFrameLength)
+	defer xp2.Close()
+	cli = NewClient(xp2, nil, nil)
+	ctx = WithIdempotencyKey(context.Background(), "k2")
+	require.Error(t, cli.Call(ctx, shout, "hi", &res, 0))
+	require.NoError(t, cli.Call(ctx, shout, "hi", &res, 0))
+	require.Equal(t, "hi!", res)
+}
@@ -4,6 +4,7 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"strings"
 	"sync"
 	"time"
 )
@@ -12,6 +13,31 @@ type NetworkInstrumenterStorage interface {
 	Put(ctx context.Context, tag string, record InstrumentationRecord) error
 }
 
+// LiveInstrumenterStorage is a NetworkInstrumenterStorage that also wants to
+// know when records start, and when transports come and go, so that it can
+// keep track of what's in flight. Its tags tell V2 methods apart, with their
+// own method types and their names, where other storages keep getting the
+// V1 method types and empty names that they always have for V2 methods.
+type LiveInstrumenterStorage interface {
+	NetworkInstrumenterStorage
+	// Begin is called when a record with the given tag is started. It's
+	// followed by a Put with the same tag once the record is finished.
+	Begin(tag string)
+	// TransportOpened is called when a transport using the storage is
+	// created.
+	TransportOpened()
+	// TransportClosed is called when a transport using the storage is
+	// closed.
+	TransportClosed()
+}
+
+// SplitInstrumentTag splits a tag made by InstrumentTag back into the
+// method type and the method name.
+func SplitInstrumentTag(tag string) (methodType string, method string) {
+	methodType, method, _ = strings.Cut(tag, " ")
+	return methodType, method
+}
+
 func InstrumentTag(methodType MethodType, method string) string {
 	return fmt.Sprintf("%s %s", methodType, method)
 }
@@ -19,7 +45,23 @@ func InstrumentTag(methodType MethodType, method string) string {
 type InstrumentationRecord struct {
 	Ctime time.Time
 	Dur   time.Duration
-	Size  int64
+	// Size is the total number of bytes sent and received.
+	Size int64
+	// SentBytes and ReceivedBytes split Size by direction. They're the
+	// sizes of the frames on the wire.
+	SentBytes     int64
+	ReceivedBytes int64
+	// CompressedBytes and UncompressedBytes are the sizes of the
+	// compressed payloads of a compressed call, in both directions, after
+	// and before compression respectively. They're zero for other calls.
+	CompressedBytes   int64
+	UncompressedBytes int64
+	// TTFB is the time to first byte: for outgoing calls, how long it took
+	// for the reply to start arriving, and for incoming ones, how long it
+	// took to start sending the reply. It's zero for notifies and cancels.
+	TTFB time.Duration
+	// Failed is set if the call or notify returned an error.
+	Failed bool
 }
 
 type DummyInstrumentationStorage struct{}
@@ -65,6 +107,16 @@ type NetworkInstrumenter struct {
 // NewNetworkInstrumenter records network usage of a single call.
 // Not safe for concurrent use.
 func NewNetworkInstrumenter(storage NetworkInstrumenterStorage, tag string) *NetworkInstrumenter {
+	return newNetworkInstrumenter(storage, tag, tag)
+}
+
+// newNetworkInstrumenter is like NewNetworkInstrumenter, but records under
+// liveTag instead if storage is a LiveInstrumenterStorage.
+func newNetworkInstrumenter(storage NetworkInstrumenterStorage, tag, liveTag string) *NetworkInstrumenter {
+	if ls, ok := storage.(LiveInstrumenterStorage); ok {
+		tag = liveTag
+		ls.Begin(tag)
+	}
 	return &NetworkInstrumenter{
 		InstrumentationRecord: &InstrumentationRecord{
 			Ctime: time.Now(),
@@ -78,20 +130,76 @@ func (r *NetworkInstrumenter) String() string {
 	if r == nil {
 		return "<NetworkInstrumenter(nil)>"
 	}
-	return fmt.Sprintf("Tag: %s, Ctime: %v, Dur: %v, Size: %d, finished: %v", r.tag, r.Ctime, r.Dur, r.Size, r.finished)
+	return fmt.Sprintf("Tag: %s, Ctime: %v, Dur: %v, Size: %d, Sent: %d, Received: %d, finished: %v",
+		r.tag, r.Ctime, r.Dur, r.Size, r.SentBytes, r.ReceivedBytes, r.finished)
 }
 
-func (r *NetworkInstrumenter) IncrementSize(size int64) {
+// update applies f to the record, if there's one.
+func (r *NetworkInstrumenter) update(f func(*InstrumentationRecord)) {
 	if r == nil {
 		return
 	}
 	r.Lock()
 	defer r.Unlock()
 	if r.InstrumentationRecord != nil {
-		r.Size += size
+		f(r.InstrumentationRecord)
 	}
 }
 
+// IncrementSize adds to the total size, without saying in which direction
+// the bytes went.
+func (r *NetworkInstrumenter) IncrementSize(size int64) {
+	r.update(func(rec *InstrumentationRecord) { rec.Size += size })
+}
+
+// IncrementSent records size bytes sent.
+func (r *NetworkInstrumenter) IncrementSent(size int64) {
+	r.update(func(rec *InstrumentationRecord) {
+		rec.Size += size
+		rec.SentBytes += size
+	})
+}
+
+// IncrementReceived records size bytes received.
+func (r *NetworkInstrumenter) IncrementReceived(size int64) {
+	r.update(func(rec *InstrumentationRecord) {
+		rec.Size += size
+		rec.ReceivedBytes += size
+	})
+}
+
+// addCompression records a payload that was compressed from uncompressed
+// bytes down to compressed bytes, or decompressed the other way around.
+func (r *NetworkInstrumenter) addCompression(compressed, uncompressed int) {
+	r.update(func(rec *InstrumentationRecord) {
+		rec.CompressedBytes += int64(compressed)
+		rec.UncompressedBytes += int64(uncompressed)
+	})
+}
+
+// markFirstByte sets the time to first byte, unless it's already set.
+func (r *NetworkInstrumenter) markFirstByte(t time.Time) {
+	r.update(func(rec *InstrumentationRecord) {
+		if rec.TTFB == 0 {
+			rec.TTFB = t.Sub(rec.Ctime)
+		}
+	})
+}
+
+// setFailed marks the record as failed if err is non-nil.
+func (r *NetworkInstrumenter) setFailed(err error) {
+	if err == nil {
+		return
+	}
+	r.update(func(rec *InstrumentationRecord) { rec.Failed = true })
+}
+
+// received returns the number of bytes received so far.
+func (r *NetworkInstrumenter) received() (ret int64) {
+	r.update(func(rec *InstrumentationRecord) { ret = rec.ReceivedBytes })
+	return ret
+}
+
 func (r *NetworkInstrumenter) EndCall() {
 	if r == nil {
 		return
@@ -103,11 +211,13 @@ func (r *NetworkInstrumenter) EndCall() {
 	}
 }
 
+// RecordAndFinish records size bytes sent, and the end of the call, and
+// then finishes the record.
 func (r *NetworkInstrumenter) RecordAndFinish(ctx context.Context, size int64) error {
 	if r == nil {
 		return nil
 	}
-	r.IncrementSize(size)
+	r.IncrementSent(size)
 	r.EndCall()
 	return r.Finish(ctx)
 }
@@ -0,0 +1,332 @@
+package rpc
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"time"
+)
+
+// AggregateInstrumentationOpts configures an AggregateInstrumentationStorage.
+// The zero value is fine.
+type AggregateInstrumentationOpts struct {
+	// Windows are the time windows that aggregates are reported over, on
+	// top of the total since the last reset. Defaults to 1, 5 and 15
+	// minutes.
+	Windows []time.Duration
+	// Resolution is the granularity of the windows: records are
+	// aggregated into slots of this length, and windows start at a slot
+	// boundary. Defaults to a sixth of the smallest window.
+	Resolution time.Duration
+	// MaxTags bounds the number of tags that are tracked separately.
+	// Records for tags beyond the limit are aggregated under
+	// AggregateOverflowTag. Defaults to 1024.
+	MaxTags int
+}
+
+// AggregateOverflowTag is the tag that records are aggregated under once an
+// AggregateInstrumentationStorage has reached its MaxTags.
+const AggregateOverflowTag = "(other)"
+
+const defaultAggregateMaxTags = 1024
+
+var defaultAggregateWindows = []time.Duration{time.Minute, 5 * time.Minute, 15 * time.Minute}
+
+// aggregate accumulates records.
+type aggregate struct {
+	count        uint64
+	errors       uint64
+	bytes        int64
+	sent         int64
+	received     int64
+	compressed   int64
+	uncompressed int64
+	dur          quantileSketch
+	ttfb         quantileSketch
+	maxDur       time.Duration
+}
+
+func (a *aggregate) add(record InstrumentationRecord) {
+	a.count++
+	if record.Failed {
+		a.errors++
+	}
+	a.bytes += record.Size
+	a.sent += record.SentBytes
+	a.received += record.ReceivedBytes
+	a.compressed += record.CompressedBytes
+	a.uncompressed += record.UncompressedBytes
+	a.dur.add(float64(record.Dur))
+	if record.TTFB > 0 {
+		a.ttfb.add(float64(record.TTFB))
+	}
+	if record.Dur > a.maxDur {
+		a.maxDur = record.Dur
+	}
+}
+
+func (a *aggregate) merge(o *aggregate) {
+	a.count += o.count
+	a.errors += o.errors
+	a.bytes += o.bytes
+	a.sent += o.sent
+	a.received += o.received
+	a.compressed += o.compressed
+	a.uncompressed += o.uncompressed
+	a.dur.merge(&o.dur)
+	a.ttfb.merge(&o.ttfb)
+	if o.maxDur > a.maxDur {
+		a.maxDur = o.maxDur
+	}
+}
+
+func (a *aggregate) stats(window time.Duration) InstrumentationStats {
+	q := a.dur.quantiles(0.5, 0.9, 0.99)
+	tq := a.ttfb.quantiles(0.5, 0.99)
+	return InstrumentationStats{
+		Window:            window,
+		Count:             a.count,
+		Errors:            a.errors,
+		Bytes:             a.bytes,
+		SentBytes:         a.sent,
+		ReceivedBytes:     a.received,
+		CompressedBytes:   a.compressed,
+		UncompressedBytes: a.uncompressed,
+		P50:               time.Duration(q[0]),
+		P90:               time.Duration(q[1]),
+		P99:               time.Duration(q[2]),
+		Max:               a.maxDur,
+		TTFBP50:           time.Duration(tq[0]),
+		TTFBP99:           time.Duration(tq[1]),
+	}
+}
+
+// aggregateSlot holds the records of one slot of time.
+type aggregateSlot struct {
+	// epoch is the start of the slot, in units of the resolution.
+	epoch int64
+	aggregate
+}
+
+// tagAggregates are all of the aggregates of a single tag: the total, and
+// a ring of slots covering the largest window.
+type tagAggregates struct {
+	total aggregate
+	slots []aggregateSlot
+}
+
+// InstrumentationStats are the aggregates of the records of a tag over a
+// window of time. Durations are estimated to within 1%.
+type InstrumentationStats struct {
+	// Window is zero for the total since the last reset.
+	Window time.Duration
+	Count  uint64
+	Errors uint64
+	// Bytes is SentBytes plus ReceivedBytes.
+	Bytes         int64
+	SentBytes     int64
+	ReceivedBytes int64
+	// CompressedBytes and UncompressedBytes are only counted for
+	// compressed calls. See InstrumentationRecord.
+	CompressedBytes   int64
+	UncompressedBytes int64
+	P50               time.Duration
+	P90               time.Duration
+	P99               time.Duration
+	Max               time.Duration
+	// TTFBP50 and TTFBP99 are quantiles of the time to first byte, over
+	// the records that have one.
+	TTFBP50 time.Duration
+	TTFBP99 time.Duration
+}
+
+// InstrumentationReportEntry is the report of a single tag.
+type InstrumentationReportEntry struct {
+	Tag string
+	// MethodType and Method are split out of Tag.
+	MethodType string
+	Method     string
+	// Total is over everything since the last reset.
+	Total InstrumentationStats
+	// Windows follow the order of AggregateInstrumentationOpts.Windows.
+	Windows []InstrumentationStats
+}
+
+// InstrumentationReport is a snapshot of an AggregateInstrumentationStorage.
+type InstrumentationReport struct {
+	Time time.Time
+	// Since is the time of the last reset, or of the creation of the
+	// storage.
+	Since time.Time
+	// Entries are sorted by total bytes, largest first, and then by tag.
+	Entries []InstrumentationReportEntry
+}
+
+// AggregateInstrumentationStorage keeps rolling aggregates of records per
+// tag, rather than the records themselves, so its memory use is bounded.
+// Use Snapshot to read them. It is safe for concurrent use.
+type AggregateInstrumentationStorage struct {
+	sync.Mutex
+	windows    []time.Duration
+	resolution time.Duration
+	maxTags    int
+	clock      func() time.Time
+
+	since time.Time
+	tags  map[string]*tagAggregates
+}
+
+var _ NetworkInstrumenterStorage = (*AggregateInstrumentationStorage)(nil)
+
+func NewAggregateInstrumentationStorage() *AggregateInstrumentationStorage {
+	return NewAggregateInstrumentationStorageWithOpts(AggregateInstrumentationOpts{})
+}
+
+func NewAggregateInstrumentationStorageWithOpts(opts AggregateInstrumentationOpts) *AggregateInstrumentationStorage {
+	windows := append([]time.Duration(nil), opts.Windows...)
+	if len(windows) == 0 {
+		windows = append(windows, defaultAggregateWindows...)
+	}
+	smallest, largest := windows[0], windows[0]
+	for _, w := range windows {
+		if w < smallest {
+			smallest = w
+		}
+		if w > largest {
+			largest = w
+		}
+	}
+	resolution := opts.Resolution
+	if resolution <= 0 {
+		resolution = smallest / 6
+	}
+	if resolution <= 0 {
+		resolution = time.Second
+	}
+	maxTags := opts.MaxTags
+	if maxTags <= 0 {
+		maxTags = defaultAggregateMaxTags
+	}
+	ret := &AggregateInstrumentationStorage{
+		windows:    windows,
+		resolution: resolution,
+		maxTags:    maxTags,
+		clock:      time.Now,
+		tags:       make(map[string]*tagAggregates),
+	}
+	ret.since = ret.clock()
+	return ret
+}
+
+// numSlots is enough slots to cover the largest window, plus the current,
+// partial one.
+func (s *AggregateInstrumentationStorage) numSlots() int {
+	var largest time.Duration
+	for _, w := range s.windows {
+		if w > largest {
+			largest = w
+		}
+	}
+	return int((largest+s.resolution-1)/s.resolution) + 1
+}
+
+func (s *AggregateInstrumentationStorage) epoch(t time.Time) int64 {
+	return t.UnixNano() / int64(s.resolution)
+}
+
+func (s *AggregateInstrumentationStorage) Put(_ context.Context, tag string, record InstrumentationRecord) error {
+	s.Lock()
+	defer s.Unlock()
+
+	agg, found := s.tags[tag]
+	if !found {
+		if len(s.tags) >= s.maxTags {
+			tag = AggregateOverflowTag
+			agg = s.tags[tag]
+		}
+		if agg == nil {
+			agg = &tagAggregates{slots: make([]aggregateSlot, s.numSlots())}
+			s.tags[tag] = agg
+		}
+	}
+
+	agg.total.add(record)
+	epoch := s.epoch(s.clock())
+	slot := &agg.slots[epoch%int64(len(agg.slots))]
+	if slot.epoch != epoch {
+		*slot = aggregateSlot{epoch: epoch}
+	}
+	slot.add(record)
+	return nil
+}
+
+// Snapshot returns the current aggregates of every tag.
+func (s *AggregateInstrumentationStorage) Snapshot() InstrumentationReport {
+	s.Lock()
+	defer s.Unlock()
+	return s.snapshotLocked()
+}
+
+// SnapshotAndReset returns the current aggregates, like Snapshot, and
+// resets them atomically, so that no record is missed or counted twice.
+func (s *AggregateInstrumentationStorage) SnapshotAndReset() InstrumentationReport {
+	s.Lock()
+	defer s.Unlock()
+	ret := s.snapshotLocked()
+	s.resetLocked(ret.Time)
+	return ret
+}
+
+// Reset drops all of the aggregates.
+func (s *AggregateInstrumentationStorage) Reset() {
+	s.Lock()
+	defer s.Unlock()
+	s.resetLocked(s.clock())
+}
+
+func (s *AggregateInstrumentationStorage) resetLocked(now time.Time) {
+	s.tags = make(map[string]*tagAggregates)
+	s.since = now
+}
+
+func (s *AggregateInstrumentationStorage) snapshotLocked() InstrumentationReport {
+	now := s.clock()
+	epoch := s.epoch(now)
+	ret := InstrumentationReport{
+		Time:    now,
+		Since:   s.since,
+		Entries: make([]InstrumentationReportEntry, 0, len(s.tags)),
+	}
+	for tag, agg := range s.tags {
+		methodType, method := SplitInstrumentTag(tag)
+		entry := InstrumentationReportEntry{
+			Tag:        tag,
+			MethodType: methodType,
+			Method:     method,
+			Total:      agg.total.stats(0),
+			Windows:    make([]InstrumentationStats, 0, len(s.windows)),
+		}
+		for _, w := range s.windows {
+			// The window covers the current slot, and as many of
+			// the previous ones as it takes to cover w.
+			oldest := epoch - int64((w+s.resolution-1)/s.resolution) + 1
+			var sum aggregate
+			for i := range agg.slots {
+				slot := &agg.slots[i]
+				if slot.epoch >= oldest && slot.epoch <= epoch {
+					sum.merge(&slot.aggregate)
+				}
+			}
+			entry.Windows = append(entry.Windows, sum.stats(w))
+		}
+		ret.Entries = append(ret.Entries, entry)
+	}
+	sort.Slice(ret.Entries, func(i, j int) bool {
+		a, b := ret.Entries[i], ret.Entries[j]
+		if a.Total.Bytes != b.Total.Bytes {
+			return a.Total.Bytes > b.Total.Bytes
+		}
+		return a.Tag < b.Tag
+	})
+	return ret
+}
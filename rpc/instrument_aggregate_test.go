@@ -0,0 +1,109 @@
+package rpc
+
+import (
+	"context"
+	"math/rand"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestQuantileSketch(t *testing.T) {
+	var s quantileSketch
+	require.Equal(t, []float64{0, 0}, s.quantiles(0.5, 0.99))
+
+	rng := rand.New(rand.NewSource(1))
+	vals := make([]float64, 10000)
+	for i := range vals {
+		vals[i] = rng.ExpFloat64() * 1e6
+		s.add(vals[i])
+	}
+	sort.Float64s(vals)
+	qs := []float64{0.1, 0.5, 0.9, 0.99}
+	res := s.quantiles(qs...)
+	for i, q := range qs {
+		exact := vals[int(q*float64(len(vals)-1))]
+		require.InEpsilon(t, exact, res[i], 2*sketchRelativeAccuracy, "quantile %v", q)
+	}
+
+	var other quantileSketch
+	for i := 0; i < 10000; i++ {
+		other.add(0)
+	}
+	other.merge(&s)
+	require.Equal(t, uint64(20000), other.count)
+	res = other.quantiles(0.25, 0.75)
+	require.Equal(t, 0.0, res[0])
+	require.InEpsilon(t, vals[len(vals)/2], res[1], 2*sketchRelativeAccuracy)
+}
+
+func TestAggregateInstrumentationStorage(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	s := NewAggregateInstrumentationStorageWithOpts(AggregateInstrumentationOpts{
+		Windows:    []time.Duration{time.Minute, 10 * time.Minute},
+		Resolution: 10 * time.Second,
+		MaxTags:    3,
+	})
+	s.clock = func() time.Time { return now }
+	s.since = now
+	ctx := context.Background()
+
+	put := func(tag string, size int64, dur time.Duration, failed bool) {
+		require.NoError(t, s.Put(ctx, tag, InstrumentationRecord{Size: size, Dur: dur, Failed: failed}))
+	}
+	small := InstrumentTag(MethodCall, "a.small")
+	big := InstrumentTag(MethodCall, "a.big")
+	put(small, 10, time.Millisecond, false)
+	put(big, 1000, 100*time.Millisecond, true)
+
+	// Move past the one-minute window.
+	now = now.Add(5 * time.Minute)
+	put(small, 10, 3*time.Millisecond, false)
+	put(small, 10, 5*time.Millisecond, false)
+
+	rep := s.Snapshot()
+	require.Equal(t, now, rep.Time)
+	require.Len(t, rep.Entries, 2)
+
+	require.Equal(t, big, rep.Entries[0].Tag)
+	require.Equal(t, "Call", rep.Entries[0].MethodType)
+	require.Equal(t, "a.big", rep.Entries[0].Method)
+	require.Equal(t, uint64(1), rep.Entries[0].Total.Count)
+	require.Equal(t, uint64(1), rep.Entries[0].Total.Errors)
+	require.Equal(t, int64(1000), rep.Entries[0].Total.Bytes)
+	require.Equal(t, 100*time.Millisecond, rep.Entries[0].Total.Max)
+	require.Equal(t, InstrumentationStats{Window: time.Minute}, rep.Entries[0].Windows[0])
+	require.Equal(t, uint64(1), rep.Entries[0].Windows[1].Count)
+
+	require.Equal(t, small, rep.Entries[1].Tag)
+	require.Equal(t, uint64(3), rep.Entries[1].Total.Count)
+	require.Equal(t, int64(30), rep.Entries[1].Total.Bytes)
+	require.Equal(t, uint64(2), rep.Entries[1].Windows[0].Count)
+	require.Equal(t, int64(20), rep.Entries[1].Windows[0].Bytes)
+	require.InEpsilon(t, float64(5*time.Millisecond), float64(rep.Entries[1].Windows[0].P99), sketchRelativeAccuracy)
+	require.Equal(t, 5*time.Millisecond, rep.Entries[1].Windows[0].Max)
+
+	// Once the 10-minute window has passed, only the total remains.
+	now = now.Add(10 * time.Minute)
+	rep = s.Snapshot()
+	require.Equal(t, uint64(0), rep.Entries[1].Windows[1].Count)
+	require.Equal(t, uint64(3), rep.Entries[1].Total.Count)
+
+	// Tags beyond MaxTags are lumped together.
+	put(InstrumentTag(MethodNotify, "a.c"), 1, 0, false)
+	put(InstrumentTag(MethodNotify, "a.d"), 1, 0, false)
+	put(InstrumentTag(MethodNotify, "a.e"), 1, 0, false)
+	rep = s.SnapshotAndReset()
+	var tags []string
+	for _, e := range rep.Entries {
+		tags = append(tags, e.Tag)
+	}
+	require.Equal(t, []string{big, small, AggregateOverflowTag, InstrumentTag(MethodNotify, "a.c")}, tags)
+	require.Equal(t, uint64(2), rep.Entries[2].Total.Count)
+
+	rep = s.Snapshot()
+	require.Empty(t, rep.Entries)
+	require.Equal(t, now, rep.Since)
+}
@@ -0,0 +1,127 @@
+package rpc
+
+import (
+	"context"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestInstrumentationDirectionalSizes(t *testing.T) {
+	clientConn, serverConn := net.Pipe()
+	lf := NewSimpleLogFactory(&testLogOutput{t: t}, nil)
+	clientStorage := NewMemoryInstrumentationStorage()
+	serverStorage := NewMemoryInstrumentationStorage()
+	sxp := NewTransport(context.Background(), serverConn, lf, serverStorage, nil, testMaxFrameLength)
+	cxp := NewTransport(context.Background(), clientConn, lf, clientStorage, nil, testMaxFrameLength)
+	defer cxp.Close()
+	defer sxp.Close()
+
+	srv := NewServer(sxp, nil)
+	require.NoError(t, srv.Register(Protocol{
+		Name: "echo",
+		Methods: map[string]ServeHandlerDescription{
+			"echo": {
+				MakeArg: func() interface{} { return new(string) },
+				Handler: func(_ context.Context, arg interface{}) (interface{}, error) {
+					return *arg.(*string), nil
+				},
+			},
+		},
+	}))
+	srv.Run()
+
+	cli := NewClient(cxp, nil, nil)
+	ctx := context.Background()
+	arg := strings.Repeat("compressible ", 50)
+	var res string
+	require.NoError(t, cli.Call(ctx, newMethodV1("echo.echo"), arg, &res, 0))
+	require.NoError(t, cli.CallCompressed(ctx, newMethodV1("echo.echo"), arg, &res, CompressionGzip, 0))
+
+	getRecord := func(s *MemoryInstrumentationStorage, typ MethodType) InstrumentationRecord {
+		var ret []InstrumentationRecord
+		require.Eventually(t, func() bool {
+			s.Lock()
+			defer s.Unlock()
+			ret = s.storage[InstrumentTag(typ, "echo.echo")]
+			return len(ret) == 1
+		}, time.Second, time.Millisecond)
+		return ret[0]
+	}
+
+	for _, s := range []*MemoryInstrumentationStorage{clientStorage, serverStorage} {
+		plain := getRecord(s, MethodCall)
+		require.Greater(t, plain.SentBytes, int64(len(arg)))
+		require.Greater(t, plain.ReceivedBytes, int64(len(arg)))
+		require.Equal(t, plain.SentBytes+plain.ReceivedBytes, plain.Size)
+		require.Zero(t, plain.CompressedBytes)
+		require.Zero(t, plain.UncompressedBytes)
+		require.Greater(t, plain.TTFB, time.Duration(0))
+		require.LessOrEqual(t, plain.TTFB, plain.Dur)
+
+		compressed := getRecord(s, MethodCallCompressed)
+		require.Less(t, compressed.SentBytes, int64(len(arg)))
+		require.Less(t, compressed.ReceivedBytes, int64(len(arg)))
+		require.Equal(t, compressed.SentBytes+compressed.ReceivedBytes, compressed.Size)
+		// Both the argument and the result were compressed.
+		require.Greater(t, compressed.UncompressedBytes, int64(2*len(arg)))
+		require.Less(t, compressed.CompressedBytes, compressed.Size)
+		require.Greater(t, compressed.TTFB, time.Duration(0))
+	}
+}
+
+func TestInstrumentationV2Tags(t *testing.T) {
+	clientConn, serverConn := net.Pipe()
+	lf := NewSimpleLogFactory(&testLogOutput{t: t}, nil)
+	clientStorage := NewMemoryInstrumentationStorage()
+	serverStorage := NewMemoryInstrumentationStorage()
+	sxp := NewTransport(context.Background(), serverConn, lf, serverStorage, nil, testMaxFrameLength)
+	cxp := NewTransport(context.Background(), clientConn, lf, clientStorage, nil, testMaxFrameLength)
+	defer cxp.Close()
+	defer sxp.Close()
+
+	done := make(chan struct{})
+	srv := NewServer(sxp, nil)
+	require.NoError(t, srv.RegisterV2(ProtocolV2{
+		Name: "v2",
+		ID:   0x1a6,
+		Methods: map[Position]ServeHandlerDescriptionV2{
+			0: {
+				ServeHandlerDescription: ServeHandlerDescription{
+					MakeArg: func() interface{} { return new(string) },
+					Handler: func(context.Context, interface{}) (interface{}, error) {
+						done <- struct{}{}
+						return nil, nil
+					},
+				},
+				Name: "ping",
+			},
+		},
+	}))
+	srv.Run()
+
+	cli := NewClient(cxp, nil, nil)
+	ping := NewMethodV2(0x1a6, 0, "v2.ping")
+	require.NoError(t, cli.Notify(context.Background(), ping, "hi", 0))
+	<-done
+
+	// Storages that aren't live keep getting the tags that they always
+	// did, whatever the live ones get.
+	tags := func(s *MemoryInstrumentationStorage) []string {
+		s.Lock()
+		defer s.Unlock()
+		var ret []string
+		for tag := range s.storage {
+			ret = append(ret, tag)
+		}
+		return ret
+	}
+	require.Equal(t, []string{InstrumentTag(MethodNotify, "v2.ping")}, tags(clientStorage))
+	require.Eventually(t, func() bool {
+		ret := tags(serverStorage)
+		return len(ret) == 1 && ret[0] == InstrumentTag(MethodNotify, "")
+	}, time.Second, time.Millisecond)
+}
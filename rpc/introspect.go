@@ -0,0 +1,189 @@
+package rpc
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Introspector keeps track of live transports, so that their outstanding
+// calls and served tasks can be listed when debugging. It's opt-in: pass it
+// in TransportOpts.Introspector to the transports to watch. It is safe for
+// concurrent use.
+type Introspector struct {
+	sync.Mutex
+	nextID     uint64
+	transports map[*transport]uint64
+}
+
+// NewIntrospector makes an empty Introspector.
+func NewIntrospector() *Introspector {
+	return &Introspector{transports: make(map[*transport]uint64)}
+}
+
+func (i *Introspector) add(t *transport) {
+	i.Lock()
+	defer i.Unlock()
+	i.nextID++
+	i.transports[t] = i.nextID
+}
+
+func (i *Introspector) remove(t *transport) {
+	i.Lock()
+	defer i.Unlock()
+	delete(i.transports, t)
+}
+
+// OutstandingCallInfo is a call made to the peer that hasn't been answered
+// yet.
+type OutstandingCallInfo struct {
+	SeqNo       SeqNumber
+	Method      string
+	Compression CompressionType
+	Started     time.Time
+	Age         time.Duration
+}
+
+// MarshalJSON encodes c with readable compression and age.
+func (c OutstandingCallInfo) MarshalJSON() ([]byte, error) {
+	return json.Marshal(struct {
+		SeqNo       SeqNumber `json:"seqno"`
+		Method      string    `json:"method"`
+		Compression string    `json:"compression"`
+		Started     time.Time `json:"started"`
+		Age         string    `json:"age"`
+	}{c.SeqNo, c.Method, c.Compression.String(), c.Started, c.Age.String()})
+}
+
+// ServedTaskInfo is an incoming call or notify being served. Notifies have a
+// SeqNo of -1.
+type ServedTaskInfo struct {
+	SeqNo    SeqNumber
+	Type     MethodType
+	Method   string
+	Started  time.Time
+	Duration time.Duration
+}
+
+// MarshalJSON encodes t with readable type and duration.
+func (t ServedTaskInfo) MarshalJSON() ([]byte, error) {
+	return json.Marshal(struct {
+		SeqNo    SeqNumber `json:"seqno"`
+		Type     string    `json:"type"`
+		Method   string    `json:"method"`
+		Started  time.Time `json:"started"`
+		Duration string    `json:"duration"`
+	}{t.SeqNo, t.Type.String(), t.Method, t.Started, t.Duration.String()})
+}
+
+// TransportInfo describes a live transport.
+type TransportInfo struct {
+	// ID is assigned by the Introspector, in order of creation.
+	ID            uint64    `json:"id"`
+	RemoteAddr    string    `json:"remote_addr"`
+	LocalAddr     string    `json:"local_addr"`
+	Opened        time.Time `json:"opened"`
+	Draining      bool      `json:"draining"`
+	PeerGoingAway bool      `json:"peer_going_away"`
+	// QueueDepth is the number of frames waiting to be written, or being
+	// written.
+	QueueDepth int                   `json:"queue_depth"`
+	Calls      []OutstandingCallInfo `json:"calls"`
+	Tasks      []ServedTaskInfo      `json:"tasks"`
+}
+
+// IntrospectionSnapshot lists the live transports at a given time, by ID.
+type IntrospectionSnapshot struct {
+	Time       time.Time       `json:"time"`
+	Transports []TransportInfo `json:"transports"`
+}
+
+func (t *transport) describe(id uint64, now time.Time) TransportInfo {
+	ret := TransportInfo{
+		ID:         id,
+		RemoteAddr: AddrToString(t.c.RemoteAddr()),
+		LocalAddr:  AddrToString(t.c.LocalAddr()),
+		Opened:     t.opened,
+		Draining:   t.draining.Load(),
+		QueueDepth: t.enc.queueDepth(),
+		Calls:      t.calls.describe(now),
+		Tasks:      t.receiver.describeTasks(),
+	}
+	select {
+	case <-t.peerGoAway.ch:
+		ret.PeerGoingAway = true
+	default:
+	}
+	return ret
+}
+
+// Snapshot describes the live transports.
+func (i *Introspector) Snapshot() IntrospectionSnapshot {
+	i.Lock()
+	transports := make(map[*transport]uint64, len(i.transports))
+	for t, id := range i.transports {
+		transports[t] = id
+	}
+	i.Unlock()
+
+	// Describe the transports without the lock, since asking a transport
+	// for its tasks has to wait for its task loop.
+	now := time.Now()
+	ret := IntrospectionSnapshot{Time: now, Transports: make([]TransportInfo, 0, len(transports))}
+	for t, id := range transports {
+		ret.Transports = append(ret.Transports, t.describe(id, now))
+	}
+	sort.Slice(ret.Transports, func(i, j int) bool { return ret.Transports[i].ID < ret.Transports[j].ID })
+	return ret
+}
+
+// Handler returns an http.Handler that renders a Snapshot, as text, or as
+// JSON if the request has format=json in its query, or accepts
+// application/json. Like the handlers of net/http/pprof, it's meant for a
+// debug port that isn't reachable by untrusted clients.
+func (i *Introspector) Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		snapshot := i.Snapshot()
+		w.Header().Set("Cache-Control", "no-cache")
+		if r.URL.Query().Get("format") == "json" ||
+			strings.Contains(r.Header.Get("Accept"), "application/json") {
+			w.Header().Set("Content-Type", "application/json")
+			enc := json.NewEncoder(w)
+			enc.SetIndent("", "  ")
+			_ = enc.Encode(snapshot)
+			return
+		}
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		snapshot.WriteText(w)
+	})
+}
+
+// WriteText writes a human-readable rendering of s to w.
+func (s IntrospectionSnapshot) WriteText(w io.Writer) {
+	fmt.Fprintf(w, "%d transports at %s\n", len(s.Transports), s.Time.Format(time.RFC3339))
+	for _, t := range s.Transports {
+		fmt.Fprintf(w, "\ntransport %d remote=%s local=%s age=%s queue=%d",
+			t.ID, t.RemoteAddr, t.LocalAddr, s.Time.Sub(t.Opened).Round(time.Millisecond), t.QueueDepth)
+		if t.Draining {
+			fmt.Fprint(w, " draining")
+		}
+		if t.PeerGoingAway {
+			fmt.Fprint(w, " peer-going-away")
+		}
+		fmt.Fprintf(w, "\n  outstanding calls: %d\n", len(t.Calls))
+		for _, c := range t.Calls {
+			fmt.Fprintf(w, "    seqno=%d method=%s age=%s compression=%s\n",
+				c.SeqNo, c.Method, c.Age.Round(time.Millisecond), c.Compression)
+		}
+		fmt.Fprintf(w, "  served tasks: %d\n", len(t.Tasks))
+		for _, task := range t.Tasks {
+			fmt.Fprintf(w, "    seqno=%d type=%s method=%s duration=%s\n",
+				task.SeqNo, task.Type, task.Method, task.Duration.Round(time.Millisecond))
+		}
+	}
+}
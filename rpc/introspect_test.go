@@ -0,0 +1,113 @@
+package rpc
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestIntrospector(t *testing.T) {
+	in := NewIntrospector()
+	started := make(chan struct{})
+	release := make(chan struct{})
+
+	clientConn, serverConn := net.Pipe()
+	opts := TransportOpts{Introspector: in}
+	sxp := NewTransportWithOpts(context.Background(), serverConn, nil, nil, nil, testMaxFrameLength, opts)
+	srv := NewServer(sxp, nil)
+	require.NoError(t, srv.Register(drainTestProtocol(started, release)))
+	srv.Run()
+	cxp := NewTransportWithOpts(context.Background(), clientConn, nil, nil, nil, testMaxFrameLength, opts)
+	defer cxp.Close()
+	defer sxp.Close()
+	cli := NewClient(cxp, nil, nil)
+
+	require.Empty(t, in.Snapshot().Transports[1].Calls)
+
+	errCh := make(chan error, 1)
+	go func() {
+		var res int
+		errCh <- cli.CallCompressed(context.Background(), newMethodV1("drain.block"), 5, &res, CompressionGzip, 0)
+	}()
+	<-started
+
+	snapshot := in.Snapshot()
+	require.Len(t, snapshot.Transports, 2)
+	server, client := snapshot.Transports[0], snapshot.Transports[1]
+	require.Equal(t, uint64(1), server.ID)
+	require.Equal(t, uint64(2), client.ID)
+	require.Equal(t, "pipe://pipe", client.RemoteAddr)
+	require.Empty(t, server.Calls)
+	require.Empty(t, client.Tasks)
+
+	require.Len(t, client.Calls, 1)
+	require.Equal(t, SeqNumber(0), client.Calls[0].SeqNo)
+	require.Equal(t, "drain.block", client.Calls[0].Method)
+	require.Equal(t, CompressionGzip, client.Calls[0].Compression)
+	require.True(t, client.Calls[0].Age >= 0)
+
+	require.Len(t, server.Tasks, 1)
+	require.Equal(t, SeqNumber(0), server.Tasks[0].SeqNo)
+	require.Equal(t, MethodCallCompressed, server.Tasks[0].Type)
+	require.Equal(t, "drain.block", server.Tasks[0].Method)
+
+	handler := in.Handler()
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/debug/rpc", nil))
+	require.Equal(t, http.StatusOK, rec.Code)
+	body, err := io.ReadAll(rec.Body)
+	require.NoError(t, err)
+	require.Contains(t, string(body), "2 transports")
+	require.Contains(t, string(body), "seqno=0 method=drain.block")
+	require.Contains(t, string(body), "type=CallCompressed method=drain.block")
+
+	rec = httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/debug/rpc?format=json", nil))
+	require.Equal(t, "application/json", rec.Header().Get("Content-Type"))
+	var decoded struct {
+		Transports []struct {
+			ID    uint64 `json:"id"`
+			Calls []struct {
+				Method      string `json:"method"`
+				Compression string `json:"compression"`
+			} `json:"calls"`
+			Tasks []struct {
+				Type string `json:"type"`
+			} `json:"tasks"`
+		} `json:"transports"`
+	}
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &decoded))
+	require.Len(t, decoded.Transports, 2)
+	require.Equal(t, "gzip", decoded.Transports[1].Calls[0].Compression)
+	require.Equal(t, "CallCompressed", decoded.Transports[0].Tasks[0].Type)
+
+	// Notifies are listed too, with no seqno.
+	require.NoError(t, cli.Notify(context.Background(), newMethodV1("drain.block"), 6, 0))
+	<-started
+	tasks := in.Snapshot().Transports[0].Tasks
+	require.Len(t, tasks, 2)
+	require.Equal(t, SeqNumber(-1), tasks[1].SeqNo)
+	require.Equal(t, MethodNotify, tasks[1].Type)
+
+	close(release)
+	require.NoError(t, <-errCh)
+	require.Eventually(t, func() bool {
+		snapshot := in.Snapshot()
+		return len(snapshot.Transports[0].Tasks) == 0 && len(snapshot.Transports[1].Calls) == 0
+	}, 5*time.Second, time.Millisecond)
+
+	// Closed transports are forgotten.
+	cxp.Close()
+	for _, info := range in.Snapshot().Transports {
+		require.NotEqual(t, uint64(2), info.ID)
+	}
+	sxp.Close()
+	require.Empty(t, in.Snapshot().Transports)
+}
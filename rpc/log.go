@@ -324,7 +324,7 @@ func (s SimpleLog) trace(which string, objname string, verbose bool, _ SeqNumber
 		mh.WriteExt = true
 		var b []byte
 		enc := codec.NewEncoderBytes(&b, &mh)
-		err := enc.Encode(obj)
+		err := enc.Encode(logValue(obj))
 		var val interface{}
 		if err != nil {
 			val = fmt.Sprintf("<encoding error: %s>", err.Error())
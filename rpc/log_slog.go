@@ -0,0 +1,372 @@
+package rpc
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"runtime"
+	"time"
+)
+
+// Attribute keys of the records emitted by the slog adapters.
+const (
+	SlogKeyEvent       = "event"
+	SlogKeySeqno       = "seqno"
+	SlogKeyMethod      = "method"
+	SlogKeyCompression = "compression"
+	SlogKeyError       = "error"
+	SlogKeyRemoteAddr  = "remote_addr"
+	SlogKeyArg         = "arg"
+	SlogKeyResult      = "result"
+	SlogKeyFrame       = "frame"
+	SlogKeyDuration    = "duration"
+	SlogKeySection     = "section"
+	SlogKeyConnID      = "conn_id"
+)
+
+// SlogLevelTrace is the level of frame traces, which are even more verbose
+// than debug logs.
+const SlogLevelTrace = slog.LevelDebug - 4
+
+// slogLog emits a record at the given level, with the source location of
+// the caller that's skip frames above it.
+func slogLog(l *slog.Logger, skip int, level slog.Level, msg string, attrs ...slog.Attr) {
+	ctx := context.Background()
+	if !l.Enabled(ctx, level) {
+		return
+	}
+	var pcs [1]uintptr
+	// Skip runtime.Callers and slogLog itself.
+	runtime.Callers(skip+2, pcs[:])
+	r := slog.NewRecord(time.Now(), level, msg, pcs[0])
+	r.AddAttrs(attrs...)
+	_ = l.Handler().Handle(ctx, r)
+}
+
+func logFieldsToAttrs(fields []LogField) []slog.Attr {
+	ret := make([]slog.Attr, 0, len(fields))
+	for _, f := range fields {
+		ret = append(ret, slog.Any(f.Key, f.Value))
+	}
+	return ret
+}
+
+//-------------------------------------------------
+
+// SlogLogFactory is a LogFactory whose logs emit structured records to a
+// slog.Logger. RPC traces are logged at slog.LevelDebug, and frame traces at
+// SlogLevelTrace, so the level of the logger's handler decides what's
+// emitted, on top of the LogOptions.
+type SlogLogFactory struct {
+	logger *slog.Logger
+	opts   LogOptions
+}
+
+var _ LogFactory = SlogLogFactory{}
+
+// NewSlogLogFactory makes a SlogLogFactory. A nil logger means
+// slog.Default(), and nil opts enable everything.
+func NewSlogLogFactory(logger *slog.Logger, opts LogOptions) SlogLogFactory {
+	if logger == nil {
+		logger = slog.Default()
+	}
+	if opts == nil {
+		opts = SimpleLogOptions{}
+	}
+	return SlogLogFactory{logger: logger, opts: opts}
+}
+
+func (f SlogLogFactory) NewLog(a net.Addr) LogInterface {
+	logger := f.logger
+	if f.opts.ShowAddress() {
+		logger = logger.With(slog.String(SlogKeyRemoteAddr, AddrToString(a)))
+	}
+	ret := SlogLog{logger: logger, opts: f.opts}
+	ret.TransportStart()
+	return ret
+}
+
+// SlogLog is the LogInterface of a SlogLogFactory.
+type SlogLog struct {
+	logger *slog.Logger
+	opts   LogOptions
+}
+
+var _ LogInterface = SlogLog{}
+
+func (s SlogLog) log(level slog.Level, msg string, attrs ...slog.Attr) {
+	// Skip log, and the LogInterface method that called it.
+	slogLog(s.logger, 2, level, msg, attrs...)
+}
+
+func (s SlogLog) TransportStart() {
+	if s.opts.TransportStart() {
+		s.log(slog.LevelDebug, "new connection", slog.String(SlogKeyEvent, "transport-start"))
+	}
+}
+
+func (s SlogLog) TransportError(e error) {
+	if e != io.EOF {
+		s.log(slog.LevelError, "error in transport",
+			slog.String(SlogKeyEvent, "transport-error"), slog.Any(SlogKeyError, e))
+	} else if s.opts.TransportStart() {
+		s.log(slog.LevelDebug, "EOF", slog.String(SlogKeyEvent, "transport-eof"))
+	}
+}
+
+func (s SlogLog) FrameRead(bytes []byte) {
+	if s.opts.FrameTrace() && s.logger.Enabled(context.Background(), SlogLevelTrace) {
+		s.log(SlogLevelTrace, "frame read",
+			slog.String(SlogKeyEvent, "frame-read"), slog.String(SlogKeyFrame, hex.EncodeToString(bytes)))
+	}
+}
+
+// trace logs an RPC event. seqno and ctype are only logged if non-nil,
+// and obj only if verbose.
+func (s SlogLog) trace(event string, seqno *SeqNumber, meth string, err error,
+	objKey string, obj interface{}, verbose bool, ctype *CompressionType) {
+	attrs := []slog.Attr{slog.String(SlogKeyEvent, event)}
+	if seqno != nil {
+		attrs = append(attrs, slog.Int64(SlogKeySeqno, int64(*seqno)))
+	}
+	if len(meth) > 0 {
+		attrs = append(attrs, slog.String(SlogKeyMethod, meth))
+	}
+	if ctype != nil {
+		attrs = append(attrs, slog.String(SlogKeyCompression, ctype.String()))
+	}
+	if err != nil {
+		attrs = append(attrs, slog.Any(SlogKeyError, err))
+	}
+	if verbose {
+		attrs = append(attrs, slog.Any(objKey, obj))
+	}
+	// Skip trace, and the LogInterface method that called it.
+	slogLog(s.logger, 2, slog.LevelDebug, event, attrs...)
+}
+
+func (s SlogLog) ClientCall(q SeqNumber, meth string, arg interface{}) {
+	if s.opts.ClientTrace() {
+		s.trace("call", &q, meth, nil, SlogKeyArg, arg, s.opts.ShowArg(), nil)
+	}
+}
+
+func (s SlogLog) ServerCall(q SeqNumber, meth string, err error, arg interface{}) {
+	if s.opts.ServerTrace() {
+		s.trace("serve", &q, meth, err, SlogKeyArg, arg, s.opts.ShowArg(), nil)
+	}
+}
+
+func (s SlogLog) ServerReply(q SeqNumber, meth string, err error, res interface{}) {
+	if s.opts.ServerTrace() {
+		s.trace("reply", &q, meth, err, SlogKeyResult, res, s.opts.ShowResult(), nil)
+	}
+}
+
+func (s SlogLog) ClientCallCompressed(q SeqNumber, meth string, arg interface{}, ctype CompressionType) {
+	if s.opts.ClientTrace() {
+		s.trace("call-compressed", &q, meth, nil, SlogKeyArg, arg, s.opts.ShowArg(), &ctype)
+	}
+}
+
+func (s SlogLog) ServerCallCompressed(q SeqNumber, meth string, err error, arg interface{}, ctype CompressionType) {
+	if s.opts.ServerTrace() {
+		s.trace("serve-compressed", &q, meth, err, SlogKeyArg, arg, s.opts.ShowArg(), &ctype)
+	}
+}
+
+func (s SlogLog) ServerReplyCompressed(q SeqNumber, meth string, err error, res interface{}, ctype CompressionType) {
+	if s.opts.ServerTrace() {
+		s.trace("reply-compressed", &q, meth, err, SlogKeyResult, res, s.opts.ShowResult(), &ctype)
+	}
+}
+
+func (s SlogLog) ClientNotify(meth string, arg interface{}) {
+	if s.opts.ClientTrace() {
+		s.trace("notify", nil, meth, nil, SlogKeyArg, arg, s.opts.ShowArg(), nil)
+	}
+}
+
+func (s SlogLog) ServerNotifyCall(meth string, err error, arg interface{}) {
+	if s.opts.ServerTrace() {
+		s.trace("serve-notify", nil, meth, err, SlogKeyArg, arg, s.opts.ShowArg(), nil)
+	}
+}
+
+func (s SlogLog) ServerNotifyComplete(meth string, err error) {
+	if s.opts.ServerTrace() {
+		s.trace("complete", nil, meth, err, "", nil, false, nil)
+	}
+}
+
+func (s SlogLog) ClientCancel(q SeqNumber, meth string, err error) {
+	if s.opts.ClientTrace() {
+		s.trace("cancel", &q, meth, err, "", nil, false, nil)
+	}
+}
+
+func (s SlogLog) ServerCancelCall(q SeqNumber, meth string) {
+	if s.opts.ServerTrace() {
+		s.trace("serve-cancel", &q, meth, nil, "", nil, false, nil)
+	}
+}
+
+func (s SlogLog) ClientReply(q SeqNumber, meth string, err error, res interface{}) {
+	if s.opts.ClientTrace() {
+		s.trace("client-reply", &q, meth, err, SlogKeyResult, res, s.opts.ShowResult(), nil)
+	}
+}
+
+func (s SlogLog) StartProfiler(format string, args ...interface{}) Profiler {
+	if s.opts.Profile() && s.logger.Enabled(context.Background(), slog.LevelDebug) {
+		return &slogProfiler{
+			start: time.Now(),
+			msg:   fmt.Sprintf(format, args...),
+			log:   s,
+		}
+	}
+	return NilProfiler{}
+}
+
+func (s SlogLog) UnexpectedReply(seqno SeqNumber) {
+	s.log(slog.LevelWarn, "unexpected seqno in incoming reply",
+		slog.String(SlogKeyEvent, "unexpected-reply"), slog.Int64(SlogKeySeqno, int64(seqno)))
+}
+
+func (s SlogLog) Warnf(format string, args ...interface{}) {
+	s.log(slog.LevelWarn, fmt.Sprintf(format, args...))
+}
+
+func (s SlogLog) Warnw(msg string, args ...LogField) {
+	s.log(slog.LevelWarn, msg, logFieldsToAttrs(args)...)
+}
+
+func (s SlogLog) Infof(format string, args ...interface{}) {
+	s.log(slog.LevelInfo, fmt.Sprintf(format, args...))
+}
+
+func (s SlogLog) Infow(msg string, args ...LogField) {
+	s.log(slog.LevelInfo, msg, logFieldsToAttrs(args)...)
+}
+
+type slogProfiler struct {
+	start time.Time
+	msg   string
+	log   SlogLog
+}
+
+func (p *slogProfiler) Stop() {
+	p.log.log(slog.LevelDebug, p.msg,
+		slog.String(SlogKeyEvent, "profile"), slog.Duration(SlogKeyDuration, time.Since(p.start)))
+}
+
+//-------------------------------------------------
+
+// SlogLogOutput is a LogOutput that writes to a slog.Logger. Profile logs
+// are written at slog.LevelDebug.
+type SlogLogOutput struct {
+	logger *slog.Logger
+	depth  int
+}
+
+var _ LogOutputWithDepthAdder = SlogLogOutput{}
+
+// NewSlogLogOutput makes a SlogLogOutput. A nil logger means slog.Default().
+func NewSlogLogOutput(logger *slog.Logger) SlogLogOutput {
+	if logger == nil {
+		logger = slog.Default()
+	}
+	return SlogLogOutput{logger: logger}
+}
+
+func (s SlogLogOutput) logf(level slog.Level, format string, args []interface{}) {
+	if !s.logger.Enabled(context.Background(), level) {
+		return
+	}
+	// Skip logf, and the LogOutput method that called it.
+	slogLog(s.logger, 2+s.depth, level, fmt.Sprintf(format, args...))
+}
+
+func (s SlogLogOutput) logw(level slog.Level, msg string, fields []LogField) {
+	slogLog(s.logger, 2+s.depth, level, msg, logFieldsToAttrs(fields)...)
+}
+
+func (s SlogLogOutput) Errorf(f string, args ...interface{})   { s.logf(slog.LevelError, f, args) }
+func (s SlogLogOutput) Errorw(msg string, args ...LogField)    { s.logw(slog.LevelError, msg, args) }
+func (s SlogLogOutput) Warnf(f string, args ...interface{})    { s.logf(slog.LevelWarn, f, args) }
+func (s SlogLogOutput) Warnw(msg string, args ...LogField)     { s.logw(slog.LevelWarn, msg, args) }
+func (s SlogLogOutput) Infof(f string, args ...interface{})    { s.logf(slog.LevelInfo, f, args) }
+func (s SlogLogOutput) Infow(msg string, args ...LogField)     { s.logw(slog.LevelInfo, msg, args) }
+func (s SlogLogOutput) Debugf(f string, args ...interface{})   { s.logf(slog.LevelDebug, f, args) }
+func (s SlogLogOutput) Debugw(msg string, args ...LogField)    { s.logw(slog.LevelDebug, msg, args) }
+func (s SlogLogOutput) Profilef(f string, args ...interface{}) { s.logf(slog.LevelDebug, f, args) }
+func (s SlogLogOutput) Profilew(msg string, args ...LogField)  { s.logw(slog.LevelDebug, msg, args) }
+
+func (s SlogLogOutput) CloneWithAddedDepth(depth int) LogOutputWithDepthAdder {
+	s.depth += depth
+	return s
+}
+
+//-------------------------------------------------
+
+// SlogConnectionLogFactory is a ConnectionLogFactory that writes to a
+// slog.Logger. Each ConnectionLog it makes tags its records with the
+// section, and with a random connection ID.
+type SlogConnectionLogFactory struct {
+	logger *slog.Logger
+}
+
+var _ ConnectionLogFactory = SlogConnectionLogFactory{}
+
+// NewSlogConnectionLogFactory makes a SlogConnectionLogFactory. A nil logger
+// means slog.Default().
+func NewSlogConnectionLogFactory(logger *slog.Logger) SlogConnectionLogFactory {
+	if logger == nil {
+		logger = slog.Default()
+	}
+	return SlogConnectionLogFactory{logger: logger}
+}
+
+func (f SlogConnectionLogFactory) Make(section string) ConnectionLog {
+	randBytes := make([]byte, 4)
+	_, _ = rand.Read(randBytes)
+	return slogConnectionLog{logger: f.logger.With(
+		slog.String(SlogKeySection, section),
+		slog.String(SlogKeyConnID, hex.EncodeToString(randBytes)),
+	)}
+}
+
+type slogConnectionLog struct {
+	logger *slog.Logger
+}
+
+// log uses the ConnectionLogMsgKey field as the message, if there's one.
+func (l slogConnectionLog) log(level slog.Level, format string, fields []LogField) {
+	msg := format
+	attrs := make([]slog.Attr, 0, len(fields))
+	for _, f := range fields {
+		if f.Key == ConnectionLogMsgKey {
+			msg = fmt.Sprint(f.Value)
+			continue
+		}
+		attrs = append(attrs, slog.Any(f.Key, f.Value))
+	}
+	// Skip log, and the ConnectionLog method that called it.
+	slogLog(l.logger, 2, level, msg, attrs...)
+}
+
+func (l slogConnectionLog) Warnw(format string, fields ...LogField) {
+	l.log(slog.LevelWarn, format, fields)
+}
+
+func (l slogConnectionLog) Debugw(format string, fields ...LogField) {
+	l.log(slog.LevelDebug, format, fields)
+}
+
+func (l slogConnectionLog) Infow(format string, fields ...LogField) {
+	l.log(slog.LevelInfo, format, fields)
+}
@@ -0,0 +1,136 @@
+package rpc
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// syncBuffer is a bytes.Buffer that's safe for concurrent use.
+type syncBuffer struct {
+	sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.Lock()
+	defer b.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) records(t *testing.T) []map[string]interface{} {
+	b.Lock()
+	defer b.Unlock()
+	var ret []map[string]interface{}
+	for _, line := range strings.Split(strings.TrimSpace(b.buf.String()), "\n") {
+		if line == "" {
+			continue
+		}
+		var m map[string]interface{}
+		require.NoError(t, json.Unmarshal([]byte(line), &m))
+		ret = append(ret, m)
+	}
+	return ret
+}
+
+func findRecord(records []map[string]interface{}, event string) map[string]interface{} {
+	for _, r := range records {
+		if r[SlogKeyEvent] == event {
+			return r
+		}
+	}
+	return nil
+}
+
+func TestSlogLogFactory(t *testing.T) {
+	var buf syncBuffer
+	logger := slog.New(slog.NewJSONHandler(&buf, &slog.HandlerOptions{Level: slog.LevelDebug, AddSource: true}))
+	opts, err := ParseStandardLogOptions("csv")
+	require.NoError(t, err)
+	lf := NewSlogLogFactory(logger, opts)
+
+	clientConn, serverConn := net.Pipe()
+	sxp := NewTransport(context.Background(), serverConn, lf, nil, nil, testMaxFrameLength)
+	cxp := NewTransport(context.Background(), clientConn, lf, nil, nil, testMaxFrameLength)
+	defer cxp.Close()
+	defer sxp.Close()
+
+	srv := NewServer(sxp, nil)
+	require.NoError(t, srv.Register(rateLimitTestProtocol(nil, nil)))
+	srv.Run()
+	cli := NewClient(cxp, nil, nil)
+	var res int
+	require.NoError(t, cli.Call(context.Background(), newMethodV1("limited.ping"), 7, &res, 0))
+	require.Error(t, cli.Call(context.Background(), newMethodV1("limited.nope"), 7, &res, 0))
+
+	records := buf.records(t)
+	call := findRecord(records, "call")
+	require.NotNil(t, call)
+	require.Equal(t, "DEBUG", call["level"])
+	require.Equal(t, "limited.ping", call[SlogKeyMethod])
+	require.Equal(t, float64(0), call[SlogKeySeqno])
+	require.Equal(t, float64(7), call[SlogKeyArg])
+	require.Equal(t, "pipe://pipe", call[SlogKeyRemoteAddr])
+	require.Contains(t, call["source"].(map[string]interface{})["file"], "dispatch.go")
+
+	reply := findRecord(records, "reply")
+	require.NotNil(t, reply)
+	require.Equal(t, float64(7), reply[SlogKeyResult])
+
+	serve := findRecord(records, "serve")
+	require.NotNil(t, serve)
+	require.NotContains(t, serve, SlogKeyError)
+
+	var failed map[string]interface{}
+	for _, r := range records {
+		if r[SlogKeyEvent] == "serve" && r[SlogKeyMethod] == "limited.nope" {
+			failed = r
+		}
+	}
+	require.NotNil(t, failed)
+	require.Contains(t, failed[SlogKeyError], "not found")
+
+	// Frame traces are off, and below the handler's level anyway.
+	require.Nil(t, findRecord(records, "frame-read"))
+}
+
+func TestSlogLogOutput(t *testing.T) {
+	var buf syncBuffer
+	logger := slog.New(slog.NewJSONHandler(&buf, &slog.HandlerOptions{Level: slog.LevelInfo}))
+	out := NewSlogLogOutput(logger)
+	out.Debugf("hidden %d", 1)
+	out.Warnf("shown %d", 2)
+	out.Errorw("structured", LogField{"k", "v"})
+
+	records := buf.records(t)
+	require.Len(t, records, 2)
+	require.Equal(t, "shown 2", records[0]["msg"])
+	require.Equal(t, "WARN", records[0]["level"])
+	require.Equal(t, "structured", records[1]["msg"])
+	require.Equal(t, "v", records[1]["k"])
+}
+
+func TestSlogConnectionLogFactory(t *testing.T) {
+	var buf syncBuffer
+	logger := slog.New(slog.NewJSONHandler(&buf, &slog.HandlerOptions{Level: slog.LevelDebug}))
+	log := NewSlogConnectionLogFactory(logger).Make("conn")
+	log.Infow("ignored format", LogField{ConnectionLogMsgKey, "real message"}, LogField{"err", errors.New("boom")})
+	log.Debugw("plain")
+
+	records := buf.records(t)
+	require.Len(t, records, 2)
+	require.Equal(t, "real message", records[0]["msg"])
+	require.Equal(t, "boom", records[0]["err"])
+	require.Equal(t, "conn", records[0][SlogKeySection])
+	require.Len(t, records[0][SlogKeyConnID], 8)
+	require.Equal(t, records[0][SlogKeyConnID], records[1][SlogKeyConnID])
+	require.Equal(t, "plain", records[1]["msg"])
+}
@@ -149,7 +149,8 @@ func (lc *LoopbackConn) Write(b []byte) (n int, err error) {
 	if lc.isClosed {
 		return 0, syscall.EINVAL
 	}
-	lc.ch <- b
+	// Writers may reuse b once Write returns, so the reader gets a copy.
+	lc.ch <- append([]byte(nil), b...)
 	return len(b), nil
 }
 
@@ -5,6 +5,7 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"time"
 
 	"github.com/foks-proj/go-ctxlog"
 	"github.com/keybase/go-codec/codec"
@@ -24,6 +25,8 @@ type rpcMessage interface {
 type basicRPCData struct {
 	ctx          context.Context
 	instrumenter *NetworkInstrumenter
+	// headers is the optional field that follows the ctxlog tags.
+	headers map[string]string
 }
 
 func (r *basicRPCData) Context() context.Context {
@@ -33,6 +36,10 @@ func (r *basicRPCData) Context() context.Context {
 	return r.ctx
 }
 
+func (r *basicRPCData) setFailed(err error) {
+	r.instrumenter.setFailed(err)
+}
+
 func (r *basicRPCData) loadContext(l int, d *fieldDecoder) error {
 	if l == 0 {
 		return nil
@@ -42,9 +49,62 @@ func (r *basicRPCData) loadContext(l int, d *fieldDecoder) error {
 		return err
 	}
 	r.ctx = ctxlog.AddTagsToContext(r.Context(), tags)
+	if l == 1 {
+		return nil
+	}
+	// Be lenient about the headers, since older peers might have sent
+	// something else here.
+	var headers interface{}
+	if err := d.Decode(&headers); err != nil {
+		return err
+	}
+	r.headers = toHeaders(headers)
 	return nil
 }
 
+func toHeaders(i interface{}) map[string]string {
+	switch m := i.(type) {
+	case map[interface{}]interface{}:
+		ret := make(map[string]string, len(m))
+		for k, v := range m {
+			ks, kok := k.(string)
+			vs, vok := v.(string)
+			if kok && vok {
+				ret[ks] = vs
+			}
+		}
+		return ret
+	// The JSON codec decodes maps with string keys.
+	case map[string]interface{}:
+		ret := make(map[string]string, len(m))
+		for k, v := range m {
+			if vs, ok := v.(string); ok {
+				ret[k] = vs
+			}
+		}
+		return ret
+	default:
+		return nil
+	}
+}
+
+// appendTrailer appends the optional trailing fields of a call or notify: the
+// ctxlog tags from ctx, and the given headers. The tags are sent (even if
+// empty) whenever the headers are.
+func appendTrailer(ctx context.Context, v []interface{}, headers map[string]string) []interface{} {
+	rpcTags, _ := ctxlog.TagsFromContext(ctx)
+	if len(headers) > 0 {
+		if rpcTags == nil {
+			rpcTags = make(ctxlog.CtxLogTags)
+		}
+		return append(v, rpcTags, headers)
+	}
+	if len(rpcTags) > 0 {
+		v = append(v, rpcTags)
+	}
+	return v
+}
+
 type rpcCallMessage struct {
 	basicRPCData
 	seqno SeqNumber
@@ -70,8 +130,10 @@ func (r *rpcCallMessage) DecodeMessage(l int, d *fieldDecoder, p protocolHandler
 	if r.err = r.name.decodeInto(d); r.err != nil {
 		return r.err
 	}
-	r.instrumenter = NewNetworkInstrumenter(instrumenterStorage, InstrumentTag(r.Type(), r.Name().String()))
-	r.instrumenter.IncrementSize(int64(d.totalSize))
+	tag := InstrumentTag(r.Type(), r.Name().String())
+	r.name.resolveName(p)
+	r.instrumenter = newNetworkInstrumenter(instrumenterStorage, tag, InstrumentTag(r.name.CallMethodType(), r.Name().String()))
+	r.instrumenter.IncrementReceived(int64(d.totalSize))
 	if r.arg, r.err = r.name.getArg(p); r.err != nil {
 		return r.err
 	}
@@ -139,8 +201,10 @@ func (r *rpcCallCompressedMessage) DecodeMessage(l int, d *fieldDecoder, p proto
 	if r.err = r.name.decodeInto(d); r.err != nil {
 		return r.err
 	}
-	r.instrumenter = NewNetworkInstrumenter(instrumenterStorage, InstrumentTag(r.Type(), r.Name().String()))
-	r.instrumenter.IncrementSize(int64(d.totalSize))
+	tag := InstrumentTag(r.Type(), r.Name().String())
+	r.name.resolveName(p)
+	r.instrumenter = newNetworkInstrumenter(instrumenterStorage, tag, InstrumentTag(r.Type(), r.Name().String()))
+	r.instrumenter.IncrementReceived(int64(d.totalSize))
 	if r.arg, r.err = r.name.getArg(p); r.err != nil {
 		return r.err
 	}
@@ -156,7 +220,8 @@ func (r *rpcCallCompressedMessage) DecodeMessage(l int, d *fieldDecoder, p proto
 				r.err = err
 				return r.err
 			}
-			if r.err = newUncompressedDecoder(uncompressed, d.fieldNumber).Decode(r.arg); r.err != nil {
+			r.instrumenter.addCompression(len(compressed), len(uncompressed))
+			if r.err = newUncompressedDecoder(d.handle, uncompressed, d.fieldNumber).Decode(r.arg); r.err != nil {
 				return r.err
 			}
 		}
@@ -195,7 +260,7 @@ func (r *rpcResponseMessage) RecordAndFinish(ctx context.Context, size int64) er
 	return r.c.instrumenter.RecordAndFinish(ctx, size)
 }
 
-func (r *rpcResponseMessage) DecodeMessage(_ int, d *fieldDecoder, _ protocolHandlers, cc *callContainer,
+func (r *rpcResponseMessage) DecodeMessage(l int, d *fieldDecoder, _ protocolHandlers, cc *callContainer,
 	compressorCacher *compressorCacher, _ NetworkInstrumenterStorage) error {
 
 	var seqNo SeqNumber
@@ -209,7 +274,8 @@ func (r *rpcResponseMessage) DecodeMessage(_ int, d *fieldDecoder, _ protocolHan
 		r.err = newCallNotFoundError(seqNo)
 		return r.err
 	}
-	r.c.instrumenter.IncrementSize(int64(d.totalSize))
+	r.c.instrumenter.IncrementReceived(int64(d.totalSize))
+	r.c.instrumenter.markFirstByte(d.start)
 
 	// Decode the error
 	var responseErr interface{}
@@ -239,28 +305,48 @@ func (r *rpcResponseMessage) DecodeMessage(_ int, d *fieldDecoder, _ protocolHan
 		}
 	}
 
-	// Decode the result
-	if r.c.res == nil {
+	// The status, if any, comes after the result.
+	hasStatus := l > 3
+	if r.c.res == nil && !hasStatus {
 		return nil
 	}
+	if r.err = r.decodeResult(d, compressorCacher); r.err != nil {
+		return r.err
+	}
+	if hasStatus {
+		var s replyStatus
+		if r.err = d.Decode(&s); r.err != nil {
+			return r.err
+		}
+		if err := s.err(r.c.method); err != nil {
+			r.responseErr = err
+		}
+	}
+	return nil
+}
 
+// decodeResult decodes the result into the call's, or skips it if the call
+// has none.
+func (r *rpcResponseMessage) decodeResult(d *fieldDecoder, compressorCacher *compressorCacher) error {
+	if r.c.res == nil {
+		var skip interface{}
+		return d.Decode(&skip)
+	}
 	if compressor := compressorCacher.getCompressor(r.c.ctype); compressor != nil {
 		var compressed []byte
-		if r.err = d.Decode(&compressed); r.err != nil {
-			return r.err
+		if err := d.Decode(&compressed); err != nil {
+			return err
 		}
 		if len(compressed) > 0 {
 			uncompressed, err := compressor.Decompress(compressed)
 			if err != nil {
-				r.err = err
-				return r.err
+				return err
 			}
-			d = newUncompressedDecoder(uncompressed, d.fieldNumber)
+			r.c.instrumenter.addCompression(len(compressed), len(uncompressed))
+			return newUncompressedDecoder(d.handle, uncompressed, d.fieldNumber).Decode(r.c.res)
 		}
 	}
-
-	r.err = d.Decode(r.c.res)
-	return r.err
+	return d.Decode(r.c.res)
 }
 
 func (r rpcResponseMessage) Type() MethodType {
@@ -327,8 +413,10 @@ func (r *rpcNotifyMessage) DecodeMessage(l int, d *fieldDecoder, p protocolHandl
 	if r.err = r.name.decodeInto(d); r.err != nil {
 		return r.err
 	}
-	r.instrumenter = NewNetworkInstrumenter(instrumenterStorage, InstrumentTag(r.Type(), r.Name().String()))
-	r.instrumenter.IncrementSize(int64(d.totalSize))
+	tag := InstrumentTag(r.Type(), r.Name().String())
+	r.name.resolveName(p)
+	r.instrumenter = newNetworkInstrumenter(instrumenterStorage, tag, InstrumentTag(r.name.NotifyMethodType(), r.Name().String()))
+	r.instrumenter.IncrementReceived(int64(d.totalSize))
 	if r.arg, r.err = r.name.getArg(p); r.err != nil {
 		return r.err
 	}
@@ -339,8 +427,8 @@ func (r *rpcNotifyMessage) DecodeMessage(l int, d *fieldDecoder, p protocolHandl
 	return r.err
 }
 
-func (rpcNotifyMessage) MinLength() int {
-	return 2
+func (r rpcNotifyMessage) MinLength() int {
+	return 1 + r.name.numFields()
 }
 
 func (r rpcNotifyMessage) Type() MethodType {
@@ -410,24 +498,109 @@ func (r rpcCancelMessage) Err() error {
 	return r.err
 }
 
+type rpcGoAwayMessage struct {
+	err error
+}
+
+func (r *rpcGoAwayMessage) RecordAndFinish(_ context.Context, _ int64) error {
+	return nil
+}
+
+func (r *rpcGoAwayMessage) DecodeMessage(_ int, _ *fieldDecoder, _ protocolHandlers, _ *callContainer,
+	_ *compressorCacher, _ NetworkInstrumenterStorage) error {
+	// Any fields are reserved for future use, and are skipped.
+	return nil
+}
+
+func (rpcGoAwayMessage) MinLength() int {
+	return 0
+}
+
+func (r rpcGoAwayMessage) Type() MethodType {
+	return MethodGoAway
+}
+
+func (r rpcGoAwayMessage) Compression() CompressionType {
+	return CompressionNone
+}
+
+func (r rpcGoAwayMessage) SeqNo() SeqNumber {
+	return -1
+}
+
+func (r rpcGoAwayMessage) Name() Methoder {
+	return &MethodV1{}
+}
+
+func (r rpcGoAwayMessage) Err() error {
+	return r.err
+}
+
+type rpcHandshakeMessage struct {
+	info HandshakeInfo
+	err  error
+}
+
+func (r *rpcHandshakeMessage) RecordAndFinish(_ context.Context, _ int64) error {
+	return nil
+}
+
+func (r *rpcHandshakeMessage) DecodeMessage(_ int, d *fieldDecoder, _ protocolHandlers, _ *callContainer,
+	_ *compressorCacher, _ NetworkInstrumenterStorage) error {
+	// Any further fields are reserved for future use, and are skipped.
+	r.err = d.Decode(&r.info)
+	return r.err
+}
+
+func (rpcHandshakeMessage) MinLength() int {
+	return 1
+}
+
+func (r rpcHandshakeMessage) Type() MethodType {
+	return MethodHandshake
+}
+
+func (r rpcHandshakeMessage) Compression() CompressionType {
+	return CompressionNone
+}
+
+func (r rpcHandshakeMessage) SeqNo() SeqNumber {
+	return -1
+}
+
+func (r rpcHandshakeMessage) Name() Methoder {
+	return &MethodV1{}
+}
+
+func (r rpcHandshakeMessage) Err() error {
+	return r.err
+}
+
 // fieldDecoder decodes the fields of a packet.
 type fieldDecoder struct {
-	d           *codec.Decoder
+	d *codec.Decoder
+	// handle is the handle of d, for the compressed fields.
+	handle      codec.Handle
 	fieldNumber int
 	totalSize   int32
+	// start is when the frame started arriving.
+	start time.Time
 }
 
-func newFieldDecoder(reader *frameReader) *fieldDecoder {
+func newFieldDecoder(reader *frameReader, h codec.Handle) *fieldDecoder {
 	return &fieldDecoder{
-		d:           codec.NewDecoder(reader, newCodecMsgpackHandle()),
+		d:           codec.NewDecoder(reader, h),
+		handle:      h,
 		fieldNumber: 0,
 		totalSize:   reader.totalSize,
+		start:       reader.start,
 	}
 }
 
-func newUncompressedDecoder(data []byte, fieldNumber int) *fieldDecoder {
+func newUncompressedDecoder(h codec.Handle, data []byte, fieldNumber int) *fieldDecoder {
 	return &fieldDecoder{
-		d:           codec.NewDecoder(bytes.NewBuffer(data), newCodecMsgpackHandle()),
+		d:           codec.NewDecoder(bytes.NewBuffer(data), h),
+		handle:      h,
 		fieldNumber: fieldNumber,
 		totalSize:   int32(len(data)),
 	}
@@ -445,10 +618,8 @@ func (dw *fieldDecoder) Decode(i interface{}) error {
 	return nil
 }
 
-func decodeRPC(ctx context.Context, l int, r *frameReader, p protocolHandlers, cc *callContainer, compressorCacher *compressorCacher,
+func decodeRPC(ctx context.Context, l int, decoder *fieldDecoder, p protocolHandlers, cc *callContainer, compressorCacher *compressorCacher,
 	instrumenterStorage NetworkInstrumenterStorage) (rpcMessage, error) {
-	decoder := newFieldDecoder(r)
-
 	typ := MethodInvalid
 	if err := decoder.Decode(&typ); err != nil {
 		return nil, newRPCDecodeError(typ, "", l, CompressionNone, err)
@@ -472,6 +643,10 @@ func decodeRPC(ctx context.Context, l int, r *frameReader, p protocolHandlers, c
 		data = &rpcCancelMessage{name: &MethodV2{}}
 	case MethodCallCompressed:
 		data = newRPCCallCompressedMessage()
+	case MethodGoAway:
+		data = &rpcGoAwayMessage{}
+	case MethodHandshake:
+		data = &rpcHandshakeMessage{}
 	default:
 		return nil, newRPCDecodeError(typ, "", l, CompressionNone, errors.New("invalid RPC type"))
 	}
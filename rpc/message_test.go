@@ -25,12 +25,38 @@ func createMessageTestProtocol(t *testing.T) protocolHandlers {
 		},
 	})
 	require.NoError(t, err)
-	return protocolHandlers{v1: p}
+	p2 := newProtocolV2Handler(nil)
+	err = p2.registerProtocol(ProtocolV2{
+		Name: "abc2",
+		ID:   0x2a,
+		Methods: map[Position]ServeHandlerDescriptionV2{
+			3: {
+				ServeHandlerDescription: ServeHandlerDescription{
+					MakeArg: func() interface{} {
+						return new(string)
+					},
+					Handler: func(context.Context, interface{}) (interface{}, error) {
+						return nil, nil
+					},
+				},
+				Name: "hello",
+			},
+		},
+	})
+	require.NoError(t, err)
+	return protocolHandlers{v1: p, v2: p2}
+}
+
+// doWithAllCodecs runs fn once for each codec, in a subtest.
+func doWithAllCodecs(t *testing.T, fn func(t *testing.T, ct CodecType)) {
+	for _, ct := range []CodecType{CodecMsgpack, CodecJSON, CodecCBOR} {
+		t.Run(ct.String(), func(t *testing.T) { fn(t, ct) })
+	}
 }
 
-func runMessageTest(t *testing.T, ctype CompressionType, v []interface{}) (rpcMessage, error) {
+func runMessageTest(t *testing.T, ct CodecType, ctype CompressionType, v []interface{}) (rpcMessage, error) {
 	var buf bytes.Buffer
-	enc := newFramedMsgpackEncoder(testMaxFrameLength, &buf)
+	enc := newFramedEncoder(testMaxFrameLength, &buf, ct, nil)
 	cc := newCallContainer()
 	instrumenterStorage := NewMemoryInstrumentationStorage()
 	record := NewNetworkInstrumenter(instrumenterStorage, "foo.bar")
@@ -38,7 +64,7 @@ func runMessageTest(t *testing.T, ctype CompressionType, v []interface{}) (rpcMe
 	cc.AddCall(c)
 
 	log := newTestLog(t)
-	pkt := newPacketizer(testMaxFrameLength, &buf, createMessageTestProtocol(t),
+	pkt := newCodecPacketizer(ct, testMaxFrameLength, &buf, createMessageTestProtocol(t),
 		cc, log, instrumenterStorage)
 
 	size, errCh := enc.EncodeAndWrite(c.ctx, v, nil)
@@ -50,107 +76,174 @@ func runMessageTest(t *testing.T, ctype CompressionType, v []interface{}) (rpcMe
 }
 
 func TestMessageDecodeValid(t *testing.T) {
-	v := []interface{}{MethodCall, 999, "abc.hello", new(interface{})}
+	doWithAllCodecs(t, func(t *testing.T, ct CodecType) {
+		v := []interface{}{MethodCall, 999, "abc.hello", new(interface{})}
 
-	rpc, err := runMessageTest(t, CompressionNone, v)
-	require.NoError(t, err)
-	c, ok := rpc.(*rpcCallMessage)
-	require.True(t, ok)
-	require.Equal(t, MethodCall, c.Type())
-	require.Equal(t, CompressionNone, c.Compression())
-	require.Equal(t, SeqNumber(999), c.SeqNo())
-	require.Equal(t, newMethodV1("abc.hello"), c.Name())
-	require.Equal(t, nil, c.Arg())
+		rpc, err := runMessageTest(t, ct, CompressionNone, v)
+		require.NoError(t, err)
+		c, ok := rpc.(*rpcCallMessage)
+		require.True(t, ok)
+		require.Equal(t, MethodCall, c.Type())
+		require.Equal(t, CompressionNone, c.Compression())
+		require.Equal(t, SeqNumber(999), c.SeqNo())
+		require.Equal(t, newMethodV1("abc.hello"), c.Name())
+		require.Equal(t, nil, c.Arg())
+	})
 }
 
 func TestMessageDecodeValidCompressed(t *testing.T) {
-	doWithAllCompressionTypes(func(ctype CompressionType) {
-		v := []interface{}{MethodCallCompressed, 999, ctype, "abc.hello", new(interface{})}
+	doWithAllCodecs(t, func(t *testing.T, ct CodecType) {
+		doWithAllCompressionTypes(func(ctype CompressionType) {
+			v := []interface{}{MethodCallCompressed, 999, ctype, "abc.hello", new(interface{})}
+
+			rpc, err := runMessageTest(t, ct, ctype, v)
+			require.NoError(t, err)
+			c, ok := rpc.(*rpcCallCompressedMessage)
+			require.True(t, ok)
+			require.Equal(t, MethodCallCompressed, c.Type())
+			require.Equal(t, ctype, c.Compression())
+			require.Equal(t, SeqNumber(999), c.SeqNo())
+			require.Equal(t, newMethodV1("abc.hello"), c.Name())
+			require.Equal(t, nil, c.Arg())
+		})
+	})
+}
+
+func TestMessageDecodeValidExtraParams(t *testing.T) {
+	doWithAllCodecs(t, func(t *testing.T, ct CodecType) {
+		tags := ctxlog.CtxLogTags{"hello": "world"}
+		v := []interface{}{MethodCall, 999, "abc.hello", new(interface{}), tags, "foo"}
 
-		rpc, err := runMessageTest(t, ctype, v)
+		rpc, err := runMessageTest(t, ct, CompressionNone, v)
 		require.NoError(t, err)
-		c, ok := rpc.(*rpcCallCompressedMessage)
+		c, ok := rpc.(*rpcCallMessage)
 		require.True(t, ok)
-		require.Equal(t, MethodCallCompressed, c.Type())
-		require.Equal(t, ctype, c.Compression())
+		require.Equal(t, MethodCall, c.Type())
 		require.Equal(t, SeqNumber(999), c.SeqNo())
+		require.Equal(t, CompressionNone, c.Compression())
 		require.Equal(t, newMethodV1("abc.hello"), c.Name())
 		require.Equal(t, nil, c.Arg())
+		resultTags, ok := ctxlog.TagsFromContext(c.Context())
+		require.True(t, ok)
+		require.Equal(t, tags, resultTags)
 	})
 }
 
-func TestMessageDecodeValidExtraParams(t *testing.T) {
-	tags := ctxlog.CtxLogTags{"hello": "world"}
-	v := []interface{}{MethodCall, 999, "abc.hello", new(interface{}), tags, "foo"}
+func TestMessageDecodeValidHeaders(t *testing.T) {
+	doWithAllCodecs(t, func(t *testing.T, ct CodecType) {
+		tags := ctxlog.CtxLogTags{}
+		headers := map[string]string{"traceparent": "abc"}
+		v := []interface{}{MethodCall, 999, "abc.hello", new(interface{}), tags, headers, "foo"}
 
-	rpc, err := runMessageTest(t, CompressionNone, v)
-	require.NoError(t, err)
-	c, ok := rpc.(*rpcCallMessage)
-	require.True(t, ok)
-	require.Equal(t, MethodCall, c.Type())
-	require.Equal(t, SeqNumber(999), c.SeqNo())
-	require.Equal(t, CompressionNone, c.Compression())
-	require.Equal(t, newMethodV1("abc.hello"), c.Name())
-	require.Equal(t, nil, c.Arg())
-	resultTags, ok := ctxlog.TagsFromContext(c.Context())
-	require.True(t, ok)
-	require.Equal(t, tags, resultTags)
+		rpc, err := runMessageTest(t, ct, CompressionNone, v)
+		require.NoError(t, err)
+		c, ok := rpc.(*rpcCallMessage)
+		require.True(t, ok)
+		require.Equal(t, headers, c.headers)
+	})
+}
+
+func TestAppendTrailer(t *testing.T) {
+	headers := map[string]string{"traceparent": "abc"}
+	trailer := appendTrailer(context.Background(), nil, headers)
+	require.Equal(t, []interface{}{ctxlog.CtxLogTags{}, headers}, trailer)
+	trailer = appendTrailer(ctxlog.AddTagsToContext(context.Background(), ctxlog.CtxLogTags{"a": "b"}), nil, nil)
+	require.Equal(t, []interface{}{ctxlog.CtxLogTags{"a": "b"}}, trailer)
+	require.Empty(t, appendTrailer(context.Background(), nil, nil))
+}
+
+func TestMessageDecodeValidNotifyV2(t *testing.T) {
+	doWithAllCodecs(t, func(t *testing.T, ct CodecType) {
+		// The method takes two fields, so a notify without tags is as
+		// long as one with them that names a V1 method.
+		v := []interface{}{MethodNotifyV2, ProtocolUniqueID(0x2a), Position(3), "hi"}
+
+		rpc, err := runMessageTest(t, ct, CompressionNone, v)
+		require.NoError(t, err)
+		n, ok := rpc.(*rpcNotifyMessage)
+		require.True(t, ok)
+		require.Equal(t, NewMethodV2(0x2a, 3, "abc2.hello"), n.Name())
+		require.Equal(t, "hi", *n.Arg().(*string))
+		_, ok = ctxlog.TagsFromContext(n.Context())
+		require.False(t, ok)
+
+		tags := ctxlog.CtxLogTags{"hello": "world"}
+		rpc, err = runMessageTest(t, ct, CompressionNone, append(v, tags))
+		require.NoError(t, err)
+		resultTags, ok := ctxlog.TagsFromContext(rpc.(*rpcNotifyMessage).Context())
+		require.True(t, ok)
+		require.Equal(t, tags, resultTags)
+	})
 }
 
 func TestMessageDecodeValidResponse(t *testing.T) {
-	v := []interface{}{MethodResponse, SeqNumber(0), nil, "hi"}
-	rpc, err := runMessageTest(t, CompressionNone, v)
-	require.NoError(t, err)
-	c, ok := rpc.(*rpcResponseMessage)
-	require.True(t, ok)
-	require.Equal(t, MethodResponse, c.Type())
-	require.Equal(t, CompressionNone, c.Compression())
-	require.Equal(t, SeqNumber(0), c.SeqNo())
-	resAsString, ok := c.Res().(*string)
-	require.True(t, ok)
-	require.Equal(t, "hi", *resAsString)
-	require.True(t, ok)
+	doWithAllCodecs(t, func(t *testing.T, ct CodecType) {
+		v := []interface{}{MethodResponse, SeqNumber(0), nil, "hi"}
+		rpc, err := runMessageTest(t, ct, CompressionNone, v)
+		require.NoError(t, err)
+		c, ok := rpc.(*rpcResponseMessage)
+		require.True(t, ok)
+		require.Equal(t, MethodResponse, c.Type())
+		require.Equal(t, CompressionNone, c.Compression())
+		require.Equal(t, SeqNumber(0), c.SeqNo())
+		resAsString, ok := c.Res().(*string)
+		require.True(t, ok)
+		require.Equal(t, "hi", *resAsString)
+		require.True(t, ok)
+	})
 }
 
 func TestMessageDecodeInvalidType(t *testing.T) {
-	v := []interface{}{"hello", SeqNumber(0), "invalid", new(interface{})}
+	doWithAllCodecs(t, func(t *testing.T, ct CodecType) {
+		v := []interface{}{"hello", SeqNumber(0), "invalid", new(interface{})}
 
-	_, err := runMessageTest(t, CompressionNone, v)
-	require.Error(t, err)
-	require.Contains(t, err.Error(), "RPC error. type: Invalid, method: , length: 4, compression: none, error: error decoding message field at position 0, error: ")
+		_, err := runMessageTest(t, ct, CompressionNone, v)
+		require.Error(t, err)
+		require.Contains(t, err.Error(), "RPC error. type: Invalid, method: , length: 4, compression: none, error: error decoding message field at position 0, error: ")
+	})
 }
 
 func TestMessageDecodeInvalidMethodType(t *testing.T) {
-	v := []interface{}{MethodType(999), SeqNumber(0), "invalid", new(interface{})}
+	doWithAllCodecs(t, func(t *testing.T, ct CodecType) {
+		v := []interface{}{MethodType(999), SeqNumber(0), "invalid", new(interface{})}
 
-	_, err := runMessageTest(t, CompressionNone, v)
-	require.EqualError(t, err, "RPC error. type: Method(999), method: , length: 4, compression: none, error: invalid RPC type")
+		_, err := runMessageTest(t, ct, CompressionNone, v)
+		require.EqualError(t, err, "RPC error. type: Method(999), method: , length: 4, compression: none, error: invalid RPC type")
+	})
 }
 
 func TestMessageDecodeInvalidProtocol(t *testing.T) {
-	v := []interface{}{MethodCall, SeqNumber(0), "nonexistent.broken", new(interface{})}
+	doWithAllCodecs(t, func(t *testing.T, ct CodecType) {
+		v := []interface{}{MethodCall, SeqNumber(0), "nonexistent.broken", new(interface{})}
 
-	_, err := runMessageTest(t, CompressionNone, v)
-	require.EqualError(t, err, "RPC error. type: Call, method: nonexistent.broken, length: 4, compression: none, error: protocol not found: nonexistent")
+		_, err := runMessageTest(t, ct, CompressionNone, v)
+		require.EqualError(t, err, "RPC error. type: Call, method: nonexistent.broken, length: 4, compression: none, error: protocol not found: nonexistent")
+	})
 }
 
 func TestMessageDecodeInvalidMethod(t *testing.T) {
-	v := []interface{}{MethodCall, SeqNumber(0), "abc.invalid", new(interface{})}
+	doWithAllCodecs(t, func(t *testing.T, ct CodecType) {
+		v := []interface{}{MethodCall, SeqNumber(0), "abc.invalid", new(interface{})}
 
-	_, err := runMessageTest(t, CompressionNone, v)
-	require.EqualError(t, err, "RPC error. type: Call, method: abc.invalid, length: 4, compression: none, error: method 'invalid' not found in protocol 'abc'")
+		_, err := runMessageTest(t, ct, CompressionNone, v)
+		require.EqualError(t, err, "RPC error. type: Call, method: abc.invalid, length: 4, compression: none, error: method 'invalid' not found in protocol 'abc'")
+	})
 }
 
 func TestMessageDecodeWrongMessageLength(t *testing.T) {
-	v := []interface{}{MethodCall, SeqNumber(0), "abc.invalid"}
+	doWithAllCodecs(t, func(t *testing.T, ct CodecType) {
+		v := []interface{}{MethodCall, SeqNumber(0), "abc.invalid"}
 
-	_, err := runMessageTest(t, CompressionNone, v)
-	require.EqualError(t, err, "RPC error. type: Call, method: , length: 3, compression: none, error: wrong message length")
+		_, err := runMessageTest(t, ct, CompressionNone, v)
+		require.EqualError(t, err, "RPC error. type: Call, method: , length: 3, compression: none, error: wrong message length")
+	})
 }
 
 func TestMessageDecodeResponseNilCall(t *testing.T) {
-	v := []interface{}{MethodResponse, SeqNumber(-1), 32, "hi"}
+	doWithAllCodecs(t, func(t *testing.T, ct CodecType) {
+		v := []interface{}{MethodResponse, SeqNumber(-1), 32, "hi"}
 
-	_, err := runMessageTest(t, CompressionNone, v)
-	require.EqualError(t, err, "RPC error. type: Response, method: , length: 4, compression: none, error: Call not found for sequence number -1")
+		_, err := runMessageTest(t, ct, CompressionNone, v)
+		require.EqualError(t, err, "RPC error. type: Response, method: , length: 4, compression: none, error: Call not found for sequence number -1")
+	})
 }
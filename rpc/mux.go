@@ -0,0 +1,644 @@
+package rpc
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+// A Mux carries logical channels over a single connection, so that
+// independent subsystems can each have their own transport, with its own
+// protocols, outstanding calls and lifecycle, without a connection each.
+// Either side can open channels, and close them. Each MuxChannel is a
+// net.Conn, to be passed to NewTransport like any other.
+//
+// Channels have their own flow control, so a channel whose reader falls
+// behind doesn't hold up the others, and an error on a channel, such as a
+// bad frame, only closes that channel's transport. Errors of the underlying
+// connection close every channel.
+//
+// A channel counts against MuxOpts.MaxChannels until both sides have closed
+// it, and its ID isn't reused until then.
+//
+// On the wire, the mux frames each have a 9-byte header, with their type, the
+// channel ID and the length of their payload, and then the payload.
+type Mux struct {
+	conn    net.Conn
+	opts    MuxOpts
+	writeMu sync.Mutex
+
+	sync.Mutex
+	channels map[uint32]*MuxChannel
+	nextID   uint32
+	acceptCh chan *MuxChannel
+	doneCh   chan struct{}
+	doneOnce sync.Once
+	err      error
+}
+
+type muxFrameType byte
+
+const (
+	// muxFrameOpen opens a channel. Its payload is the channel's name.
+	muxFrameOpen muxFrameType = 1
+	muxFrameData muxFrameType = 2
+	// muxFrameWindow lets the peer send more on a channel. Its payload is
+	// the number of bytes, as a uint32.
+	muxFrameWindow muxFrameType = 3
+	muxFrameClose  muxFrameType = 4
+)
+
+const (
+	muxHeaderSize = 9
+	// muxInitialWindow is how much either side can send on a new channel
+	// before it hears from the other.
+	muxInitialWindow = 64 * 1024
+	// maxMuxChunk bounds the payload of data frames.
+	maxMuxChunk = 16 * 1024
+	// MaxMuxChannelName bounds the length of channel names.
+	MaxMuxChannelName       = 1024
+	defaultMuxWindow        = 256 * 1024
+	defaultMuxAcceptBacklog = 64
+	defaultMuxMaxChannels   = 1024
+	// maxMuxChannels is less than half of the IDs, those of one side.
+	maxMuxChannels = 1<<31 - 1
+)
+
+// MuxOpts are the options of a Mux.
+type MuxOpts struct {
+	// Window is how many bytes each channel buffers, before the peer has
+	// to wait for them to be read. It defaults to 256KiB, and can't be
+	// less than 64KiB.
+	Window uint32
+	// AcceptBacklog is how many channels opened by the peer can wait for
+	// Accept. Channels opened beyond that are closed right away. It
+	// defaults to 64.
+	AcceptBacklog int
+	// MaxChannels is how many channels can be open at once, counting
+	// those that only one side has closed, so that a peer that never
+	// closes its side can't use up memory or channel IDs. Open fails with
+	// a MuxChannelLimitError beyond it, and channels that the peer opens
+	// beyond it are closed right away. It defaults to 1024.
+	MaxChannels int
+}
+
+// NewMux makes a Mux over conn, and starts reading from it. One side of the
+// connection must be the initiator, and the other not, so that the channels
+// they open get different IDs.
+func NewMux(conn net.Conn, initiator bool) *Mux {
+	return NewMuxWithOpts(conn, initiator, MuxOpts{})
+}
+
+// NewMuxWithOpts is like NewMux, but takes additional optional parameters.
+func NewMuxWithOpts(conn net.Conn, initiator bool, opts MuxOpts) *Mux {
+	if opts.Window < muxInitialWindow {
+		if opts.Window == 0 {
+			opts.Window = defaultMuxWindow
+		} else {
+			opts.Window = muxInitialWindow
+		}
+	}
+	if opts.AcceptBacklog <= 0 {
+		opts.AcceptBacklog = defaultMuxAcceptBacklog
+	}
+	if opts.MaxChannels <= 0 {
+		opts.MaxChannels = defaultMuxMaxChannels
+	} else if opts.MaxChannels > maxMuxChannels {
+		opts.MaxChannels = maxMuxChannels
+	}
+	m := &Mux{
+		conn:     conn,
+		opts:     opts,
+		channels: make(map[uint32]*MuxChannel),
+		nextID:   2,
+		acceptCh: make(chan *MuxChannel, opts.AcceptBacklog),
+		doneCh:   make(chan struct{}),
+	}
+	if initiator {
+		m.nextID = 1
+	}
+	go m.readLoop()
+	return m
+}
+
+// Open opens a channel. The name is for the peer to tell channels apart
+// when it accepts them, e.g. by subsystem; it doesn't have to be unique.
+func (m *Mux) Open(name string) (*MuxChannel, error) {
+	if len(name) > MaxMuxChannelName {
+		return nil, fmt.Errorf("mux channel name too long: %d > %d", len(name), MaxMuxChannelName)
+	}
+	m.Lock()
+	if m.err != nil {
+		m.Unlock()
+		return nil, m.err
+	}
+	if len(m.channels) >= m.opts.MaxChannels {
+		m.Unlock()
+		return nil, MuxChannelLimitError{Max: m.opts.MaxChannels}
+	}
+	c := m.newChannelLocked(m.nextIDLocked(), name)
+	m.Unlock()
+
+	if err := m.writeFrame(muxFrameOpen, c.id, []byte(name)); err != nil {
+		return nil, err
+	}
+	c.growRemoteWindow()
+	return c, nil
+}
+
+// Accept waits for the next channel opened by the peer.
+func (m *Mux) Accept() (*MuxChannel, error) {
+	select {
+	case c := <-m.acceptCh:
+		return c, nil
+	case <-m.doneCh:
+		// Channels that were opened before the Mux was done can
+		// still be accepted.
+		select {
+		case c := <-m.acceptCh:
+			return c, nil
+		default:
+		}
+		return nil, m.Err()
+	}
+}
+
+// Close closes the connection, and with it every channel.
+func (m *Mux) Close() error {
+	m.fail(net.ErrClosed)
+	return nil
+}
+
+// Done returns a channel that's closed when the Mux is closed, or its
+// connection fails.
+func (m *Mux) Done() <-chan struct{} {
+	return m.doneCh
+}
+
+// Err returns why the Mux is done, or nil if it isn't.
+func (m *Mux) Err() error {
+	m.Lock()
+	defer m.Unlock()
+	return m.err
+}
+
+// nextIDLocked returns the next ID with our parity that no channel has. IDs
+// wrap around, so those of channels that are still open are skipped; there
+// is a free one, since there are fewer channels than IDs with our parity.
+func (m *Mux) nextIDLocked() uint32 {
+	for {
+		id := m.nextID
+		m.nextID += 2
+		if _, found := m.channels[id]; !found {
+			return id
+		}
+	}
+}
+
+func (m *Mux) newChannelLocked(id uint32, name string) *MuxChannel {
+	c := &MuxChannel{
+		mux:        m,
+		id:         id,
+		name:       name,
+		notifyCh:   make(chan struct{}),
+		recvWindow: muxInitialWindow,
+		sendWindow: muxInitialWindow,
+	}
+	m.channels[id] = c
+	return c
+}
+
+func (m *Mux) forget(id uint32) {
+	m.Lock()
+	defer m.Unlock()
+	delete(m.channels, id)
+}
+
+func (m *Mux) fail(err error) {
+	m.doneOnce.Do(func() {
+		m.Lock()
+		m.err = err
+		channels := make([]*MuxChannel, 0, len(m.channels))
+		for _, c := range m.channels {
+			channels = append(channels, c)
+		}
+		m.Unlock()
+		close(m.doneCh)
+		m.conn.Close()
+		for _, c := range channels {
+			c.fail(err)
+		}
+	})
+}
+
+func (m *Mux) writeFrame(typ muxFrameType, id uint32, payload []byte) error {
+	buf := make([]byte, muxHeaderSize, muxHeaderSize+len(payload))
+	buf[0] = byte(typ)
+	binary.BigEndian.PutUint32(buf[1:5], id)
+	binary.BigEndian.PutUint32(buf[5:9], uint32(len(payload)))
+	buf = append(buf, payload...)
+
+	m.writeMu.Lock()
+	defer m.writeMu.Unlock()
+	if err := m.Err(); err != nil {
+		return err
+	}
+	if _, err := m.conn.Write(buf); err != nil {
+		m.fail(err)
+		return err
+	}
+	return nil
+}
+
+func (m *Mux) writeWindow(id uint32, n uint32) error {
+	var payload [4]byte
+	binary.BigEndian.PutUint32(payload[:], n)
+	return m.writeFrame(muxFrameWindow, id, payload[:])
+}
+
+func (m *Mux) readLoop() {
+	r := bufio.NewReader(m.conn)
+	var header [muxHeaderSize]byte
+	for {
+		if _, err := io.ReadFull(r, header[:]); err != nil {
+			m.fail(err)
+			return
+		}
+		typ := muxFrameType(header[0])
+		id := binary.BigEndian.Uint32(header[1:5])
+		l := binary.BigEndian.Uint32(header[5:9])
+		if max := maxMuxPayload(typ); l > max {
+			m.fail(newMuxError("payload too big for frame type %d: %d > %d", typ, l, max))
+			return
+		}
+		payload := make([]byte, l)
+		if _, err := io.ReadFull(r, payload); err != nil {
+			m.fail(err)
+			return
+		}
+		if err := m.handleFrame(typ, id, payload); err != nil {
+			m.fail(err)
+			return
+		}
+	}
+}
+
+func maxMuxPayload(typ muxFrameType) uint32 {
+	switch typ {
+	case muxFrameOpen:
+		return MaxMuxChannelName
+	case muxFrameData:
+		return maxMuxChunk
+	case muxFrameWindow:
+		return 4
+	default:
+		return 0
+	}
+}
+
+func (m *Mux) handleFrame(typ muxFrameType, id uint32, payload []byte) error {
+	if typ == muxFrameOpen {
+		return m.handleOpen(id, string(payload))
+	}
+
+	m.Lock()
+	c := m.channels[id]
+	m.Unlock()
+	// Frames for channels that are gone are dropped: they were sent before
+	// the peer knew.
+	if c == nil {
+		return nil
+	}
+	switch typ {
+	case muxFrameData:
+		return c.receive(payload)
+	case muxFrameWindow:
+		if len(payload) != 4 {
+			return newMuxError("bad window frame length: %d", len(payload))
+		}
+		c.growSendWindow(binary.BigEndian.Uint32(payload))
+		return nil
+	case muxFrameClose:
+		c.remoteClose()
+		return nil
+	default:
+		return newMuxError("unknown frame type %d", typ)
+	}
+}
+
+func (m *Mux) handleOpen(id uint32, name string) error {
+	m.Lock()
+	// The peer opens the channels with the other parity.
+	if id%2 == m.nextID%2 {
+		m.Unlock()
+		return newMuxError("peer opened channel %d, which has our parity", id)
+	}
+	if _, found := m.channels[id]; found {
+		m.Unlock()
+		return newMuxError("peer opened channel %d twice", id)
+	}
+	if len(m.channels) >= m.opts.MaxChannels {
+		m.Unlock()
+		// The channel isn't tracked, so whatever else the peer sends on
+		// it is dropped.
+		go func() { _ = m.writeFrame(muxFrameClose, id, nil) }()
+		return nil
+	}
+	c := m.newChannelLocked(id, name)
+	m.Unlock()
+
+	// The read loop doesn't write, lest both sides of the connection wait
+	// on each other's writes.
+	select {
+	case m.acceptCh <- c:
+		go c.growRemoteWindow()
+	default:
+		// Nobody is accepting.
+		go c.Close()
+	}
+	return nil
+}
+
+// MuxChannel is a logical channel of a Mux. It's a net.Conn, to be passed to
+// NewTransport.
+type MuxChannel struct {
+	mux  *Mux
+	id   uint32
+	name string
+
+	sync.Mutex
+	// notifyCh is closed, and replaced, whenever the state changes.
+	notifyCh chan struct{}
+	recvBuf  bytes.Buffer
+	// recvWindow is how much more the peer may send.
+	recvWindow uint32
+	// consumed is how much was read since the last window update.
+	consumed      uint32
+	sendWindow    uint32
+	localClosed   bool
+	remoteClosed  bool
+	err           error
+	readDeadline  time.Time
+	writeDeadline time.Time
+}
+
+var _ net.Conn = (*MuxChannel)(nil)
+
+// ID returns the ID of the channel, which is unique in its Mux.
+func (c *MuxChannel) ID() uint32 { return c.id }
+
+// Name returns the name the channel was opened with.
+func (c *MuxChannel) Name() string { return c.name }
+
+func (c *MuxChannel) notifyLocked() {
+	close(c.notifyCh)
+	c.notifyCh = make(chan struct{})
+}
+
+// waitLocked waits for the state to change, or for the deadline. It's called
+// with the lock held, and returns with it held.
+func (c *MuxChannel) waitLocked(deadline time.Time) error {
+	ch := c.notifyCh
+	c.Unlock()
+	defer c.Lock()
+	if deadline.IsZero() {
+		<-ch
+		return nil
+	}
+	d := time.Until(deadline)
+	if d <= 0 {
+		return os.ErrDeadlineExceeded
+	}
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-ch:
+		return nil
+	case <-timer.C:
+		return os.ErrDeadlineExceeded
+	}
+}
+
+// growRemoteWindow lets the peer send up to the full window, rather than the
+// initial one.
+func (c *MuxChannel) growRemoteWindow() {
+	n := c.mux.opts.Window - muxInitialWindow
+	if n == 0 {
+		return
+	}
+	c.Lock()
+	c.recvWindow += n
+	c.Unlock()
+	_ = c.mux.writeWindow(c.id, n)
+}
+
+func (c *MuxChannel) receive(data []byte) error {
+	c.Lock()
+	defer c.Unlock()
+	if uint32(len(data)) > c.recvWindow {
+		return newMuxError("peer overflowed the window of channel %d", c.id)
+	}
+	c.recvWindow -= uint32(len(data))
+	// Data that arrives after Close is dropped.
+	if c.localClosed {
+		return nil
+	}
+	c.recvBuf.Write(data)
+	c.notifyLocked()
+	return nil
+}
+
+func (c *MuxChannel) growSendWindow(n uint32) {
+	c.Lock()
+	defer c.Unlock()
+	c.sendWindow += n
+	c.notifyLocked()
+}
+
+func (c *MuxChannel) remoteClose() {
+	c.Lock()
+	c.remoteClosed = true
+	c.notifyLocked()
+	local := c.localClosed
+	c.Unlock()
+	if local {
+		c.mux.forget(c.id)
+	}
+}
+
+func (c *MuxChannel) fail(err error) {
+	c.Lock()
+	defer c.Unlock()
+	if c.err == nil {
+		c.err = err
+		c.notifyLocked()
+	}
+}
+
+// Read reads the data the peer sent on the channel. It returns io.EOF once
+// the peer has closed the channel, and all its data has been read.
+func (c *MuxChannel) Read(p []byte) (int, error) {
+	c.Lock()
+	for {
+		if c.recvBuf.Len() > 0 {
+			n, _ := c.recvBuf.Read(p)
+			c.consumed += uint32(n)
+			// Return the window in big enough chunks.
+			var update uint32
+			if c.consumed >= c.mux.opts.Window/2 && !c.remoteClosed {
+				update = c.consumed
+				c.consumed = 0
+				c.recvWindow += update
+			}
+			c.Unlock()
+			if update > 0 {
+				_ = c.mux.writeWindow(c.id, update)
+			}
+			return n, nil
+		}
+		switch {
+		case c.localClosed:
+			c.Unlock()
+			return 0, net.ErrClosed
+		case c.remoteClosed:
+			c.Unlock()
+			return 0, io.EOF
+		case c.err != nil:
+			err := c.err
+			c.Unlock()
+			return 0, err
+		}
+		if err := c.waitLocked(c.readDeadline); err != nil {
+			c.Unlock()
+			return 0, err
+		}
+	}
+}
+
+// Write sends p on the channel, waiting for the peer to make room for it.
+func (c *MuxChannel) Write(p []byte) (int, error) {
+	var written int
+	c.Lock()
+	for len(p) > 0 {
+		switch {
+		case c.localClosed:
+			c.Unlock()
+			return written, net.ErrClosed
+		case c.remoteClosed:
+			c.Unlock()
+			return written, io.ErrClosedPipe
+		case c.err != nil:
+			err := c.err
+			c.Unlock()
+			return written, err
+		}
+		if c.sendWindow == 0 {
+			if err := c.waitLocked(c.writeDeadline); err != nil {
+				c.Unlock()
+				return written, err
+			}
+			continue
+		}
+		n := len(p)
+		if n > maxMuxChunk {
+			n = maxMuxChunk
+		}
+		if uint32(n) > c.sendWindow {
+			n = int(c.sendWindow)
+		}
+		c.sendWindow -= uint32(n)
+		c.Unlock()
+		if err := c.mux.writeFrame(muxFrameData, c.id, p[:n]); err != nil {
+			return written, err
+		}
+		written += n
+		p = p[n:]
+		c.Lock()
+	}
+	c.Unlock()
+	return written, nil
+}
+
+// Close closes the channel. The peer reads io.EOF once it has read what was
+// sent before.
+func (c *MuxChannel) Close() error {
+	c.Lock()
+	if c.localClosed {
+		c.Unlock()
+		return nil
+	}
+	c.localClosed = true
+	c.recvBuf.Reset()
+	c.notifyLocked()
+	remote, failed := c.remoteClosed, c.err != nil
+	c.Unlock()
+
+	if remote || failed {
+		c.mux.forget(c.id)
+	}
+	if !failed {
+		_ = c.mux.writeFrame(muxFrameClose, c.id, nil)
+	}
+	return nil
+}
+
+// muxAddr is the address of a channel: that of the connection, with the
+// channel's ID and name.
+type muxAddr struct {
+	addr net.Addr
+	id   uint32
+	name string
+}
+
+func (a muxAddr) Network() string {
+	if a.addr == nil {
+		return "mux"
+	}
+	return a.addr.Network()
+}
+
+func (a muxAddr) String() string {
+	addr := "-"
+	if a.addr != nil {
+		addr = a.addr.String()
+	}
+	return fmt.Sprintf("%s#%d(%s)", addr, a.id, a.name)
+}
+
+func (c *MuxChannel) LocalAddr() net.Addr {
+	return muxAddr{c.mux.conn.LocalAddr(), c.id, c.name}
+}
+
+func (c *MuxChannel) RemoteAddr() net.Addr {
+	return muxAddr{c.mux.conn.RemoteAddr(), c.id, c.name}
+}
+
+func (c *MuxChannel) SetDeadline(t time.Time) error {
+	c.Lock()
+	defer c.Unlock()
+	c.readDeadline, c.writeDeadline = t, t
+	c.notifyLocked()
+	return nil
+}
+
+func (c *MuxChannel) SetReadDeadline(t time.Time) error {
+	c.Lock()
+	defer c.Unlock()
+	c.readDeadline = t
+	c.notifyLocked()
+	return nil
+}
+
+func (c *MuxChannel) SetWriteDeadline(t time.Time) error {
+	c.Lock()
+	defer c.Unlock()
+	c.writeDeadline = t
+	c.notifyLocked()
+	return nil
+}
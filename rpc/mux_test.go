@@ -0,0 +1,301 @@
+package rpc
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"math"
+	"net"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func muxTestPair(t *testing.T, opts MuxOpts) (*Mux, *Mux) {
+	c1, c2 := net.Pipe()
+	m1 := NewMuxWithOpts(c1, true, opts)
+	m2 := NewMuxWithOpts(c2, false, opts)
+	t.Cleanup(func() {
+		m1.Close()
+		m2.Close()
+	})
+	return m1, m2
+}
+
+// serveMuxChannel serves a protocol named after the channel, whose echo
+// method returns its argument with the name appended.
+func serveMuxChannel(t *testing.T, c *MuxChannel) Transporter {
+	xp := NewTransport(context.Background(), c, nil, nil, nil, DefaultMaxFrameLength)
+	srv := NewServer(xp, nil)
+	require.NoError(t, srv.Register(Protocol{
+		Name: c.Name(),
+		Methods: map[string]ServeHandlerDescription{
+			"echo": {
+				MakeArg: func() interface{} { return new(string) },
+				Handler: func(_ context.Context, arg interface{}) (interface{}, error) {
+					return *arg.(*string) + "@" + c.Name(), nil
+				},
+			},
+		},
+	}))
+	srv.Run()
+	return xp
+}
+
+func acceptMuxChannel(t *testing.T, m *Mux) *MuxChannel {
+	ch := make(chan *MuxChannel, 1)
+	go func() {
+		c, err := m.Accept()
+		require.NoError(t, err)
+		ch <- c
+	}()
+	select {
+	case c := <-ch:
+		return c
+	case <-time.After(5 * time.Second):
+		require.FailNow(t, "timed out accepting a channel")
+		return nil
+	}
+}
+
+func muxEcho(t *testing.T, xp Transporter, protocol, arg string) (string, error) {
+	var res string
+	err := NewClient(xp, nil, nil).Call(context.Background(), newMethodV1(protocol+".echo"), arg, &res, 0)
+	return res, err
+}
+
+func TestMuxChannels(t *testing.T) {
+	m1, m2 := muxTestPair(t, MuxOpts{})
+
+	// Channels can be opened from either side, and each has its own
+	// protocols.
+	a1, err := m1.Open("a")
+	require.NoError(t, err)
+	a2 := acceptMuxChannel(t, m2)
+	require.Equal(t, "a", a2.Name())
+	require.Equal(t, a1.ID(), a2.ID())
+
+	b2, err := m2.Open("b")
+	require.NoError(t, err)
+	b1 := acceptMuxChannel(t, m1)
+	require.Equal(t, "b", b1.Name())
+	require.NotEqual(t, a1.ID(), b1.ID())
+
+	serveMuxChannel(t, a2)
+	serveMuxChannel(t, b1)
+	axp := NewTransport(context.Background(), a1, nil, nil, nil, DefaultMaxFrameLength)
+	bxp := NewTransport(context.Background(), b2, nil, nil, nil, DefaultMaxFrameLength)
+
+	res, err := muxEcho(t, axp, "a", "x")
+	require.NoError(t, err)
+	require.Equal(t, "x@a", res)
+	res, err = muxEcho(t, bxp, "b", "y")
+	require.NoError(t, err)
+	require.Equal(t, "y@b", res)
+	_, err = muxEcho(t, axp, "b", "z")
+	require.Error(t, err)
+
+	// Closing a channel's transport leaves the other channels be.
+	axp.Close()
+	_, err = muxEcho(t, axp, "a", "x")
+	require.Error(t, err)
+	res, err = muxEcho(t, bxp, "b", "still")
+	require.NoError(t, err)
+	require.Equal(t, "still@b", res)
+	require.Eventually(t, func() bool {
+		m1.Lock()
+		defer m1.Unlock()
+		_, found := m1.channels[a1.ID()]
+		return !found
+	}, 5*time.Second, time.Millisecond)
+
+	// So does a channel whose peer sends garbage.
+	c1, err := m1.Open("c")
+	require.NoError(t, err)
+	c2 := acceptMuxChannel(t, m2)
+	cxp := serveMuxChannel(t, c2)
+	_, err = c1.Write([]byte{0xc1, 0xc1, 0xc1, 0xc1})
+	require.NoError(t, err)
+	require.Eventually(t, func() bool { return !cxp.IsConnected() }, 5*time.Second, time.Millisecond)
+	_, err = io.ReadAll(c1)
+	require.NoError(t, err)
+	res, err = muxEcho(t, bxp, "b", "again")
+	require.NoError(t, err)
+	require.Equal(t, "again@b", res)
+
+	// Closing the Mux closes every channel.
+	require.NoError(t, m1.Close())
+	<-m2.Done()
+	require.Error(t, m2.Err())
+	_, err = muxEcho(t, bxp, "b", "gone")
+	require.Error(t, err)
+	_, err = m1.Open("d")
+	require.ErrorIs(t, err, net.ErrClosed)
+	_, err = m2.Accept()
+	require.Error(t, err)
+}
+
+func TestMuxFlowControl(t *testing.T) {
+	m1, m2 := muxTestPair(t, MuxOpts{Window: 128 * 1024})
+	slow1, err := m1.Open("slow")
+	require.NoError(t, err)
+	slow2 := acceptMuxChannel(t, m2)
+	fast1, err := m1.Open("fast")
+	require.NoError(t, err)
+	fast2 := acceptMuxChannel(t, m2)
+
+	// Writes past the window wait for the reader.
+	big := bytes.Repeat([]byte("0123456789abcdef"), 64*1024)
+	writeErrCh := make(chan error, 1)
+	go func() {
+		_, err := slow1.Write(big)
+		writeErrCh <- err
+	}()
+
+	// Meanwhile, the other channels carry on.
+	_, err = fast1.Write([]byte("ping"))
+	require.NoError(t, err)
+	buf := make([]byte, 4)
+	_, err = io.ReadFull(fast2, buf)
+	require.NoError(t, err)
+	require.Equal(t, "ping", string(buf))
+	select {
+	case err := <-writeErrCh:
+		require.FailNow(t, "write didn't wait for the reader", "err=%v", err)
+	case <-time.After(10 * time.Millisecond):
+	}
+
+	read := make([]byte, len(big))
+	_, err = io.ReadFull(slow2, read)
+	require.NoError(t, err)
+	require.Equal(t, big, read)
+	require.NoError(t, <-writeErrCh)
+
+	// Deadlines apply to waiting for the window, too.
+	require.NoError(t, slow1.SetWriteDeadline(time.Now().Add(10*time.Millisecond)))
+	_, err = slow1.Write(big)
+	require.ErrorIs(t, err, os.ErrDeadlineExceeded)
+	require.NoError(t, slow2.SetReadDeadline(time.Now().Add(-time.Second)))
+	require.NoError(t, fast2.SetReadDeadline(time.Now().Add(10*time.Millisecond)))
+	_, err = fast2.Read(buf)
+	require.ErrorIs(t, err, os.ErrDeadlineExceeded)
+
+	// Once the writer closes, the reader gets what was sent, then EOF.
+	_, err = fast1.Write([]byte("bye"))
+	require.NoError(t, err)
+	require.NoError(t, fast1.Close())
+	require.NoError(t, fast2.SetReadDeadline(time.Time{}))
+	rest, err := io.ReadAll(fast2)
+	require.NoError(t, err)
+	require.Equal(t, "bye", string(rest))
+	_, err = fast1.Write([]byte("more"))
+	require.ErrorIs(t, err, net.ErrClosed)
+}
+
+func TestMuxProtocolErrors(t *testing.T) {
+	// A peer that overflows the window breaks the mux.
+	c1, c2 := net.Pipe()
+	m := NewMux(c2, false)
+	defer m.Close()
+
+	frame := func(typ muxFrameType, id uint32, payload []byte) []byte {
+		buf := make([]byte, muxHeaderSize)
+		buf[0] = byte(typ)
+		binary.BigEndian.PutUint32(buf[1:5], id)
+		binary.BigEndian.PutUint32(buf[5:9], uint32(len(payload)))
+		return append(buf, payload...)
+	}
+	// Drain what the mux writes, such as window updates.
+	go func() { _, _ = io.Copy(io.Discard, c1) }()
+	_, err := c1.Write(frame(muxFrameOpen, 1, []byte("x")))
+	require.NoError(t, err)
+	chunk := make([]byte, maxMuxChunk)
+	for i := 0; i < int(defaultMuxWindow/maxMuxChunk)+1; i++ {
+		if _, err := c1.Write(frame(muxFrameData, 1, chunk)); err != nil {
+			break
+		}
+	}
+	<-m.Done()
+	var muxErr MuxError
+	require.True(t, errors.As(m.Err(), &muxErr))
+	require.Contains(t, m.Err().Error(), "overflowed the window")
+
+	// So does one that opens a channel with our parity.
+	c3, c4 := net.Pipe()
+	m = NewMux(c4, false)
+	defer m.Close()
+	go func() { _, _ = io.Copy(io.Discard, c3) }()
+	_, err = c3.Write(frame(muxFrameOpen, 2, nil))
+	require.NoError(t, err)
+	<-m.Done()
+	require.True(t, errors.As(m.Err(), &muxErr))
+}
+
+func TestMuxChannelIDsWrap(t *testing.T) {
+	m1, m2 := muxTestPair(t, MuxOpts{})
+	a1, err := m1.Open("a")
+	require.NoError(t, err)
+	acceptMuxChannel(t, m2)
+	require.Equal(t, uint32(1), a1.ID())
+
+	// Past the last ID, the IDs start over, skipping those of channels
+	// that are still open.
+	m1.Lock()
+	m1.nextID = math.MaxUint32
+	m1.Unlock()
+	b1, err := m1.Open("b")
+	require.NoError(t, err)
+	require.Equal(t, uint32(math.MaxUint32), b1.ID())
+	acceptMuxChannel(t, m2)
+	c1, err := m1.Open("c")
+	require.NoError(t, err)
+	require.Equal(t, uint32(3), c1.ID())
+	c2 := acceptMuxChannel(t, m2)
+	require.Equal(t, "c", c2.Name())
+	require.NoError(t, m2.Err())
+}
+
+func TestMuxMaxChannels(t *testing.T) {
+	c1, c2 := net.Pipe()
+	m1 := NewMuxWithOpts(c1, true, MuxOpts{MaxChannels: 2})
+	defer m1.Close()
+	m2 := NewMux(c2, false)
+	defer m2.Close()
+	a1, err := m1.Open("a")
+	require.NoError(t, err)
+	a2 := acceptMuxChannel(t, m2)
+	_, err = m1.Open("b")
+	require.NoError(t, err)
+	b2 := acceptMuxChannel(t, m2)
+	_, err = m1.Open("c")
+	require.Equal(t, MuxChannelLimitError{Max: 2}, err)
+
+	// A channel that only one side has closed still counts.
+	require.NoError(t, a1.Close())
+	_, err = m1.Open("c")
+	require.Equal(t, MuxChannelLimitError{Max: 2}, err)
+
+	// Channels that the peer opens beyond the limit are closed right
+	// away.
+	e2, err := m2.Open("e")
+	require.NoError(t, err)
+	_, err = e2.Read(make([]byte, 1))
+	require.Equal(t, io.EOF, err)
+	require.NoError(t, e2.Close())
+
+	// Once both sides have closed a channel, there's room again.
+	require.NoError(t, a2.Close())
+	require.Eventually(t, func() bool {
+		d1, err := m1.Open("d")
+		if err != nil {
+			return false
+		}
+		d2 := acceptMuxChannel(t, m2)
+		return d2.ID() == d1.ID()
+	}, 5*time.Second, time.Millisecond)
+	require.NoError(t, b2.Close())
+}
@@ -0,0 +1,539 @@
+package rpc
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/foks-proj/go-ctxlog"
+)
+
+// Ordered notifies are notifies that are delivered at least once, and
+// handled one at a time, in the order they were sent. An OrderedNotifier
+// buffers them, and sends them as calls to the notified method, whose
+// replies acknowledge them; it sends the unacknowledged ones again on the
+// next transport, after a reconnect. Each carries its session, which
+// identifies the OrderedNotifier, and its sequence number, in a header. The
+// receiving transport, if it has an OrderedNotifyReceiver, handles them in
+// order, and drops the ones it has already handled. Other transports handle
+// them like any other call: at least once, but in no particular order.
+// Notifies that the server refuses without handling them, e.g. because it's
+// draining, are sent again, along with the ones after them, which it refuses
+// in turn so that none is skipped.
+
+// orderedNotifyHeader is the header of ordered notifies. Its value is the
+// session and the sequence number, separated by a slash.
+const orderedNotifyHeader = "snowpack-ordered"
+
+const (
+	defaultOrderedNotifyMaxPending = 1024
+	defaultOrderedNotifySessionTTL = time.Hour
+	defaultOrderedNotifyRetryDelay = time.Second
+)
+
+type orderedNotifyKey struct{}
+
+// withOrderedNotify marks the calls made with ctx as ordered notifies, with
+// the given header.
+func withOrderedNotify(ctx context.Context, header string) context.Context {
+	return context.WithValue(ctx, orderedNotifyKey{}, header)
+}
+
+// addOrderedNotifyHeader adds the ordered notify header of ctx, if any, to
+// headers.
+func addOrderedNotifyHeader(ctx context.Context, headers map[string]string) map[string]string {
+	header, ok := ctx.Value(orderedNotifyKey{}).(string)
+	if !ok {
+		return headers
+	}
+	if headers == nil {
+		headers = make(map[string]string)
+	}
+	headers[orderedNotifyHeader] = header
+	return headers
+}
+
+func parseOrderedNotifyHeader(header string) (session string, seq uint64, err error) {
+	session, s, ok := strings.Cut(header, "/")
+	if !ok || session == "" {
+		return "", 0, fmt.Errorf("bad ordered notify header %q", header)
+	}
+	seq, err = strconv.ParseUint(s, 10, 64)
+	if err != nil {
+		return "", 0, fmt.Errorf("bad ordered notify header %q: %w", header, err)
+	}
+	return session, seq, nil
+}
+
+// OrderedNotifierOpts are the options of an OrderedNotifier.
+type OrderedNotifierOpts struct {
+	// MaxPending is how many notifies can wait to be acknowledged. Notify
+	// waits for room beyond that. It defaults to 1024.
+	MaxPending int
+	// OnError, if set, is called when the handler of a notify returns an
+	// error, or when a notify can't be sent for another reason than the
+	// transport failing, e.g. because its argument can't be encoded. The
+	// notify is taken as acknowledged anyway, so the next ones go on.
+	// Notifies that the server refuses without handling them, e.g. because
+	// it's draining, or over a rate limit, aren't errors: they're sent
+	// again.
+	OnError func(method Methoder, err error)
+	// RetryDelay is how long to wait before sending again, on the same
+	// transport, the notifies that the server refused. It defaults to a
+	// second. They're sent again right away on the next transport.
+	RetryDelay time.Duration
+}
+
+// OrderedNotifier sends ordered notifies, on the transports it's attached
+// to. See ConnectionOpts.OrderedNotifier, which attaches it to each of the
+// transports of a Connection. It is safe for concurrent use.
+type OrderedNotifier struct {
+	opts    OrderedNotifierOpts
+	session string
+
+	sync.Mutex
+	nextSeq uint64
+	// pending are the notifies that weren't acknowledged yet, by sequence
+	// number, with no gaps.
+	pending []*orderedNotify
+	// changeCh is closed, and replaced, whenever pending changes, or the
+	// notifier is attached to another transport.
+	changeCh chan struct{}
+	// gen counts the transports the notifier was attached to.
+	gen uint64
+	// resend, if set, is the sequence number to send from again on the
+	// current transport, since the server refused that notify.
+	resend uint64
+}
+
+type orderedNotify struct {
+	seq    uint64
+	method Methoder
+	arg    interface{}
+	tags   ctxlog.CtxLogTags
+}
+
+// NewOrderedNotifier makes an OrderedNotifier, with a new random session.
+func NewOrderedNotifier() *OrderedNotifier {
+	return NewOrderedNotifierWithOpts(OrderedNotifierOpts{})
+}
+
+// NewOrderedNotifierWithOpts is like NewOrderedNotifier, but takes
+// additional optional parameters.
+func NewOrderedNotifierWithOpts(opts OrderedNotifierOpts) *OrderedNotifier {
+	if opts.MaxPending <= 0 {
+		opts.MaxPending = defaultOrderedNotifyMaxPending
+	}
+	if opts.RetryDelay <= 0 {
+		opts.RetryDelay = defaultOrderedNotifyRetryDelay
+	}
+	var session [16]byte
+	_, _ = rand.Read(session[:])
+	return &OrderedNotifier{
+		opts:     opts,
+		session:  hex.EncodeToString(session[:]),
+		nextSeq:  1,
+		changeCh: make(chan struct{}),
+	}
+}
+
+func (n *OrderedNotifier) changedLocked() {
+	close(n.changeCh)
+	n.changeCh = make(chan struct{})
+}
+
+// Notify queues a notify, to be sent in order. It returns once the notify is
+// queued, waiting for room if MaxPending notifies are already, or until ctx
+// is done. The ctxlog tags of ctx are sent with it.
+func (n *OrderedNotifier) Notify(ctx context.Context, method Methoder, arg interface{}) error {
+	tags, _ := ctxlog.TagsFromContext(ctx)
+	n.Lock()
+	defer n.Unlock()
+	for len(n.pending) >= n.opts.MaxPending {
+		ch := n.changeCh
+		n.Unlock()
+		select {
+		case <-ch:
+		case <-ctx.Done():
+			n.Lock()
+			return ctx.Err()
+		}
+		n.Lock()
+	}
+	n.pending = append(n.pending, &orderedNotify{
+		seq:    n.nextSeq,
+		method: method,
+		arg:    arg,
+		tags:   tags,
+	})
+	n.nextSeq++
+	n.changedLocked()
+	return nil
+}
+
+// Pending returns how many notifies haven't been acknowledged yet.
+func (n *OrderedNotifier) Pending() int {
+	n.Lock()
+	defer n.Unlock()
+	return len(n.pending)
+}
+
+// Flush waits until every notify queued so far is acknowledged, or ctx is
+// done.
+func (n *OrderedNotifier) Flush(ctx context.Context) error {
+	n.Lock()
+	last := n.nextSeq - 1
+	for len(n.pending) > 0 && n.pending[0].seq <= last {
+		ch := n.changeCh
+		n.Unlock()
+		select {
+		case <-ch:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+		n.Lock()
+	}
+	n.Unlock()
+	return nil
+}
+
+// Attach makes the notifier send its notifies on xp, from the oldest
+// unacknowledged one, rather than on the transport it was attached to
+// before. It sends them until xp fails, or it's attached to another one.
+func (n *OrderedNotifier) Attach(xp Transporter) {
+	n.Lock()
+	n.gen++
+	gen := n.gen
+	n.resend = 0
+	var seq uint64
+	if len(n.pending) > 0 {
+		seq = n.pending[0].seq
+	} else {
+		seq = n.nextSeq
+	}
+	n.changedLocked()
+	n.Unlock()
+	go n.sendLoop(xp, gen, seq)
+}
+
+// next returns the notify with the given sequence number, or the one to
+// send again, waiting for it to be queued. It returns nil once the notifier
+// is attached to another transport, or xp is done.
+func (n *OrderedNotifier) next(xp Transporter, gen, seq uint64) *orderedNotify {
+	n.Lock()
+	defer n.Unlock()
+	for {
+		if n.gen != gen {
+			return nil
+		}
+		if n.resend != 0 {
+			seq = min(seq, n.resend)
+			n.resend = 0
+		}
+		if len(n.pending) > 0 {
+			// Notifies before the first pending one were acknowledged,
+			// on another transport, or since they were refused.
+			seq = max(seq, n.pending[0].seq)
+			if i := seq - n.pending[0].seq; i < uint64(len(n.pending)) {
+				return n.pending[i]
+			}
+		}
+		ch := n.changeCh
+		n.Unlock()
+		select {
+		case <-ch:
+		case <-xp.done():
+			n.Lock()
+			return nil
+		}
+		n.Lock()
+	}
+}
+
+// resendLater makes the send loop of gen send the notifies from seq on
+// again, after the retry delay, unless xp is done first.
+func (n *OrderedNotifier) resendLater(xp Transporter, gen, seq uint64) {
+	select {
+	case <-time.After(n.opts.RetryDelay):
+	case <-xp.done():
+		return
+	}
+	n.Lock()
+	defer n.Unlock()
+	if n.gen != gen || (n.resend != 0 && n.resend <= seq) {
+		return
+	}
+	n.resend = seq
+	n.changedLocked()
+}
+
+func (n *OrderedNotifier) ack(seq uint64) {
+	n.Lock()
+	defer n.Unlock()
+	i := 0
+	for i < len(n.pending) && n.pending[i].seq <= seq {
+		n.pending[i] = nil
+		i++
+	}
+	if i > 0 {
+		n.pending = n.pending[i:]
+		n.changedLocked()
+	}
+}
+
+// sendLoop sends the notifies from seq on. It sends one as soon as the
+// previous one is written, without waiting for its acknowledgement, so
+// that they're written in order.
+func (n *OrderedNotifier) sendLoop(xp Transporter, gen, seq uint64) {
+	for {
+		on := n.next(xp, gen, seq)
+		if on == nil {
+			return
+		}
+		// Each notify gets its own client, so that the send notifier of
+		// one that failed can't be taken for that of the next one.
+		sentCh := make(chan struct{}, 1)
+		cli := NewClientWithSendNotifier(xp, nil, nil, func(SeqNumber) {
+			sentCh <- struct{}{}
+		})
+		type result struct {
+			acked bool
+			err   error
+		}
+		resCh := make(chan result, 1)
+		go func() {
+			acked, err := n.send(xp, cli, on)
+			resCh <- result{acked, err}
+			if isRefusal(err) {
+				n.resendLater(xp, gen, on.seq)
+			}
+		}()
+		select {
+		case <-sentCh:
+		case res := <-resCh:
+			if res.err != nil && !isRefusal(res.err) {
+				// It will be sent again on the next transport.
+				return
+			}
+			if res.acked {
+				// A notify can be acknowledged, or refused, before
+				// its send notifier fires.
+				<-sentCh
+			}
+		}
+		seq = on.seq + 1
+	}
+}
+
+// send sends on, and waits for it to be acknowledged. It returns an error if
+// it wasn't because of xp, so that it's sent again on the next transport,
+// or if the server refused it without handling it, so that it's sent again
+// later. Other errors, e.g. if on can't be encoded, would happen again, so
+// on is given up on: it's reported to OnError, and dropped as if
+// acknowledged.
+func (n *OrderedNotifier) send(xp Transporter, cli *Client, on *orderedNotify) (acked bool, err error) {
+	ctx := withOrderedNotify(context.Background(), n.session+"/"+strconv.FormatUint(on.seq, 10))
+	if on.tags != nil {
+		ctx = ctxlog.AddTagsToContext(ctx, on.tags)
+	}
+	u := &orderedNotifyAcker{}
+	err = cli.Call2(ctx, on.method, on.arg, nil, 0, u)
+	acked = u.acked.Load()
+	if isRefusal(err) {
+		return acked, err
+	}
+	if isConnectionError(err) && !xp.IsConnected() {
+		// Even if the reply came, its status may not have.
+		return false, err
+	}
+	if !acked {
+		if err == nil {
+			err = fmt.Errorf("ordered notify %d wasn't acknowledged", on.seq)
+		}
+		if !xp.IsConnected() || isConnectionError(err) {
+			return false, err
+		}
+		err = fmt.Errorf("ordered notify %d dropped: %w", on.seq, err)
+	}
+	if err != nil && n.opts.OnError != nil {
+		n.opts.OnError(on.method, err)
+	}
+	n.ack(on.seq)
+	return acked, nil
+}
+
+// orderedNotifyAcker is the ErrorUnwrapper of an ordered notify, which
+// records that the reply came, whatever its error.
+type orderedNotifyAcker struct {
+	acked atomic.Bool
+}
+
+var _ ErrorUnwrapper = (*orderedNotifyAcker)(nil)
+
+func (a *orderedNotifyAcker) MakeArg() interface{} {
+	return new(interface{})
+}
+
+func (a *orderedNotifyAcker) UnwrapError(arg interface{}) (appError error, dispatchError error) {
+	a.acked.Store(true)
+	if e := *arg.(*interface{}); e != nil && e != "" {
+		return fmt.Errorf("%v", e), nil
+	}
+	return nil, nil
+}
+
+// OrderedNotifyReceiverOpts are the options of an OrderedNotifyReceiver.
+type OrderedNotifyReceiverOpts struct {
+	// SessionTTL is how long the receiver remembers the sessions that it
+	// hasn't heard from, to drop the notifies that they send again. It
+	// defaults to an hour.
+	SessionTTL time.Duration
+}
+
+// OrderedNotifyReceiver handles ordered notifies in order, and handles each
+// only once, for the transports that it's given to (see
+// TransportOpts.OrderedNotifies). A session's notifies are handled in order
+// even across transports, e.g. when a client reconnects, so a server should
+// use one receiver for all of its transports. It is safe for concurrent use.
+type OrderedNotifyReceiver struct {
+	opts OrderedNotifyReceiverOpts
+
+	sync.Mutex
+	sessions map[string]*orderedNotifySession
+}
+
+type orderedNotifySession struct {
+	sync.Mutex
+	// last is the sequence number of the last notify handled.
+	last uint64
+	// refused has the sequence numbers after last of the notifies that
+	// were refused, e.g. by a rate limit. The ones after them are refused
+	// too, until they're sent again, so that none is skipped.
+	refused map[uint64]struct{}
+	queue   []orderedNotifyTask
+	running bool
+	used    time.Time
+}
+
+type orderedNotifyTask struct {
+	seq uint64
+	// serve serves the notify, or just acknowledges it if it's a
+	// duplicate.
+	serve func(dup bool)
+	// refuse refuses the notify, which comes after one that was.
+	refuse func()
+}
+
+// NewOrderedNotifyReceiver makes an OrderedNotifyReceiver.
+func NewOrderedNotifyReceiver() *OrderedNotifyReceiver {
+	return NewOrderedNotifyReceiverWithOpts(OrderedNotifyReceiverOpts{})
+}
+
+// NewOrderedNotifyReceiverWithOpts is like NewOrderedNotifyReceiver, but
+// takes additional optional parameters.
+func NewOrderedNotifyReceiverWithOpts(opts OrderedNotifyReceiverOpts) *OrderedNotifyReceiver {
+	if opts.SessionTTL <= 0 {
+		opts.SessionTTL = defaultOrderedNotifySessionTTL
+	}
+	return &OrderedNotifyReceiver{
+		opts:     opts,
+		sessions: make(map[string]*orderedNotifySession),
+	}
+}
+
+// session returns the session with the given ID, making it if needed. Idle
+// sessions past their TTL are forgotten along the way.
+func (o *OrderedNotifyReceiver) session(id string) *orderedNotifySession {
+	now := time.Now()
+	o.Lock()
+	defer o.Unlock()
+	if s, ok := o.sessions[id]; ok {
+		return s
+	}
+	for sid, s := range o.sessions {
+		s.Lock()
+		expired := !s.running && now.Sub(s.used) > o.opts.SessionTTL
+		s.Unlock()
+		if expired {
+			delete(o.sessions, sid)
+		}
+	}
+	s := &orderedNotifySession{used: now}
+	o.sessions[id] = s
+	return s
+}
+
+// enqueue queues the task of a notify of the session with the given ID, to
+// be run after the ones before it.
+func (o *OrderedNotifyReceiver) enqueue(id string, t orderedNotifyTask) {
+	s := o.session(id)
+	s.Lock()
+	defer s.Unlock()
+	s.queue = append(s.queue, t)
+	s.used = time.Now()
+	if !s.running {
+		s.running = true
+		go s.run()
+	}
+}
+
+// refused records that the notify of the session with the given ID and
+// sequence number was refused, without being handled.
+func (o *OrderedNotifyReceiver) refused(id string, seq uint64) {
+	s := o.session(id)
+	s.Lock()
+	defer s.Unlock()
+	if seq > s.last {
+		if s.refused == nil {
+			s.refused = make(map[uint64]struct{})
+		}
+		s.refused[seq] = struct{}{}
+	}
+	s.used = time.Now()
+}
+
+// refusedBefore tells whether a notify before seq was refused, and not
+// handled since.
+func (s *orderedNotifySession) refusedBefore(seq uint64) bool {
+	for r := range s.refused {
+		if r < seq {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *orderedNotifySession) run() {
+	s.Lock()
+	for len(s.queue) > 0 {
+		t := s.queue[0]
+		s.queue[0] = orderedNotifyTask{}
+		s.queue = s.queue[1:]
+		dup := t.seq <= s.last
+		gap := !dup && s.refusedBefore(t.seq)
+		s.Unlock()
+		if gap {
+			t.refuse()
+		} else {
+			t.serve(dup)
+		}
+		s.Lock()
+		if !dup && !gap {
+			s.last = t.seq
+			for r := range s.refused {
+				if r <= t.seq {
+					delete(s.refused, r)
+				}
+			}
+		}
+		s.used = time.Now()
+	}
+	s.running = false
+	s.Unlock()
+}
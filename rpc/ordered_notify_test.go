@@ -0,0 +1,313 @@
+package rpc
+
+import (
+	"context"
+	"errors"
+	"math/rand"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/keybase/backoff"
+	"github.com/stretchr/testify/require"
+)
+
+// orderedNotifyTestServer records the notifies it handles, and checks that
+// they're handled one at a time.
+type orderedNotifyTestServer struct {
+	receiver *OrderedNotifyReceiver
+	// rateLimit, if set, limits the notifies.
+	rateLimit *RateLimit
+	// handshake, if set, makes the transports handshake.
+	handshake *HandshakeConfig
+
+	sync.Mutex
+	handled []int
+	running int
+	overlap bool
+	// gate, if set, holds the handler of the notify with that argument.
+	gateArg int
+	gate    chan struct{}
+}
+
+func (s *orderedNotifyTestServer) serve(t *testing.T, conn net.Conn) Transporter {
+	xp := NewTransportWithOpts(context.Background(), conn, nil, nil, nil, testMaxFrameLength,
+		TransportOpts{OrderedNotifies: s.receiver, Handshake: s.handshake})
+	srv := NewServer(xp, nil)
+	require.NoError(t, srv.Register(Protocol{
+		Name: "ordered",
+		Methods: map[string]ServeHandlerDescription{
+			"push": {
+				RateLimit: s.rateLimit,
+				MakeArg:   func() interface{} { return new(int) },
+				Handler: func(_ context.Context, arg interface{}) (interface{}, error) {
+					n := *arg.(*int)
+					s.Lock()
+					s.running++
+					if s.running > 1 {
+						s.overlap = true
+					}
+					gate := s.gate
+					if n != s.gateArg {
+						gate = nil
+					}
+					s.Unlock()
+					if gate != nil {
+						<-gate
+					}
+					time.Sleep(time.Duration(rand.Intn(200)) * time.Microsecond)
+					s.Lock()
+					defer s.Unlock()
+					s.running--
+					s.handled = append(s.handled, n)
+					if n < 0 {
+						return nil, errors.New("negative")
+					}
+					return nil, nil
+				},
+			},
+		},
+	}))
+	srv.Run()
+	return xp
+}
+
+func (s *orderedNotifyTestServer) getHandled() ([]int, bool) {
+	s.Lock()
+	defer s.Unlock()
+	return append([]int(nil), s.handled...), s.overlap
+}
+
+func TestOrderedNotify(t *testing.T) {
+	s := &orderedNotifyTestServer{receiver: NewOrderedNotifyReceiver()}
+	clientConn, serverConn := net.Pipe()
+	sxp := s.serve(t, serverConn)
+	defer sxp.Close()
+	xp := NewTransport(context.Background(), clientConn, nil, nil, nil, testMaxFrameLength)
+	defer xp.Close()
+
+	var errMu sync.Mutex
+	var handlerErrs []error
+	n := NewOrderedNotifierWithOpts(OrderedNotifierOpts{
+		MaxPending: 8,
+		OnError: func(_ Methoder, err error) {
+			errMu.Lock()
+			defer errMu.Unlock()
+			handlerErrs = append(handlerErrs, err)
+		},
+	})
+	n.Attach(xp)
+
+	var expected []int
+	for i := 1; i <= 100; i++ {
+		arg := i
+		if i == 50 {
+			arg = -1
+		}
+		expected = append(expected, arg)
+		require.NoError(t, n.Notify(context.Background(), newMethodV1("ordered.push"), arg))
+		require.LessOrEqual(t, n.Pending(), 8)
+	}
+	require.NoError(t, n.Flush(context.Background()))
+	require.Equal(t, 0, n.Pending())
+	handled, overlap := s.getHandled()
+	require.Equal(t, expected, handled)
+	require.False(t, overlap)
+	errMu.Lock()
+	require.Len(t, handlerErrs, 1)
+	require.EqualError(t, handlerErrs[0], "negative")
+	errMu.Unlock()
+
+	// Without a receiver, ordered notifies are plain calls.
+	clientConn, serverConn = net.Pipe()
+	plain := &orderedNotifyTestServer{}
+	psxp := plain.serve(t, serverConn)
+	defer psxp.Close()
+	pxp := NewTransport(context.Background(), clientConn, nil, nil, nil, testMaxFrameLength)
+	defer pxp.Close()
+	n = NewOrderedNotifier()
+	n.Attach(pxp)
+	require.NoError(t, n.Notify(context.Background(), newMethodV1("ordered.push"), 7))
+	require.NoError(t, n.Flush(context.Background()))
+	handled, _ = plain.getHandled()
+	require.Equal(t, []int{7}, handled)
+}
+
+func TestOrderedNotifyUnencodable(t *testing.T) {
+	s := &orderedNotifyTestServer{receiver: NewOrderedNotifyReceiver()}
+	clientConn, serverConn := net.Pipe()
+	sxp := s.serve(t, serverConn)
+	defer sxp.Close()
+	xp := NewTransport(context.Background(), clientConn, nil, nil, nil, testMaxFrameLength)
+	defer xp.Close()
+
+	errCh := make(chan error, 1)
+	n := NewOrderedNotifierWithOpts(OrderedNotifierOpts{
+		MaxPending: 1,
+		OnError:    func(_ Methoder, err error) { errCh <- err },
+	})
+	n.Attach(xp)
+
+	// A notify that can't be sent is dropped, rather than holding up the
+	// ones after it. The codecs can't encode complex numbers.
+	require.NoError(t, n.Notify(context.Background(), newMethodV1("ordered.push"), complex(1, 2)))
+	require.NoError(t, n.Notify(context.Background(), newMethodV1("ordered.push"), 5))
+	require.NoError(t, n.Flush(context.Background()))
+	require.ErrorContains(t, <-errCh, "ordered notify 1 dropped")
+	handled, _ := s.getHandled()
+	require.Equal(t, []int{5}, handled)
+	require.True(t, xp.IsConnected())
+}
+
+func TestOrderedNotifyReconnect(t *testing.T) {
+	s := &orderedNotifyTestServer{
+		receiver: NewOrderedNotifyReceiver(),
+		gateArg:  3,
+		gate:     make(chan struct{}),
+	}
+	ct := &pipeConnectionTransport{serve: func(conn net.Conn) Transporter { return s.serve(t, conn) }}
+	n := NewOrderedNotifier()
+	conn := NewConnectionWithTransport(testConnectionHandler{}, ct, nil, &testLogOutput{t: t}, ConnectionOpts{
+		OrderedNotifier: n,
+		ReconnectBackoff: func() backoff.BackOff {
+			return backoff.NewConstantBackOff(time.Millisecond)
+		},
+	})
+	defer conn.Shutdown()
+
+	// Notifies are buffered while there's no connection yet.
+	for i := 1; i <= 5; i++ {
+		require.NoError(t, n.Notify(context.Background(), newMethodV1("ordered.push"), i))
+	}
+	require.NoError(t, conn.ForceReconnect(context.Background()))
+
+	// The third notify is being handled when the connection drops, so
+	// it and the ones after it aren't acknowledged, unlike the first two.
+	require.Eventually(t, func() bool {
+		handled, _ := s.getHandled()
+		return len(handled) == 2 && n.Pending() == 3
+	}, 5*time.Second, time.Millisecond)
+	ct.dropServer()
+	require.Eventually(t, func() bool { return !ct.IsConnected() }, 5*time.Second, time.Millisecond)
+	require.Equal(t, 3, n.Pending())
+	require.NoError(t, n.Notify(context.Background(), newMethodV1("ordered.push"), 6))
+
+	// After reconnecting, they're sent again, and the receiver drops the
+	// ones it already handled.
+	require.NoError(t, conn.ForceReconnect(context.Background()))
+	close(s.gate)
+	require.NoError(t, n.Flush(context.Background()))
+	handled, overlap := s.getHandled()
+	require.Equal(t, []int{1, 2, 3, 4, 5, 6}, handled)
+	require.False(t, overlap)
+	require.GreaterOrEqual(t, ct.dials(), 2)
+}
+
+// refused tells whether the receiver refuses the notifies of the only
+// session from seq on.
+func (s *orderedNotifyTestServer) refused(seq uint64) bool {
+	s.receiver.Lock()
+	defer s.receiver.Unlock()
+	for _, session := range s.receiver.sessions {
+		session.Lock()
+		defer session.Unlock()
+		_, ok := session.refused[seq]
+		return ok && !session.refusedBefore(seq)
+	}
+	return false
+}
+
+func TestOrderedNotifyDrain(t *testing.T) {
+	s := &orderedNotifyTestServer{
+		receiver:  NewOrderedNotifyReceiver(),
+		handshake: &HandshakeConfig{},
+		gateArg:   3,
+		gate:      make(chan struct{}),
+	}
+	dial := func() (Transporter, Transporter) {
+		clientConn, serverConn := net.Pipe()
+		sxp := s.serve(t, serverConn)
+		xp := NewTransportWithOpts(context.Background(), clientConn, nil, nil, nil, testMaxFrameLength,
+			TransportOpts{Handshake: &HandshakeConfig{}})
+		t.Cleanup(func() {
+			xp.Close()
+			sxp.Close()
+		})
+		return xp, sxp
+	}
+	n := NewOrderedNotifierWithOpts(OrderedNotifierOpts{
+		OnError: func(_ Methoder, err error) { t.Errorf("unexpected error: %v", err) },
+	})
+	xp, sxp := dial()
+	n.Attach(xp)
+
+	// The third notify is being handled when the server starts draining.
+	for i := 1; i <= 3; i++ {
+		require.NoError(t, n.Notify(context.Background(), newMethodV1("ordered.push"), i))
+	}
+	require.Eventually(t, func() bool {
+		handled, _ := s.getHandled()
+		return len(handled) == 2
+	}, 5*time.Second, time.Millisecond)
+	drainErrCh := make(chan error, 1)
+	go func() { drainErrCh <- sxp.Drain(context.Background()) }()
+	<-xp.goingAway()
+
+	// The ones sent while it drains are refused, rather than taken as
+	// handled, and are sent again on the next transport, to a server that
+	// shares the receiver.
+	for i := 4; i <= 10; i++ {
+		require.NoError(t, n.Notify(context.Background(), newMethodV1("ordered.push"), i))
+	}
+	require.Eventually(t, func() bool { return s.refused(4) }, 5*time.Second, time.Millisecond)
+	xp2, _ := dial()
+	n.Attach(xp2)
+	close(s.gate)
+	require.NoError(t, <-drainErrCh)
+	require.NoError(t, n.Flush(context.Background()))
+	handled, overlap := s.getHandled()
+	require.Equal(t, []int{1, 2, 3, 4, 5, 6, 7, 8, 9, 10}, handled)
+	require.False(t, overlap)
+}
+
+func TestOrderedNotifyRateLimited(t *testing.T) {
+	s := &orderedNotifyTestServer{
+		receiver:  NewOrderedNotifyReceiver(),
+		rateLimit: &RateLimit{Rate: 200, Burst: 2},
+	}
+	clientConn, serverConn := net.Pipe()
+	sxp := s.serve(t, serverConn)
+	defer sxp.Close()
+	xp := NewTransport(context.Background(), clientConn, nil, nil, nil, testMaxFrameLength)
+	defer xp.Close()
+	n := NewOrderedNotifierWithOpts(OrderedNotifierOpts{
+		RetryDelay: 5 * time.Millisecond,
+		OnError:    func(_ Methoder, err error) { t.Errorf("unexpected error: %v", err) },
+	})
+	n.Attach(xp)
+
+	// The notifies over the limit are refused, and so are the ones after
+	// them, so that they're sent again, in order, on the same transport.
+	var expected []int
+	for i := 1; i <= 30; i++ {
+		expected = append(expected, i)
+		require.NoError(t, n.Notify(context.Background(), newMethodV1("ordered.push"), i))
+	}
+	require.NoError(t, n.Flush(context.Background()))
+	handled, overlap := s.getHandled()
+	require.Equal(t, expected, handled)
+	require.False(t, overlap)
+	require.True(t, xp.IsConnected())
+}
+
+func TestParseOrderedNotifyHeader(t *testing.T) {
+	session, seq, err := parseOrderedNotifyHeader("abc/42")
+	require.NoError(t, err)
+	require.Equal(t, "abc", session)
+	require.Equal(t, uint64(42), seq)
+	for _, bad := range []string{"", "abc", "/1", "abc/x", "abc/-1"} {
+		_, _, err := parseOrderedNotifyHeader(bad)
+		require.Error(t, err, bad)
+	}
+}
@@ -0,0 +1,147 @@
+// Package oteltrace is an rpc.Tracer that traces calls and notifies with
+// OpenTelemetry.
+package oteltrace
+
+import (
+	"context"
+	"fmt"
+
+	rpc "github.com/foks-proj/go-snowpack-rpc/rpc"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Opts configures a Tracer. The zero value is fine.
+type Opts struct {
+	// TracerProvider defaults to the global one.
+	TracerProvider trace.TracerProvider
+	// Propagator defaults to W3C trace context.
+	Propagator propagation.TextMapPropagator
+}
+
+const tracerName = "github.com/foks-proj/go-snowpack-rpc/rpc"
+
+// Span attribute keys. The generic ones follow the OpenTelemetry RPC
+// semantic conventions.
+const (
+	attrRPCSystem   = attribute.Key("rpc.system")
+	attrRPCMethod   = attribute.Key("rpc.method")
+	attrType        = attribute.Key("rpc.snowpack.type")
+	attrProtocolID  = attribute.Key("rpc.snowpack.protocol_id")
+	attrMethodID    = attribute.Key("rpc.snowpack.method_id")
+	attrSeqno       = attribute.Key("rpc.snowpack.seqno")
+	attrCompression = attribute.Key("rpc.snowpack.compression")
+	attrSentSize    = attribute.Key("rpc.snowpack.sent_size")
+	attrRecvSize    = attribute.Key("rpc.snowpack.received_size")
+	attrErrorType   = attribute.Key("rpc.snowpack.error_type")
+)
+
+// Tracer starts OpenTelemetry spans for the calls and notifies of the
+// transports it's set on, via rpc.TransportOpts.Tracer, and propagates their
+// context to the peer in the headers of the messages.
+type Tracer struct {
+	tracer trace.Tracer
+	prop   propagation.TextMapPropagator
+}
+
+var _ rpc.Tracer = (*Tracer)(nil)
+
+// New makes a Tracer with the given options.
+func New(opts Opts) *Tracer {
+	tp := opts.TracerProvider
+	if tp == nil {
+		tp = otel.GetTracerProvider()
+	}
+	prop := opts.Propagator
+	if prop == nil {
+		prop = propagation.TraceContext{}
+	}
+	return &Tracer{
+		tracer: tp.Tracer(tracerName),
+		prop:   prop,
+	}
+}
+
+func spanKind(k rpc.SpanKind) trace.SpanKind {
+	switch k {
+	case rpc.SpanKindClient:
+		return trace.SpanKindClient
+	case rpc.SpanKindServer:
+		return trace.SpanKindServer
+	case rpc.SpanKindProducer:
+		return trace.SpanKindProducer
+	case rpc.SpanKindConsumer:
+		return trace.SpanKindConsumer
+	default:
+		return trace.SpanKindUnspecified
+	}
+}
+
+func methodAttributes(info rpc.SpanInfo) []attribute.KeyValue {
+	ret := []attribute.KeyValue{
+		attrRPCSystem.String("snowpack"),
+		attrRPCMethod.String(info.Method.String()),
+		attrType.String(info.Type.String()),
+		attrCompression.String(info.Compression.String()),
+	}
+	if m, ok := info.Method.(*rpc.MethodV2); ok {
+		ret = append(ret,
+			attrProtocolID.Int64(int64(m.ProtocolID())),
+			attrMethodID.Int64(int64(m.Position())))
+	}
+	return ret
+}
+
+func (t *Tracer) start(ctx context.Context, info rpc.SpanInfo) (context.Context, *span) {
+	ctx, s := t.tracer.Start(ctx, info.Method.String(),
+		trace.WithSpanKind(spanKind(info.Kind)),
+		trace.WithAttributes(methodAttributes(info)...))
+	return ctx, &span{s}
+}
+
+// StartClient implements rpc.Tracer.
+func (t *Tracer) StartClient(ctx context.Context, info rpc.SpanInfo) (context.Context, rpc.Span, map[string]string) {
+	ctx, s := t.start(ctx, info)
+	headers := make(map[string]string)
+	t.prop.Inject(ctx, propagation.MapCarrier(headers))
+	return ctx, s, headers
+}
+
+// Extract implements rpc.Tracer.
+func (t *Tracer) Extract(ctx context.Context, headers map[string]string) context.Context {
+	return t.prop.Extract(ctx, propagation.MapCarrier(headers))
+}
+
+// StartServer implements rpc.Tracer.
+func (t *Tracer) StartServer(ctx context.Context, info rpc.SpanInfo) (context.Context, rpc.Span) {
+	return t.start(ctx, info)
+}
+
+type span struct {
+	trace.Span
+}
+
+func (s *span) SetSeqNo(q rpc.SeqNumber) {
+	s.SetAttributes(attrSeqno.Int(int(q)))
+}
+
+func (s *span) SetSentSize(n int64) {
+	s.SetAttributes(attrSentSize.Int64(n))
+}
+
+func (s *span) SetReceivedSize(n int64) {
+	s.SetAttributes(attrRecvSize.Int64(n))
+}
+
+// End records the outcome of a call on the span, and ends it.
+func (s *span) End(err error) {
+	if err != nil && s.IsRecording() {
+		s.SetAttributes(attrErrorType.String(fmt.Sprintf("%T", err)))
+		s.RecordError(err)
+		s.SetStatus(codes.Error, err.Error())
+	}
+	s.Span.End()
+}
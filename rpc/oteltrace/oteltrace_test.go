@@ -0,0 +1,197 @@
+package oteltrace
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	rpc "github.com/foks-proj/go-snowpack-rpc/rpc"
+	"github.com/stretchr/testify/require"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const testMaxFrameLength = 1024 * 1024
+
+func tracingTestProtocol(notified chan<- struct{}) rpc.Protocol {
+	return rpc.Protocol{
+		Name: "traced",
+		Methods: map[string]rpc.ServeHandlerDescription{
+			"ok": {
+				MakeArg: func() interface{} { return new(int) },
+				Handler: func(ctx context.Context, arg interface{}) (interface{}, error) {
+					if !trace.SpanContextFromContext(ctx).IsValid() {
+						return nil, errors.New("no span in handler context")
+					}
+					return *arg.(*int), nil
+				},
+			},
+			"fail": {
+				MakeArg: func() interface{} { return new(int) },
+				Handler: func(_ context.Context, _ interface{}) (interface{}, error) {
+					return nil, errors.New("it failed")
+				},
+			},
+			"notify": {
+				MakeArg: func() interface{} { return new(int) },
+				Handler: func(_ context.Context, _ interface{}) (interface{}, error) {
+					notified <- struct{}{}
+					return nil, nil
+				},
+			},
+		},
+	}
+}
+
+func prepTracingTest(t *testing.T, ctracing, stracing rpc.Tracer, notified chan<- struct{}) *rpc.Client {
+	clientConn, serverConn := net.Pipe()
+	lf := rpc.NewSimpleLogFactory(rpc.NilLogOutput{}, nil)
+	sxp := rpc.NewTransportWithOpts(context.Background(), serverConn, lf, nil, nil, testMaxFrameLength,
+		rpc.TransportOpts{Tracer: stracing})
+	srv := rpc.NewServer(sxp, nil)
+	require.NoError(t, srv.Register(tracingTestProtocol(notified)))
+	srv.Run()
+	cxp := rpc.NewTransportWithOpts(context.Background(), clientConn, lf, nil, nil, testMaxFrameLength,
+		rpc.TransportOpts{Tracer: ctracing})
+	t.Cleanup(func() {
+		cxp.Close()
+		sxp.Close()
+	})
+	return rpc.NewClient(cxp, nil, nil)
+}
+
+func spanAttr(s sdktrace.ReadOnlySpan, k attribute.Key) (attribute.Value, bool) {
+	for _, kv := range s.Attributes() {
+		if kv.Key == k {
+			return kv.Value, true
+		}
+	}
+	return attribute.Value{}, false
+}
+
+func waitForSpans(t *testing.T, sr *tracetest.SpanRecorder, n int) []sdktrace.ReadOnlySpan {
+	require.Eventually(t, func() bool { return len(sr.Ended()) >= n }, 5*time.Second, time.Millisecond)
+	return sr.Ended()
+}
+
+func TestTracingCall(t *testing.T) {
+	sr := tracetest.NewSpanRecorder()
+	tp := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(sr))
+	tracer := New(Opts{TracerProvider: tp})
+	cli := prepTracingTest(t, tracer, tracer, nil)
+
+	ctx, parent := tp.Tracer("test").Start(context.Background(), "parent")
+	var res int
+	require.NoError(t, cli.Call(ctx, rpc.NewMethodV1("traced.ok"), 5, &res, 0))
+	require.Equal(t, 5, res)
+	parent.End()
+
+	spans := waitForSpans(t, sr, 3)
+	byKind := make(map[trace.SpanKind]sdktrace.ReadOnlySpan)
+	for _, s := range spans {
+		byKind[s.SpanKind()] = s
+	}
+	client, server := byKind[trace.SpanKindClient], byKind[trace.SpanKindServer]
+	require.NotNil(t, client)
+	require.NotNil(t, server)
+
+	require.Equal(t, "traced.ok", client.Name())
+	require.Equal(t, parent.SpanContext().SpanID(), client.Parent().SpanID())
+	require.Equal(t, client.SpanContext().TraceID(), server.SpanContext().TraceID())
+	require.Equal(t, client.SpanContext().SpanID(), server.Parent().SpanID())
+	require.True(t, server.Parent().IsRemote())
+
+	for _, s := range []sdktrace.ReadOnlySpan{client, server} {
+		v, ok := spanAttr(s, attrRPCMethod)
+		require.True(t, ok)
+		require.Equal(t, "traced.ok", v.AsString())
+		v, ok = spanAttr(s, attrSeqno)
+		require.True(t, ok)
+		require.Equal(t, int64(0), v.AsInt64())
+		v, ok = spanAttr(s, attrCompression)
+		require.True(t, ok)
+		require.Equal(t, "none", v.AsString())
+		require.Equal(t, codes.Unset, s.Status().Code)
+	}
+	sent, ok := spanAttr(client, attrSentSize)
+	require.True(t, ok)
+	recv, ok := spanAttr(server, attrRecvSize)
+	require.True(t, ok)
+	// The server doesn't count the frame length prefix.
+	require.Greater(t, sent.AsInt64(), recv.AsInt64())
+	require.Greater(t, recv.AsInt64(), int64(0))
+	v, ok := spanAttr(client, attrRecvSize)
+	require.True(t, ok)
+	require.Greater(t, v.AsInt64(), int64(0))
+}
+
+func TestTracingError(t *testing.T) {
+	sr := tracetest.NewSpanRecorder()
+	tp := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(sr))
+	tracer := New(Opts{TracerProvider: tp})
+	cli := prepTracingTest(t, tracer, tracer, nil)
+
+	var res int
+	err := cli.CallCompressed(context.Background(), rpc.NewMethodV1("traced.fail"), 1, &res, rpc.CompressionGzip, 0)
+	require.EqualError(t, err, "it failed")
+
+	for _, s := range waitForSpans(t, sr, 2) {
+		require.Equal(t, codes.Error, s.Status().Code)
+		require.Equal(t, "it failed", s.Status().Description)
+		v, ok := spanAttr(s, attrCompression)
+		require.True(t, ok)
+		require.Equal(t, "gzip", v.AsString())
+		_, ok = spanAttr(s, attrErrorType)
+		require.True(t, ok)
+	}
+}
+
+func TestTracingNotify(t *testing.T) {
+	sr := tracetest.NewSpanRecorder()
+	tp := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(sr))
+	tracer := New(Opts{TracerProvider: tp})
+	notified := make(chan struct{}, 1)
+	cli := prepTracingTest(t, tracer, tracer, notified)
+
+	require.NoError(t, cli.Notify(context.Background(), rpc.NewMethodV1("traced.notify"), 1, 0))
+	<-notified
+
+	spans := waitForSpans(t, sr, 2)
+	byKind := make(map[trace.SpanKind]sdktrace.ReadOnlySpan)
+	for _, s := range spans {
+		byKind[s.SpanKind()] = s
+	}
+	producer, consumer := byKind[trace.SpanKindProducer], byKind[trace.SpanKindConsumer]
+	require.NotNil(t, producer)
+	require.NotNil(t, consumer)
+	require.Equal(t, producer.SpanContext().SpanID(), consumer.Parent().SpanID())
+}
+
+func TestTracingOneSided(t *testing.T) {
+	// A server without tracing ignores the headers.
+	sr := tracetest.NewSpanRecorder()
+	tp := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(sr))
+	cli := prepTracingTest(t, New(Opts{TracerProvider: tp}), nil, nil)
+
+	var res int
+	err := cli.Call(context.Background(), rpc.NewMethodV1("traced.ok"), 1, &res, 0)
+	require.EqualError(t, err, "no span in handler context")
+	require.Len(t, waitForSpans(t, sr, 1), 1)
+}
+
+func TestTracingV2Attributes(t *testing.T) {
+	attrs := methodAttributes(rpc.SpanInfo{
+		Kind:        rpc.SpanKindClient,
+		Type:        rpc.MethodCallV2,
+		Method:      rpc.NewMethodV2(12, 3, "p.m"),
+		Compression: rpc.CompressionNone,
+	})
+	require.Contains(t, attrs, attrProtocolID.Int64(12))
+	require.Contains(t, attrs, attrMethodID.Int64(3))
+	require.Contains(t, attrs, attrType.String("Call2"))
+}
@@ -6,8 +6,7 @@ import (
 	"fmt"
 	"io"
 	"net"
-
-	"github.com/keybase/go-codec/codec"
+	"time"
 )
 
 // lastErrReader stores the last error returned by its child
@@ -25,21 +24,33 @@ func (r *lastErrReader) Read(buf []byte) (int, error) {
 
 type packetizer struct {
 	maxFrameLength      int32
-	lengthDecoder       *codec.Decoder
+	codec               wireCodec
+	readLength          func() (int32, error)
 	reader              *lastErrReader
 	protocols           protocolHandlers
 	calls               *callContainer
 	compressorCacher    *compressorCacher
 	instrumenterStorage NetworkInstrumenterStorage
 	log                 LogInterface
+
+	// The length of the last frame returned by NextFrame.
+	lastLength int32
 }
 
 func newPacketizer(maxFrameLength int32, reader io.Reader, protocols protocolHandlers, calls *callContainer,
+	log LogInterface, instrumenterStorage NetworkInstrumenterStorage) *packetizer {
+	return newCodecPacketizer(CodecMsgpack, maxFrameLength, reader, protocols, calls, log, instrumenterStorage)
+}
+
+// newCodecPacketizer is like newPacketizer, for frames encoded with ct.
+func newCodecPacketizer(ct CodecType, maxFrameLength int32, reader io.Reader, protocols protocolHandlers, calls *callContainer,
 	log LogInterface, instrumenterStorage NetworkInstrumenterStorage) *packetizer {
 	wrappedReader := &lastErrReader{bufio.NewReader(reader), nil}
+	wc := ct.wireCodec()
 	return &packetizer{
 		maxFrameLength:      maxFrameLength,
-		lengthDecoder:       codec.NewDecoder(wrappedReader, newCodecMsgpackHandle()),
+		codec:               wc,
+		readLength:          wc.newLengthReader(wrappedReader),
 		reader:              wrappedReader,
 		protocols:           protocols,
 		calls:               calls,
@@ -56,6 +67,8 @@ type frameReader struct {
 	remaining int32
 	totalSize int32
 	log       LogInterface
+	// start is when the frame started arriving.
+	start time.Time
 }
 
 func newFrameReader(reader *bufio.Reader, totalSize int32, log LogInterface) *frameReader {
@@ -64,6 +77,7 @@ func newFrameReader(reader *bufio.Reader, totalSize int32, log LogInterface) *fr
 		totalSize: totalSize,
 		remaining: totalSize,
 		log:       log,
+		start:     time.Now(),
 	}
 }
 
@@ -125,6 +139,12 @@ func (l *frameReader) drain() error {
 
 var _ io.Reader = (*frameReader)(nil)
 
+// lastFrameSize returns the length of the frame that the last call to
+// NextFrame read.
+func (p *packetizer) lastFrameSize() int64 {
+	return int64(p.lastLength)
+}
+
 // NextFrame returns the next message and an error. The error can be:
 //
 //   - nil, in which case the returned rpcMessage will be non-nil.
@@ -141,10 +161,10 @@ var _ io.Reader = (*frameReader)(nil)
 //     packet.
 func (p *packetizer) NextFrame(ctx context.Context) (msg rpcMessage, err error) {
 	// Get the packet length.
-	var l int32
-	if err := p.lengthDecoder.Decode(&l); err != nil {
+	l, err := p.readLength()
+	if err != nil {
 		// If the connection is reset or has been closed on
-		// this side, return EOF. lengthDecoder wraps most
+		// this side, return EOF. The codec wraps most
 		// errors, so we have to check p.reader.err instead of
 		// err.
 		if _, ok := p.reader.err.(*net.OpError); ok {
@@ -159,6 +179,7 @@ func (p *packetizer) NextFrame(ctx context.Context) (msg rpcMessage, err error)
 	if l > p.maxFrameLength {
 		return nil, NewPacketizerError("frame length too big: %d > %d", l, p.maxFrameLength)
 	}
+	p.lastLength = l
 
 	r := newFrameReader(p.reader.reader, l, p.log)
 	defer func() {
@@ -169,19 +190,9 @@ func (p *packetizer) NextFrame(ctx context.Context) (msg rpcMessage, err error)
 		}
 	}()
 
-	nb, err := r.ReadByte()
+	n, decoder, err := p.codec.newFrameDecoder(r)
 	if err != nil {
 		return nil, err
 	}
-
-	// Interpret the byte as the length field of a fixarray of up
-	// to 15 elements: see
-	// https://github.com/msgpack/msgpack/blob/master/spec.md#formats-array
-	// for details. Do this so we can decode directly into the
-	// expected fields without copying.
-	if nb < 0x91 || nb > 0x9f {
-		return nil, NewPacketizerError("wrong message structure prefix (0x%x)", nb)
-	}
-
-	return decodeRPC(ctx, int(nb-0x90), r, p.protocols, p.calls, p.compressorCacher, p.instrumenterStorage)
+	return decodeRPC(ctx, n, decoder, p.protocols, p.calls, p.compressorCacher, p.instrumenterStorage)
 }
@@ -0,0 +1,215 @@
+// Package prommetrics is a NetworkInstrumenterStorage that exports the
+// records of the rpc package as Prometheus metrics.
+package prommetrics
+
+import (
+	"context"
+	"net/http"
+
+	rpc "github.com/foks-proj/go-snowpack-rpc/rpc"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// DefaultNamespace prefixes the names of all metrics unless Opts.Namespace
+// is set.
+const DefaultNamespace = "snowpack_rpc"
+
+// DefaultSizeBuckets are the buckets of the size histogram, in bytes, unless
+// Opts.SizeBuckets is set.
+var DefaultSizeBuckets = prometheus.ExponentialBuckets(64, 4, 10)
+
+// Opts configures a Storage. The zero value is fine.
+type Opts struct {
+	// Namespace defaults to DefaultNamespace.
+	Namespace string
+	// ConstLabels are added to every metric, for instance to tell apart
+	// the client and server sides of a process.
+	ConstLabels prometheus.Labels
+	// DurationBuckets are in seconds, and default to
+	// prometheus.DefBuckets.
+	DurationBuckets []float64
+	// SizeBuckets are in bytes, and default to DefaultSizeBuckets.
+	SizeBuckets []float64
+}
+
+// Storage records calls, notifies and cancels as Prometheus metrics, labeled
+// by method type and method name:
+//
+//   - <ns>_duration_seconds: histogram of the duration of each message
+//   - <ns>_sent_bytes, <ns>_received_bytes: histograms of the bytes sent
+//     and received for each message
+//   - <ns>_ttfb_seconds: histogram of the time to first byte of calls
+//   - <ns>_compressed_bytes_total, <ns>_uncompressed_bytes_total: counters
+//     of the payload bytes of compressed calls, after and before compression
+//   - <ns>_messages_total: counter of messages, by type
+//   - <ns>_errors_total: counter of messages that failed
+//   - <ns>_in_flight: gauge of messages that have started but not finished
+//   - <ns>_transports: gauge of the transports using the storage
+//
+// Storage is a prometheus.Collector, so it can be registered on any
+// registry, or scraped directly via Handler.
+type Storage struct {
+	duration     *prometheus.HistogramVec
+	ttfb         *prometheus.HistogramVec
+	sent         *prometheus.HistogramVec
+	received     *prometheus.HistogramVec
+	compressed   *prometheus.CounterVec
+	uncompressed *prometheus.CounterVec
+	messages     *prometheus.CounterVec
+	errors       *prometheus.CounterVec
+	inFlight     *prometheus.GaugeVec
+	transports   prometheus.Gauge
+}
+
+var _ rpc.LiveInstrumenterStorage = (*Storage)(nil)
+var _ prometheus.Collector = (*Storage)(nil)
+
+var labels = []string{"type", "method"}
+
+// New makes a Storage.
+func New(opts Opts) *Storage {
+	ns := opts.Namespace
+	if ns == "" {
+		ns = DefaultNamespace
+	}
+	durationBuckets := opts.DurationBuckets
+	if durationBuckets == nil {
+		durationBuckets = prometheus.DefBuckets
+	}
+	sizeBuckets := opts.SizeBuckets
+	if sizeBuckets == nil {
+		sizeBuckets = DefaultSizeBuckets
+	}
+	return &Storage{
+		duration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace:   ns,
+			Name:        "duration_seconds",
+			Help:        "Duration of RPC messages, from start to finish.",
+			ConstLabels: opts.ConstLabels,
+			Buckets:     durationBuckets,
+		}, labels),
+		ttfb: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace:   ns,
+			Name:        "ttfb_seconds",
+			Help:        "Time to first byte of the replies to RPC calls.",
+			ConstLabels: opts.ConstLabels,
+			Buckets:     durationBuckets,
+		}, labels),
+		sent: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace:   ns,
+			Name:        "sent_bytes",
+			Help:        "Bytes sent for RPC messages.",
+			ConstLabels: opts.ConstLabels,
+			Buckets:     sizeBuckets,
+		}, labels),
+		received: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace:   ns,
+			Name:        "received_bytes",
+			Help:        "Bytes received for RPC messages.",
+			ConstLabels: opts.ConstLabels,
+			Buckets:     sizeBuckets,
+		}, labels),
+		compressed: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace:   ns,
+			Name:        "compressed_bytes_total",
+			Help:        "Payload bytes of compressed RPC calls, after compression.",
+			ConstLabels: opts.ConstLabels,
+		}, labels),
+		uncompressed: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace:   ns,
+			Name:        "uncompressed_bytes_total",
+			Help:        "Payload bytes of compressed RPC calls, before compression.",
+			ConstLabels: opts.ConstLabels,
+		}, labels),
+		messages: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace:   ns,
+			Name:        "messages_total",
+			Help:        "Number of finished RPC calls, notifies and cancels.",
+			ConstLabels: opts.ConstLabels,
+		}, labels),
+		errors: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace:   ns,
+			Name:        "errors_total",
+			Help:        "Number of RPC messages that failed.",
+			ConstLabels: opts.ConstLabels,
+		}, labels),
+		inFlight: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace:   ns,
+			Name:        "in_flight",
+			Help:        "Number of RPC messages that have started but not finished.",
+			ConstLabels: opts.ConstLabels,
+		}, labels),
+		transports: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace:   ns,
+			Name:        "transports",
+			Help:        "Number of live transports.",
+			ConstLabels: opts.ConstLabels,
+		}),
+	}
+}
+
+// Begin implements rpc.LiveInstrumenterStorage.
+func (s *Storage) Begin(tag string) {
+	s.inFlight.WithLabelValues(rpc.SplitInstrumentTag(tag)).Inc()
+}
+
+// Put implements rpc.NetworkInstrumenterStorage.
+func (s *Storage) Put(_ context.Context, tag string, record rpc.InstrumentationRecord) error {
+	typ, method := rpc.SplitInstrumentTag(tag)
+	s.inFlight.WithLabelValues(typ, method).Dec()
+	s.messages.WithLabelValues(typ, method).Inc()
+	if record.Failed {
+		s.errors.WithLabelValues(typ, method).Inc()
+	}
+	s.duration.WithLabelValues(typ, method).Observe(record.Dur.Seconds())
+	s.sent.WithLabelValues(typ, method).Observe(float64(record.SentBytes))
+	s.received.WithLabelValues(typ, method).Observe(float64(record.ReceivedBytes))
+	if record.TTFB > 0 {
+		s.ttfb.WithLabelValues(typ, method).Observe(record.TTFB.Seconds())
+	}
+	if record.UncompressedBytes > 0 {
+		s.compressed.WithLabelValues(typ, method).Add(float64(record.CompressedBytes))
+		s.uncompressed.WithLabelValues(typ, method).Add(float64(record.UncompressedBytes))
+	}
+	return nil
+}
+
+// TransportOpened implements rpc.LiveInstrumenterStorage.
+func (s *Storage) TransportOpened() {
+	s.transports.Inc()
+}
+
+// TransportClosed implements rpc.LiveInstrumenterStorage.
+func (s *Storage) TransportClosed() {
+	s.transports.Dec()
+}
+
+func (s *Storage) collectors() []prometheus.Collector {
+	return []prometheus.Collector{
+		s.duration, s.ttfb, s.sent, s.received, s.compressed, s.uncompressed,
+		s.messages, s.errors, s.inFlight, s.transports,
+	}
+}
+
+// Describe implements prometheus.Collector.
+func (s *Storage) Describe(ch chan<- *prometheus.Desc) {
+	for _, c := range s.collectors() {
+		c.Describe(ch)
+	}
+}
+
+// Collect implements prometheus.Collector.
+func (s *Storage) Collect(ch chan<- prometheus.Metric) {
+	for _, c := range s.collectors() {
+		c.Collect(ch)
+	}
+}
+
+// Handler returns an http.Handler that serves the metrics of s, and only
+// those, in the Prometheus exposition format.
+func (s *Storage) Handler() http.Handler {
+	reg := prometheus.NewRegistry()
+	reg.MustRegister(s)
+	return promhttp.HandlerFor(reg, promhttp.HandlerOpts{})
+}
@@ -0,0 +1,131 @@
+package prommetrics
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	rpc "github.com/foks-proj/go-snowpack-rpc/rpc"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/require"
+)
+
+const testMaxFrameLength = 1024 * 1024
+
+const testProtocolID rpc.ProtocolUniqueID = 0x5e5e5e
+
+var (
+	methodOK   = rpc.NewMethodV2(testProtocolID, 0, "test.ok")
+	methodFail = rpc.NewMethodV2(testProtocolID, 1, "test.fail")
+)
+
+func testProtocol() rpc.ProtocolV2 {
+	return rpc.ProtocolV2{
+		Name: "test",
+		ID:   testProtocolID,
+		Methods: map[rpc.Position]rpc.ServeHandlerDescriptionV2{
+			0: {
+				ServeHandlerDescription: rpc.ServeHandlerDescription{
+					MakeArg: func() interface{} { return new(string) },
+					Handler: func(_ context.Context, arg interface{}) (interface{}, error) {
+						return *arg.(*string), nil
+					},
+				},
+				Name: "ok",
+			},
+			1: {
+				ServeHandlerDescription: rpc.ServeHandlerDescription{
+					MakeArg: func() interface{} { return new(string) },
+					Handler: func(_ context.Context, _ interface{}) (interface{}, error) {
+						return nil, errors.New("nope")
+					},
+				},
+				Name: "fail",
+			},
+		},
+	}
+}
+
+func TestStorage(t *testing.T) {
+	clientStorage := New(Opts{ConstLabels: prometheus.Labels{"side": "client"}})
+	serverStorage := New(Opts{ConstLabels: prometheus.Labels{"side": "server"}})
+
+	clientConn, serverConn := net.Pipe()
+	lf := rpc.NewSimpleLogFactory(rpc.NilLogOutput{}, nil)
+	sxp := rpc.NewTransport(context.Background(), serverConn, lf, serverStorage, nil, testMaxFrameLength)
+	cxp := rpc.NewTransport(context.Background(), clientConn, lf, clientStorage, nil, testMaxFrameLength)
+	require.Equal(t, 1.0, testutil.ToFloat64(clientStorage.transports))
+	require.Equal(t, 1.0, testutil.ToFloat64(serverStorage.transports))
+
+	srv := rpc.NewServer(sxp, nil)
+	require.NoError(t, srv.RegisterV2(testProtocol()))
+	srv.Run()
+
+	ctx := context.Background()
+	cli := rpc.NewClient(cxp, nil, nil)
+	var res string
+	for i := 0; i < 3; i++ {
+		require.NoError(t, cli.Call(ctx, methodOK, "hello", &res, 0))
+	}
+	require.Error(t, cli.Call(ctx, methodFail, "hello", &res, 0))
+
+	check := func(s *Storage) bool {
+		return testutil.ToFloat64(s.messages.WithLabelValues("Call2", "test.ok")) == 3 &&
+			testutil.ToFloat64(s.errors.WithLabelValues("Call2", "test.ok")) == 0 &&
+			testutil.ToFloat64(s.messages.WithLabelValues("Call2", "test.fail")) == 1 &&
+			testutil.ToFloat64(s.errors.WithLabelValues("Call2", "test.fail")) == 1 &&
+			testutil.ToFloat64(s.inFlight.WithLabelValues("Call2", "test.ok")) == 0
+	}
+	// The client finishes its records before the calls return, but the
+	// server finishes its own after sending the replies.
+	require.True(t, check(clientStorage))
+	require.Eventually(t, func() bool { return check(serverStorage) }, time.Second, time.Millisecond)
+	require.Equal(t, 2, testutil.CollectAndCount(clientStorage.duration))
+
+	// Notifies that aren't served are finished too.
+	require.NoError(t, cli.Notify(ctx, rpc.NewMethodV1("test.missing"), "hello", 0))
+	require.NoError(t, cli.Notify(ctx, rpc.NewMethodV2(testProtocolID, 7, "test.missing"), "hello", 0))
+	require.Eventually(t, func() bool {
+		return testutil.ToFloat64(serverStorage.errors.WithLabelValues("Notify", "test.missing")) == 1 &&
+			testutil.ToFloat64(serverStorage.errors.WithLabelValues("Notify2", "")) == 1
+	}, time.Second, time.Millisecond)
+	require.Equal(t, 0.0, testutil.ToFloat64(serverStorage.inFlight.WithLabelValues("Notify", "test.missing")))
+	require.Equal(t, 0.0, testutil.ToFloat64(serverStorage.inFlight.WithLabelValues("Notify2", "")))
+
+	cxp.Close()
+	sxp.Close()
+	require.Equal(t, 0.0, testutil.ToFloat64(clientStorage.transports))
+	require.Equal(t, 0.0, testutil.ToFloat64(serverStorage.transports))
+}
+
+func TestStorageHandler(t *testing.T) {
+	s := New(Opts{Namespace: "test_rpc"})
+	s.Begin(rpc.InstrumentTag(rpc.MethodNotify, "a.b"))
+	require.NoError(t, s.Put(context.Background(), rpc.InstrumentTag(rpc.MethodNotify, "a.b"),
+		rpc.InstrumentationRecord{Size: 100, SentBytes: 100, Failed: true}))
+
+	srv := httptest.NewServer(s.Handler())
+	defer srv.Close()
+	resp, err := srv.Client().Get(srv.URL)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+
+	for _, line := range []string{
+		`test_rpc_messages_total{method="a.b",type="Notify"} 1`,
+		`test_rpc_errors_total{method="a.b",type="Notify"} 1`,
+		`test_rpc_in_flight{method="a.b",type="Notify"} 0`,
+		`test_rpc_sent_bytes_sum{method="a.b",type="Notify"} 100`,
+		`test_rpc_received_bytes_sum{method="a.b",type="Notify"} 0`,
+		`test_rpc_transports 0`,
+	} {
+		require.True(t, strings.Contains(string(body), line), "missing %q", line)
+	}
+}
@@ -9,6 +9,24 @@ import (
 type ServeHandlerDescription struct {
 	MakeArg func() interface{}
 	Handler func(ctx context.Context, arg interface{}) (ret interface{}, err error)
+	// RateLimit, if set, limits how often each peer can invoke this
+	// method. It overrides the RateLimit of the protocol.
+	RateLimit *RateLimit
+	// SerialKey, if set, returns the key of a decoded arg. The requests
+	// with the same non-empty key, for any method, are served one at a
+	// time, in the order they arrived, e.g. so that those of a user don't
+	// race each other. The others are served concurrently. Requests are
+	// ordered only against those of the same connection, unless the
+	// transports share a SerialQueues (see TransportOpts.SerialQueues),
+	// and at most SerialQueuesOpts.MaxQueued can wait for each key.
+	SerialKey func(arg interface{}) string
+	// Redaction, if set, redacts the arg and result of this method in
+	// logs.
+	Redaction *Redaction
+
+	// refuse, if set, is the error that requests are refused with,
+	// without being served, once the transport kills incoming ones.
+	refuse error
 }
 
 type MethodType int
@@ -27,6 +45,15 @@ const (
 	MethodCallV2   MethodType = 5
 	MethodNotifyV2 MethodType = 6
 	MethodCancelV2 MethodType = 7
+
+	// MethodGoAway is a control message that tells the peer that the
+	// sender is draining: it won't accept new calls, and will close the
+	// connection once the outstanding ones are done.
+	MethodGoAway MethodType = 8
+
+	// MethodHandshake is a control message that advertises what the
+	// sender supports. See HandshakeConfig.
+	MethodHandshake MethodType = 9
 )
 
 func (t MethodType) String() string {
@@ -47,6 +74,12 @@ func (t MethodType) String() string {
 		return "Call2"
 	case MethodNotifyV2:
 		return "Notify2"
+	case MethodCancelV2:
+		return "Cancel2"
+	case MethodGoAway:
+		return "GoAway"
+	case MethodHandshake:
+		return "Handshake"
 	default:
 		return fmt.Sprintf("Method(%d)", t)
 	}
@@ -73,6 +106,16 @@ func (t CompressionType) String() string {
 	}
 }
 
+// ParseCompressionType parses the String of a CompressionType.
+func ParseCompressionType(s string) (CompressionType, error) {
+	for _, t := range []CompressionType{CompressionNone, CompressionGzip, CompressionMsgpackzip} {
+		if s == t.String() {
+			return t, nil
+		}
+	}
+	return CompressionNone, fmt.Errorf("unknown compression type: %q", s)
+}
+
 func (t CompressionType) NewCompressor() compressor {
 	switch t {
 	case CompressionGzip:
@@ -93,6 +136,9 @@ type Protocol struct {
 	Name      string
 	Methods   map[string]ServeHandlerDescription
 	WrapError WrapErrorFunc
+	// RateLimit, if set, limits how often each peer can invoke each of
+	// the methods in this protocol.
+	RateLimit *RateLimit
 }
 
 type ProtocolV2 struct {
@@ -100,6 +146,9 @@ type ProtocolV2 struct {
 	ID        ProtocolUniqueID
 	Methods   map[Position]ServeHandlerDescriptionV2
 	WrapError WrapErrorFunc
+	// RateLimit, if set, limits how often each peer can invoke each of
+	// the methods in this protocol.
+	RateLimit *RateLimit
 }
 
 type ServeHandlerDescriptionV2 struct {
@@ -202,14 +251,24 @@ func (h *protocolHandler) findServeHandler(method Methoder) (*ServeHandlerDescri
 	if !found {
 		return nil, h.wef, newMethodNotFoundError(p, m)
 	}
-	if h.killWith != nil {
-		srv.Handler = func(_ context.Context, _ interface{}) (ret interface{}, err error) {
-			return nil, h.killWith
-		}
-	}
+	srv.refuse = h.killWith
 	return &srv, prot.WrapError, nil
 }
 
+func (h *protocolHandlerV2) methodName(meth MethodV2) string {
+	h.mtx.RLock()
+	defer h.mtx.RUnlock()
+	prot, found := h.protocols[meth.puid]
+	if !found {
+		return ""
+	}
+	srv, found := prot.Methods[meth.method]
+	if !found {
+		return ""
+	}
+	return prot.Name + "." + srv.Name
+}
+
 func (h *protocolHandlerV2) findServeHandler(meth MethodV2) (*ServeHandlerDescriptionV2, WrapErrorFunc, error) {
 	h.mtx.RLock()
 	defer h.mtx.RUnlock()
@@ -221,14 +280,46 @@ func (h *protocolHandlerV2) findServeHandler(meth MethodV2) (*ServeHandlerDescri
 	if !found {
 		return nil, h.wef, NewMethodV2NotFoundError(meth.puid, meth.method, prot.Name)
 	}
-	if h.killWith != nil {
-		srv.Handler = func(_ context.Context, _ interface{}) (ret interface{}, err error) {
-			return nil, h.killWith
-		}
-	}
+	srv.refuse = h.killWith
 	return &srv, prot.WrapError, nil
 }
 
+func pickRateLimit(method *RateLimit, prot *RateLimit) RateLimit {
+	switch {
+	case method != nil:
+		return *method
+	case prot != nil:
+		return *prot
+	default:
+		return RateLimit{}
+	}
+}
+
+func (h *protocolHandler) findRateLimit(method Methoder) RateLimit {
+	h.mtx.RLock()
+	defer h.mtx.RUnlock()
+
+	p, m := splitMethodName(method.String())
+	prot, found := h.protocols[p]
+	if !found {
+		return RateLimit{}
+	}
+	srv := prot.Methods[m]
+	return pickRateLimit(srv.RateLimit, prot.RateLimit)
+}
+
+func (h *protocolHandlerV2) findRateLimit(meth MethodV2) RateLimit {
+	h.mtx.RLock()
+	defer h.mtx.RUnlock()
+
+	prot, found := h.protocols[meth.puid]
+	if !found {
+		return RateLimit{}
+	}
+	srv := prot.Methods[meth.method]
+	return pickRateLimit(srv.RateLimit, prot.RateLimit)
+}
+
 func (h *protocolHandler) getArg(name Methoder) (interface{}, error) {
 	handler, _, err := h.findServeHandler(name)
 	if err != nil {
@@ -263,6 +354,11 @@ func (m *MethodV1) getArg(p protocolHandlers) (interface{}, error) {
 func (m *MethodV1) findServeHandler(p protocolHandlers) (*ServeHandlerDescription, WrapErrorFunc, error) {
 	return p.v1.findServeHandler(m)
 }
+func (m *MethodV1) findRateLimit(p protocolHandlers) RateLimit {
+	return p.v1.findRateLimit(m)
+}
+
+func (m *MethodV1) resolveName(_ protocolHandlers) {}
 
 func (m *MethodV1) numFields() int { return 1 }
 
@@ -272,6 +368,11 @@ func newMethodV1(s string) *MethodV1 {
 	return &MethodV1{s: s}
 }
 
+// NewMethodV1 makes a V1 method, named "protocol.method".
+func NewMethodV1(s string) *MethodV1 {
+	return newMethodV1(s)
+}
+
 type Methoder interface {
 	String() string
 	appendForEncoding(v []interface{}) []interface{}
@@ -281,6 +382,8 @@ type Methoder interface {
 	NotifyMethodType() MethodType
 	getArg(p protocolHandlers) (interface{}, error)
 	findServeHandler(p protocolHandlers) (*ServeHandlerDescription, WrapErrorFunc, error)
+	findRateLimit(p protocolHandlers) RateLimit
+	resolveName(p protocolHandlers)
 	numFields() int
 }
 
@@ -298,6 +401,12 @@ func (m *MethodV2) String() string {
 	return m.name
 }
 
+// ProtocolID returns the unique ID of the protocol of the method.
+func (m *MethodV2) ProtocolID() ProtocolUniqueID { return m.puid }
+
+// Position returns the position of the method in its protocol.
+func (m *MethodV2) Position() Position { return m.method }
+
 func (m *MethodV2) numFields() int { return 2 }
 
 func (m *MethodV1) CallMethodType() MethodType   { return MethodCall }
@@ -333,6 +442,19 @@ func (m *MethodV2) findServeHandler(p protocolHandlers) (*ServeHandlerDescriptio
 	return &se.ServeHandlerDescription, wef, nil
 }
 
+func (m *MethodV2) findRateLimit(p protocolHandlers) RateLimit {
+	return p.v2.findRateLimit(*m)
+}
+
+// resolveName fills in the name of a method decoded off the wire, which only
+// carries its IDs, from the registered protocols.
+func (m *MethodV2) resolveName(p protocolHandlers) {
+	if m.name != "" || p.v2 == nil {
+		return
+	}
+	m.name = p.v2.methodName(*m)
+}
+
 var _ Methoder = (*MethodV2)(nil)
 
 type Encoder interface {
@@ -176,6 +176,16 @@ func TestCallCompressed(t *testing.T) {
 	verifyRes(res, err)
 }
 
+func TestParseCompressionType(t *testing.T) {
+	doWithAllCompressionTypes(func(ctype CompressionType) {
+		parsed, err := ParseCompressionType(ctype.String())
+		require.NoError(t, err)
+		require.Equal(t, ctype, parsed)
+	})
+	_, err := ParseCompressionType("lz4")
+	require.Error(t, err)
+}
+
 func TestLongCallCancel(t *testing.T) {
 	cli, listener, conn := prepTest(t)
 	defer endTest(t, conn, listener)
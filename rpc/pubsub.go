@@ -0,0 +1,413 @@
+package rpc
+
+import (
+	"context"
+	"errors"
+	"sort"
+	"sync"
+)
+
+// PubSubProtocolID is the ID of the built-in publish/subscribe protocol.
+const PubSubProtocolID ProtocolUniqueID = ReservedProtocolIDs + 2
+
+const (
+	pubSubSubscribe   Position = 0
+	pubSubUnsubscribe Position = 1
+	// pubSubMessage is the notify that carries messages, from the broker
+	// to the subscribers.
+	pubSubMessage Position = 2
+)
+
+const defaultPubSubQueueSize = 256
+
+// PubSubMessage is a message published to a topic.
+type PubSubMessage struct {
+	Topic string `codec:"t"`
+	Data  []byte `codec:"d"`
+	// Dropped is how many messages were dropped for this subscriber, in
+	// any topic, since the previous message it got, because it was too
+	// slow. See SlowConsumerPolicy.
+	Dropped uint64 `codec:"x"`
+}
+
+type pubSubTopicsArg struct {
+	Topics []string `codec:"t"`
+}
+
+// SlowConsumerPolicy is what a PubSubBroker does with messages for a
+// subscriber whose queue is full.
+type SlowConsumerPolicy int
+
+const (
+	// SlowConsumerDropNewest drops the messages that don't fit.
+	SlowConsumerDropNewest SlowConsumerPolicy = 0
+	// SlowConsumerDropOldest drops the oldest queued message to make
+	// room.
+	SlowConsumerDropOldest SlowConsumerPolicy = 1
+	// SlowConsumerDisconnect closes the subscriber's transport.
+	SlowConsumerDisconnect SlowConsumerPolicy = 2
+)
+
+// PubSubBrokerOpts are the options of a PubSubBroker.
+type PubSubBrokerOpts struct {
+	// QueueSize is how many messages can be queued for each subscriber.
+	// It defaults to 256.
+	QueueSize int
+	// SlowConsumer is what to do when a subscriber's queue is full.
+	SlowConsumer SlowConsumerPolicy
+	// CanSubscribe, if set, vets subscriptions. ctx is that of the
+	// subscribe call, e.g. with the handshake result.
+	CanSubscribe func(ctx context.Context, topic string) error
+}
+
+// PubSubBroker lets servers publish messages to topics that their peers
+// subscribe to, with a PubSubClient. Each subscriber gets the messages of its
+// topics in the order they were published, as notifies, from a bounded
+// queue; see SlowConsumerPolicy for what happens when it fills up. It is
+// safe for concurrent use.
+type PubSubBroker struct {
+	opts PubSubBrokerOpts
+
+	sync.Mutex
+	subscribers map[*pubSubSubscriber]struct{}
+}
+
+type pubSubSubscriber struct {
+	broker *PubSubBroker
+	xp     Transporter
+	cli    *Client
+
+	sync.Mutex
+	topics  map[string]struct{}
+	queue   []PubSubMessage
+	dropped uint64
+	wakeCh  chan struct{}
+}
+
+// NewPubSubBroker makes a PubSubBroker.
+func NewPubSubBroker() *PubSubBroker {
+	return NewPubSubBrokerWithOpts(PubSubBrokerOpts{})
+}
+
+// NewPubSubBrokerWithOpts is like NewPubSubBroker, but takes additional
+// optional parameters.
+func NewPubSubBrokerWithOpts(opts PubSubBrokerOpts) *PubSubBroker {
+	if opts.QueueSize <= 0 {
+		opts.QueueSize = defaultPubSubQueueSize
+	}
+	return &PubSubBroker{
+		opts:        opts,
+		subscribers: make(map[*pubSubSubscriber]struct{}),
+	}
+}
+
+// Register registers the pub/sub protocol on s, so that its peer can
+// subscribe to topics. Its subscriptions end when its transport closes.
+func (b *PubSubBroker) Register(s *Server) error {
+	sub := &pubSubSubscriber{
+		broker: b,
+		xp:     s.xp,
+		cli:    NewClient(s.xp, nil, nil),
+		topics: make(map[string]struct{}),
+		wakeCh: make(chan struct{}, 1),
+	}
+	if err := s.RegisterV2(b.protocol(sub)); err != nil {
+		return err
+	}
+	b.Lock()
+	b.subscribers[sub] = struct{}{}
+	b.Unlock()
+	go sub.sendLoop()
+	return nil
+}
+
+func (b *PubSubBroker) protocol(sub *pubSubSubscriber) ProtocolV2 {
+	makeArg := func() interface{} { return new(pubSubTopicsArg) }
+	return ProtocolV2{
+		Name: "snowpack.pubsub",
+		ID:   PubSubProtocolID,
+		Methods: map[Position]ServeHandlerDescriptionV2{
+			pubSubSubscribe: {
+				ServeHandlerDescription: ServeHandlerDescription{
+					MakeArg: makeArg,
+					Handler: func(ctx context.Context, arg interface{}) (interface{}, error) {
+						topics := arg.(*pubSubTopicsArg).Topics
+						if b.opts.CanSubscribe != nil {
+							for _, topic := range topics {
+								if err := b.opts.CanSubscribe(ctx, topic); err != nil {
+									return nil, err
+								}
+							}
+						}
+						sub.subscribe(topics, true)
+						return nil, nil
+					},
+				},
+				Name: "subscribe",
+			},
+			pubSubUnsubscribe: {
+				ServeHandlerDescription: ServeHandlerDescription{
+					MakeArg: makeArg,
+					Handler: func(_ context.Context, arg interface{}) (interface{}, error) {
+						sub.subscribe(arg.(*pubSubTopicsArg).Topics, false)
+						return nil, nil
+					},
+				},
+				Name: "unsubscribe",
+			},
+		},
+	}
+}
+
+// Publish queues data for the subscribers of topic, and returns how many
+// there are. It doesn't wait for the messages to be sent.
+func (b *PubSubBroker) Publish(topic string, data []byte) int {
+	b.Lock()
+	subs := make([]*pubSubSubscriber, 0, len(b.subscribers))
+	for sub := range b.subscribers {
+		subs = append(subs, sub)
+	}
+	b.Unlock()
+
+	n := 0
+	for _, sub := range subs {
+		if sub.enqueue(topic, data) {
+			n++
+		}
+	}
+	return n
+}
+
+// Subscribers returns how many peers are subscribed to topic.
+func (b *PubSubBroker) Subscribers(topic string) int {
+	b.Lock()
+	defer b.Unlock()
+	n := 0
+	for sub := range b.subscribers {
+		sub.Lock()
+		if _, ok := sub.topics[topic]; ok {
+			n++
+		}
+		sub.Unlock()
+	}
+	return n
+}
+
+func (s *pubSubSubscriber) subscribe(topics []string, on bool) {
+	s.Lock()
+	defer s.Unlock()
+	for _, topic := range topics {
+		if on {
+			s.topics[topic] = struct{}{}
+		} else {
+			delete(s.topics, topic)
+		}
+	}
+}
+
+// enqueue queues a message for the subscriber, if it's subscribed to topic.
+func (s *pubSubSubscriber) enqueue(topic string, data []byte) bool {
+	s.Lock()
+	defer s.Unlock()
+	if _, ok := s.topics[topic]; !ok {
+		return false
+	}
+	if len(s.queue) >= s.broker.opts.QueueSize {
+		switch s.broker.opts.SlowConsumer {
+		case SlowConsumerDropOldest:
+			s.queue = s.queue[1:]
+			s.dropped++
+		case SlowConsumerDisconnect:
+			go s.xp.Close()
+			return true
+		default:
+			s.dropped++
+			return true
+		}
+	}
+	s.queue = append(s.queue, PubSubMessage{Topic: topic, Data: data})
+	select {
+	case s.wakeCh <- struct{}{}:
+	default:
+	}
+	return true
+}
+
+func (s *pubSubSubscriber) next() (PubSubMessage, bool) {
+	s.Lock()
+	defer s.Unlock()
+	if len(s.queue) == 0 {
+		return PubSubMessage{}, false
+	}
+	msg := s.queue[0]
+	s.queue[0] = PubSubMessage{}
+	s.queue = s.queue[1:]
+	msg.Dropped = s.dropped
+	s.dropped = 0
+	return msg, true
+}
+
+func (s *pubSubSubscriber) sendLoop() {
+	defer func() {
+		s.broker.Lock()
+		delete(s.broker.subscribers, s)
+		s.broker.Unlock()
+	}()
+	m := NewMethodV2(PubSubProtocolID, pubSubMessage, "snowpack.pubsub.message")
+	for {
+		select {
+		case <-s.wakeCh:
+		case <-s.xp.done():
+			return
+		}
+		for {
+			msg, ok := s.next()
+			if !ok {
+				break
+			}
+			if err := s.cli.Notify(context.Background(), m, msg, 0); err != nil {
+				s.xp.Close()
+				return
+			}
+		}
+	}
+}
+
+// PubSubHandler handles the messages of the topics that a PubSubClient is
+// subscribed to. It can be called concurrently, so messages may be handled
+// out of order.
+type PubSubHandler func(ctx context.Context, msg PubSubMessage)
+
+// PubSubClient subscribes to topics of a PubSubBroker on the other end of a
+// transport. It remembers its topics, so that it can subscribe to them again
+// on a new transport: see ConnectionOpts.PubSub, which does it whenever the
+// Connection reconnects. It is safe for concurrent use.
+type PubSubClient struct {
+	handler PubSubHandler
+
+	sync.Mutex
+	topics map[string]struct{}
+	cli    GenericClient
+}
+
+// NewPubSubClient makes a PubSubClient that passes messages to handler.
+func NewPubSubClient(handler PubSubHandler) *PubSubClient {
+	return &PubSubClient{
+		handler: handler,
+		topics:  make(map[string]struct{}),
+	}
+}
+
+// Register registers the handler of messages on srv, and subscribes to the
+// client's topics with cli, which are on the same transport. Calls to
+// Subscribe and Unsubscribe use cli from then on.
+func (c *PubSubClient) Register(ctx context.Context, cli GenericClient, srv *Server) error {
+	if err := c.registerHandler(srv); err != nil {
+		return err
+	}
+	return c.resubscribe(ctx, cli)
+}
+
+// registerHandler registers the handler of messages on srv.
+func (c *PubSubClient) registerHandler(srv *Server) error {
+	return srv.RegisterV2(ProtocolV2{
+		Name: "snowpack.pubsub",
+		ID:   PubSubProtocolID,
+		Methods: map[Position]ServeHandlerDescriptionV2{
+			pubSubMessage: {
+				ServeHandlerDescription: ServeHandlerDescription{
+					MakeArg: func() interface{} { return new(PubSubMessage) },
+					Handler: func(ctx context.Context, arg interface{}) (interface{}, error) {
+						c.handler(ctx, *arg.(*PubSubMessage))
+						return nil, nil
+					},
+				},
+				Name: "message",
+			},
+		},
+	})
+}
+
+// resubscribe makes the client use cli, and subscribes to its topics with
+// it.
+func (c *PubSubClient) resubscribe(ctx context.Context, cli GenericClient) error {
+	c.Lock()
+	c.cli = cli
+	c.Unlock()
+	if topics := c.Topics(); len(topics) > 0 {
+		return c.call(ctx, cli, pubSubSubscribe, "subscribe", topics)
+	}
+	return nil
+}
+
+func (c *PubSubClient) call(ctx context.Context, cli GenericClient, pos Position, name string, topics []string) error {
+	m := NewMethodV2(PubSubProtocolID, pos, "snowpack.pubsub."+name)
+	return cli.Call(ctx, m, pubSubTopicsArg{Topics: topics}, nil, 0)
+}
+
+// Subscribe subscribes to topics. If the client isn't registered yet, they
+// are subscribed to on Register. If the broker refuses them, they are
+// forgotten, and the error is returned. Other errors, e.g. from the
+// connection dropping, are returned too, but the topics are kept, and
+// subscribed to again on the next Register.
+func (c *PubSubClient) Subscribe(ctx context.Context, topics ...string) error {
+	c.Lock()
+	var added []string
+	for _, topic := range topics {
+		if _, ok := c.topics[topic]; !ok {
+			c.topics[topic] = struct{}{}
+			added = append(added, topic)
+		}
+	}
+	cli := c.cli
+	c.Unlock()
+	if cli == nil || len(added) == 0 {
+		return nil
+	}
+	err := c.call(ctx, cli, pubSubSubscribe, "subscribe", added)
+	if isPubSubRefusal(err) {
+		c.Lock()
+		for _, topic := range added {
+			delete(c.topics, topic)
+		}
+		c.Unlock()
+	}
+	return err
+}
+
+// isPubSubRefusal returns true if err, from a subscribe call, came from the
+// broker.
+func isPubSubRefusal(err error) bool {
+	if err == nil || isConnectionError(err) {
+		return false
+	}
+	var draining DrainingError
+	return !errors.Is(err, context.Canceled) && !errors.Is(err, context.DeadlineExceeded) &&
+		!errors.As(err, &draining)
+}
+
+// Unsubscribe unsubscribes from topics.
+func (c *PubSubClient) Unsubscribe(ctx context.Context, topics ...string) error {
+	c.Lock()
+	for _, topic := range topics {
+		delete(c.topics, topic)
+	}
+	cli := c.cli
+	c.Unlock()
+	if cli == nil {
+		return nil
+	}
+	return c.call(ctx, cli, pubSubUnsubscribe, "unsubscribe", topics)
+}
+
+// Topics returns the topics the client is subscribed to, sorted.
+func (c *PubSubClient) Topics() []string {
+	c.Lock()
+	defer c.Unlock()
+	ret := make([]string, 0, len(c.topics))
+	for topic := range c.topics {
+		ret = append(ret, topic)
+	}
+	sort.Strings(ret)
+	return ret
+}
@@ -0,0 +1,312 @@
+package rpc
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/keybase/backoff"
+	"github.com/stretchr/testify/require"
+)
+
+type pubSubTestReceiver struct {
+	sync.Mutex
+	msgs []PubSubMessage
+}
+
+func (r *pubSubTestReceiver) handle(_ context.Context, msg PubSubMessage) {
+	r.Lock()
+	defer r.Unlock()
+	r.msgs = append(r.msgs, msg)
+}
+
+// received returns the data of the messages received so far, sorted, since
+// they can be handled out of order.
+func (r *pubSubTestReceiver) received() []string {
+	r.Lock()
+	defer r.Unlock()
+	ret := make([]string, 0, len(r.msgs))
+	for _, msg := range r.msgs {
+		ret = append(ret, msg.Topic+":"+string(msg.Data))
+	}
+	sort.Strings(ret)
+	return ret
+}
+
+func (r *pubSubTestReceiver) dropped() uint64 {
+	r.Lock()
+	defer r.Unlock()
+	var ret uint64
+	for _, msg := range r.msgs {
+		ret += msg.Dropped
+	}
+	return ret
+}
+
+func (r *pubSubTestReceiver) waitFor(t *testing.T, n int) []string {
+	require.Eventually(t, func() bool { return len(r.received()) >= n }, 5*time.Second, time.Millisecond)
+	return r.received()
+}
+
+// pubSubTestPair connects a PubSubClient to a broker over a pipe.
+func pubSubTestPair(t *testing.T, b *PubSubBroker) (*PubSubClient, *pubSubTestReceiver, Transporter, Transporter) {
+	clientConn, serverConn := net.Pipe()
+	sxp := NewTransport(context.Background(), serverConn, nil, nil, nil, testMaxFrameLength)
+	srv := NewServer(sxp, nil)
+	require.NoError(t, b.Register(srv))
+	srv.Run()
+	cxp := NewTransport(context.Background(), clientConn, nil, nil, nil, testMaxFrameLength)
+	r := &pubSubTestReceiver{}
+	c := NewPubSubClient(r.handle)
+	require.NoError(t, c.Register(context.Background(), NewClient(cxp, nil, nil), NewServer(cxp, nil)))
+	t.Cleanup(func() {
+		cxp.Close()
+		sxp.Close()
+	})
+	return c, r, cxp, sxp
+}
+
+func TestPubSub(t *testing.T) {
+	b := NewPubSubBrokerWithOpts(PubSubBrokerOpts{
+		CanSubscribe: func(_ context.Context, topic string) error {
+			if topic == "secret" {
+				return errors.New("not allowed")
+			}
+			return nil
+		},
+	})
+	ctx := context.Background()
+	c1, r1, _, _ := pubSubTestPair(t, b)
+	c2, r2, cxp2, _ := pubSubTestPair(t, b)
+
+	require.NoError(t, c1.Subscribe(ctx, "a", "b"))
+	require.NoError(t, c2.Subscribe(ctx, "b"))
+	require.Equal(t, []string{"a", "b"}, c1.Topics())
+	require.Equal(t, 2, b.Subscribers("b"))
+
+	require.Equal(t, 1, b.Publish("a", []byte("1")))
+	require.Equal(t, 2, b.Publish("b", []byte("2")))
+	require.Equal(t, 0, b.Publish("c", []byte("3")))
+	require.Equal(t, []string{"a:1", "b:2"}, r1.waitFor(t, 2))
+	require.Equal(t, []string{"b:2"}, r2.waitFor(t, 1))
+
+	require.NoError(t, c1.Unsubscribe(ctx, "b"))
+	require.Equal(t, 1, b.Publish("b", []byte("4")))
+	require.Equal(t, []string{"b:2", "b:4"}, r2.waitFor(t, 2))
+
+	// Refused subscriptions are forgotten.
+	err := c1.Subscribe(ctx, "secret")
+	require.Error(t, err)
+	require.Equal(t, []string{"a"}, c1.Topics())
+	require.Equal(t, 0, b.Subscribers("secret"))
+
+	// Subscribers go away with their transports.
+	cxp2.Close()
+	require.Eventually(t, func() bool { return b.Subscribers("b") == 0 }, 5*time.Second, time.Millisecond)
+	require.Equal(t, 0, b.Publish("b", []byte("5")))
+	require.Equal(t, []string{"a:1", "b:2"}, r1.received())
+}
+
+func TestPubSubSlowConsumer(t *testing.T) {
+	expected := map[SlowConsumerPolicy][]string{
+		SlowConsumerDropNewest: {"t:0", "t:1", "t:2"},
+		SlowConsumerDropOldest: {"t:0", "t:3", "t:4"},
+	}
+	for _, policy := range []SlowConsumerPolicy{SlowConsumerDropNewest, SlowConsumerDropOldest, SlowConsumerDisconnect} {
+		b := NewPubSubBrokerWithOpts(PubSubBrokerOpts{QueueSize: 2, SlowConsumer: policy})
+		clientConn, serverConn := net.Pipe()
+		sxp := NewTransport(context.Background(), serverConn, nil, nil, nil, testMaxFrameLength)
+		defer sxp.Close()
+		srv := NewServer(sxp, nil)
+		require.NoError(t, b.Register(srv))
+		srv.Run()
+		var sub *pubSubSubscriber
+		b.Lock()
+		for s := range b.subscribers {
+			sub = s
+		}
+		b.Unlock()
+		sub.subscribe([]string{"t"}, true)
+
+		// Nothing reads the other end yet, so the first message blocks
+		// the sender, and the next ones are queued.
+		require.Equal(t, 1, b.Publish("t", []byte("0")))
+		require.Eventually(t, func() bool {
+			sub.Lock()
+			defer sub.Unlock()
+			return len(sub.queue) == 0
+		}, 5*time.Second, time.Millisecond)
+		for _, data := range []string{"1", "2", "3", "4"} {
+			b.Publish("t", []byte(data))
+		}
+
+		if policy == SlowConsumerDisconnect {
+			select {
+			case <-sxp.done():
+			case <-time.After(5 * time.Second):
+				require.FailNow(t, "slow consumer wasn't disconnected")
+			}
+			clientConn.Close()
+			continue
+		}
+
+		cxp := NewTransport(context.Background(), clientConn, nil, nil, nil, testMaxFrameLength)
+		defer cxp.Close()
+		r := &pubSubTestReceiver{}
+		csrv := NewServer(cxp, nil)
+		require.NoError(t, NewPubSubClient(r.handle).Register(context.Background(), NewClient(cxp, nil, nil), csrv))
+		csrv.Run()
+		require.Equal(t, expected[policy], r.waitFor(t, 3), "policy=%d", policy)
+		require.Equal(t, uint64(2), r.dropped())
+	}
+}
+
+func TestPubSubSubscribeDisconnected(t *testing.T) {
+	b := NewPubSubBroker()
+	c, r, cxp, _ := pubSubTestPair(t, b)
+	ctx := context.Background()
+
+	// Topics subscribed to while the transport is down aren't refused,
+	// so they're kept for the next one.
+	cxp.Close()
+	require.Error(t, c.Subscribe(ctx, "news"))
+	require.Equal(t, []string{"news"}, c.Topics())
+
+	clientConn, serverConn := net.Pipe()
+	sxp := NewTransport(ctx, serverConn, nil, nil, nil, testMaxFrameLength)
+	defer sxp.Close()
+	srv := NewServer(sxp, nil)
+	require.NoError(t, b.Register(srv))
+	srv.Run()
+	cxp = NewTransport(ctx, clientConn, nil, nil, nil, testMaxFrameLength)
+	defer cxp.Close()
+	require.NoError(t, c.Register(ctx, NewClient(cxp, nil, nil), NewServer(cxp, nil)))
+	require.Equal(t, 1, b.Subscribers("news"))
+	require.Equal(t, 1, b.Publish("news", []byte("1")))
+	require.Equal(t, []string{"news:1"}, r.waitFor(t, 1))
+}
+
+// pubSubAuthHandler logs in on connect, which the broker requires to
+// subscribe.
+type pubSubAuthHandler struct {
+	testConnectionHandler
+}
+
+func (pubSubAuthHandler) OnConnect(ctx context.Context, _ *Connection, cli GenericClient, _ *Server) error {
+	return cli.Call(ctx, newMethodV1("auth.login"), nil, nil, 0)
+}
+
+func TestPubSubConnectionResubscribes(t *testing.T) {
+	var loggedIn atomic.Bool
+	b := NewPubSubBrokerWithOpts(PubSubBrokerOpts{
+		CanSubscribe: func(context.Context, string) error {
+			if !loggedIn.Load() {
+				return errors.New("not logged in")
+			}
+			return nil
+		},
+	})
+	r := &pubSubTestReceiver{}
+	c := NewPubSubClient(r.handle)
+	require.NoError(t, c.Subscribe(context.Background(), "news"))
+
+	ct := &pipeConnectionTransport{serve: func(conn net.Conn) Transporter {
+		loggedIn.Store(false)
+		sxp := NewTransport(context.Background(), conn, nil, nil, nil, testMaxFrameLength)
+		srv := NewServer(sxp, nil)
+		require.NoError(t, b.Register(srv))
+		require.NoError(t, srv.Register(Protocol{
+			Name: "auth",
+			Methods: map[string]ServeHandlerDescription{
+				"login": {
+					MakeArg: func() interface{} { return new(interface{}) },
+					Handler: func(context.Context, interface{}) (interface{}, error) {
+						loggedIn.Store(true)
+						return nil, nil
+					},
+				},
+			},
+		}))
+		srv.Run()
+		return sxp
+	}}
+	conn := NewConnectionWithTransport(pubSubAuthHandler{}, ct, nil, &testLogOutput{t: t}, ConnectionOpts{
+		PubSub: c,
+		ReconnectBackoff: func() backoff.BackOff {
+			return backoff.NewConstantBackOff(time.Millisecond)
+		},
+	})
+	defer conn.Shutdown()
+
+	require.Eventually(t, func() bool { return b.Subscribers("news") == 1 }, 5*time.Second, time.Millisecond)
+	b.Publish("news", []byte("first"))
+	r.waitFor(t, 1)
+
+	// After the connection drops, the Connection reconnects when next
+	// used, and the subscriptions come back.
+	ct.dropServer()
+	require.Eventually(t, func() bool { return !ct.IsConnected() }, 5*time.Second, time.Millisecond)
+	require.NoError(t, conn.ForceReconnect(context.Background()))
+	require.Equal(t, 2, ct.dials())
+	require.Equal(t, 1, b.Subscribers("news"))
+	b.Publish("news", []byte("second"))
+	require.Equal(t, []string{"news:first", "news:second"}, r.waitFor(t, 2))
+}
+
+// pipeConnectionTransport dials a new pipe each time, with a server
+// transport made by serve on the other end.
+type pipeConnectionTransport struct {
+	serve func(conn net.Conn) Transporter
+
+	sync.Mutex
+	xp      Transporter
+	sxp     Transporter
+	numDial int
+}
+
+var _ ConnectionTransport = (*pipeConnectionTransport)(nil)
+
+func (ct *pipeConnectionTransport) Dial(context.Context) (Transporter, error) {
+	clientConn, serverConn := net.Pipe()
+	sxp := ct.serve(serverConn)
+	xp := NewTransport(context.Background(), clientConn, nil, nil, nil, testMaxFrameLength)
+	ct.Lock()
+	defer ct.Unlock()
+	ct.xp, ct.sxp = xp, sxp
+	ct.numDial++
+	return xp, nil
+}
+
+func (ct *pipeConnectionTransport) IsConnected() bool {
+	ct.Lock()
+	defer ct.Unlock()
+	return ct.xp != nil && ct.xp.IsConnected()
+}
+
+func (ct *pipeConnectionTransport) Finalize() {}
+
+func (ct *pipeConnectionTransport) Close() {
+	ct.Lock()
+	defer ct.Unlock()
+	if ct.xp != nil {
+		ct.xp.Close()
+		ct.sxp.Close()
+	}
+}
+
+func (ct *pipeConnectionTransport) dropServer() {
+	ct.Lock()
+	defer ct.Unlock()
+	ct.sxp.Close()
+}
+
+func (ct *pipeConnectionTransport) dials() int {
+	ct.Lock()
+	defer ct.Unlock()
+	return ct.numDial
+}
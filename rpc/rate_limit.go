@@ -0,0 +1,233 @@
+package rpc
+
+import (
+	"context"
+	"math"
+	"sync"
+	"time"
+)
+
+// RateLimit describes a token bucket: Rate tokens are added every second, up
+// to a maximum of Burst tokens. The zero value means "unlimited".
+type RateLimit struct {
+	Rate  float64
+	Burst int64
+}
+
+// IsUnlimited returns true if the RateLimit doesn't limit anything.
+func (l RateLimit) IsUnlimited() bool {
+	return l.Rate <= 0
+}
+
+func (l RateLimit) burst() float64 {
+	if l.Burst <= 0 {
+		return math.Max(1, l.Rate)
+	}
+	return float64(l.Burst)
+}
+
+// RateLimiter is the pluggable backend for rate limiting. Buckets are named
+// by key, and the limit is passed in on every use, so that an implementation
+// can keep its state elsewhere (e.g., shared between processes) without
+// needing to know about the RPC configuration. Requests for more tokens than
+// the bucket can hold are capped at the bucket size.
+type RateLimiter interface {
+	// Allow takes n tokens from the bucket named by key if they are
+	// available, and returns whether it did.
+	Allow(key string, limit RateLimit, n int64) bool
+	// Wait blocks until n tokens can be taken from the bucket named by
+	// key, or until ctx is done.
+	Wait(ctx context.Context, key string, limit RateLimit, n int64) error
+}
+
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+	// limit is the limit that the bucket was last used with.
+	limit RateLimit
+}
+
+// refill adds the tokens accrued since the last refill.
+func (b *tokenBucket) refill(now time.Time, limit RateLimit) {
+	b.tokens += now.Sub(b.last).Seconds() * limit.Rate
+	b.last = now
+	b.limit = limit
+	if burst := limit.burst(); b.tokens > burst {
+		b.tokens = burst
+	}
+}
+
+func (b *tokenBucket) isFull(now time.Time) bool {
+	return b.tokens+now.Sub(b.last).Seconds()*b.limit.Rate >= b.limit.burst()
+}
+
+// MemoryRateLimiter is an in-process RateLimiter. It is safe for concurrent
+// use. Buckets that have refilled completely are equivalent to new ones, so
+// they are periodically pruned to keep memory bounded.
+type MemoryRateLimiter struct {
+	sync.Mutex
+	buckets  map[string]*tokenBucket
+	newSince int
+}
+
+var _ RateLimiter = (*MemoryRateLimiter)(nil)
+
+// memoryRateLimiterPruneEvery is the number of new buckets that are created
+// between two prunings.
+const memoryRateLimiterPruneEvery = 1024
+
+func NewMemoryRateLimiter() *MemoryRateLimiter {
+	return &MemoryRateLimiter{
+		buckets: make(map[string]*tokenBucket),
+	}
+}
+
+func (m *MemoryRateLimiter) pruneLocked(now time.Time) {
+	m.newSince = 0
+	for key, b := range m.buckets {
+		if b.isFull(now) {
+			delete(m.buckets, key)
+		}
+	}
+}
+
+// take tries to take n tokens from the bucket for key. On failure, it returns
+// how long the caller should wait before the tokens will be available.
+func (m *MemoryRateLimiter) take(key string, limit RateLimit, n int64) (bool, time.Duration) {
+	if limit.IsUnlimited() {
+		return true, 0
+	}
+	m.Lock()
+	defer m.Unlock()
+
+	now := time.Now()
+	want := math.Min(float64(n), limit.burst())
+	b, ok := m.buckets[key]
+	if !ok {
+		m.newSince++
+		if m.newSince >= memoryRateLimiterPruneEvery {
+			m.pruneLocked(now)
+		}
+		b = &tokenBucket{tokens: limit.burst(), last: now, limit: limit}
+		m.buckets[key] = b
+	}
+	b.refill(now, limit)
+	if b.tokens >= want {
+		b.tokens -= want
+		return true, 0
+	}
+	missing := want - b.tokens
+	return false, time.Duration(missing / limit.Rate * float64(time.Second))
+}
+
+// Allow implements the RateLimiter interface.
+func (m *MemoryRateLimiter) Allow(key string, limit RateLimit, n int64) bool {
+	ok, _ := m.take(key, limit, n)
+	return ok
+}
+
+// Wait implements the RateLimiter interface.
+func (m *MemoryRateLimiter) Wait(ctx context.Context, key string, limit RateLimit, n int64) error {
+	for {
+		ok, wait := m.take(key, limit, n)
+		if ok {
+			return nil
+		}
+		timer := time.NewTimer(wait)
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return ctx.Err()
+		}
+	}
+}
+
+// MethodRateLimits configures client-side limits on outgoing calls. The
+// limit for a method is the first one found in Methods (keyed by the full
+// method name), Protocols (keyed by protocol name), or Default. Every method
+// gets its own bucket.
+type MethodRateLimits struct {
+	// Limiter is the backend that holds the buckets. If nil, an in-memory
+	// limiter private to the client is used.
+	Limiter   RateLimiter
+	Default   RateLimit
+	Protocols map[string]RateLimit
+	Methods   map[string]RateLimit
+}
+
+func (m *MethodRateLimits) limitFor(name string) RateLimit {
+	if l, ok := m.Methods[name]; ok {
+		return l
+	}
+	p, _ := splitMethodName(name)
+	if l, ok := m.Protocols[p]; ok {
+		return l
+	}
+	return m.Default
+}
+
+// TransportRateLimit configures server-side limits on the incoming calls and
+// notifies accepted from one transport. Calls over the limit are answered
+// with a ResourceExhaustedError, and notifies over the limit are dropped.
+// Per-protocol and per-method limits are configured via the RateLimit
+// fields of Protocol, ProtocolV2 and ServeHandlerDescription, and also apply
+// when TransportRateLimit is not given.
+type TransportRateLimit struct {
+	// Limiter is the backend that holds the buckets. If nil, an in-memory
+	// limiter private to the transport is used.
+	Limiter RateLimiter
+	// PeerKey names the peer in bucket keys. Set it to something stable,
+	// like a user ID or an IP, to share limits between several
+	// connections from the same peer. Defaults to the remote address.
+	PeerKey string
+	Frames  RateLimit
+	Bytes   RateLimit
+}
+
+type transportRateLimiter struct {
+	limiter RateLimiter
+	peer    string
+	frames  RateLimit
+	bytes   RateLimit
+}
+
+func newTransportRateLimiter(opts *TransportRateLimit, remote string) *transportRateLimiter {
+	ret := &transportRateLimiter{peer: remote}
+	if opts != nil {
+		ret.limiter = opts.Limiter
+		ret.frames = opts.Frames
+		ret.bytes = opts.Bytes
+		if opts.PeerKey != "" {
+			ret.peer = opts.PeerKey
+		}
+	}
+	if ret.limiter == nil {
+		ret.limiter = NewMemoryRateLimiter()
+	}
+	return ret
+}
+
+// check returns a ResourceExhaustedError if the given incoming message,
+// which was read from a frame of the given size, is over one of the limits.
+func (l *transportRateLimiter) check(rpc rpcMessage, size int64, p protocolHandlers) error {
+	switch rpc.Type() {
+	case MethodCall, MethodCallV2, MethodCallCompressed, MethodNotify, MethodNotifyV2:
+	default:
+		// Responses and cancels are triggered by our own calls, so
+		// don't limit them.
+		return nil
+	}
+	name := rpc.Name().String()
+	if !l.frames.IsUnlimited() && !l.limiter.Allow(l.peer+" frames", l.frames, 1) {
+		return newResourceExhaustedError("frames", name)
+	}
+	if !l.bytes.IsUnlimited() && !l.limiter.Allow(l.peer+" bytes", l.bytes, size) {
+		return newResourceExhaustedError("bytes", name)
+	}
+	limit := rpc.Name().findRateLimit(p)
+	if !limit.IsUnlimited() && !l.limiter.Allow(l.peer+" method "+name, limit, 1) {
+		return newResourceExhaustedError("calls", name)
+	}
+	return nil
+}
@@ -0,0 +1,197 @@
+package rpc
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestMemoryRateLimiter(t *testing.T) {
+	l := NewMemoryRateLimiter()
+	limit := RateLimit{Rate: 1, Burst: 3}
+
+	for i := 0; i < 3; i++ {
+		require.True(t, l.Allow("a", limit, 1))
+	}
+	require.False(t, l.Allow("a", limit, 1))
+
+	// Other keys have their own bucket.
+	require.True(t, l.Allow("b", limit, 1))
+
+	// Requests larger than the bucket are capped at the bucket size.
+	require.True(t, l.Allow("c", limit, 100))
+	require.False(t, l.Allow("c", limit, 1))
+
+	// Unlimited always passes.
+	for i := 0; i < 10; i++ {
+		require.True(t, l.Allow("a", RateLimit{}, 1))
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	err := l.Wait(ctx, "a", limit, 1)
+	require.Equal(t, context.DeadlineExceeded, err)
+
+	fast := RateLimit{Rate: 1000, Burst: 1}
+	require.True(t, l.Allow("d", fast, 1))
+	err = l.Wait(context.Background(), "d", fast, 1)
+	require.NoError(t, err)
+}
+
+func prepRateLimitTest(t *testing.T, rl *TransportRateLimit, p Protocol) *Client {
+	clientConn, serverConn := net.Pipe()
+	lf := NewSimpleLogFactory(&testLogOutput{t: t}, nil)
+
+	sxp := NewTransportWithOpts(context.Background(), serverConn, lf, nil, nil, testMaxFrameLength,
+		TransportOpts{RateLimit: rl})
+	srv := NewServer(sxp, nil)
+	require.NoError(t, srv.Register(p))
+	srv.Run()
+
+	cxp := NewTransport(context.Background(), clientConn, lf, nil, nil, testMaxFrameLength)
+	t.Cleanup(func() {
+		cxp.Close()
+		sxp.Close()
+	})
+	return NewClient(cxp, nil, nil)
+}
+
+func rateLimitTestProtocol(prot *RateLimit, meth *RateLimit) Protocol {
+	return Protocol{
+		Name:      "limited",
+		RateLimit: prot,
+		Methods: map[string]ServeHandlerDescription{
+			"ping": {
+				MakeArg: func() interface{} { return new(int) },
+				Handler: func(_ context.Context, arg interface{}) (interface{}, error) {
+					return *arg.(*int), nil
+				},
+				RateLimit: meth,
+			},
+			"pong": {
+				MakeArg: func() interface{} { return new(int) },
+				Handler: func(_ context.Context, arg interface{}) (interface{}, error) {
+					return *arg.(*int), nil
+				},
+			},
+		},
+	}
+}
+
+func TestServerMethodRateLimit(t *testing.T) {
+	slow := &RateLimit{Rate: 0.001, Burst: 2}
+	cli := prepRateLimitTest(t, nil, rateLimitTestProtocol(nil, slow))
+	ctx := context.Background()
+
+	var res int
+	for i := 0; i < 2; i++ {
+		err := cli.Call(ctx, newMethodV1("limited.ping"), i, &res, 0)
+		require.NoError(t, err)
+		require.Equal(t, i, res)
+	}
+	err := cli.Call(ctx, newMethodV1("limited.ping"), 5, &res, 0)
+	require.EqualError(t, err, newResourceExhaustedError("calls", "limited.ping").Error())
+
+	// Other methods aren't affected.
+	err = cli.Call(ctx, newMethodV1("limited.pong"), 5, &res, 0)
+	require.NoError(t, err)
+	require.Equal(t, 5, res)
+}
+
+func TestServerProtocolRateLimit(t *testing.T) {
+	slow := &RateLimit{Rate: 0.001, Burst: 1}
+	cli := prepRateLimitTest(t, nil, rateLimitTestProtocol(slow, nil))
+	ctx := context.Background()
+
+	var res int
+	require.NoError(t, cli.Call(ctx, newMethodV1("limited.ping"), 1, &res, 0))
+	require.NoError(t, cli.Call(ctx, newMethodV1("limited.pong"), 1, &res, 0))
+	err := cli.Call(ctx, newMethodV1("limited.pong"), 1, &res, 0)
+	require.EqualError(t, err, newResourceExhaustedError("calls", "limited.pong").Error())
+}
+
+func TestServerTransportRateLimit(t *testing.T) {
+	rl := &TransportRateLimit{
+		Frames: RateLimit{Rate: 0.001, Burst: 3},
+	}
+	cli := prepRateLimitTest(t, rl, rateLimitTestProtocol(nil, nil))
+	ctx := context.Background()
+
+	var res int
+	for i := 0; i < 3; i++ {
+		require.NoError(t, cli.Call(ctx, newMethodV1("limited.pong"), i, &res, 0))
+	}
+	err := cli.Call(ctx, newMethodV1("limited.ping"), 1, &res, 0)
+	require.EqualError(t, err, newResourceExhaustedError("frames", "limited.ping").Error())
+
+	rl = &TransportRateLimit{
+		Bytes: RateLimit{Rate: 0.001, Burst: 20},
+	}
+	cli = prepRateLimitTest(t, rl, rateLimitTestProtocol(nil, nil))
+	require.NoError(t, cli.Call(ctx, newMethodV1("limited.pong"), 1, &res, 0))
+	err = cli.Call(ctx, newMethodV1("limited.pong"), 1, &res, 0)
+	require.EqualError(t, err, newResourceExhaustedError("bytes", "limited.pong").Error())
+}
+
+func TestClientRateLimit(t *testing.T) {
+	clientConn, serverConn := net.Pipe()
+	lf := NewSimpleLogFactory(&testLogOutput{t: t}, nil)
+	sxp := NewTransport(context.Background(), serverConn, lf, nil, nil, testMaxFrameLength)
+	srv := NewServer(sxp, nil)
+	require.NoError(t, srv.Register(rateLimitTestProtocol(nil, nil)))
+	srv.Run()
+	cxp := NewTransport(context.Background(), clientConn, lf, nil, nil, testMaxFrameLength)
+	defer cxp.Close()
+	defer sxp.Close()
+
+	cli := NewClientWithRateLimits(cxp, nil, nil, MethodRateLimits{
+		Methods: map[string]RateLimit{
+			"limited.ping": {Rate: 0.001, Burst: 1},
+		},
+	})
+
+	ctx := context.Background()
+	var res int
+	require.NoError(t, cli.Call(ctx, newMethodV1("limited.ping"), 1, &res, 0))
+	err := cli.Call(ctx, newMethodV1("limited.ping"), 1, &res, 10*time.Millisecond)
+	require.Equal(t, context.DeadlineExceeded, err)
+	require.NoError(t, cli.Call(ctx, newMethodV1("limited.pong"), 1, &res, 0))
+}
+
+func TestResourceExhaustedRoundTrip(t *testing.T) {
+	doWithAllCodecs(t, func(t *testing.T, ct CodecType) {
+		clientConn, serverConn := net.Pipe()
+		lf := NewSimpleLogFactory(&testLogOutput{t: t}, nil)
+		sxp := NewTransportWithOpts(context.Background(), serverConn, lf, nil, nil, testMaxFrameLength,
+			TransportOpts{Codec: ct})
+		// The protocol's errors are wrapped into statuses that the
+		// unwrapper turns back into nil.
+		srv := NewServer(sxp, testWrapError)
+		require.NoError(t, srv.Register(rateLimitTestProtocol(nil, &RateLimit{Rate: 0.001, Burst: 1})))
+		srv.Run()
+		cxp := NewTransportWithOpts(context.Background(), clientConn, lf, nil, nil, testMaxFrameLength,
+			TransportOpts{Codec: ct})
+		t.Cleanup(func() {
+			cxp.Close()
+			sxp.Close()
+		})
+		cli := NewClient(cxp, testErrorUnwrapper{}, nil)
+		ctx := context.Background()
+
+		var res int
+		require.NoError(t, cli.Call(ctx, newMethodV1("limited.ping"), 1, &res, 0))
+		require.Equal(t, 1, res)
+		err := cli.Call(ctx, newMethodV1("limited.ping"), 2, &res, 0)
+		var re ResourceExhaustedError
+		require.ErrorAs(t, err, &re)
+		require.Equal(t, newResourceExhaustedError("calls", "limited.ping"), re)
+		err = cli.CallCompressed(ctx, newMethodV1("limited.ping"), 3, &res, CompressionGzip, 0)
+		require.Equal(t, newResourceExhaustedError("calls", "limited.ping"), err)
+		// Without a result to decode into, too.
+		err = cli.Call(ctx, newMethodV1("limited.ping"), 4, nil, 0)
+		require.Equal(t, newResourceExhaustedError("calls", "limited.ping"), err)
+	})
+}
@@ -2,15 +2,45 @@ package rpc
 
 import (
 	"context"
+	"sort"
+	"time"
 )
 
 type task struct {
 	seqid      SeqNumber
 	cancelFunc context.CancelFunc
+	typ        MethodType
+	method     string
+	start      time.Time
 }
 
+func (t *task) isNotify() bool {
+	return t.typ == MethodNotify || t.typ == MethodNotifyV2
+}
+
+// servedCall is implemented by the requests for incoming calls, which are
+// watched for slowness.
+type servedCall interface {
+	Context() context.Context
+	Arg() interface{}
+}
+
+var (
+	_ servedCall = (*callRequest)(nil)
+	_ servedCall = (*callCompressedRequest)(nil)
+	_ servedCall = (*notifyRequest)(nil)
+)
+
 type receiver interface {
 	Receive(rpcMessage) error
+	// Reject refuses an incoming call with the given error, without
+	// running its handler. Rejected notifies are dropped.
+	Reject(rpcMessage, error) error
+	// WaitIdle blocks until no incoming calls or notifies are being
+	// served, or until ctx is done.
+	WaitIdle(ctx context.Context) error
+	// describeTasks lists the incoming calls and notifies being served.
+	describeTasks() []ServedTaskInfo
 	Close() <-chan struct{}
 }
 
@@ -28,9 +58,21 @@ type receiveHandler struct {
 	// Task loop channels
 	taskBeginCh  chan *task
 	taskCancelCh chan SeqNumber
-	taskEndCh    chan SeqNumber
+	taskEndCh    chan *task
+	taskIdleCh   chan chan struct{}
+	taskListCh   chan chan []ServedTaskInfo
 
-	log LogInterface
+	log    LogInterface
+	tracer *rpcTracer
+	slow   *slowCallWatcher
+	// ordered, if set, handles ordered notifies.
+	ordered *OrderedNotifyReceiver
+	// serial serves the requests that have a SerialKey.
+	serial *SerialQueues
+	// idempotency, if set, caches the replies to the calls that have an
+	// idempotency key, which are keyed by peer, by default.
+	idempotency *IdempotencyCache
+	peer        string
 }
 
 func newReceiveHandler(enc *framedMsgpackEncoder, protHandlers protocolHandlers,
@@ -44,36 +86,57 @@ func newReceiveHandler(enc *framedMsgpackEncoder, protHandlers protocolHandlers,
 
 		taskBeginCh:  make(chan *task),
 		taskCancelCh: make(chan SeqNumber),
-		taskEndCh:    make(chan SeqNumber),
+		taskEndCh:    make(chan *task),
+		taskIdleCh:   make(chan chan struct{}),
+		taskListCh:   make(chan chan []ServedTaskInfo),
 
-		log: l,
+		log:    l,
+		serial: NewSerialQueues(),
 	}
 	go r.taskLoop()
 	return r
 }
 
 func (r *receiveHandler) taskLoop() {
-	tasks := make(map[SeqNumber]context.CancelFunc)
+	// Calls are canceled by seqid. Notifies all share the same one, so
+	// they're only kept track of as running tasks.
+	calls := make(map[SeqNumber]*task)
+	running := make(map[*task]struct{})
+	var idleWaiters []chan struct{}
 	for {
+		if len(running) == 0 {
+			for _, ch := range idleWaiters {
+				close(ch)
+			}
+			idleWaiters = nil
+		}
 		select {
 		case <-r.stopCh:
-			for _, cancelFunc := range tasks {
-				cancelFunc()
+			for t := range running {
+				t.cancelFunc()
 			}
 			close(r.closedCh)
 			return
 		case t := <-r.taskBeginCh:
-			tasks[t.seqid] = t.cancelFunc
+			if !t.isNotify() {
+				calls[t.seqid] = t
+			}
+			running[t] = struct{}{}
 		case seqid := <-r.taskCancelCh:
-			if cancelFunc, ok := tasks[seqid]; ok {
-				cancelFunc()
+			if t, ok := calls[seqid]; ok {
+				t.cancelFunc()
 			}
-			delete(tasks, seqid)
-		case seqid := <-r.taskEndCh:
-			if cancelFunc, ok := tasks[seqid]; ok {
-				cancelFunc()
+			delete(calls, seqid)
+		case t := <-r.taskEndCh:
+			t.cancelFunc()
+			if calls[t.seqid] == t {
+				delete(calls, t.seqid)
 			}
-			delete(tasks, seqid)
+			delete(running, t)
+		case ch := <-r.taskIdleCh:
+			idleWaiters = append(idleWaiters, ch)
+		case ch := <-r.taskListCh:
+			ch <- describeRunningTasks(running, time.Now())
 		}
 	}
 }
@@ -95,18 +158,126 @@ func (r *receiveHandler) Receive(rpc rpcMessage) error {
 	}
 }
 
+// endTask tells the task loop that t is done, unless the receiver is gone,
+// since the queues that t may have waited in can outlive it.
+func (r *receiveHandler) endTask(t *task) {
+	select {
+	case r.taskEndCh <- t:
+	case <-r.stopCh:
+	}
+}
+
+func (r *receiveHandler) WaitIdle(ctx context.Context) error {
+	ch := make(chan struct{})
+	select {
+	case r.taskIdleCh <- ch:
+	case <-r.stopCh:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	select {
+	case <-ch:
+		return nil
+	case <-r.stopCh:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// wireMethodType returns the type of the frame that req came in, telling V1
+// and V2 methods apart.
+func wireMethodType(req request) MethodType {
+	switch req.Type() {
+	case MethodCall:
+		return req.Name().CallMethodType()
+	case MethodNotify:
+		return req.Name().NotifyMethodType()
+	default:
+		return req.Type()
+	}
+}
+
+func describeRunningTasks(running map[*task]struct{}, now time.Time) []ServedTaskInfo {
+	ret := make([]ServedTaskInfo, 0, len(running))
+	for t := range running {
+		ret = append(ret, ServedTaskInfo{
+			SeqNo:    t.seqid,
+			Type:     t.typ,
+			Method:   t.method,
+			Started:  t.start,
+			Duration: now.Sub(t.start),
+		})
+	}
+	sort.Slice(ret, func(i, j int) bool {
+		if !ret[i].Started.Equal(ret[j].Started) {
+			return ret[i].Started.Before(ret[j].Started)
+		}
+		return ret[i].SeqNo < ret[j].SeqNo
+	})
+	return ret
+}
+
+func (r *receiveHandler) describeTasks() []ServedTaskInfo {
+	ch := make(chan []ServedTaskInfo, 1)
+	select {
+	case r.taskListCh <- ch:
+		return <-ch
+	case <-r.stopCh:
+		return nil
+	}
+}
+
+func (r *receiveHandler) Reject(rpc rpcMessage, err error) error {
+	var req request
+	switch message := rpc.(type) {
+	case *rpcNotifyMessage:
+		req = newNotifyRequest(message, r.log, r.tracer)
+	case *rpcCallMessage:
+		req = newCallRequest(message, r.log, r.tracer)
+	case *rpcCallCompressedMessage:
+		req = newCallCompressedRequest(message, r.log, r.tracer)
+	default:
+		return r.Receive(rpc)
+	}
+	wrapErrorFunc := r.protocols.v1.wef
+	if serveHandler, wef, se := req.Name().findServeHandler(r.protocols); se == nil {
+		wrapErrorFunc = wef
+		req.setRedaction(serveHandler.Redaction)
+	}
+	return r.refuse(req, err, wrapErrorFunc)
+}
+
+// refuse replies to req with err, without serving it. The status of the
+// reply tells the client that it wasn't served, and the session of an
+// ordered notify refuses the ones after it until it's sent again.
+func (r *receiveHandler) refuse(req request, err error, wrapErrorFunc WrapErrorFunc) error {
+	req.LogInvocation(err)
+	req.setFailed(err)
+	req.setReplyStatus(newReplyStatus(err))
+	if cr, ok := req.(*callRequest); ok && r.ordered != nil {
+		if header, ok := cr.headers[orderedNotifyHeader]; ok {
+			if session, seq, perr := parseOrderedNotifyHeader(header); perr == nil {
+				r.ordered.refused(session, seq)
+			}
+		}
+	}
+	return req.Reply(r.writer, nil, wrapError(wrapErrorFunc, err))
+}
+
 func (r *receiveHandler) receiveNotify(rpc *rpcNotifyMessage) error {
-	req := newNotifyRequest(rpc, r.log)
+	req := newNotifyRequest(rpc, r.log, r.tracer)
 	return r.handleReceiveDispatch(req)
 }
 
 func (r *receiveHandler) receiveCall(rpc *rpcCallMessage) error {
-	req := newCallRequest(rpc, r.log)
+	req := newCallRequest(rpc, r.log, r.tracer)
 	return r.handleReceiveDispatch(req)
 }
 
 func (r *receiveHandler) receiveCallCompressed(rpc *rpcCallCompressedMessage) error {
-	req := newCallCompressedRequest(rpc, r.log)
+	req := newCallCompressedRequest(rpc, r.log, r.tracer)
 	return r.handleReceiveDispatch(req)
 }
 
@@ -119,18 +290,108 @@ func (r *receiveHandler) receiveCancel(rpc *rpcCancelMessage) error {
 func (r *receiveHandler) handleReceiveDispatch(req request) error {
 	if req.Err() != nil {
 		req.LogInvocation(req.Err())
+		req.setFailed(req.Err())
 		return req.Reply(r.writer, nil, wrapError(r.protocols.v1.wef, req.Err()))
 	}
 	serveHandler, wrapErrorFunc, se := req.Name().findServeHandler(r.protocols)
 	if se != nil {
-		req.LogInvocation(se)
-		return req.Reply(r.writer, nil, wrapError(wrapErrorFunc, se))
-	}
-	r.taskBeginCh <- &task{req.SeqNo(), req.CancelFunc()}
-	go func() {
-		req.Serve(r.writer, serveHandler, wrapErrorFunc)
-		r.taskEndCh <- req.SeqNo()
-	}()
+		return r.refuse(req, se, wrapErrorFunc)
+	}
+	req.setRedaction(serveHandler.Redaction)
+	if serveHandler.refuse != nil {
+		return r.refuse(req, serveHandler.refuse, wrapErrorFunc)
+	}
+	if cr, ok := req.(*callRequest); ok && r.ordered != nil {
+		if header, ok := cr.headers[orderedNotifyHeader]; ok {
+			return r.receiveOrdered(cr, header, serveHandler, wrapErrorFunc)
+		}
+	}
+	t := &task{
+		seqid:      req.SeqNo(),
+		cancelFunc: req.CancelFunc(),
+		typ:        wireMethodType(req),
+		method:     req.Name().String(),
+		start:      time.Now(),
+	}
+	r.taskBeginCh <- t
+	serve := func() {
+		stop := func() {}
+		if c, ok := req.(servedCall); ok && req.Type() != MethodNotify {
+			stop = r.slow.watch(c.Context(), true, t.seqid, t.method, c.Arg(), serveHandler.Redaction.arg())
+		}
+		if key, ok := r.idempotencyKey(req); ok {
+			r.serveIdempotent(req, key, serveHandler, wrapErrorFunc)
+		} else {
+			req.Serve(r.writer, serveHandler, wrapErrorFunc)
+		}
+		stop()
+		r.endTask(t)
+	}
+	if serveHandler.SerialKey != nil {
+		if c, ok := req.(servedCall); ok {
+			if key := serveHandler.SerialKey(c.Arg()); key != "" {
+				queued := r.serial.run(key, func() {
+					// Calls that were canceled while queued
+					// aren't served.
+					if err := req.serveContext().Err(); err != nil && req.Type() != MethodNotify {
+						req.LogInvocation(err)
+						req.setFailed(err)
+						_ = req.Reply(r.writer, nil, wrapError(wrapErrorFunc, err))
+						r.endTask(t)
+						return
+					}
+					serve()
+				})
+				if !queued {
+					err := r.refuse(req, newResourceExhaustedError("queued requests", t.method), wrapErrorFunc)
+					r.endTask(t)
+					return err
+				}
+				return nil
+			}
+		}
+	}
+	go serve()
+	return nil
+}
+
+// receiveOrdered queues an ordered notify, to be served after the ones
+// before it in its session.
+func (r *receiveHandler) receiveOrdered(req *callRequest, header string, serveHandler *ServeHandlerDescription,
+	wrapErrorFunc WrapErrorFunc) error {
+	session, seq, err := parseOrderedNotifyHeader(header)
+	if err != nil {
+		req.LogInvocation(err)
+		req.setFailed(err)
+		return req.Reply(r.writer, nil, wrapError(wrapErrorFunc, err))
+	}
+	t := &task{
+		seqid:      req.SeqNo(),
+		cancelFunc: req.CancelFunc(),
+		typ:        wireMethodType(req),
+		method:     req.Name().String(),
+		start:      time.Now(),
+	}
+	r.taskBeginCh <- t
+	r.ordered.enqueue(session, orderedNotifyTask{
+		seq: seq,
+		serve: func(dup bool) {
+			if dup {
+				// It was handled already, but the acknowledgement
+				// didn't make it.
+				_ = req.Reply(r.writer, nil, nil)
+			} else {
+				req.Serve(r.writer, serveHandler, wrapErrorFunc)
+			}
+			// The session outlives the transport, so it mustn't
+			// wait on a receiver that's gone.
+			r.endTask(t)
+		},
+		refuse: func() {
+			_ = r.refuse(req, orderedNotifyGapError{}, wrapErrorFunc)
+			r.endTask(t)
+		},
+	})
 	return nil
 }
 
@@ -2,6 +2,7 @@ package rpc
 
 import (
 	"context"
+	"errors"
 	"net"
 	"testing"
 
@@ -121,3 +122,27 @@ func TestCloseReceiver(t *testing.T) {
 	err := <-waitCh
 	require.EqualError(t, err, context.Canceled.Error())
 }
+
+func TestReplyStatus(t *testing.T) {
+	v1 := newMethodV1("prot.meth")
+	v2 := NewMethodV2(0x2a, 3, "prot2.meth")
+	for _, tc := range []struct {
+		method Methoder
+		err    error
+	}{
+		{v1, newResourceExhaustedError("calls", "prot.meth")},
+		{v1, DrainingError{}},
+		{v1, newProtocolNotFoundError("prot")},
+		{v1, newMethodNotFoundError("prot", "meth")},
+		{v2, NewProtocolV2NotFoundError(0x2a)},
+		{v2, NewMethodV2NotFoundError(0x2a, 3, "prot2")},
+		{v1, orderedNotifyGapError{}},
+	} {
+		s := newReplyStatus(tc.err)
+		require.NotNil(t, s, tc.err)
+		require.Equal(t, tc.err, s.err(tc.method))
+		require.True(t, isRefusal(tc.err))
+	}
+	require.Nil(t, newReplyStatus(errors.New("app error")))
+	require.False(t, isRefusal(nil))
+}
@@ -0,0 +1,296 @@
+package rpc
+
+import (
+	"fmt"
+	"log/slog"
+	"reflect"
+	"sync"
+)
+
+// RedactedPlaceholder replaces redacted strings in logged arguments and
+// results. Redacted fields of other types are zeroed.
+const RedactedPlaceholder = "[REDACTED]"
+
+// Redactable is implemented by argument and result types that know how to
+// hide their own secrets. Redacted returns the value to log in their place.
+type Redactable interface {
+	Redacted() interface{}
+}
+
+// RedactFunc returns a view of an argument or result that's safe to log.
+type RedactFunc func(v interface{}) interface{}
+
+// Redaction says how to redact the arguments and results of a served
+// method, set on its ServeHandlerDescription. A nil func falls back to the
+// Redactable interface and to `redact:"true"` struct tags, which are all
+// that apply on the client side.
+type Redaction struct {
+	Arg    RedactFunc
+	Result RedactFunc
+}
+
+func (r *Redaction) arg() RedactFunc {
+	if r == nil {
+		return nil
+	}
+	return r.Arg
+}
+
+func (r *Redaction) result() RedactFunc {
+	if r == nil {
+		return nil
+	}
+	return r.Result
+}
+
+// RedactedValue is passed to the LogInterface in place of an argument or
+// result that has something to redact. It's only redacted once it's
+// formatted, with Value, String or as a slog.LogValuer, so that values that
+// aren't logged cost nothing.
+type RedactedValue struct {
+	v interface{}
+	f RedactFunc
+}
+
+var _ slog.LogValuer = RedactedValue{}
+
+// Value returns the redacted view of the value.
+func (r RedactedValue) Value() interface{} {
+	return redactNow(r.f, r.v)
+}
+
+func (r RedactedValue) String() string {
+	return fmt.Sprintf("%+v", r.Value())
+}
+
+func (r RedactedValue) LogValue() slog.Value {
+	return slog.AnyValue(r.Value())
+}
+
+// redactLater returns v as is if there's nothing to redact in it, and a
+// RedactedValue otherwise. f, if set, is the redaction of the method.
+func redactLater(f RedactFunc, v interface{}) interface{} {
+	if f == nil && !mightNeedRedaction(v) {
+		return v
+	}
+	return RedactedValue{v: v, f: f}
+}
+
+func redactNow(f RedactFunc, v interface{}) interface{} {
+	if f != nil {
+		return f(v)
+	}
+	return Redact(v)
+}
+
+// logValue resolves v if it's a RedactedValue, before it's formatted.
+func logValue(v interface{}) interface{} {
+	if r, ok := v.(RedactedValue); ok {
+		return r.Value()
+	}
+	return v
+}
+
+func mightNeedRedaction(v interface{}) bool {
+	if v == nil {
+		return false
+	}
+	if _, ok := v.(Redactable); ok {
+		return true
+	}
+	return typeNeedsRedaction(reflect.TypeOf(v))
+}
+
+// Redact returns v as is, unless it's Redactable, or it has Redactable
+// values or struct fields tagged with `redact:"true"`, at any depth. In the
+// latter case, it returns a copy of v in which the Redactable values are
+// replaced by their Redacted ones, and the fields by RedactedPlaceholder if
+// they're strings, or zeroed otherwise.
+func Redact(v interface{}) interface{} {
+	if v == nil {
+		return nil
+	}
+	if r, ok := v.(Redactable); ok {
+		return r.Redacted()
+	}
+	rv := reflect.ValueOf(v)
+	if !typeNeedsRedaction(rv.Type()) {
+		return v
+	}
+	return redactValue(rv).Interface()
+}
+
+// redactTypes caches whether values of a type might need redacting.
+var redactTypes sync.Map
+
+func typeNeedsRedaction(t reflect.Type) bool {
+	if ret, ok := redactTypes.Load(t); ok {
+		return ret.(bool)
+	}
+	ret := computeNeedsRedaction(t, make(map[reflect.Type]bool))
+	redactTypes.Store(t, ret)
+	return ret
+}
+
+func computeNeedsRedaction(t reflect.Type, visiting map[reflect.Type]bool) bool {
+	if visiting[t] {
+		// Recursive types need redacting if any of their other
+		// fields do.
+		return false
+	}
+	visiting[t] = true
+	defer delete(visiting, t)
+
+	if isRedactableType(t) {
+		return true
+	}
+	switch t.Kind() {
+	case reflect.Interface:
+		// Depends on the dynamic type.
+		return true
+	case reflect.Ptr, reflect.Slice, reflect.Array:
+		return computeNeedsRedaction(t.Elem(), visiting)
+	case reflect.Map:
+		return computeNeedsRedaction(t.Elem(), visiting)
+	case reflect.Struct:
+		for i := 0; i < t.NumField(); i++ {
+			f := t.Field(i)
+			if !f.IsExported() {
+				continue
+			}
+			if f.Tag.Get("redact") == "true" || computeNeedsRedaction(f.Type, visiting) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// redactValue returns a redacted copy of v, or v itself if there's nothing
+// to redact.
+func redactValue(v reflect.Value) reflect.Value {
+	t := v.Type()
+	if !typeNeedsRedaction(t) {
+		return v
+	}
+	if isRedactableType(t) {
+		return redactRedactable(v)
+	}
+	switch t.Kind() {
+	case reflect.Interface:
+		if v.IsNil() {
+			return v
+		}
+		elem := v.Elem()
+		ret := reflect.New(t).Elem()
+		if r, ok := elem.Interface().(Redactable); ok {
+			rv := reflect.ValueOf(r.Redacted())
+			if !rv.IsValid() {
+				return ret
+			}
+			if rv.Type().AssignableTo(t) {
+				ret.Set(rv)
+				return ret
+			}
+		}
+		ret.Set(redactValue(elem))
+		return ret
+	case reflect.Ptr:
+		if v.IsNil() {
+			return v
+		}
+		ret := reflect.New(t.Elem())
+		ret.Elem().Set(redactValue(v.Elem()))
+		return ret
+	case reflect.Slice:
+		if v.IsNil() {
+			return v
+		}
+		ret := reflect.MakeSlice(t, v.Len(), v.Len())
+		for i := 0; i < v.Len(); i++ {
+			ret.Index(i).Set(redactValue(v.Index(i)))
+		}
+		return ret
+	case reflect.Array:
+		ret := reflect.New(t).Elem()
+		for i := 0; i < v.Len(); i++ {
+			ret.Index(i).Set(redactValue(v.Index(i)))
+		}
+		return ret
+	case reflect.Map:
+		if v.IsNil() {
+			return v
+		}
+		ret := reflect.MakeMapWithSize(t, v.Len())
+		iter := v.MapRange()
+		for iter.Next() {
+			ret.SetMapIndex(iter.Key(), redactValue(iter.Value()))
+		}
+		return ret
+	case reflect.Struct:
+		ret := reflect.New(t).Elem()
+		ret.Set(v)
+		for i := 0; i < t.NumField(); i++ {
+			f := t.Field(i)
+			if !f.IsExported() {
+				continue
+			}
+			field := ret.Field(i)
+			switch {
+			case f.Tag.Get("redact") == "true":
+				if f.Type.Kind() == reflect.String {
+					field.SetString(RedactedPlaceholder)
+				} else {
+					field.Set(reflect.Zero(f.Type))
+				}
+			case typeNeedsRedaction(f.Type):
+				field.Set(redactValue(field))
+			}
+		}
+		return ret
+	}
+	return v
+}
+
+var redactableType = reflect.TypeOf((*Redactable)(nil)).Elem()
+
+// isRedactableType returns whether values of t, which isn't an interface,
+// are Redactable, themselves or through a pointer to them.
+func isRedactableType(t reflect.Type) bool {
+	return t.Kind() != reflect.Interface &&
+		(t.Implements(redactableType) || reflect.PointerTo(t).Implements(redactableType))
+}
+
+// redactRedactable returns what v, of a Redactable type, is logged as,
+// where a value of its type has to be. A Redacted value that doesn't fit
+// there is replaced by RedactedPlaceholder if it's a string, and zeroed
+// otherwise.
+func redactRedactable(v reflect.Value) reflect.Value {
+	t := v.Type()
+	if t.Kind() == reflect.Ptr && v.IsNil() {
+		return v
+	}
+	var r Redactable
+	if t.Implements(redactableType) {
+		r = v.Interface().(Redactable)
+	} else {
+		p := reflect.New(t)
+		p.Elem().Set(v)
+		r = p.Interface().(Redactable)
+	}
+	ret := reflect.New(t).Elem()
+	rv := reflect.ValueOf(r.Redacted())
+	switch {
+	case !rv.IsValid():
+	case rv.Type().AssignableTo(t):
+		ret.Set(rv)
+	case rv.Type().ConvertibleTo(t) && rv.Kind() == t.Kind():
+		ret.Set(rv.Convert(t))
+	case t.Kind() == reflect.Ptr && rv.Type().AssignableTo(t.Elem()):
+		ret.Set(reflect.New(t.Elem()))
+		ret.Elem().Set(rv)
+	case t.Kind() == reflect.String:
+		ret.SetString(RedactedPlaceholder)
+	}
+	return ret
+}
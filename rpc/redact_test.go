@@ -0,0 +1,245 @@
+package rpc
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+type redactTestLogin struct {
+	User     string
+	Password string `redact:"true"`
+	PIN      int    `redact:"true"`
+	Nested   *redactTestKey
+	Keys     []redactTestKey
+	Any      interface{}
+}
+
+type redactTestKey struct {
+	ID     string
+	Secret []byte `redact:"true"`
+}
+
+type redactTestToken string
+
+func (redactTestToken) Redacted() interface{} { return "token:" + RedactedPlaceholder }
+
+// redactTestPIN is Redactable through a pointer only.
+type redactTestPIN struct{ N int }
+
+func (*redactTestPIN) Redacted() interface{} { return redactTestPIN{} }
+
+type redactTestArg struct {
+	User  string
+	Token redactTestToken
+	PIN   redactTestPIN
+}
+
+func TestRedactRedactableValues(t *testing.T) {
+	arg := &redactTestArg{User: "a", Token: "hunter2", PIN: redactTestPIN{1234}}
+	require.Equal(t, &redactTestArg{User: "a", Token: "token:" + RedactedPlaceholder}, Redact(arg))
+	require.Equal(t, "&{User:a Token:token:[REDACTED] PIN:{N:0}}", fmt.Sprint(redactLater(nil, arg)))
+	require.Equal(t, "hunter2", string(arg.Token))
+
+	require.Equal(t, []redactTestToken{"token:" + RedactedPlaceholder},
+		Redact([]redactTestToken{"hunter2"}))
+	require.Equal(t, map[string]redactTestPIN{"a": {}},
+		Redact(map[string]redactTestPIN{"a": {1234}}))
+	require.Equal(t, [1]*redactTestPIN{{}}, Redact([1]*redactTestPIN{{1234}}))
+	require.Equal(t, []*redactTestPIN{nil}, Redact([]*redactTestPIN{nil}))
+}
+
+func TestRedact(t *testing.T) {
+	require.Nil(t, Redact(nil))
+	require.Equal(t, 3, Redact(3))
+	plain := struct{ A string }{"a"}
+	require.Equal(t, plain, Redact(plain))
+	require.Equal(t, "token:"+RedactedPlaceholder, Redact(redactTestToken("abc")))
+
+	login := &redactTestLogin{
+		User:     "max",
+		Password: "hunter2",
+		PIN:      1234,
+		Nested:   &redactTestKey{ID: "n", Secret: []byte("s1")},
+		Keys:     []redactTestKey{{ID: "k", Secret: []byte("s2")}},
+		Any:      redactTestKey{ID: "a", Secret: []byte("s3")},
+	}
+	res := Redact(login).(*redactTestLogin)
+	require.Equal(t, &redactTestLogin{
+		User:     "max",
+		Password: RedactedPlaceholder,
+		Nested:   &redactTestKey{ID: "n"},
+		Keys:     []redactTestKey{{ID: "k"}},
+		Any:      redactTestKey{ID: "a"},
+	}, res)
+	// The original is untouched.
+	require.Equal(t, "hunter2", login.Password)
+	require.Equal(t, []byte("s2"), login.Keys[0].Secret)
+
+	m := Redact(map[string]redactTestKey{"x": {ID: "x", Secret: []byte("s")}})
+	require.Equal(t, map[string]redactTestKey{"x": {ID: "x"}}, m)
+
+	redaction := &Redaction{
+		Arg: func(v interface{}) interface{} { return "custom" },
+	}
+	require.Equal(t, "custom", logValue(redactLater(redaction.arg(), login)))
+	require.Equal(t, res, logValue(redactLater(redaction.result(), login)))
+	require.Equal(t, "custom", fmt.Sprint(redactLater(redaction.arg(), login)))
+
+	// Values with nothing to redact are passed on as is.
+	require.Equal(t, plain, redactLater(nil, plain))
+	require.Equal(t, res, logValue(redactLater(nil, login)))
+}
+
+// redactCaptureLogOutput collects everything that's logged, with base64
+// fields decoded, since SimpleLog encodes arguments that way.
+type redactCaptureLogOutput struct {
+	sync.Mutex
+	NilLogOutput
+	buf strings.Builder
+}
+
+func (o *redactCaptureLogOutput) add(s string) {
+	o.Lock()
+	defer o.Unlock()
+	o.buf.WriteString(s + "\n")
+	if b, err := base64.StdEncoding.DecodeString(s); err == nil {
+		o.buf.Write(b)
+		o.buf.WriteString("\n")
+	}
+}
+
+func (o *redactCaptureLogOutput) addw(msg string, fields []LogField) {
+	o.add(msg)
+	for _, f := range fields {
+		o.add(fmt.Sprint(f.Value))
+	}
+}
+
+func (o *redactCaptureLogOutput) Debugf(s string, args ...interface{}) {
+	o.add(fmt.Sprintf(s, args...))
+}
+func (o *redactCaptureLogOutput) Debugw(s string, args ...LogField)   { o.addw(s, args) }
+func (o *redactCaptureLogOutput) Infof(s string, args ...interface{}) { o.add(fmt.Sprintf(s, args...)) }
+func (o *redactCaptureLogOutput) Infow(s string, args ...LogField)    { o.addw(s, args) }
+func (o *redactCaptureLogOutput) Warnf(s string, args ...interface{}) { o.add(fmt.Sprintf(s, args...)) }
+func (o *redactCaptureLogOutput) Warnw(s string, args ...LogField)    { o.addw(s, args) }
+func (o *redactCaptureLogOutput) Errorf(s string, args ...interface{}) {
+	o.add(fmt.Sprintf(s, args...))
+}
+func (o *redactCaptureLogOutput) Errorw(s string, args ...LogField) { o.addw(s, args) }
+
+func (o *redactCaptureLogOutput) String() string {
+	o.Lock()
+	defer o.Unlock()
+	return o.buf.String()
+}
+
+func TestRedactTraceLogs(t *testing.T) {
+	out := &redactCaptureLogOutput{}
+	opts, err := ParseStandardLogOptions("csv")
+	require.NoError(t, err)
+	lf := NewSimpleLogFactory(out, opts)
+
+	clientConn, serverConn := net.Pipe()
+	sxp := NewTransport(context.Background(), serverConn, lf, nil, nil, testMaxFrameLength)
+	cxp := NewTransport(context.Background(), clientConn, lf, nil, nil, testMaxFrameLength)
+	defer cxp.Close()
+	defer sxp.Close()
+
+	srv := NewServer(sxp, nil)
+	require.NoError(t, srv.Register(Protocol{
+		Name: "redact",
+		Methods: map[string]ServeHandlerDescription{
+			"login": {
+				MakeArg: func() interface{} { return new(redactTestLogin) },
+				Handler: func(_ context.Context, arg interface{}) (interface{}, error) {
+					login := arg.(*redactTestLogin)
+					return redactTestKey{ID: login.User + "-session", Secret: []byte("session-secret")}, nil
+				},
+			},
+			"token": {
+				MakeArg: func() interface{} { return new(string) },
+				Handler: func(_ context.Context, arg interface{}) (interface{}, error) {
+					return "token-secret", nil
+				},
+				Redaction: &Redaction{
+					Result: func(interface{}) interface{} { return "token:" + RedactedPlaceholder },
+				},
+			},
+		},
+	}))
+	srv.Run()
+
+	cli := NewClient(cxp, nil, nil)
+	ctx := context.Background()
+	var res redactTestKey
+	login := redactTestLogin{User: "max", Password: "hunter2", Keys: []redactTestKey{{ID: "k", Secret: []byte("key-secret")}}}
+	require.NoError(t, cli.Call(ctx, newMethodV1("redact.login"), login, &res, 0))
+	require.Equal(t, []byte("session-secret"), res.Secret)
+	require.NoError(t, cli.CallCompressed(ctx, newMethodV1("redact.login"), login, &res, CompressionGzip, 0))
+	require.NoError(t, cli.Notify(ctx, newMethodV1("redact.login"), login, 0))
+	// The server returns a plain string, which its method redacts, while
+	// the client decodes it into a Redactable type.
+	var token redactTestToken
+	require.NoError(t, cli.Call(ctx, newMethodV1("redact.token"), "x", &token, 0))
+	require.Equal(t, redactTestToken("token-secret"), token)
+
+	// Wait for the notify to be served, and the last reply to be logged.
+	require.Eventually(t, func() bool {
+		return strings.Count(out.String(), "serve-notify") == 1 &&
+			strings.Count(out.String(), "token:"+RedactedPlaceholder) == 2
+	}, 5*time.Second, time.Millisecond)
+
+	logged := out.String()
+	require.Contains(t, logged, "max-session")
+	require.Contains(t, logged, RedactedPlaceholder)
+	for _, secret := range []string{"hunter2", "key-secret", "session-secret", "token-secret"} {
+		require.NotContains(t, logged, secret)
+	}
+}
+
+func TestRedactOnlyWhenLogged(t *testing.T) {
+	opts, err := ParseStandardLogOptions("")
+	require.NoError(t, err)
+	lf := NewSimpleLogFactory(&redactCaptureLogOutput{}, opts)
+
+	clientConn, serverConn := net.Pipe()
+	sxp := NewTransport(context.Background(), serverConn, lf, nil, nil, testMaxFrameLength)
+	cxp := NewTransport(context.Background(), clientConn, lf, nil, nil, testMaxFrameLength)
+	defer cxp.Close()
+	defer sxp.Close()
+
+	var redacted atomic.Int32
+	count := func(v interface{}) interface{} {
+		redacted.Add(1)
+		return v
+	}
+	srv := NewServer(sxp, nil)
+	require.NoError(t, srv.Register(Protocol{
+		Name: "redact",
+		Methods: map[string]ServeHandlerDescription{
+			"echo": {
+				MakeArg: func() interface{} { return new(string) },
+				Handler: func(_ context.Context, arg interface{}) (interface{}, error) {
+					return *arg.(*string), nil
+				},
+				Redaction: &Redaction{Arg: count, Result: count},
+			},
+		},
+	}))
+	srv.Run()
+
+	var res string
+	require.NoError(t, NewClient(cxp, nil, nil).Call(context.Background(), newMethodV1("redact.echo"), "x", &res, 0))
+	require.Equal(t, "x", res)
+	require.Zero(t, redacted.Load())
+}
@@ -0,0 +1,162 @@
+package rpc
+
+import (
+	"context"
+	"sort"
+)
+
+// ReservedProtocolIDs is the start of the range of ProtocolUniqueIDs that are
+// reserved for protocols built into the library.
+const ReservedProtocolIDs ProtocolUniqueID = 0xffffffffffffff00
+
+// ReflectionProtocolID is the ID of the built-in reflection protocol.
+const ReflectionProtocolID ProtocolUniqueID = ReservedProtocolIDs + 1
+
+const (
+	reflectionListProtocols   Position = 0
+	reflectionListProtocolsV2 Position = 1
+	reflectionAllUniques      Position = 2
+)
+
+// ProtocolDescription describes a registered Protocol.
+type ProtocolDescription struct {
+	Name string `codec:"name"`
+	// Methods are sorted by name.
+	Methods []string `codec:"methods"`
+}
+
+// ProtocolV2Description describes a registered ProtocolV2.
+type ProtocolV2Description struct {
+	ID      ProtocolUniqueID    `codec:"id"`
+	Name    string              `codec:"name"`
+	Methods map[Position]string `codec:"methods"`
+}
+
+func (h *protocolHandler) describe() []ProtocolDescription {
+	h.mtx.RLock()
+	defer h.mtx.RUnlock()
+
+	ret := make([]ProtocolDescription, 0, len(h.protocols))
+	for _, p := range h.protocols {
+		d := ProtocolDescription{Name: p.Name, Methods: make([]string, 0, len(p.Methods))}
+		for m := range p.Methods {
+			d.Methods = append(d.Methods, m)
+		}
+		sort.Strings(d.Methods)
+		ret = append(ret, d)
+	}
+	sort.Slice(ret, func(i, j int) bool { return ret[i].Name < ret[j].Name })
+	return ret
+}
+
+func (h *protocolHandlerV2) describe() []ProtocolV2Description {
+	h.mtx.RLock()
+	defer h.mtx.RUnlock()
+
+	ret := make([]ProtocolV2Description, 0, len(h.protocols))
+	for _, p := range h.protocols {
+		d := ProtocolV2Description{ID: p.ID, Name: p.Name, Methods: make(map[Position]string, len(p.Methods))}
+		for pos, m := range p.Methods {
+			d.Methods[pos] = m.Name
+		}
+		ret = append(ret, d)
+	}
+	sort.Slice(ret, func(i, j int) bool { return ret[i].ID < ret[j].ID })
+	return ret
+}
+
+func makeEmptyArg() interface{} {
+	return new(struct{})
+}
+
+// ReflectionOpts configures the reflection protocol of a Server. The zero
+// value is fine.
+type ReflectionOpts struct {
+	// Uniques returns the unique IDs to report, and defaults to
+	// AllUniques.
+	Uniques func() []uint64
+}
+
+func reflectionProtocol(xp Transporter, opts ReflectionOpts) ProtocolV2 {
+	uniques := opts.Uniques
+	if uniques == nil {
+		uniques = AllUniques
+	}
+	return ProtocolV2{
+		Name: "snowpack.reflection",
+		ID:   ReflectionProtocolID,
+		Methods: map[Position]ServeHandlerDescriptionV2{
+			reflectionListProtocols: {
+				ServeHandlerDescription: ServeHandlerDescription{
+					MakeArg: makeEmptyArg,
+					Handler: func(_ context.Context, _ interface{}) (interface{}, error) {
+						v1, _ := xp.describeProtocols()
+						return v1, nil
+					},
+				},
+				Name: "listProtocols",
+			},
+			reflectionListProtocolsV2: {
+				ServeHandlerDescription: ServeHandlerDescription{
+					MakeArg: makeEmptyArg,
+					Handler: func(_ context.Context, _ interface{}) (interface{}, error) {
+						_, v2 := xp.describeProtocols()
+						return v2, nil
+					},
+				},
+				Name: "listProtocolsV2",
+			},
+			reflectionAllUniques: {
+				ServeHandlerDescription: ServeHandlerDescription{
+					MakeArg: makeEmptyArg,
+					Handler: func(_ context.Context, _ interface{}) (interface{}, error) {
+						return uniques(), nil
+					},
+				},
+				Name: "allUniques",
+			},
+		},
+	}
+}
+
+// EnableReflection registers the built-in reflection protocol, which lets
+// peers list the protocols registered on this server (including itself),
+// and the registry of unique IDs returned by AllUniques. Use a
+// ReflectionClient to query it.
+func (s *Server) EnableReflection() error {
+	return s.EnableReflectionWithOpts(ReflectionOpts{})
+}
+
+// EnableReflectionWithOpts is like EnableReflection, with options.
+func (s *Server) EnableReflectionWithOpts(opts ReflectionOpts) error {
+	return s.RegisterV2(reflectionProtocol(s.xp, opts))
+}
+
+// ReflectionClient queries the reflection protocol of a server that has
+// called EnableReflection.
+type ReflectionClient struct {
+	Cli GenericClient
+}
+
+func (c ReflectionClient) call(ctx context.Context, pos Position, name string, res interface{}) error {
+	m := NewMethodV2(ReflectionProtocolID, pos, "snowpack.reflection."+name)
+	return c.Cli.Call(ctx, m, struct{}{}, res, 0)
+}
+
+// ListProtocols returns the registered Protocols, sorted by name.
+func (c ReflectionClient) ListProtocols(ctx context.Context) (res []ProtocolDescription, err error) {
+	err = c.call(ctx, reflectionListProtocols, "listProtocols", &res)
+	return res, err
+}
+
+// ListProtocolsV2 returns the registered ProtocolV2s, sorted by ID.
+func (c ReflectionClient) ListProtocolsV2(ctx context.Context) (res []ProtocolV2Description, err error) {
+	err = c.call(ctx, reflectionListProtocolsV2, "listProtocolsV2", &res)
+	return res, err
+}
+
+// AllUniques returns the result of AllUniques on the server.
+func (c ReflectionClient) AllUniques(ctx context.Context) (res []uint64, err error) {
+	err = c.call(ctx, reflectionAllUniques, "allUniques", &res)
+	return res, err
+}
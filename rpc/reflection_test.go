@@ -0,0 +1,71 @@
+package rpc
+
+import (
+	"context"
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// closeTransportAndWait closes xp, and waits for its receive loop, if it was
+// started, so that it doesn't log after the test is over.
+func closeTransportAndWait(xp Transporter) {
+	t := xp.(*transport)
+	t.Close()
+	t.startOnce.Do(func() { close(t.receiveDone) })
+	<-t.receiveDone
+}
+
+func TestReflection(t *testing.T) {
+	clientConn, serverConn := net.Pipe()
+	lf := NewSimpleLogFactory(&testLogOutput{t: t}, nil)
+	sxp := NewTransport(context.Background(), serverConn, lf, nil, nil, testMaxFrameLength)
+	cxp := NewTransport(context.Background(), clientConn, lf, nil, nil, testMaxFrameLength)
+	t.Cleanup(func() {
+		closeTransportAndWait(cxp)
+		closeTransportAndWait(sxp)
+	})
+
+	const testID ProtocolUniqueID = 0xabcdef
+
+	srv := NewServer(sxp, nil)
+	require.NoError(t, srv.Register(rateLimitTestProtocol(nil, nil)))
+	require.NoError(t, srv.RegisterV2(ProtocolV2{
+		Name: "reflected",
+		ID:   testID,
+		Methods: map[Position]ServeHandlerDescriptionV2{
+			3: {Name: "three"},
+			4: {Name: "four"},
+		},
+	}))
+	require.NoError(t, srv.EnableReflectionWithOpts(ReflectionOpts{
+		Uniques: func() []uint64 { return []uint64{uint64(testID)} },
+	}))
+	require.Error(t, srv.EnableReflection())
+	srv.Run()
+
+	cli := ReflectionClient{Cli: NewClient(cxp, nil, nil)}
+	ctx := context.Background()
+
+	v1, err := cli.ListProtocols(ctx)
+	require.NoError(t, err)
+	require.Equal(t, []ProtocolDescription{
+		{Name: "limited", Methods: []string{"ping", "pong"}},
+	}, v1)
+
+	v2, err := cli.ListProtocolsV2(ctx)
+	require.NoError(t, err)
+	require.Equal(t, []ProtocolV2Description{
+		{ID: testID, Name: "reflected", Methods: map[Position]string{3: "three", 4: "four"}},
+		{ID: ReflectionProtocolID, Name: "snowpack.reflection", Methods: map[Position]string{
+			0: "listProtocols",
+			1: "listProtocolsV2",
+			2: "allUniques",
+		}},
+	}, v2)
+
+	uniques, err := cli.AllUniques(ctx)
+	require.NoError(t, err)
+	require.Equal(t, []uint64{uint64(testID)}, uniques)
+}
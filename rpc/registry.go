@@ -0,0 +1,241 @@
+package rpc
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"time"
+)
+
+// PeerID is how the application identifies a peer in a PeerRegistry, e.g. by
+// user or device.
+type PeerID string
+
+// PeerRegistryOpts are the options of a PeerRegistry.
+type PeerRegistryOpts struct {
+	// ErrorUnwrapper and TagsFunc are given to the clients of the peers.
+	ErrorUnwrapper ErrorUnwrapper
+	TagsFunc       LogTagsFromContext
+	// OnRemove, if set, is called when a peer is removed, because its
+	// transport closed or it was unregistered. It isn't called when a
+	// peer is replaced by another registration with the same ID.
+	OnRemove func(id PeerID)
+}
+
+// PeerRegistry keeps track of the peers connected to a server, so that it
+// can call them back later: transports are bidirectional, so the server can
+// make calls and notifies on them too. Peers are registered under an ID that
+// the application picks, e.g. in the handshake's metadata, or after
+// authenticating them, and can join groups to be notified together. They are
+// removed when their transport closes. It is safe for concurrent use.
+type PeerRegistry struct {
+	opts PeerRegistryOpts
+
+	sync.Mutex
+	peers map[PeerID]*registeredPeer
+}
+
+type registeredPeer struct {
+	id     PeerID
+	xp     Transporter
+	cli    *Client
+	groups map[string]struct{}
+}
+
+// NewPeerRegistry makes an empty PeerRegistry.
+func NewPeerRegistry() *PeerRegistry {
+	return NewPeerRegistryWithOpts(PeerRegistryOpts{})
+}
+
+// NewPeerRegistryWithOpts is like NewPeerRegistry, but takes additional
+// optional parameters.
+func NewPeerRegistryWithOpts(opts PeerRegistryOpts) *PeerRegistry {
+	return &PeerRegistry{
+		opts:  opts,
+		peers: make(map[PeerID]*registeredPeer),
+	}
+}
+
+// Register adds the peer at the other end of xp under id, until xp is closed.
+// A peer already registered under id is replaced, e.g. when a client
+// reconnects before its old connection is known to be gone; its transport is
+// left open, and it leaves its groups.
+func (r *PeerRegistry) Register(id PeerID, xp Transporter) GenericClient {
+	p := &registeredPeer{
+		id:     id,
+		xp:     xp,
+		cli:    NewClient(xp, r.opts.ErrorUnwrapper, r.opts.TagsFunc),
+		groups: make(map[string]struct{}),
+	}
+	r.Lock()
+	r.peers[id] = p
+	r.Unlock()
+
+	go func() {
+		<-xp.done()
+		r.remove(p)
+	}()
+	return p.cli
+}
+
+// RegisterFromHandshake waits for the handshake on xp (see
+// TransportOpts.Handshake), and registers the peer under the value it gave
+// for key in its metadata.
+func (r *PeerRegistry) RegisterFromHandshake(ctx context.Context, xp Transporter, key string) (PeerID, GenericClient, error) {
+	res, err := xp.Handshake(ctx)
+	if err != nil {
+		return "", nil, err
+	}
+	if res == nil {
+		return "", nil, HandshakeError{"the transport has no handshake"}
+	}
+	id, ok := res.Peer.Metadata[key]
+	if !ok || id == "" {
+		return "", nil, HandshakeError{"no peer ID in metadata key " + key}
+	}
+	return PeerID(id), r.Register(PeerID(id), xp), nil
+}
+
+// Unregister removes the peer registered under id, if any. Its transport is
+// left open.
+func (r *PeerRegistry) Unregister(id PeerID) {
+	r.Lock()
+	p := r.peers[id]
+	r.Unlock()
+	if p != nil {
+		r.remove(p)
+	}
+}
+
+// remove removes p, unless it was replaced.
+func (r *PeerRegistry) remove(p *registeredPeer) {
+	r.Lock()
+	found := r.peers[p.id] == p
+	if found {
+		delete(r.peers, p.id)
+	}
+	r.Unlock()
+	if found && r.opts.OnRemove != nil {
+		r.opts.OnRemove(p.id)
+	}
+}
+
+// Peer returns the client to call the peer registered under id.
+func (r *PeerRegistry) Peer(id PeerID) (GenericClient, bool) {
+	r.Lock()
+	defer r.Unlock()
+	p, ok := r.peers[id]
+	if !ok {
+		return nil, false
+	}
+	return p.cli, true
+}
+
+// Peers returns the IDs of the registered peers, sorted.
+func (r *PeerRegistry) Peers() []PeerID {
+	return r.collect(func(*registeredPeer) bool { return true })
+}
+
+// Join adds the peer registered under id to the group.
+func (r *PeerRegistry) Join(id PeerID, group string) error {
+	r.Lock()
+	defer r.Unlock()
+	p, ok := r.peers[id]
+	if !ok {
+		return PeerNotFoundError{ID: id}
+	}
+	p.groups[group] = struct{}{}
+	return nil
+}
+
+// Leave removes the peer registered under id from the group.
+func (r *PeerRegistry) Leave(id PeerID, group string) {
+	r.Lock()
+	defer r.Unlock()
+	if p, ok := r.peers[id]; ok {
+		delete(p.groups, group)
+	}
+}
+
+// Group returns the IDs of the peers in the group, sorted.
+func (r *PeerRegistry) Group(group string) []PeerID {
+	return r.collect(func(p *registeredPeer) bool {
+		_, ok := p.groups[group]
+		return ok
+	})
+}
+
+func (r *PeerRegistry) collect(match func(*registeredPeer) bool) []PeerID {
+	r.Lock()
+	defer r.Unlock()
+	var ret []PeerID
+	for id, p := range r.peers {
+		if match(p) {
+			ret = append(ret, id)
+		}
+	}
+	sort.Slice(ret, func(i, j int) bool { return ret[i] < ret[j] })
+	return ret
+}
+
+// Broadcast sends a notify to every registered peer. See Notify.
+func (r *PeerRegistry) Broadcast(ctx context.Context, method Methoder, arg interface{}, timeout time.Duration) error {
+	return r.notify(ctx, method, arg, timeout, func(*registeredPeer) bool { return true })
+}
+
+// Multicast sends a notify to the peers in the group. See Notify.
+func (r *PeerRegistry) Multicast(ctx context.Context, group string, method Methoder, arg interface{}, timeout time.Duration) error {
+	return r.notify(ctx, method, arg, timeout, func(p *registeredPeer) bool {
+		_, ok := p.groups[group]
+		return ok
+	})
+}
+
+// Notify sends a notify to the peers registered under ids; those that
+// aren't are skipped. The notifies are sent concurrently, so that a slow peer
+// doesn't hold up the others. If any fail, it returns a BroadcastError.
+func (r *PeerRegistry) Notify(ctx context.Context, ids []PeerID, method Methoder, arg interface{}, timeout time.Duration) error {
+	set := make(map[PeerID]struct{}, len(ids))
+	for _, id := range ids {
+		set[id] = struct{}{}
+	}
+	return r.notify(ctx, method, arg, timeout, func(p *registeredPeer) bool {
+		_, ok := set[p.id]
+		return ok
+	})
+}
+
+func (r *PeerRegistry) notify(ctx context.Context, method Methoder, arg interface{}, timeout time.Duration,
+	match func(*registeredPeer) bool) error {
+	r.Lock()
+	var peers []*registeredPeer
+	for _, p := range r.peers {
+		if match(p) {
+			peers = append(peers, p)
+		}
+	}
+	r.Unlock()
+
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	var errs map[PeerID]error
+	for _, p := range peers {
+		wg.Add(1)
+		go func(p *registeredPeer) {
+			defer wg.Done()
+			if err := p.cli.Notify(ctx, method, arg, timeout); err != nil {
+				mu.Lock()
+				defer mu.Unlock()
+				if errs == nil {
+					errs = make(map[PeerID]error)
+				}
+				errs[p.id] = err
+			}
+		}(p)
+	}
+	wg.Wait()
+	if errs != nil {
+		return BroadcastError{Errors: errs, Peers: len(peers)}
+	}
+	return nil
+}
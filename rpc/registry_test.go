@@ -0,0 +1,171 @@
+package rpc
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// registryTestClient is a client connected to a server with a PeerRegistry,
+// serving a protocol that the server calls back.
+type registryTestClient struct {
+	xp   Transporter
+	sxp  Transporter
+	mu   sync.Mutex
+	msgs []string
+}
+
+func (c *registryTestClient) received() []string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return append([]string(nil), c.msgs...)
+}
+
+func newRegistryTestClient(t *testing.T, name string, handshake bool) *registryTestClient {
+	clientConn, serverConn := net.Pipe()
+	var copts, sopts TransportOpts
+	if handshake {
+		copts.Handshake = &HandshakeConfig{Metadata: map[string]string{"peer": name}}
+		sopts.Handshake = &HandshakeConfig{}
+	}
+	c := &registryTestClient{
+		xp:  NewTransportWithOpts(context.Background(), clientConn, nil, nil, nil, testMaxFrameLength, copts),
+		sxp: NewTransportWithOpts(context.Background(), serverConn, nil, nil, nil, testMaxFrameLength, sopts),
+	}
+	srv := NewServer(c.xp, nil)
+	require.NoError(t, srv.Register(Protocol{
+		Name: "peer",
+		Methods: map[string]ServeHandlerDescription{
+			"push": {
+				MakeArg: func() interface{} { return new(string) },
+				Handler: func(_ context.Context, arg interface{}) (interface{}, error) {
+					c.mu.Lock()
+					defer c.mu.Unlock()
+					c.msgs = append(c.msgs, *arg.(*string))
+					return nil, nil
+				},
+			},
+			"whoami": {
+				MakeArg: func() interface{} { return new(interface{}) },
+				Handler: func(_ context.Context, _ interface{}) (interface{}, error) {
+					return name, nil
+				},
+			},
+		},
+	}))
+	srv.Run()
+	NewServer(c.sxp, nil).Run()
+	t.Cleanup(func() {
+		c.xp.Close()
+		c.sxp.Close()
+	})
+	return c
+}
+
+func TestPeerRegistry(t *testing.T) {
+	var removedMu sync.Mutex
+	var removed []PeerID
+	r := NewPeerRegistryWithOpts(PeerRegistryOpts{
+		OnRemove: func(id PeerID) {
+			removedMu.Lock()
+			defer removedMu.Unlock()
+			removed = append(removed, id)
+		},
+	})
+
+	alice := newRegistryTestClient(t, "alice", false)
+	bob := newRegistryTestClient(t, "bob", false)
+	carol := newRegistryTestClient(t, "carol", true)
+	r.Register("alice", alice.sxp)
+	r.Register("bob", bob.sxp)
+	id, _, err := r.RegisterFromHandshake(context.Background(), carol.sxp, "peer")
+	require.NoError(t, err)
+	require.Equal(t, PeerID("carol"), id)
+	require.Equal(t, []PeerID{"alice", "bob", "carol"}, r.Peers())
+
+	// The server can call a given peer.
+	cli, ok := r.Peer("bob")
+	require.True(t, ok)
+	var res string
+	require.NoError(t, cli.Call(context.Background(), newMethodV1("peer.whoami"), nil, &res, 0))
+	require.Equal(t, "bob", res)
+	_, ok = r.Peer("dave")
+	require.False(t, ok)
+
+	// Notifies go to everyone, to groups, or to a list of peers.
+	require.NoError(t, r.Join("alice", "team"))
+	require.NoError(t, r.Join("carol", "team"))
+	require.Equal(t, PeerNotFoundError{ID: "dave"}, r.Join("dave", "team"))
+	require.Equal(t, []PeerID{"alice", "carol"}, r.Group("team"))
+
+	push := newMethodV1("peer.push")
+	require.NoError(t, r.Broadcast(context.Background(), push, "all", 0))
+	require.NoError(t, r.Multicast(context.Background(), "team", push, "team", 0))
+	require.NoError(t, r.Notify(context.Background(), []PeerID{"bob", "dave"}, push, "bob", 0))
+	r.Leave("alice", "team")
+	require.NoError(t, r.Multicast(context.Background(), "team", push, "carol", 0))
+
+	expected := map[*registryTestClient][]string{
+		alice: {"all", "team"},
+		bob:   {"all", "bob"},
+		carol: {"all", "team", "carol"},
+	}
+	for c, msgs := range expected {
+		require.Eventually(t, func() bool {
+			return len(c.received()) == len(msgs)
+		}, 5*time.Second, time.Millisecond)
+		require.Equal(t, msgs, c.received())
+	}
+
+	// Peers are removed when they disconnect.
+	bob.xp.Close()
+	require.Eventually(t, func() bool {
+		_, ok := r.Peer("bob")
+		return !ok
+	}, 5*time.Second, time.Millisecond)
+	require.Equal(t, []PeerID{"alice", "carol"}, r.Peers())
+
+	// A peer that registers again replaces the old registration, which
+	// isn't removed when its transport closes.
+	alice2 := newRegistryTestClient(t, "alice", false)
+	r.Register("alice", alice2.sxp)
+	alice.xp.Close()
+	<-alice.sxp.done()
+	require.NoError(t, r.Broadcast(context.Background(), push, "again", 0))
+	require.Eventually(t, func() bool {
+		return len(alice2.received()) == 1
+	}, 5*time.Second, time.Millisecond)
+	require.Equal(t, []PeerID{"alice", "carol"}, r.Peers())
+
+	r.Unregister("carol")
+	require.Equal(t, []PeerID{"alice"}, r.Peers())
+	removedMu.Lock()
+	require.Equal(t, []PeerID{"bob", "carol"}, removed)
+	removedMu.Unlock()
+}
+
+func TestPeerRegistryBroadcastError(t *testing.T) {
+	r := NewPeerRegistry()
+	alice := newRegistryTestClient(t, "alice", false)
+	bob := newRegistryTestClient(t, "bob", false)
+	r.Register("alice", alice.sxp)
+	r.Register("bob", bob.sxp)
+
+	// A transport that can't be written to, but hasn't closed yet.
+	bob.sxp.Conn().SetWriteDeadline(time.Now().Add(-time.Second))
+	err := r.Broadcast(context.Background(), newMethodV1("peer.push"), "hi", time.Second)
+	var berr BroadcastError
+	require.True(t, errors.As(err, &berr))
+	require.Equal(t, 2, berr.Peers)
+	require.Len(t, berr.Errors, 1)
+	require.Contains(t, berr.Errors, PeerID("bob"))
+	require.EqualError(t, err, "notify failed for 1 of 2 peers")
+
+	_, _, err = r.RegisterFromHandshake(context.Background(), alice.sxp, "peer")
+	require.EqualError(t, err, "handshake error: the transport has no handshake")
+}
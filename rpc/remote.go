@@ -8,6 +8,7 @@ import (
 	"math/rand"
 	"strings"
 	"sync"
+	"time"
 )
 
 // Remote defines an address or a group of addresses that all point to a remote
@@ -27,6 +28,16 @@ type Remote interface {
 	String() string
 }
 
+// DrainingRemote is a Remote that can steer away from addresses whose
+// servers have announced that they're shutting down.
+type DrainingRemote interface {
+	Remote
+	// MarkDraining makes GetAddress skip addr for the given duration,
+	// as long as there are other addresses to try. Marks aren't
+	// cleared by Reset.
+	MarkDraining(addr string, d time.Duration)
+}
+
 type fixedRemote string
 
 // NewFixedRemote returns a remote that always uses remoteAddr.
@@ -57,8 +68,13 @@ type prioritizedRoundRobinRemote struct {
 
 	lock      sync.Mutex
 	toIterate [][]string
+	// draining maps addresses to the time until which they should be
+	// skipped.
+	draining map[string]time.Time
 }
 
+var _ DrainingRemote = (*prioritizedRoundRobinRemote)(nil)
+
 // NewPrioritizedRoundRobinRemote creates a new Remote that include
 // prioritized remote groups. Each call to GetAddress() will round-robin by
 // random order within the first group. If we run out of address within the
@@ -90,6 +106,7 @@ func NewPrioritizedRoundRobinRemote(addressGroups [][]string) (Remote, error) {
 
 	r := &prioritizedRoundRobinRemote{
 		addresses: cleaned,
+		draining:  make(map[string]time.Time),
 	}
 	r.resetLocked()
 	return r, nil
@@ -114,11 +131,41 @@ func (r *prioritizedRoundRobinRemote) Reset() {
 	r.resetLocked()
 }
 
-// GetAddress implements the Remote interface.
-func (r *prioritizedRoundRobinRemote) GetAddress() string {
+// MarkDraining implements the DrainingRemote interface.
+func (r *prioritizedRoundRobinRemote) MarkDraining(addr string, d time.Duration) {
 	r.lock.Lock()
 	defer r.lock.Unlock()
 
+	r.draining[strings.ToLower(strings.TrimSpace(addr))] = time.Now().Add(d)
+}
+
+// isDrainingLocked returns true if addr should be skipped.
+func (r *prioritizedRoundRobinRemote) isDrainingLocked(addr string, now time.Time) bool {
+	until, ok := r.draining[addr]
+	if !ok {
+		return false
+	}
+	if now.After(until) {
+		delete(r.draining, addr)
+		return false
+	}
+	return true
+}
+
+// allDrainingLocked returns true if there is no address that isn't draining,
+// in which case the marks are ignored.
+func (r *prioritizedRoundRobinRemote) allDrainingLocked(now time.Time) bool {
+	for _, group := range r.addresses {
+		for _, addr := range group {
+			if !r.isDrainingLocked(addr, now) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+func (r *prioritizedRoundRobinRemote) popLocked() string {
 	// If we have run out of addresses, reset to include all addresses and
 	// start over on next call.
 	if len(r.toIterate) == 0 {
@@ -136,14 +183,53 @@ func (r *prioritizedRoundRobinRemote) GetAddress() string {
 	return addr
 }
 
+// GetAddress implements the Remote interface.
+func (r *prioritizedRoundRobinRemote) GetAddress() string {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	now := time.Now()
+	if len(r.draining) == 0 || r.allDrainingLocked(now) {
+		return r.popLocked()
+	}
+	for {
+		if addr := r.popLocked(); !r.isDrainingLocked(addr, now) {
+			return addr
+		}
+	}
+}
+
 // Peek implements the Remote interface.
 func (r *prioritizedRoundRobinRemote) Peek() string {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
 	// If we have run out of addresses, reset to include all addresses and
 	// start over on next call.
 	if len(r.toIterate) == 0 {
 		r.resetLocked()
 	}
 
+	now := time.Now()
+	if len(r.draining) != 0 && !r.allDrainingLocked(now) {
+		for _, group := range r.toIterate {
+			for _, addr := range group {
+				if !r.isDrainingLocked(addr, now) {
+					return addr
+				}
+			}
+		}
+		// All remaining ones in this round are draining, so
+		// GetAddress would start a new round.
+		for _, group := range r.addresses {
+			for _, addr := range group {
+				if !r.isDrainingLocked(addr, now) {
+					return addr
+				}
+			}
+		}
+	}
+
 	return r.toIterate[0][0]
 }
 
@@ -5,6 +5,7 @@ package rpc
 
 import (
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/require"
 )
@@ -63,3 +64,44 @@ func TestPrioritizedRoundRobinRemote(t *testing.T) {
 	getAndConfirmA()
 	getAndConfirmB()
 }
+
+func TestPrioritizedRoundRobinRemoteDraining(t *testing.T) {
+	r, err := NewPrioritizedRoundRobinRemote([][]string{
+		{"a0", "a1"},
+		{"b0"},
+	})
+	require.NoError(t, err)
+	dr, ok := r.(DrainingRemote)
+	require.True(t, ok)
+
+	dr.MarkDraining("a0", time.Hour)
+	for i := 0; i < 6; i++ {
+		require.Equal(t, r.Peek(), r.GetAddress())
+	}
+	r.Reset()
+	require.Equal(t, "a1", r.Peek())
+	require.Equal(t, "a1", r.GetAddress())
+	require.Equal(t, "b0", r.GetAddress())
+	require.Equal(t, "a1", r.GetAddress())
+
+	// If everything is draining, the marks are ignored.
+	dr.MarkDraining("a1", time.Hour)
+	dr.MarkDraining("b0", time.Hour)
+	r.Reset()
+	seen := make(map[string]bool)
+	for i := 0; i < 3; i++ {
+		seen[r.GetAddress()] = true
+	}
+	require.Len(t, seen, 3)
+
+	// Marks expire.
+	dr.MarkDraining("a0", -time.Second)
+	dr.MarkDraining("a1", -time.Second)
+	r.Reset()
+	seen = make(map[string]bool)
+	for i := 0; i < 2; i++ {
+		seen[r.GetAddress()] = true
+	}
+	require.True(t, seen["a0"])
+	require.True(t, seen["a1"])
+}
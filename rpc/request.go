@@ -2,6 +2,7 @@ package rpc
 
 import (
 	"context"
+	"time"
 )
 
 type request interface {
@@ -11,41 +12,76 @@ type request interface {
 	Serve(*framedMsgpackEncoder, *ServeHandlerDescription, WrapErrorFunc)
 	LogInvocation(err error)
 	LogCompletion(res interface{}, err error)
+	setFailed(err error)
+	// setRedaction sets the redaction of the served method, once it's
+	// been found.
+	setRedaction(*Redaction)
+	// setReplyStatus sets the status sent with the reply, if any.
+	setReplyStatus(*replyStatus)
+	// serveContext is the context that the handler is served with, which
+	// the peer can cancel.
+	serveContext() context.Context
 }
 
 type requestImpl struct {
 	ctx        context.Context
 	cancelFunc context.CancelFunc
 	log        LogInterface
+	tracer     *rpcTracer
+	// replySize is the size of the reply, once it's been sent.
+	replySize   int64
+	redaction   *Redaction
+	replyStatus *replyStatus
 }
 
 func (req *requestImpl) CancelFunc() context.CancelFunc {
 	return req.cancelFunc
 }
 
+func (req *requestImpl) serveContext() context.Context {
+	return req.ctx
+}
+
+func (req *requestImpl) setRedaction(r *Redaction) {
+	req.redaction = r
+}
+
+func (req *requestImpl) setReplyStatus(s *replyStatus) {
+	req.replyStatus = s
+}
+
+// appendReplyStatus appends the status to a response, if there's one.
+func (req *requestImpl) appendReplyStatus(v []interface{}) []interface{} {
+	if req.replyStatus == nil {
+		return v
+	}
+	return append(v, req.replyStatus)
+}
+
 type callRequest struct {
 	*rpcCallMessage
 	requestImpl
 }
 
-func newCallRequest(rpc *rpcCallMessage, log LogInterface) *callRequest {
-	ctx, cancel := context.WithCancel(rpc.Context())
+func newCallRequest(rpc *rpcCallMessage, log LogInterface, tracer *rpcTracer) *callRequest {
+	ctx, cancel := context.WithCancel(tracer.extract(rpc.Context(), rpc.headers))
 	return &callRequest{
 		rpcCallMessage: rpc,
 		requestImpl: requestImpl{
 			ctx:        ctx,
 			cancelFunc: cancel,
 			log:        log,
+			tracer:     tracer,
 		},
 	}
 }
 
 func (r *callRequest) LogInvocation(err error) {
-	r.log.ServerCall(r.SeqNo(), r.Name().String(), err, r.Arg())
+	r.log.ServerCall(r.SeqNo(), r.Name().String(), err, redactLater(r.redaction.arg(), r.Arg()))
 }
 
 func (r *callRequest) LogCompletion(res interface{}, err error) {
-	r.log.ServerReply(r.SeqNo(), r.Name().String(), err, res)
+	r.log.ServerReply(r.SeqNo(), r.Name().String(), err, redactLater(r.redaction.result(), res))
 }
 
 func (r *callRequest) Reply(enc *framedMsgpackEncoder, res interface{}, errArg interface{}) (err error) {
@@ -55,8 +91,11 @@ func (r *callRequest) Reply(enc *framedMsgpackEncoder, res interface{}, errArg i
 		errArg,
 		res,
 	}
+	v = r.appendReplyStatus(v)
 
+	r.instrumenter.markFirstByte(time.Now())
 	size, errCh := enc.EncodeAndWrite(r.ctx, v, nil)
+	r.replySize = size
 	defer func() { _ = r.RecordAndFinish(r.ctx, size) }()
 
 	select {
@@ -77,15 +116,19 @@ func (r *callRequest) Serve(transmitter *framedMsgpackEncoder, handler *ServeHan
 
 	prof := r.log.StartProfiler("serve %s", r.Name())
 	arg := r.Arg()
+	ctx, span := r.tracer.startServer(r.ctx, SpanKindServer, r, r.instrumenter.received())
 
 	r.LogInvocation(nil)
-	res, err := handler.Handler(r.ctx, arg)
+	res, err := handler.Handler(ctx, arg)
 	prof.Stop()
 	r.LogCompletion(res, err)
+	r.setFailed(err)
 
 	if err := r.Reply(transmitter, res, wrapError(wrapErrorFunc, err)); err != nil {
 		r.log.Infow("Unable to reply", LogField{"err", err})
 	}
+	span.SetSentSize(r.replySize)
+	span.End(err)
 }
 
 type callCompressedRequest struct {
@@ -93,28 +136,31 @@ type callCompressedRequest struct {
 	requestImpl
 }
 
-func newCallCompressedRequest(rpc *rpcCallCompressedMessage, log LogInterface) *callCompressedRequest {
-	ctx, cancel := context.WithCancel(rpc.Context())
+func newCallCompressedRequest(rpc *rpcCallCompressedMessage, log LogInterface, tracer *rpcTracer) *callCompressedRequest {
+	ctx, cancel := context.WithCancel(tracer.extract(rpc.Context(), rpc.headers))
 	return &callCompressedRequest{
 		rpcCallCompressedMessage: rpc,
 		requestImpl: requestImpl{
 			ctx:        ctx,
 			cancelFunc: cancel,
 			log:        log,
+			tracer:     tracer,
 		},
 	}
 }
 
 func (r *callCompressedRequest) LogInvocation(err error) {
-	r.log.ServerCallCompressed(r.SeqNo(), r.Name().String(), err, r.Arg(), r.Compression())
+	r.log.ServerCallCompressed(r.SeqNo(), r.Name().String(), err, redactLater(r.redaction.arg(), r.Arg()),
+		r.Compression())
 }
 
 func (r *callCompressedRequest) LogCompletion(res interface{}, err error) {
-	r.log.ServerReplyCompressed(r.SeqNo(), r.Name().String(), err, res, r.Compression())
+	r.log.ServerReplyCompressed(r.SeqNo(), r.Name().String(), err, redactLater(r.redaction.result(), res),
+		r.Compression())
 }
 
 func (r *callCompressedRequest) Reply(enc *framedMsgpackEncoder, res interface{}, errArg interface{}) (err error) {
-	res, err = enc.compressData(r.Compression(), res)
+	res, err = enc.compressData(r.Compression(), res, r.instrumenter)
 	if err != nil {
 		return err
 	}
@@ -124,8 +170,11 @@ func (r *callCompressedRequest) Reply(enc *framedMsgpackEncoder, res interface{}
 		errArg,
 		res,
 	}
+	v = r.appendReplyStatus(v)
 
+	r.instrumenter.markFirstByte(time.Now())
 	size, errCh := enc.EncodeAndWrite(r.ctx, v, nil)
+	r.replySize = size
 	defer func() { _ = r.RecordAndFinish(r.ctx, size) }()
 
 	select {
@@ -143,15 +192,19 @@ func (r *callCompressedRequest) Serve(transmitter *framedMsgpackEncoder, handler
 
 	prof := r.log.StartProfiler("serve-compressed %s", r.Name())
 	arg := r.Arg()
+	ctx, span := r.tracer.startServer(r.ctx, SpanKindServer, r, r.instrumenter.received())
 
 	r.LogInvocation(nil)
-	res, err := handler.Handler(r.ctx, arg)
+	res, err := handler.Handler(ctx, arg)
 	prof.Stop()
 	r.LogCompletion(res, err)
+	r.setFailed(err)
 
 	if err := r.Reply(transmitter, res, wrapError(wrapErrorFunc, err)); err != nil {
 		r.log.Infow("unable to reply", LogField{"err", err})
 	}
+	span.SetSentSize(r.replySize)
+	span.End(err)
 }
 
 type notifyRequest struct {
@@ -159,20 +212,21 @@ type notifyRequest struct {
 	requestImpl
 }
 
-func newNotifyRequest(rpc *rpcNotifyMessage, log LogInterface) *notifyRequest {
-	ctx, cancel := context.WithCancel(rpc.Context())
+func newNotifyRequest(rpc *rpcNotifyMessage, log LogInterface, tracer *rpcTracer) *notifyRequest {
+	ctx, cancel := context.WithCancel(tracer.extract(rpc.Context(), rpc.headers))
 	return &notifyRequest{
 		rpcNotifyMessage: rpc,
 		requestImpl: requestImpl{
 			ctx:        ctx,
 			cancelFunc: cancel,
 			log:        log,
+			tracer:     tracer,
 		},
 	}
 }
 
 func (r *notifyRequest) LogInvocation(err error) {
-	r.log.ServerNotifyCall(r.Name().String(), err, r.Arg())
+	r.log.ServerNotifyCall(r.Name().String(), err, redactLater(r.redaction.arg(), r.Arg()))
 }
 
 func (r *notifyRequest) LogCompletion(_ interface{}, err error) {
@@ -183,13 +237,19 @@ func (r *notifyRequest) Serve(_ *framedMsgpackEncoder, handler *ServeHandlerDesc
 
 	prof := r.log.StartProfiler("serve-notify %s", r.Name())
 	arg := r.Arg()
+	ctx, span := r.tracer.startServer(r.ctx, SpanKindConsumer, r, r.instrumenter.received())
 
 	r.LogInvocation(nil)
-	_, err := handler.Handler(r.ctx, arg)
+	_, err := handler.Handler(ctx, arg)
 	prof.Stop()
 	r.LogCompletion(nil, err)
+	r.setFailed(err)
+	_ = r.RecordAndFinish(r.ctx, 0)
+	span.End(err)
 }
 
+// Reply sends nothing, since notifies get no reply, but finishes the record
+// of a notify that wasn't served.
 func (r *notifyRequest) Reply(_ *framedMsgpackEncoder, _ interface{}, _ interface{}) (err error) {
-	return nil
+	return r.RecordAndFinish(r.ctx, 0)
 }
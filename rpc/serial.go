@@ -0,0 +1,80 @@
+package rpc
+
+import "sync"
+
+const defaultSerialMaxQueued = 1000
+
+// SerialQueuesOpts contains the optional parameters of SerialQueues.
+type SerialQueuesOpts struct {
+	// MaxQueued is the most requests that can wait for each key; those
+	// over it are rejected with a ResourceExhaustedError. It defaults to
+	// 1000.
+	MaxQueued int
+}
+
+// SerialQueues serves the requests that have the same SerialKey one at a
+// time, in the order they arrived, on the transports that it's given to
+// (see TransportOpts.SerialQueues). Transports that aren't given one have
+// their own, so their requests are ordered only against the others of the
+// same connection; a server whose keys span connections, e.g. a user's
+// devices, should use one SerialQueues for all of its transports. It is
+// safe for concurrent use.
+type SerialQueues struct {
+	opts SerialQueuesOpts
+
+	sync.Mutex
+	// queues has the functions waiting for each key that has one
+	// running.
+	queues map[string][]func()
+}
+
+// NewSerialQueues makes a SerialQueues.
+func NewSerialQueues() *SerialQueues {
+	return NewSerialQueuesWithOpts(SerialQueuesOpts{})
+}
+
+// NewSerialQueuesWithOpts is like NewSerialQueues, but takes additional
+// optional parameters.
+func NewSerialQueuesWithOpts(opts SerialQueuesOpts) *SerialQueues {
+	if opts.MaxQueued <= 0 {
+		opts.MaxQueued = defaultSerialMaxQueued
+	}
+	return &SerialQueues{
+		opts:   opts,
+		queues: make(map[string][]func()),
+	}
+}
+
+// run runs f after the functions added before it with the same key, and
+// concurrently with those of other keys. It returns false, without running
+// f, if too many are waiting for key already.
+func (q *SerialQueues) run(key string, f func()) bool {
+	q.Lock()
+	defer q.Unlock()
+	if queue, running := q.queues[key]; running {
+		if len(queue) >= q.opts.MaxQueued {
+			return false
+		}
+		q.queues[key] = append(queue, f)
+		return true
+	}
+	q.queues[key] = nil
+	go q.loop(key, f)
+	return true
+}
+
+func (q *SerialQueues) loop(key string, f func()) {
+	for f != nil {
+		f()
+		q.Lock()
+		if queue := q.queues[key]; len(queue) > 0 {
+			f = queue[0]
+			queue[0] = nil
+			q.queues[key] = queue[1:]
+		} else {
+			delete(q.queues, key)
+			f = nil
+		}
+		q.Unlock()
+	}
+}
@@ -0,0 +1,345 @@
+package rpc
+
+import (
+	"context"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+type serialTestArg struct {
+	User string
+	N    int
+}
+
+type serialTestServer struct {
+	sync.Mutex
+	handled map[string][]int
+	running map[string]int
+	overlap bool
+	// gates hold the handler of the given arg until they're closed.
+	gates map[serialTestArg]chan struct{}
+}
+
+func (s *serialTestServer) handle(_ context.Context, arg interface{}) (interface{}, error) {
+	a := *arg.(*serialTestArg)
+	s.Lock()
+	s.running[a.User]++
+	if s.running[a.User] > 1 {
+		s.overlap = true
+	}
+	gate := s.gates[a]
+	s.Unlock()
+	if gate != nil {
+		<-gate
+	}
+	time.Sleep(100 * time.Microsecond)
+	s.Lock()
+	defer s.Unlock()
+	s.running[a.User]--
+	s.handled[a.User] = append(s.handled[a.User], a.N)
+	return a.N, nil
+}
+
+func (s *serialTestServer) getHandled(user string) []int {
+	s.Lock()
+	defer s.Unlock()
+	return append([]int(nil), s.handled[user]...)
+}
+
+func newSerialTestServer(gated ...serialTestArg) *serialTestServer {
+	s := &serialTestServer{
+		handled: make(map[string][]int),
+		running: make(map[string]int),
+		gates:   make(map[serialTestArg]chan struct{}),
+	}
+	for _, arg := range gated {
+		s.gates[arg] = make(chan struct{})
+	}
+	return s
+}
+
+// serveSerialTest serves s on a new transport with the given options, and
+// returns a client of it.
+func serveSerialTest(t *testing.T, s *serialTestServer, opts TransportOpts) *serialTestClient {
+	clientConn, serverConn := net.Pipe()
+	sxp := NewTransportWithOpts(context.Background(), serverConn, nil, nil, testWrapError, testMaxFrameLength, opts)
+	t.Cleanup(sxp.Close)
+	srv := NewServer(sxp, testWrapError)
+	key := func(arg interface{}) string { return arg.(*serialTestArg).User }
+	require.NoError(t, srv.Register(Protocol{
+		Name: "serial",
+		Methods: map[string]ServeHandlerDescription{
+			"add": {
+				MakeArg:   func() interface{} { return new(serialTestArg) },
+				Handler:   s.handle,
+				SerialKey: key,
+			},
+		},
+	}))
+	require.NoError(t, srv.RegisterV2(ProtocolV2{
+		Name: "serial2",
+		ID:   0x5e1a1,
+		Methods: map[Position]ServeHandlerDescriptionV2{
+			0: {
+				ServeHandlerDescription: ServeHandlerDescription{
+					MakeArg:   func() interface{} { return new(serialTestArg) },
+					Handler:   s.handle,
+					SerialKey: key,
+				},
+				Name: "add",
+			},
+		},
+	}))
+	srv.Run()
+
+	c := &serialTestClient{sentCh: make(chan struct{}, 1)}
+	cxp := NewTransport(context.Background(), clientConn, nil, nil, nil, testMaxFrameLength)
+	t.Cleanup(cxp.Close)
+	c.cli = NewClientWithSendNotifier(cxp, testErrorUnwrapper{}, nil, func(SeqNumber) { c.sentCh <- struct{}{} })
+	return c
+}
+
+type serialTestClient struct {
+	cli    *Client
+	sentCh chan struct{}
+	wg     sync.WaitGroup
+}
+
+// call sends a call, and waits for it to be written, so that the calls
+// arrive in order.
+func (c *serialTestClient) call(ctx context.Context, m Methoder, arg serialTestArg) <-chan error {
+	errCh := make(chan error, 1)
+	c.wg.Add(1)
+	go func() {
+		defer c.wg.Done()
+		var res int
+		err := c.cli.Call(ctx, m, arg, &res, 0)
+		if err == nil && res != arg.N {
+			err = NewTypeError(arg.N, res)
+		}
+		errCh <- err
+	}()
+	<-c.sentCh
+	return errCh
+}
+
+func TestSerialKey(t *testing.T) {
+	s := newSerialTestServer(serialTestArg{User: "a", N: 0})
+	c := serveSerialTest(t, s, TransportOpts{})
+	call := c.call
+	v1 := newMethodV1("serial.add")
+	v2 := NewMethodV2(0x5e1a1, 0, "serial2.add")
+
+	// The first call of a is held, so a's next calls wait for it, in
+	// order, across methods, while b's go through.
+	var aErrs []<-chan error
+	aErrs = append(aErrs, call(context.Background(), v1, serialTestArg{User: "a", N: 0}))
+	for i := 1; i <= 10; i++ {
+		m := Methoder(v1)
+		if i%2 == 0 {
+			m = v2
+		}
+		aErrs = append(aErrs, call(context.Background(), m, serialTestArg{User: "a", N: i}))
+		require.NoError(t, <-call(context.Background(), m, serialTestArg{User: "b", N: i}))
+	}
+	require.Len(t, s.getHandled("b"), 10)
+	require.Empty(t, s.getHandled("a"))
+
+	// A call that's canceled while queued isn't served.
+	ctx, cancel := context.WithCancel(context.Background())
+	canceledErrCh := call(ctx, v1, serialTestArg{User: "a", N: 99})
+	cancel()
+	require.ErrorIs(t, <-canceledErrCh, context.Canceled)
+	lastErrCh := call(context.Background(), v1, serialTestArg{User: "a", N: 11})
+
+	// Calls without a key aren't serialized.
+	require.NoError(t, <-call(context.Background(), v1, serialTestArg{N: 1}))
+
+	close(s.gates[serialTestArg{User: "a", N: 0}])
+	for _, errCh := range append(aErrs, lastErrCh) {
+		require.NoError(t, <-errCh)
+	}
+	c.wg.Wait()
+	require.Equal(t, []int{0, 1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11}, s.getHandled("a"))
+	s.Lock()
+	require.False(t, s.overlap)
+	s.Unlock()
+}
+
+func TestSerialKeySharedQueues(t *testing.T) {
+	s := newSerialTestServer(serialTestArg{User: "a", N: 0})
+	q := NewSerialQueues()
+	c1 := serveSerialTest(t, s, TransportOpts{SerialQueues: q})
+	c2 := serveSerialTest(t, s, TransportOpts{SerialQueues: q})
+	c3 := serveSerialTest(t, s, TransportOpts{})
+	m := newMethodV1("serial.add")
+
+	// a's calls on the second transport wait for the first one's, but
+	// not those on a transport with its own queues.
+	errCh0 := c1.call(context.Background(), m, serialTestArg{User: "a", N: 0})
+	require.Eventually(t, func() bool {
+		s.Lock()
+		defer s.Unlock()
+		return s.running["a"] == 1
+	}, 5*time.Second, time.Millisecond)
+	errCh1 := c2.call(context.Background(), m, serialTestArg{User: "a", N: 1})
+	require.NoError(t, <-c3.call(context.Background(), m, serialTestArg{User: "a", N: 2}))
+	require.Equal(t, []int{2}, s.getHandled("a"))
+
+	close(s.gates[serialTestArg{User: "a", N: 0}])
+	require.NoError(t, <-errCh0)
+	require.NoError(t, <-errCh1)
+	require.Equal(t, []int{2, 0, 1}, s.getHandled("a"))
+}
+
+func TestSerialKeyMaxQueued(t *testing.T) {
+	s := newSerialTestServer(serialTestArg{User: "a", N: 0})
+	q := NewSerialQueuesWithOpts(SerialQueuesOpts{MaxQueued: 2})
+	c := serveSerialTest(t, s, TransportOpts{SerialQueues: q})
+	m := newMethodV1("serial.add")
+
+	var errChs []<-chan error
+	for i := 0; i < 3; i++ {
+		errChs = append(errChs, c.call(context.Background(), m, serialTestArg{User: "a", N: i}))
+	}
+	// The queue of a is full, but b's isn't.
+	err := <-c.call(context.Background(), m, serialTestArg{User: "a", N: 3})
+	require.Equal(t, newResourceExhaustedError("queued requests", "serial.add"), err)
+	require.NoError(t, <-c.call(context.Background(), m, serialTestArg{User: "b", N: 0}))
+
+	close(s.gates[serialTestArg{User: "a", N: 0}])
+	for _, errCh := range errChs {
+		require.NoError(t, <-errCh)
+	}
+	require.Equal(t, []int{0, 1, 2}, s.getHandled("a"))
+}
+
+// A transport that closes while its requests are queued doesn't hold up
+// the others sharing its queues.
+func TestSerialKeySharedQueuesClose(t *testing.T) {
+	s := newSerialTestServer(serialTestArg{User: "a", N: 0})
+	q := NewSerialQueues()
+	m := newMethodV1("serial.add")
+
+	clientConn, serverConn := net.Pipe()
+	sxp := NewTransportWithOpts(context.Background(), serverConn, nil, nil, nil, testMaxFrameLength,
+		TransportOpts{SerialQueues: q})
+	srv := NewServer(sxp, nil)
+	require.NoError(t, srv.Register(Protocol{
+		Name: "serial",
+		Methods: map[string]ServeHandlerDescription{
+			"add": {
+				MakeArg:   func() interface{} { return new(serialTestArg) },
+				Handler:   s.handle,
+				SerialKey: func(arg interface{}) string { return arg.(*serialTestArg).User },
+			},
+		},
+	}))
+	srv.Run()
+	sentCh := make(chan struct{}, 1)
+	cxp := NewTransport(context.Background(), clientConn, nil, nil, nil, testMaxFrameLength)
+	defer cxp.Close()
+	cli := NewClientWithSendNotifier(cxp, nil, nil, func(SeqNumber) { sentCh <- struct{}{} })
+	for i := 0; i < 2; i++ {
+		go func(i int) {
+			var res int
+			_ = cli.Call(context.Background(), m, serialTestArg{User: "a", N: i}, &res, 0)
+		}(i)
+		<-sentCh
+	}
+	require.Eventually(t, func() bool {
+		q.Lock()
+		defer q.Unlock()
+		return len(q.queues["a"]) == 1
+	}, 5*time.Second, time.Millisecond)
+	closeTransportAndWait(sxp)
+	close(s.gates[serialTestArg{User: "a", N: 0}])
+
+	c := serveSerialTest(t, s, TransportOpts{SerialQueues: q})
+	require.NoError(t, <-c.call(context.Background(), m, serialTestArg{User: "a", N: 2}))
+	require.Equal(t, []int{0, 2}, s.getHandled("a"))
+}
+
+func TestSerialQueues(t *testing.T) {
+	q := NewSerialQueuesWithOpts(SerialQueuesOpts{MaxQueued: 1})
+	var mu sync.Mutex
+	var order []int
+	var wg sync.WaitGroup
+	gate := make(chan struct{})
+	wg.Add(3)
+	q.run("k", func() {
+		defer wg.Done()
+		<-gate
+		mu.Lock()
+		order = append(order, 1)
+		mu.Unlock()
+	})
+	require.True(t, q.run("k", func() {
+		defer wg.Done()
+		mu.Lock()
+		order = append(order, 2)
+		mu.Unlock()
+	}))
+	// Only one can wait for k.
+	require.False(t, q.run("k", func() { t.Error("ran a function over the limit") }))
+	q.run("other", func() {
+		defer wg.Done()
+		close(gate)
+	})
+	wg.Wait()
+	require.Equal(t, []int{1, 2}, order)
+	require.Eventually(t, func() bool {
+		q.Lock()
+		defer q.Unlock()
+		return len(q.queues) == 0
+	}, 5*time.Second, time.Millisecond)
+}
+
+// Notifies all have the same seqid, so the end of one mustn't cancel those
+// waiting behind it.
+func TestSerialKeyNotifies(t *testing.T) {
+	gate := make(chan struct{})
+	errCh := make(chan error, 5)
+	clientConn, serverConn := net.Pipe()
+	sxp := NewTransport(context.Background(), serverConn, nil, nil, nil, testMaxFrameLength)
+	defer sxp.Close()
+	srv := NewServer(sxp, nil)
+	require.NoError(t, srv.Register(Protocol{
+		Name: "serial",
+		Methods: map[string]ServeHandlerDescription{
+			"push": {
+				MakeArg: func() interface{} { return new(serialTestArg) },
+				Handler: func(ctx context.Context, arg interface{}) (interface{}, error) {
+					if arg.(*serialTestArg).N == 0 {
+						<-gate
+					}
+					errCh <- ctx.Err()
+					return nil, nil
+				},
+				SerialKey: func(arg interface{}) string { return arg.(*serialTestArg).User },
+			},
+		},
+	}))
+	srv.Run()
+	cxp := NewTransport(context.Background(), clientConn, nil, nil, nil, testMaxFrameLength)
+	defer cxp.Close()
+	cli := NewClient(cxp, nil, nil)
+
+	for i := 0; i < 5; i++ {
+		require.NoError(t, cli.Notify(context.Background(), newMethodV1("serial.push"), serialTestArg{User: "a", N: i}, 0))
+	}
+	require.Eventually(t, func() bool {
+		q := sxp.(*transport).receiver.(*receiveHandler).serial
+		q.Lock()
+		defer q.Unlock()
+		return len(q.queues["a"]) == 4
+	}, 5*time.Second, time.Millisecond)
+	close(gate)
+	for i := 0; i < 5; i++ {
+		require.NoError(t, <-errCh)
+	}
+}
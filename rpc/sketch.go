@@ -0,0 +1,98 @@
+package rpc
+
+import (
+	"math"
+	"sort"
+)
+
+// sketchRelativeAccuracy is the relative error of the quantiles returned by
+// a quantileSketch.
+const sketchRelativeAccuracy = 0.01
+
+var (
+	sketchGamma    = (1 + sketchRelativeAccuracy) / (1 - sketchRelativeAccuracy)
+	sketchLogGamma = math.Log(sketchGamma)
+)
+
+// quantileSketch is a streaming quantile estimator over positive values. It
+// counts values in logarithmic buckets, so quantiles are accurate to within
+// sketchRelativeAccuracy, and its size only depends on the range of the
+// values, not on how many there are: durations between a nanosecond and a
+// day fit in about 1,600 buckets. The zero value is an empty sketch.
+type quantileSketch struct {
+	buckets map[int]uint64
+	zeros   uint64
+	count   uint64
+}
+
+func sketchIndex(v float64) int {
+	return int(math.Ceil(math.Log(v) / sketchLogGamma))
+}
+
+// sketchValue is the representative value of bucket i, which covers
+// (gamma^(i-1), gamma^i].
+func sketchValue(i int) float64 {
+	return 2 * math.Pow(sketchGamma, float64(i)) / (1 + sketchGamma)
+}
+
+func (s *quantileSketch) add(v float64) {
+	s.count++
+	if v <= 0 {
+		s.zeros++
+		return
+	}
+	if s.buckets == nil {
+		s.buckets = make(map[int]uint64)
+	}
+	s.buckets[sketchIndex(v)]++
+}
+
+func (s *quantileSketch) merge(o *quantileSketch) {
+	if o.count == 0 {
+		return
+	}
+	if s.buckets == nil {
+		s.buckets = make(map[int]uint64, len(o.buckets))
+	}
+	for i, n := range o.buckets {
+		s.buckets[i] += n
+	}
+	s.zeros += o.zeros
+	s.count += o.count
+}
+
+// quantiles returns the estimates of the given quantiles, which must be
+// sorted in increasing order.
+func (s *quantileSketch) quantiles(qs ...float64) []float64 {
+	ret := make([]float64, len(qs))
+	if s.count == 0 {
+		return ret
+	}
+	idx := make([]int, 0, len(s.buckets))
+	for i := range s.buckets {
+		idx = append(idx, i)
+	}
+	sort.Ints(idx)
+
+	seen := s.zeros
+	j := 0
+	for k, q := range qs {
+		// Nearest-rank, so that the top quantiles of small samples are
+		// their largest values.
+		var rank uint64
+		if r := math.Ceil(q * float64(s.count)); r > 1 {
+			rank = uint64(r) - 1
+		}
+		if rank < s.zeros {
+			continue
+		}
+		for j < len(idx) && seen <= rank {
+			seen += s.buckets[idx[j]]
+			j++
+		}
+		if j > 0 {
+			ret[k] = sketchValue(idx[j-1])
+		}
+	}
+	return ret
+}
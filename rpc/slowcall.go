@@ -0,0 +1,194 @@
+package rpc
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"runtime"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/foks-proj/go-ctxlog"
+)
+
+// SlowCallOpts configure the warnings about slow calls, in both directions.
+// A warning is logged through the LogInterface as soon as a call outlives its
+// threshold, rather than when it's done.
+type SlowCallOpts struct {
+	// Threshold applies to the methods that aren't in Methods. Zero
+	// disables the warnings for them.
+	Threshold time.Duration
+	// Methods overrides Threshold by method name, e.g.
+	// "protocol.method". Zero disables the warnings for a method.
+	Methods map[string]time.Duration
+	// CaptureStack adds the stack of the goroutine serving a slow
+	// incoming call to its warning.
+	CaptureStack bool
+	// Counter, if set, counts the slow calls. It can be shared by
+	// transports.
+	Counter *SlowCallCounter
+}
+
+// maxSlowCallArgLength bounds the summary of the argument in a warning.
+const maxSlowCallArgLength = 256
+
+// SlowCallCounter counts slow calls by method, separately for the calls made
+// to the peer and the calls served. It is safe for concurrent use.
+type SlowCallCounter struct {
+	sync.Mutex
+	client map[string]uint64
+	server map[string]uint64
+}
+
+// NewSlowCallCounter makes a SlowCallCounter with no counts.
+func NewSlowCallCounter() *SlowCallCounter {
+	return &SlowCallCounter{client: make(map[string]uint64), server: make(map[string]uint64)}
+}
+
+func (c *SlowCallCounter) add(server bool, method string) {
+	if c == nil {
+		return
+	}
+	c.Lock()
+	defer c.Unlock()
+	if server {
+		c.server[method]++
+	} else {
+		c.client[method]++
+	}
+}
+
+func copyCounts(m map[string]uint64) map[string]uint64 {
+	ret := make(map[string]uint64, len(m))
+	for k, v := range m {
+		ret[k] = v
+	}
+	return ret
+}
+
+// Client returns the counts of slow calls made to the peer, by method.
+func (c *SlowCallCounter) Client() map[string]uint64 {
+	c.Lock()
+	defer c.Unlock()
+	return copyCounts(c.client)
+}
+
+// Server returns the counts of slow calls served, by method.
+func (c *SlowCallCounter) Server() map[string]uint64 {
+	c.Lock()
+	defer c.Unlock()
+	return copyCounts(c.server)
+}
+
+// slowCallWatcher sets timers on calls, to warn about the slow ones. A nil
+// *slowCallWatcher doesn't watch anything.
+type slowCallWatcher struct {
+	opts SlowCallOpts
+	log  LogInterface
+}
+
+func newSlowCallWatcher(opts *SlowCallOpts, log LogInterface) *slowCallWatcher {
+	if opts == nil {
+		return nil
+	}
+	return &slowCallWatcher{opts: *opts, log: log}
+}
+
+func (w *slowCallWatcher) threshold(method string) time.Duration {
+	if d, ok := w.opts.Methods[method]; ok {
+		return d
+	}
+	return w.opts.Threshold
+}
+
+// watch starts watching a call, and returns the function to call when it's
+// done. For served calls, it must be called from the goroutine that runs the
+// handler, so that the stack of that goroutine can be captured.
+func (w *slowCallWatcher) watch(ctx context.Context, server bool, seqno SeqNumber, method string,
+	arg interface{}, redact RedactFunc) (stop func()) {
+	if w == nil {
+		return func() {}
+	}
+	threshold := w.threshold(method)
+	if threshold <= 0 {
+		return func() {}
+	}
+	var goid string
+	if server && w.opts.CaptureStack {
+		goid = currentGoroutineID()
+	}
+	start := time.Now()
+	timer := time.AfterFunc(threshold, func() {
+		w.warn(ctx, server, seqno, method, redactNow(redact, arg), time.Since(start), goid)
+	})
+	return func() { timer.Stop() }
+}
+
+func (w *slowCallWatcher) warn(ctx context.Context, server bool, seqno SeqNumber, method string,
+	arg interface{}, elapsed time.Duration, goid string) {
+	w.opts.Counter.add(server, method)
+
+	side := "client"
+	if server {
+		side = "server"
+	}
+	fields := []LogField{
+		{"side", side},
+		{"method", method},
+		{"seqno", seqno},
+		{"elapsed", elapsed},
+		{"arg", summarizeArg(arg)},
+	}
+	if tags, ok := ctxlog.TagsFromContext(ctx); ok {
+		fields = append(fields, LogField{"tags", tags})
+	}
+	if goid != "" {
+		fields = append(fields, LogField{"stack", goroutineStack(goid)})
+	}
+	w.log.Warnw("slow call", fields...)
+}
+
+// summarizeArg formats an argument for a warning, truncating it.
+func summarizeArg(arg interface{}) string {
+	s := fmt.Sprintf("%+v", arg)
+	if len(s) > maxSlowCallArgLength {
+		s = s[:maxSlowCallArgLength] + "..."
+	}
+	return s
+}
+
+// currentGoroutineID parses the ID of the calling goroutine out of its stack
+// trace, which starts with "goroutine <id> [running]:".
+func currentGoroutineID() string {
+	var buf [64]byte
+	b := buf[:runtime.Stack(buf[:], false)]
+	b = bytes.TrimPrefix(b, []byte("goroutine "))
+	if i := bytes.IndexByte(b, ' '); i > 0 {
+		if _, err := strconv.ParseUint(string(b[:i]), 10, 64); err == nil {
+			return string(b[:i])
+		}
+	}
+	return ""
+}
+
+// goroutineStack returns the stack of the goroutine with the given ID, or an
+// empty string if it's gone.
+func goroutineStack(goid string) string {
+	buf := make([]byte, 64*1024)
+	for {
+		n := runtime.Stack(buf, true)
+		if n < len(buf) {
+			buf = buf[:n]
+			break
+		}
+		buf = make([]byte, 2*len(buf))
+	}
+	prefix := []byte("goroutine " + goid + " [")
+	for _, stack := range bytes.Split(buf, []byte("\n\n")) {
+		if bytes.HasPrefix(stack, prefix) {
+			return string(stack)
+		}
+	}
+	return ""
+}
@@ -0,0 +1,115 @@
+package rpc
+
+import (
+	"context"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/foks-proj/go-ctxlog"
+	"github.com/stretchr/testify/require"
+)
+
+// warnLogOutput keeps the structured warnings.
+type warnLogOutput struct {
+	sync.Mutex
+	NilLogOutput
+	warnings []map[string]interface{}
+}
+
+func (o *warnLogOutput) Warnw(msg string, args ...LogField) {
+	o.Lock()
+	defer o.Unlock()
+	m := map[string]interface{}{"msg": msg}
+	for _, f := range args {
+		m[f.Key] = f.Value
+	}
+	o.warnings = append(o.warnings, m)
+}
+
+func (o *warnLogOutput) find(msg, side string) map[string]interface{} {
+	o.Lock()
+	defer o.Unlock()
+	for _, w := range o.warnings {
+		if w["msg"] == msg && w["side"] == side {
+			return w
+		}
+	}
+	return nil
+}
+
+func TestSlowCalls(t *testing.T) {
+	out := &warnLogOutput{}
+	lf := NewSimpleLogFactory(out, nil)
+	counter := NewSlowCallCounter()
+	opts := TransportOpts{SlowCalls: &SlowCallOpts{
+		Threshold: time.Nanosecond,
+		Methods: map[string]time.Duration{
+			"drain.block": 20 * time.Millisecond,
+			"drain.echo":  0,
+		},
+		CaptureStack: true,
+		Counter:      counter,
+	}}
+
+	started := make(chan struct{})
+	release := make(chan struct{})
+	clientConn, serverConn := net.Pipe()
+	sxp := NewTransportWithOpts(context.Background(), serverConn, lf, nil, nil, testMaxFrameLength, opts)
+	srv := NewServer(sxp, nil)
+	require.NoError(t, srv.Register(drainTestProtocol(started, release)))
+	srv.Run()
+	cxp := NewTransportWithOpts(context.Background(), clientConn, lf, nil, nil, testMaxFrameLength, opts)
+	defer cxp.Close()
+	defer sxp.Close()
+	cli := NewClient(cxp, nil, nil)
+
+	ctx := ctxlog.AddTagsToContext(context.Background(), ctxlog.CtxLogTags{"req": "slow-1"})
+	var res int
+	require.NoError(t, cli.Call(ctx, newMethodV1("drain.echo"), 1, &res, 0))
+
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- cli.Call(ctx, newMethodV1("drain.block"), 5, &res, 0)
+	}()
+	<-started
+
+	// The warnings come while the call is still running.
+	require.Eventually(t, func() bool {
+		return out.find("slow call", "client") != nil && out.find("slow call", "server") != nil
+	}, 5*time.Second, time.Millisecond)
+
+	client := out.find("slow call", "client")
+	require.Equal(t, "drain.block", client["method"])
+	require.Equal(t, SeqNumber(1), client["seqno"])
+	require.Equal(t, "5", client["arg"])
+	require.GreaterOrEqual(t, client["elapsed"].(time.Duration), 20*time.Millisecond)
+	require.Equal(t, ctxlog.CtxLogTags{"req": "slow-1"}, client["tags"])
+	require.NotContains(t, client, "stack")
+
+	server := out.find("slow call", "server")
+	require.Equal(t, "drain.block", server["method"])
+	require.Equal(t, SeqNumber(1), server["seqno"])
+	require.Equal(t, ctxlog.CtxLogTags{"req": "slow-1"}, server["tags"])
+	stack := server["stack"].(string)
+	require.True(t, strings.HasPrefix(stack, "goroutine "), stack)
+	require.Contains(t, stack, "drainTestProtocol")
+
+	close(release)
+	require.NoError(t, <-errCh)
+
+	require.Equal(t, map[string]uint64{"drain.block": 1}, counter.Client())
+	require.Equal(t, map[string]uint64{"drain.block": 1}, counter.Server())
+}
+
+func TestSummarizeArg(t *testing.T) {
+	require.Equal(t, "{A:1 B:x}", summarizeArg(struct {
+		A int
+		B string
+	}{1, "x"}))
+	long := summarizeArg(strings.Repeat("a", 1000))
+	require.Len(t, long, maxSlowCallArgLength+3)
+	require.True(t, strings.HasSuffix(long, "..."))
+}
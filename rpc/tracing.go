@@ -0,0 +1,110 @@
+package rpc
+
+import (
+	"context"
+)
+
+// SpanKind says which side of a call or notify a span is on.
+type SpanKind int
+
+const (
+	// SpanKindClient is an outgoing call.
+	SpanKindClient SpanKind = iota + 1
+	// SpanKindServer is an incoming call.
+	SpanKindServer
+	// SpanKindProducer is an outgoing notify.
+	SpanKindProducer
+	// SpanKindConsumer is an incoming notify.
+	SpanKindConsumer
+)
+
+// SpanInfo describes the call or notify of a span.
+type SpanInfo struct {
+	Kind        SpanKind
+	Type        MethodType
+	Method      Methoder
+	Compression CompressionType
+}
+
+// Span is the span of a call or notify, started by a Tracer.
+type Span interface {
+	// SetSeqNo records the sequence number of a call.
+	SetSeqNo(SeqNumber)
+	// SetSentSize and SetReceivedSize record the size of the messages
+	// sent and received, in bytes.
+	SetSentSize(int64)
+	SetReceivedSize(int64)
+	// End records the error of the call or notify, if any, and ends the
+	// span.
+	End(err error)
+}
+
+// Tracer traces the calls and notifies of a transport. Outgoing ones get a
+// client span, whose context is propagated to the peer in the headers of the
+// message, and incoming ones get a server span that's a child of the peer's
+// span. The oteltrace package implements it with OpenTelemetry.
+type Tracer interface {
+	// StartClient starts the span of an outgoing call or notify, and
+	// returns the headers that carry its context to the peer.
+	StartClient(ctx context.Context, info SpanInfo) (context.Context, Span, map[string]string)
+	// Extract adds the span context that the peer sent in the headers to
+	// ctx.
+	Extract(ctx context.Context, headers map[string]string) context.Context
+	// StartServer starts the span of an incoming call or notify, as a
+	// child of the span extracted into ctx, if any.
+	StartServer(ctx context.Context, info SpanInfo) (context.Context, Span)
+}
+
+// noopSpan is used when tracing is off.
+type noopSpan struct{}
+
+func (noopSpan) SetSeqNo(SeqNumber)    {}
+func (noopSpan) SetSentSize(int64)     {}
+func (noopSpan) SetReceivedSize(int64) {}
+func (noopSpan) End(error)             {}
+
+// rpcTracer wraps the Tracer of a transport. A nil *rpcTracer is valid, and
+// doesn't trace anything.
+type rpcTracer struct {
+	t Tracer
+}
+
+func newRPCTracer(t Tracer) *rpcTracer {
+	if t == nil {
+		return nil
+	}
+	return &rpcTracer{t: t}
+}
+
+func (t *rpcTracer) startClient(ctx context.Context, kind SpanKind, typ MethodType, name Methoder,
+	ctype CompressionType) (context.Context, Span, map[string]string) {
+	if t == nil {
+		return ctx, noopSpan{}, nil
+	}
+	return t.t.StartClient(ctx, SpanInfo{Kind: kind, Type: typ, Method: name, Compression: ctype})
+}
+
+func (t *rpcTracer) extract(ctx context.Context, headers map[string]string) context.Context {
+	if t == nil || len(headers) == 0 {
+		return ctx
+	}
+	return t.t.Extract(ctx, headers)
+}
+
+func (t *rpcTracer) startServer(ctx context.Context, kind SpanKind, rpc rpcMessage,
+	size int64) (context.Context, Span) {
+	if t == nil {
+		return ctx, noopSpan{}
+	}
+	ctx, span := t.t.StartServer(ctx, SpanInfo{
+		Kind:        kind,
+		Type:        rpc.Type(),
+		Method:      rpc.Name(),
+		Compression: rpc.Compression(),
+	})
+	if kind == SpanKindServer {
+		span.SetSeqNo(rpc.SeqNo())
+	}
+	span.SetReceivedSize(size)
+	return ctx, span
+}
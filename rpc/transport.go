@@ -6,6 +6,8 @@ import (
 	"io"
 	"net"
 	"sync"
+	"sync/atomic"
+	"time"
 )
 
 type WrapErrorFunc func(error) interface{}
@@ -28,6 +30,34 @@ type Transporter interface {
 	// the message.
 	KillIncoming(err error)
 
+	// Drain gracefully shuts down the transport. It tells the peer
+	// that we're going away, if the peer advertised FeatureGoAway in
+	// its handshake, refuses new incoming and outgoing calls with a
+	// DrainingError, waits for the incoming calls being served and the
+	// outgoing calls awaiting replies to finish, and then closes the
+	// transport. If ctx is done first, the transport is closed anyway
+	// and ctx.Err() is returned.
+	//
+	// Peers without a handshake aren't told, since those that predate
+	// the going-away message would treat it as a protocol error and drop
+	// the connection; they only find out from their refused calls.
+	Drain(ctx context.Context) error
+
+	// Handshake waits for the peer's handshake, and returns the
+	// negotiated result. It returns nil if the transport wasn't created
+	// with a HandshakeConfig, a result with PeerMissing set if the
+	// peer's handshake doesn't arrive in time, and a HandshakeError if
+	// the transport closes first.
+	Handshake(ctx context.Context) (*HandshakeResult, error)
+
+	// describeProtocols lists the protocols registered on this
+	// transport.
+	describeProtocols() ([]ProtocolDescription, []ProtocolV2Description)
+
+	// goingAway returns a channel that's closed once the peer has
+	// announced that it's draining.
+	goingAway() <-chan struct{}
+
 	// receiveFrames starts processing incoming frames in a
 	// background goroutine, if it's not already happening.
 	// Returns the result of done(), for convenience.
@@ -54,8 +84,11 @@ type Transporter interface {
 var _ Transporter = (*transport)(nil)
 
 type transport struct {
-	ctx        context.Context
-	c          net.Conn
+	ctx context.Context
+	c   net.Conn
+	// live is set if the instrumenter storage wants to know when the
+	// transport is closed.
+	live       LiveInstrumenterStorage
 	enc        *framedMsgpackEncoder
 	dispatcher dispatcher
 	receiver   receiver
@@ -66,6 +99,18 @@ type transport struct {
 	closeOnce  sync.Once
 	startOnce  sync.Once
 	stopCh     chan struct{}
+	// receiveDone is closed once receiveFramesLoop returns.
+	receiveDone chan struct{}
+	limiter     *transportRateLimiter
+	draining    atomic.Bool
+	peerGoAway  fireOnce
+	handshake   *handshaker
+	// answeredHandshake is set once the peer's handshake is answered,
+	// when handshake isn't set.
+	answeredHandshake atomic.Bool
+	// introspector, if set, lists this transport until it's closed.
+	introspector *Introspector
+	opened       time.Time
 
 	// Filled in right before stopCh is closed.
 	stopErr error
@@ -75,13 +120,60 @@ type transport struct {
 // the maxFrameLength parameter in NewTransporter.
 const DefaultMaxFrameLength = 100 * 1024 * 1024
 
+// TransportOpts contains the optional parameters of a transport. The zero
+// value gives the same transport as NewTransport.
+type TransportOpts struct {
+	// RateLimit limits the incoming calls and notifies accepted from the
+	// peer.
+	RateLimit *TransportRateLimit
+	// Handshake, if set, makes the transport start with a handshake.
+	// See HandshakeConfig.
+	Handshake *HandshakeConfig
+	// Tracer, if set, traces calls and notifies in both directions. See
+	// the oteltrace package.
+	Tracer Tracer
+	// Introspector, if set, lists the transport, with its outstanding
+	// calls and served tasks, until it's closed.
+	Introspector *Introspector
+	// SlowCalls, if set, enables warnings about slow calls. See
+	// SlowCallOpts.
+	SlowCalls *SlowCallOpts
+	// WriteBatching, if set, makes the transport write outgoing frames
+	// in batches. See WriteBatchOpts.
+	WriteBatching *WriteBatchOpts
+	// Codec is the encoding of the frames, msgpack by default. The peer
+	// must use the same one.
+	Codec CodecType
+	// OrderedNotifies, if set, handles the ordered notifies that the peer
+	// sends with an OrderedNotifier: in order, and only once.
+	OrderedNotifies *OrderedNotifyReceiver
+	// Idempotency, if set, serves the calls that have an idempotency key
+	// only once, and replays their reply to their retries.
+	Idempotency *IdempotencyCache
+	// SerialQueues, if set, serves the requests that have a SerialKey,
+	// so that they're ordered against those of the other transports it's
+	// given to. See SerialQueues.
+	SerialQueues *SerialQueues
+}
+
 // NewTransport creates a new Transporter from the given connection
 // and parameters. Both sides of a connection should use the same
-// number for maxFrameLength.
+// number for maxFrameLength, which the handshake (see
+// TransportOpts.Handshake) lets them check.
 func NewTransport(ctx context.Context, c net.Conn, l LogFactory, instrumenterStorage NetworkInstrumenterStorage, wef WrapErrorFunc, maxFrameLength int32) Transporter {
+	return NewTransportWithOpts(ctx, c, l, instrumenterStorage, wef, maxFrameLength, TransportOpts{})
+}
+
+// NewTransportWithOpts is like NewTransport, but takes additional
+// optional parameters.
+func NewTransportWithOpts(ctx context.Context, c net.Conn, l LogFactory, instrumenterStorage NetworkInstrumenterStorage,
+	wef WrapErrorFunc, maxFrameLength int32, opts TransportOpts) Transporter {
 	if maxFrameLength <= 0 {
 		panic(fmt.Sprintf("maxFrameLength must be positive: got %d", maxFrameLength))
 	}
+	if !opts.Codec.valid() {
+		panic(fmt.Sprintf("invalid codec: %s", opts.Codec))
+	}
 
 	if l == nil {
 		l = NewSimpleLogFactory(nil, nil)
@@ -92,21 +184,53 @@ func NewTransport(ctx context.Context, c net.Conn, l LogFactory, instrumenterSto
 	}
 
 	ret := &transport{
-		ctx:    ctx,
-		c:      c,
-		log:    log,
-		stopCh: make(chan struct{}),
+		ctx:         ctx,
+		c:           c,
+		log:         log,
+		stopCh:      make(chan struct{}),
+		receiveDone: make(chan struct{}),
 		protocols: protocolHandlers{
 			v1: newProtocolHandler(wef),
 			v2: newProtocolV2Handler(wef),
 		},
-		calls: newCallContainer(),
+		calls:      newCallContainer(),
+		limiter:    newTransportRateLimiter(opts.RateLimit, AddrToString(c.RemoteAddr())),
+		peerGoAway: newFireOnce(),
+		opened:     time.Now(),
 	}
-	enc := newFramedMsgpackEncoder(maxFrameLength, c)
+	enc := newFramedEncoder(maxFrameLength, c, opts.Codec, opts.WriteBatching)
 	ret.enc = enc
-	ret.dispatcher = newDispatch(enc, ret.calls, log, instrumenterStorage)
-	ret.receiver = newReceiveHandler(enc, ret.protocols, log)
-	ret.packetizer = newPacketizer(maxFrameLength, c, ret.protocols, ret.calls, log, instrumenterStorage)
+	tracer := newRPCTracer(opts.Tracer)
+	slow := newSlowCallWatcher(opts.SlowCalls, log)
+	d := newDispatch(enc, ret.calls, log, instrumenterStorage)
+	d.tracer = tracer
+	d.slow = slow
+	ret.dispatcher = d
+	r := newReceiveHandler(enc, ret.protocols, log)
+	r.tracer = tracer
+	r.slow = slow
+	r.ordered = opts.OrderedNotifies
+	r.idempotency = opts.Idempotency
+	if opts.SerialQueues != nil {
+		r.serial = opts.SerialQueues
+	}
+	r.peer = peerHost(c.RemoteAddr())
+	ret.receiver = r
+	ret.packetizer = newCodecPacketizer(opts.Codec, maxFrameLength, c, ret.protocols, ret.calls, log, instrumenterStorage)
+	if ls, ok := instrumenterStorage.(LiveInstrumenterStorage); ok {
+		ret.live = ls
+		ls.TransportOpened()
+	}
+	if opts.Handshake != nil {
+		ret.handshake = newHandshaker(opts.Handshake, maxFrameLength)
+		// Nothing else can have been written yet, so this is the first
+		// frame. Write errors will surface on the next read or write.
+		enc.EncodeAndWrite(ctx, ret.handshake.frame(), nil)
+	}
+	if opts.Introspector != nil {
+		ret.introspector = opts.Introspector
+		opts.Introspector.add(ret)
+	}
 	return ret
 }
 
@@ -124,6 +248,13 @@ func (t *transport) Close() {
 		t.c.Close()
 		// Wait for the encoder to finish handling the now unblocked writes
 		<-encoderClosed
+
+		if t.live != nil {
+			t.live.TransportClosed()
+		}
+		if t.introspector != nil {
+			t.introspector.remove(t)
+		}
 	})
 }
 
@@ -161,14 +292,26 @@ func (t *transport) err() error {
 }
 
 func (t *transport) receiveFramesLoop() {
+	defer close(t.receiveDone)
 	// Packetize: do work
 	var err error
 	for shouldContinue(err) {
 		var rpc rpcMessage
 		if rpc, err = t.packetizer.NextFrame(t.ctx); shouldReceive(rpc) {
-			if rerr := t.receiver.Receive(rpc); rerr != nil {
+			if _, ok := rpc.(*rpcGoAwayMessage); ok {
+				t.log.Infow("peer is going away")
+				t.peerGoAway.fire()
+			} else if hs, ok := rpc.(*rpcHandshakeMessage); ok {
+				t.receiveHandshake(hs.info)
+			} else if lerr := t.limiter.check(rpc, t.packetizer.lastFrameSize(), t.protocols); lerr != nil {
+				if rerr := t.receiver.Reject(rpc, lerr); rerr != nil {
+					t.log.Infow("error on Reject", LogField{"err", rerr})
+				}
+			} else if rerr := t.receiver.Receive(rpc); rerr != nil {
 				t.log.Infow("error on Receive", LogField{"err", err})
 			}
+		} else if rpc != nil {
+			finishDropped(rpc)
 		}
 	}
 
@@ -186,10 +329,95 @@ func (t *transport) KillIncoming(err error) {
 	t.protocols.killIncoming(err)
 }
 
+func (t *transport) Drain(ctx context.Context) error {
+	t.draining.Store(true)
+	t.KillIncoming(DrainingError{})
+	// Replies to our outstanding calls still need to be read.
+	t.receiveFrames()
+
+	err := t.drain(ctx)
+	t.Close()
+	return err
+}
+
+func (t *transport) drain(ctx context.Context) error {
+	// Peers that predate MethodGoAway drop the connection on it.
+	if t.handshake.peerHas(FeatureGoAway) {
+		_, errCh := t.enc.EncodeAndWrite(ctx, []interface{}{MethodGoAway}, nil)
+		select {
+		case err := <-errCh:
+			if err != nil {
+				return err
+			}
+		case <-t.stopCh:
+			return nil
+		}
+	}
+
+	// If the transport stops, all calls get an error, and all served
+	// tasks are canceled, so we're done.
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	go func() {
+		select {
+		case <-t.stopCh:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	if err := t.receiver.WaitIdle(ctx); err != nil {
+		return t.drainErr(err)
+	}
+	if err := t.calls.WaitEmpty(ctx); err != nil {
+		return t.drainErr(err)
+	}
+	return nil
+}
+
+// drainErr ignores the given error from a wait if it's due to the transport
+// having stopped.
+func (t *transport) drainErr(err error) error {
+	if !t.IsConnected() {
+		return nil
+	}
+	return err
+}
+
+func (t *transport) receiveHandshake(info HandshakeInfo) {
+	if t.handshake == nil {
+		// The peer waits for ours, so answer with the defaults.
+		if t.answeredHandshake.CompareAndSwap(false, true) {
+			t.log.Infow("answering handshake, though it's not enabled")
+			h := newHandshaker(&HandshakeConfig{}, t.enc.maxFrameLength)
+			t.enc.EncodeAndWriteAsync(h.frame())
+		}
+		return
+	}
+	t.log.Infow("handshake received",
+		LogField{"version", info.Version},
+		LogField{"features", info.Features},
+		LogField{"maxFrameLength", info.MaxFrameLength})
+	t.handshake.receive(info)
+}
+
+func (t *transport) Handshake(ctx context.Context) (*HandshakeResult, error) {
+	if t.handshake == nil {
+		return nil, nil
+	}
+	return t.handshake.wait(ctx, t.receiveFrames())
+}
+
+func (t *transport) goingAway() <-chan struct{} {
+	return t.peerGoAway.ch
+}
+
 func (t *transport) getDispatcher() (dispatcher, error) {
 	if !t.IsConnected() {
 		return nil, io.EOF
 	}
+	if t.draining.Load() {
+		return nil, DrainingError{}
+	}
 	return t.dispatcher, nil
 }
 
@@ -200,6 +428,10 @@ func (t *transport) getReceiver() (receiver, error) {
 	return t.receiver, nil
 }
 
+func (t *transport) describeProtocols() ([]ProtocolDescription, []ProtocolV2Description) {
+	return t.protocols.v1.describe(), t.protocols.v2.describe()
+}
+
 func (t *transport) registerProtocol(p Protocol) error {
 	return t.protocols.v1.registerProtocol(p)
 }
@@ -240,4 +472,17 @@ func shouldReceive(rpc rpcMessage) bool {
 	}
 }
 
+// finishDropped finishes the record of an incoming call or notify that
+// couldn't be decoded, and so won't be served. Responses are recorded with
+// their calls.
+func finishDropped(rpc rpcMessage) {
+	switch rpc.(type) {
+	case *rpcCallMessage, *rpcCallCompressedMessage, *rpcNotifyMessage:
+		if f, ok := rpc.(interface{ setFailed(error) }); ok {
+			f.setFailed(rpc.Err())
+		}
+		_ = rpc.RecordAndFinish(context.Background(), 0)
+	}
+}
+
 var _ Transporter = (*transport)(nil)
@@ -4,6 +4,7 @@ import (
 	"encoding/binary"
 	"errors"
 	"io"
+	"sync"
 )
 
 type ProtocolUniqueID uint64
@@ -35,12 +36,19 @@ func (p ProtocolUniqueID) ToUint64() uint64 {
 	return uint64(p)
 }
 
-var allUniques []uint64
+var allUniques struct {
+	sync.Mutex
+	ids []uint64
+}
 
 func AddUnique(u Uniquer) {
-	allUniques = append(allUniques, u.ToUint64())
+	allUniques.Lock()
+	defer allUniques.Unlock()
+	allUniques.ids = append(allUniques.ids, u.ToUint64())
 }
 
 func AllUniques() []uint64 {
-	return allUniques
+	allUniques.Lock()
+	defer allUniques.Unlock()
+	return append([]uint64(nil), allUniques.ids...)
 }
@@ -1,6 +1,9 @@
 package rpc
 
 import (
+	"errors"
+	"io"
+	"net"
 	"strings"
 )
 
@@ -36,3 +39,11 @@ func wrapError(f WrapErrorFunc, e error) interface{} {
 	}
 	return e.Error()
 }
+
+// isConnectionError returns true if err, from a call, is due to the
+// connection failing, rather than to the peer.
+func isConnectionError(err error) bool {
+	var netErr net.Error
+	return errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) || errors.Is(err, io.ErrClosedPipe) ||
+		errors.Is(err, net.ErrClosed) || errors.As(err, &netErr)
+}
@@ -0,0 +1,206 @@
+package rpc
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"golang.org/x/net/websocket"
+)
+
+// Frames can go over WebSocket, for clients that can only reach the server
+// through HTTP proxies. The connection is a stream of binary WebSocket
+// messages, with no regard for frame boundaries: a message can carry a frame,
+// part of one, or several. Clients dial "ws://" and "wss://" SPURIs, and
+// servers accept the connections with a WebSocketListener.
+
+// webSocketURL returns the URL to dial for f, with the plain WebSocket
+// scheme.
+func (f *SPURI) webSocketURL() (location, origin string) {
+	if f.UseTLS() {
+		return wssScheme + "://" + f.HostPort + f.Path, "https://" + f.HostPort
+	}
+	return wsScheme + "://" + f.HostPort + f.Path, "http://" + f.HostPort
+}
+
+// dialWebSocket opens a WebSocket connection to f. The TCP connection is
+// dialed with dialable if it's set.
+func (f *SPURI) dialWebSocket(ctx context.Context, dialable Dialable, config *tls.Config) (net.Conn, error) {
+	location, origin := f.webSocketURL()
+	wsConfig, err := websocket.NewConfig(location, origin)
+	if err != nil {
+		return nil, err
+	}
+
+	var conn net.Conn
+	if dialable != nil {
+		conn, err = dialable.Dial(ctx, "tcp", f.HostPort)
+	} else {
+		var d net.Dialer
+		conn, err = d.DialContext(ctx, "tcp", f.HostPort)
+	}
+	if err != nil {
+		return nil, err
+	}
+	// Disable SIGPIPE on platforms that require it (Darwin). See sigpipe_bsd.go.
+	if err := DisableSigPipe(conn); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	if f.UseTLS() {
+		config = copyTLSConfig(config)
+		if config == nil {
+			config = &tls.Config{}
+		}
+		if config.ServerName == "" {
+			config.ServerName = f.Host
+		}
+		tlsConn := tls.Client(conn, config)
+		if err := tlsConn.HandshakeContext(ctx); err != nil {
+			conn.Close()
+			return nil, err
+		}
+		conn = tlsConn
+	}
+
+	// The WebSocket handshake has no context, so bound it with a deadline
+	// instead.
+	if deadline, ok := ctx.Deadline(); ok {
+		_ = conn.SetDeadline(deadline)
+	}
+	ws, err := websocket.NewClient(wsConfig, conn)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	_ = conn.SetDeadline(time.Time{})
+	ws.PayloadType = websocket.BinaryFrame
+	return ws, nil
+}
+
+// WebSocketListenerOpts are the options of a WebSocketListener.
+type WebSocketListenerOpts struct {
+	// CheckOrigin, if set, vets incoming requests by their Origin
+	// header, which browsers set. Requests that it returns an error for
+	// are rejected. By default, any origin is accepted, which is only
+	// safe if the RPCs don't rely on the browser's credentials, such as
+	// cookies.
+	CheckOrigin func(r *http.Request) error
+}
+
+// WebSocketListener is a net.Listener for connections that come in over
+// WebSocket. It's also the http.Handler that upgrades them, to be served by
+// an HTTP server, e.g. on "/rpc". The connections it accepts are meant for
+// NewTransport, like TCP ones. It is safe for concurrent use.
+type WebSocketListener struct {
+	server    websocket.Server
+	connCh    chan net.Conn
+	closeCh   chan struct{}
+	closeOnce sync.Once
+}
+
+var _ net.Listener = (*WebSocketListener)(nil)
+var _ http.Handler = (*WebSocketListener)(nil)
+
+// NewWebSocketListener makes a WebSocketListener that accepts any origin.
+func NewWebSocketListener() *WebSocketListener {
+	return NewWebSocketListenerWithOpts(WebSocketListenerOpts{})
+}
+
+// NewWebSocketListenerWithOpts is like NewWebSocketListener, but takes
+// additional optional parameters.
+func NewWebSocketListenerWithOpts(opts WebSocketListenerOpts) *WebSocketListener {
+	l := &WebSocketListener{
+		connCh:  make(chan net.Conn),
+		closeCh: make(chan struct{}),
+	}
+	l.server.Handler = l.serve
+	if opts.CheckOrigin != nil {
+		l.server.Handshake = func(_ *websocket.Config, r *http.Request) error {
+			return opts.CheckOrigin(r)
+		}
+	}
+	return l
+}
+
+// ServeHTTP upgrades r to a WebSocket connection, and hands it to Accept.
+func (l *WebSocketListener) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	select {
+	case <-l.closeCh:
+		http.Error(w, "listener closed", http.StatusServiceUnavailable)
+		return
+	default:
+	}
+	l.server.ServeHTTP(w, r)
+}
+
+// serve hands ws to Accept, and waits until it's closed, since the
+// connection is closed when serve returns.
+func (l *WebSocketListener) serve(ws *websocket.Conn) {
+	ws.PayloadType = websocket.BinaryFrame
+	c := &webSocketServerConn{
+		Conn:       ws,
+		remoteAddr: webSocketAddr(ws.Request().RemoteAddr),
+		doneCh:     make(chan struct{}),
+	}
+	select {
+	case l.connCh <- c:
+	case <-l.closeCh:
+		return
+	}
+	<-c.doneCh
+}
+
+// Accept waits for the next WebSocket connection.
+func (l *WebSocketListener) Accept() (net.Conn, error) {
+	select {
+	case c := <-l.connCh:
+		return c, nil
+	case <-l.closeCh:
+		return nil, net.ErrClosed
+	}
+}
+
+// Close stops accepting connections. The connections already accepted are
+// left open.
+func (l *WebSocketListener) Close() error {
+	l.closeOnce.Do(func() { close(l.closeCh) })
+	return nil
+}
+
+// Addr returns a placeholder address, since the address is the HTTP
+// server's.
+func (l *WebSocketListener) Addr() net.Addr {
+	return webSocketAddr("websocket")
+}
+
+// webSocketAddr is the address of a WebSocket peer, as reported by the HTTP
+// server.
+type webSocketAddr string
+
+func (a webSocketAddr) Network() string { return "websocket" }
+func (a webSocketAddr) String() string  { return string(a) }
+
+// webSocketServerConn is a WebSocket connection accepted by a
+// WebSocketListener.
+type webSocketServerConn struct {
+	*websocket.Conn
+	remoteAddr webSocketAddr
+	doneOnce   sync.Once
+	doneCh     chan struct{}
+}
+
+// RemoteAddr returns the address of the peer, rather than the origin that
+// websocket.Conn returns.
+func (c *webSocketServerConn) RemoteAddr() net.Addr {
+	return c.remoteAddr
+}
+
+func (c *webSocketServerConn) Close() error {
+	c.doneOnce.Do(func() { close(c.doneCh) })
+	return c.Conn.Close()
+}
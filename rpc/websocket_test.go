@@ -0,0 +1,194 @@
+package rpc
+
+import (
+	"bytes"
+	"context"
+	"crypto/x509"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/keybase/backoff"
+	"github.com/stretchr/testify/require"
+)
+
+// webSocketTestServer serves an echo protocol on the connections accepted by
+// a WebSocketListener.
+type webSocketTestServer struct {
+	sync.Mutex
+	listener   *WebSocketListener
+	transports []Transporter
+	addrs      []string
+}
+
+func newWebSocketTestServer(t *testing.T, l *WebSocketListener, ct CodecType) *webSocketTestServer {
+	s := &webSocketTestServer{listener: l}
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			xp := NewTransportWithOpts(context.Background(), c, nil, nil, nil, DefaultMaxFrameLength,
+				TransportOpts{Codec: ct})
+			srv := NewServer(xp, nil)
+			require.NoError(t, srv.Register(Protocol{
+				Name: "ws",
+				Methods: map[string]ServeHandlerDescription{
+					"echo": {
+						MakeArg: func() interface{} { return new([]byte) },
+						Handler: func(_ context.Context, arg interface{}) (interface{}, error) {
+							return *arg.(*[]byte), nil
+						},
+					},
+				},
+			}))
+			srv.Run()
+			s.Lock()
+			s.transports = append(s.transports, xp)
+			s.addrs = append(s.addrs, c.RemoteAddr().String())
+			s.Unlock()
+		}
+	}()
+	return s
+}
+
+func (s *webSocketTestServer) accepted() int {
+	s.Lock()
+	defer s.Unlock()
+	return len(s.transports)
+}
+
+// dropAll closes the server side of every connection, like a proxy that
+// times them out.
+func (s *webSocketTestServer) dropAll() {
+	s.Lock()
+	defer s.Unlock()
+	for _, xp := range s.transports {
+		xp.Close()
+	}
+}
+
+type webSocketTestHandler struct {
+	testConnectionHandler
+	connects atomic.Int32
+}
+
+func (h *webSocketTestHandler) OnConnect(context.Context, *Connection, GenericClient, *Server) error {
+	h.connects.Add(1)
+	return nil
+}
+
+func webSocketTestURI(t *testing.T, scheme string, server *httptest.Server) *SPURI {
+	uri, err := ParseSPURI(scheme + "://" + strings.TrimPrefix(strings.TrimPrefix(server.URL, "http://"), "https://") + "/rpc")
+	require.NoError(t, err)
+	require.True(t, uri.UseWebSocket())
+	return uri
+}
+
+func TestWebSocketConnection(t *testing.T) {
+	l := NewWebSocketListener()
+	defer l.Close()
+	mux := http.NewServeMux()
+	mux.Handle("/rpc", l)
+	httpServer := httptest.NewServer(mux)
+	defer httpServer.Close()
+	server := newWebSocketTestServer(t, l, CodecMsgpack)
+
+	uri := webSocketTestURI(t, "ws", httpServer)
+	ct := NewWebSocketConnectionTransport(uri, nil, nil, nil, testWrapError, DefaultMaxFrameLength, TransportOpts{})
+	handler := &webSocketTestHandler{}
+	output := testLogOutput{t: t}
+	conn := NewConnectionWithTransport(handler, ct, testErrorUnwrapper{}, &output, ConnectionOpts{
+		WrapErrorFunc: testWrapError,
+		TagsFunc:      testLogTags,
+		ReconnectBackoff: func() backoff.BackOff {
+			b := backoff.NewExponentialBackOff()
+			b.InitialInterval = 5 * time.Millisecond
+			return b
+		},
+	})
+	defer conn.Shutdown()
+	cli := conn.GetClient()
+
+	// A frame bigger than the writer coalesces goes in several messages.
+	arg := bytes.Repeat([]byte("websocket"), 10000)
+	var res []byte
+	require.NoError(t, cli.Call(context.Background(), newMethodV1("ws.echo"), arg, &res, 0))
+	require.Equal(t, arg, res)
+	require.Equal(t, 1, server.accepted())
+	server.Lock()
+	host, _, err := net.SplitHostPort(server.addrs[0])
+	server.Unlock()
+	require.NoError(t, err)
+	require.Equal(t, "127.0.0.1", host)
+
+	// The Connection reconnects when the connection drops.
+	server.dropAll()
+	require.Eventually(t, func() bool {
+		var res []byte
+		err := cli.Call(context.Background(), newMethodV1("ws.echo"), []byte("again"), &res, 0)
+		return err == nil && string(res) == "again"
+	}, 5*time.Second, 10*time.Millisecond)
+	require.Equal(t, 2, server.accepted())
+	require.Equal(t, int32(2), handler.connects.Load())
+}
+
+func TestWebSocketTLS(t *testing.T) {
+	l := NewWebSocketListener()
+	defer l.Close()
+	httpServer := httptest.NewTLSServer(l)
+	defer httpServer.Close()
+	newWebSocketTestServer(t, l, CodecJSON)
+
+	roots := x509.NewCertPool()
+	roots.AddCert(httpServer.Certificate())
+	config := httpServer.Client().Transport.(*http.Transport).TLSClientConfig.Clone()
+	config.RootCAs = roots
+
+	uri := webSocketTestURI(t, "wss+json", httpServer)
+	require.True(t, uri.UseTLS())
+	require.Equal(t, CodecJSON, uri.Codec)
+	conn, err := uri.DialWithConfig(config)
+	require.NoError(t, err)
+	xp := NewTransportWithOpts(context.Background(), conn, nil, nil, nil, DefaultMaxFrameLength,
+		TransportOpts{Codec: uri.Codec})
+	defer xp.Close()
+
+	var res []byte
+	require.NoError(t, NewClient(xp, nil, nil).Call(context.Background(), newMethodV1("ws.echo"), []byte("tls"), &res, 0))
+	require.Equal(t, "tls", string(res))
+
+	// Without the test CA, the server isn't trusted.
+	_, err = uri.DialWithConfig(nil)
+	require.Error(t, err)
+}
+
+func TestWebSocketListenerOrigin(t *testing.T) {
+	l := NewWebSocketListenerWithOpts(WebSocketListenerOpts{
+		CheckOrigin: func(r *http.Request) error {
+			return errors.New("no origin is good enough")
+		},
+	})
+	httpServer := httptest.NewServer(l)
+	defer httpServer.Close()
+
+	uri := webSocketTestURI(t, "ws", httpServer)
+	_, err := uri.Dial()
+	require.Error(t, err)
+
+	// Once closed, the listener turns requests away.
+	require.NoError(t, l.Close())
+	_, err = l.Accept()
+	require.ErrorIs(t, err, net.ErrClosed)
+	resp, err := http.Get(httpServer.URL)
+	require.NoError(t, err)
+	resp.Body.Close()
+	require.Equal(t, http.StatusServiceUnavailable, resp.StatusCode)
+}
@@ -0,0 +1,246 @@
+package rpc
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strconv"
+
+	"github.com/keybase/go-codec/codec"
+)
+
+// CodecType is the encoding of the frames of a transport. Whatever the codec,
+// a frame is its length, followed by an array of fields, laid out the same
+// way. Both sides of a connection must use the same codec: it can be fixed by
+// the scheme of an SPURI, e.g. "sprpc+json://".
+type CodecType int
+
+const (
+	// CodecMsgpack is the default: frames are msgpack arrays, prefixed
+	// with their length as a msgpack uint.
+	CodecMsgpack CodecType = 0
+	// CodecJSON frames are JSON arrays, prefixed with their length in
+	// decimal and a newline. Binary fields, such as compressed arguments,
+	// are base64 strings.
+	CodecJSON CodecType = 1
+	// CodecCBOR frames are CBOR arrays, prefixed with their length as a
+	// CBOR uint.
+	CodecCBOR CodecType = 2
+)
+
+func (c CodecType) String() string {
+	switch c {
+	case CodecMsgpack:
+		return "msgpack"
+	case CodecJSON:
+		return "json"
+	case CodecCBOR:
+		return "cbor"
+	default:
+		return fmt.Sprintf("Codec(%d)", int(c))
+	}
+}
+
+// ParseCodecType parses the name of a codec, as returned by
+// CodecType.String.
+func ParseCodecType(s string) (CodecType, error) {
+	for _, c := range []CodecType{CodecMsgpack, CodecJSON, CodecCBOR} {
+		if s == c.String() {
+			return c, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown codec: %q", s)
+}
+
+func (c CodecType) valid() bool {
+	return c.wireCodec() != nil
+}
+
+func (c CodecType) wireCodec() wireCodec {
+	switch c {
+	case CodecMsgpack:
+		return msgpackWireCodec{}
+	case CodecJSON:
+		return jsonWireCodec{}
+	case CodecCBOR:
+		return cborWireCodec{}
+	default:
+		return nil
+	}
+}
+
+// wireCodec implements a CodecType: the encoding of fields, and the framing
+// around them.
+type wireCodec interface {
+	newHandle() codec.Handle
+	// putFrameLength writes n to dst, which must be frameHeaderSize
+	// long, and returns the number of bytes written.
+	putFrameLength(dst []byte, n int) int
+	// newLengthReader returns a function that reads the successive frame
+	// lengths off r.
+	newLengthReader(r io.Reader) func() (int32, error)
+	// newFrameDecoder reads the start of the frame in r, and returns the
+	// number of fields in it, and the decoder of those fields.
+	newFrameDecoder(r *frameReader) (int, *fieldDecoder, error)
+}
+
+type msgpackWireCodec struct{}
+
+func (msgpackWireCodec) newHandle() codec.Handle { return newCodecMsgpackHandle() }
+
+func (msgpackWireCodec) putFrameLength(dst []byte, n int) int { return putFrameLength(dst, n) }
+
+func (msgpackWireCodec) newLengthReader(r io.Reader) func() (int32, error) {
+	return newCodecLengthReader(r, newCodecMsgpackHandle())
+}
+
+func (msgpackWireCodec) newFrameDecoder(r *frameReader) (int, *fieldDecoder, error) {
+	nb, err := r.ReadByte()
+	if err != nil {
+		return 0, nil, err
+	}
+
+	// Interpret the byte as the length field of a fixarray of up
+	// to 15 elements: see
+	// https://github.com/msgpack/msgpack/blob/master/spec.md#formats-array
+	// for details. Do this so we can decode directly into the
+	// expected fields without copying.
+	if nb < 0x91 || nb > 0x9f {
+		return 0, nil, NewPacketizerError("wrong message structure prefix (0x%x)", nb)
+	}
+	return int(nb - 0x90), newFieldDecoder(r, newCodecMsgpackHandle()), nil
+}
+
+func newCodecCBORHandle() codec.Handle {
+	return &codec.CborHandle{}
+}
+
+type cborWireCodec struct{}
+
+func (cborWireCodec) newHandle() codec.Handle { return newCodecCBORHandle() }
+
+// putFrameLength writes n as a CBOR uint, as the codec would.
+func (cborWireCodec) putFrameLength(dst []byte, n int) int {
+	switch {
+	case n < 24:
+		dst[0] = byte(n)
+		return 1
+	case n <= 0xff:
+		dst[0], dst[1] = 0x18, byte(n)
+		return 2
+	case n <= 0xffff:
+		dst[0], dst[1], dst[2] = 0x19, byte(n>>8), byte(n)
+		return 3
+	default:
+		dst[0], dst[1], dst[2], dst[3], dst[4] = 0x1a, byte(n>>24), byte(n>>16), byte(n>>8), byte(n)
+		return 5
+	}
+}
+
+func (cborWireCodec) newLengthReader(r io.Reader) func() (int32, error) {
+	return newCodecLengthReader(r, newCodecCBORHandle())
+}
+
+func (cborWireCodec) newFrameDecoder(r *frameReader) (int, *fieldDecoder, error) {
+	nb, err := r.ReadByte()
+	if err != nil {
+		return 0, nil, err
+	}
+	// Like msgpack, CBOR has a one-byte header for short arrays.
+	if nb < 0x81 || nb > 0x8f {
+		return 0, nil, NewPacketizerError("wrong message structure prefix (0x%x)", nb)
+	}
+	return int(nb - 0x80), newFieldDecoder(r, newCodecCBORHandle()), nil
+}
+
+// newCodecLengthReader reads lengths that are encoded as uints by h.
+func newCodecLengthReader(r io.Reader, h codec.Handle) func() (int32, error) {
+	dec := codec.NewDecoder(r, h)
+	return func() (int32, error) {
+		var l int32
+		err := dec.Decode(&l)
+		return l, err
+	}
+}
+
+func newCodecJSONHandle() codec.Handle {
+	// Maps with integer keys, such as those of ProtocolV2Description,
+	// need their keys quoted to be valid JSON.
+	return &codec.JsonHandle{MapKeyAsString: true}
+}
+
+// maxJSONFrameLengthDigits is the number of digits of the biggest frame
+// length, math.MaxInt32.
+const maxJSONFrameLengthDigits = 10
+
+type jsonWireCodec struct{}
+
+func (jsonWireCodec) newHandle() codec.Handle { return newCodecJSONHandle() }
+
+// putFrameLength writes n in decimal, followed by a newline.
+func (jsonWireCodec) putFrameLength(dst []byte, n int) int {
+	b := strconv.AppendInt(dst[:0], int64(n), 10)
+	b = append(b, '\n')
+	return len(b)
+}
+
+func (jsonWireCodec) newLengthReader(r io.Reader) func() (int32, error) {
+	return func() (int32, error) {
+		// Read a byte at a time, so as not to consume the frame.
+		var digits [maxJSONFrameLengthDigits + 1]byte
+		var b [1]byte
+		for n := 0; ; {
+			if _, err := io.ReadFull(r, b[:]); err != nil {
+				if err == io.EOF && n > 0 {
+					err = io.ErrUnexpectedEOF
+				}
+				return 0, err
+			}
+			if b[0] == '\n' {
+				l, err := strconv.ParseInt(string(digits[:n]), 10, 32)
+				if err != nil {
+					return 0, NewPacketizerError("invalid frame length: %q", digits[:n])
+				}
+				return int32(l), nil
+			}
+			if b[0] < '0' || b[0] > '9' || n == len(digits) {
+				return 0, NewPacketizerError("invalid frame length prefix (0x%x)", b[0])
+			}
+			digits[n] = b[0]
+			n++
+		}
+	}
+}
+
+// newFrameDecoder splits the frame into its fields first, since JSON arrays
+// don't say how long they are. So each frame is parsed twice: once by
+// encoding/json to split it, and once more as the fields are decoded. JSON
+// is meant for debugging and interop, where that's fine, rather than speed.
+func (jsonWireCodec) newFrameDecoder(r *frameReader) (int, *fieldDecoder, error) {
+	frame := make([]byte, r.remaining)
+	if _, err := io.ReadFull(r, frame); err != nil {
+		return 0, nil, err
+	}
+	if frame[0] != '[' {
+		return 0, nil, NewPacketizerError("wrong message structure prefix (0x%x)", frame[0])
+	}
+	var fields []json.RawMessage
+	if err := json.Unmarshal(frame, &fields); err != nil {
+		return 0, nil, NewPacketizerError("invalid JSON frame: %s", err)
+	}
+	// The fields are decoded one after the other, as a stream of JSON
+	// values.
+	parts := make([][]byte, len(fields))
+	for i, f := range fields {
+		parts[i] = f
+	}
+	joined := bytes.Join(parts, []byte{'\n'})
+	d := &fieldDecoder{
+		d:         codec.NewDecoderBytes(joined, newCodecJSONHandle()),
+		handle:    newCodecJSONHandle(),
+		totalSize: r.totalSize,
+		start:     r.start,
+	}
+	return len(fields), d, nil
+}
@@ -0,0 +1,161 @@
+package rpc
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"net"
+	"testing"
+
+	"github.com/foks-proj/go-ctxlog"
+	"github.com/keybase/go-codec/codec"
+	"github.com/stretchr/testify/require"
+)
+
+type codecTestArg struct {
+	N    int
+	S    string
+	B    []byte
+	M    map[string]int
+	List []uint64
+}
+
+func codecTestTransports(t *testing.T, ct CodecType) (*Client, func()) {
+	clientConn, serverConn := net.Pipe()
+	opts := TransportOpts{Codec: ct}
+	sxp := NewTransportWithOpts(context.Background(), serverConn, nil, nil, nil, testMaxFrameLength, opts)
+	srv := NewServer(sxp, nil)
+	require.NoError(t, srv.Register(Protocol{
+		Name: "codec",
+		Methods: map[string]ServeHandlerDescription{
+			"echo": {
+				MakeArg: func() interface{} { return new(codecTestArg) },
+				Handler: func(ctx context.Context, arg interface{}) (interface{}, error) {
+					a := *arg.(*codecTestArg)
+					tags, _ := ctxlog.TagsFromContext(ctx)
+					a.S += tags["suffix"].(string)
+					return a, nil
+				},
+			},
+			"fail": {
+				MakeArg: func() interface{} { return new(codecTestArg) },
+				Handler: func(_ context.Context, arg interface{}) (interface{}, error) {
+					return nil, errors.New("failed on purpose")
+				},
+			},
+		},
+	}))
+	require.NoError(t, srv.EnableReflection())
+	srv.Run()
+	cxp := NewTransportWithOpts(context.Background(), clientConn, nil, nil, nil, testMaxFrameLength, opts)
+	return NewClient(cxp, nil, nil), func() {
+		cxp.Close()
+		sxp.Close()
+	}
+}
+
+func TestCodecs(t *testing.T) {
+	doWithAllCodecs(t, func(t *testing.T, ct CodecType) {
+		cli, cleanup := codecTestTransports(t, ct)
+		defer cleanup()
+		ctx := ctxlog.AddTagsToContext(context.Background(), ctxlog.CtxLogTags{"suffix": "!"})
+
+		arg := codecTestArg{
+			N:    -7,
+			S:    "hello",
+			B:    []byte{0, 1, 0xff},
+			M:    map[string]int{"a": 1},
+			List: []uint64{uint64(ReservedProtocolIDs) + 1},
+		}
+		var res codecTestArg
+		require.NoError(t, cli.Call(ctx, newMethodV1("codec.echo"), arg, &res, 0))
+		expected := arg
+		expected.S = "hello!"
+		require.Equal(t, expected, res)
+
+		res = codecTestArg{}
+		require.NoError(t, cli.CallCompressed(ctx, newMethodV1("codec.echo"), arg, &res, CompressionGzip, 0))
+		require.Equal(t, expected, res)
+
+		err := cli.Call(ctx, newMethodV1("codec.fail"), arg, &res, 0)
+		require.EqualError(t, err, "failed on purpose")
+
+		err = cli.Call(ctx, newMethodV1("codec.missing"), arg, &res, 0)
+		require.EqualError(t, err, "method 'missing' not found in protocol 'codec'")
+
+		// V2 methods carry the ProtocolUniqueID, which needs all 64 bits.
+		protocols, err := ReflectionClient{Cli: cli}.ListProtocolsV2(ctx)
+		require.NoError(t, err)
+		require.Len(t, protocols, 1)
+		require.Equal(t, ReflectionProtocolID, protocols[0].ID)
+		require.Equal(t, "listProtocolsV2", protocols[0].Methods[reflectionListProtocolsV2])
+
+		require.NoError(t, cli.Notify(ctx, newMethodV1("codec.echo"), arg, 0))
+	})
+}
+
+func TestCodecMsgpackzip(t *testing.T) {
+	cli, cleanup := codecTestTransports(t, CodecJSON)
+	defer cleanup()
+	var res codecTestArg
+	err := cli.CallCompressed(context.Background(), newMethodV1("codec.echo"), codecTestArg{}, &res,
+		CompressionMsgpackzip, 0)
+	require.EqualError(t, err, "msgpackzip compression needs the msgpack codec")
+}
+
+func TestCodecFrameLength(t *testing.T) {
+	handles := map[CodecType]codec.Handle{
+		CodecMsgpack: newCodecMsgpackHandle(),
+		CodecCBOR:    newCodecCBORHandle(),
+	}
+	for ct, h := range handles {
+		wc := ct.wireCodec()
+		for _, n := range []int{1, 23, 24, 0xff, 0x100, 0xffff, 0x10000, 1 << 30} {
+			var expected []byte
+			require.NoError(t, codec.NewEncoderBytes(&expected, h).Encode(n))
+			var header [frameHeaderSize]byte
+			l := wc.putFrameLength(header[:], n)
+			require.Equal(t, expected, header[:l], "codec=%s n=%d", ct, n)
+
+			read, err := wc.newLengthReader(bytes.NewReader(expected))()
+			require.NoError(t, err)
+			require.Equal(t, int32(n), read)
+		}
+	}
+
+	wc := CodecJSON.wireCodec()
+	var header [frameHeaderSize]byte
+	l := wc.putFrameLength(header[:], 2147483647)
+	require.Equal(t, "2147483647\n", string(header[:l]))
+	read, err := wc.newLengthReader(bytes.NewReader(header[:l]))()
+	require.NoError(t, err)
+	require.Equal(t, int32(2147483647), read)
+
+	_, err = wc.newLengthReader(bytes.NewReader([]byte("12[")))()
+	require.Error(t, err)
+	_, err = wc.newLengthReader(bytes.NewReader([]byte("12")))()
+	require.Equal(t, io.ErrUnexpectedEOF, err)
+	_, err = wc.newLengthReader(bytes.NewReader([]byte("99999999999\n")))()
+	require.Error(t, err)
+}
+
+func TestCodecJSONFrames(t *testing.T) {
+	var buf bytes.Buffer
+	enc := newFramedEncoder(testMaxFrameLength, &buf, CodecJSON, nil)
+	defer enc.Close()
+	_, errCh := enc.EncodeAndWrite(context.Background(),
+		[]interface{}{MethodCall, 1, "codec.echo", map[string]interface{}{"S": "x"}}, nil)
+	require.NoError(t, <-errCh)
+	require.Equal(t, "28\n[0,1,\"codec.echo\",{\"S\":\"x\"}]", buf.String())
+}
+
+func TestParseCodecType(t *testing.T) {
+	for _, ct := range []CodecType{CodecMsgpack, CodecJSON, CodecCBOR} {
+		parsed, err := ParseCodecType(ct.String())
+		require.NoError(t, err)
+		require.Equal(t, ct, parsed)
+	}
+	_, err := ParseCodecType("xml")
+	require.EqualError(t, err, `unknown codec: "xml"`)
+}